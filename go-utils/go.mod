@@ -2,4 +2,8 @@ module github.com/marcrow/listAlchemy
 
 go 1.22.2
 
-require github.com/golang/mock v1.6.0 // indirect
+require (
+	github.com/golang/mock v1.6.0 // indirect
+	github.com/klauspost/compress v1.18.0
+	golang.org/x/text v0.14.0
+)
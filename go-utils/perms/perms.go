@@ -5,15 +5,18 @@ import (
     "errors"
     "flag"
     "fmt"
+    "math/big"
     "os"
     "strconv"
     "strings"
-	"math/big"
+
+    "github.com/marcrow/listAlchemy/pkg/alchemy"
 )
 
 type sourceArg struct {
-    Path  string
-    Depth int
+    Path     string
+    Depth    int
+    MinDepth int // shortest sequence written, from file:min-max (0 = 1)
 }
 
 type sourceArgs []sourceArg
@@ -23,11 +26,29 @@ func (s *sourceArgs) Set(val string) error {
     if len(parts) != 2 {
         return errors.New("source must be in format file:depth")
     }
-    depth, err := strconv.Atoi(parts[1])
+    minSpec, maxSpec, hasMin := strings.Cut(parts[1], "-")
+    if !hasMin {
+        maxSpec = minSpec
+    }
+    depth, err := strconv.Atoi(maxSpec)
     if err != nil || depth < 1 {
         return errors.New("invalid depth in source")
     }
-    *s = append(*s, sourceArg{Path: parts[0], Depth: depth})
+    minDepth := 0
+    if hasMin {
+        minDepth, err = strconv.Atoi(minSpec)
+        if err != nil || minDepth < 1 || minDepth > depth {
+            return errors.New("invalid depth in source")
+        }
+    }
+    if isStdinPath(parts[0]) {
+        for _, prev := range *s {
+            if isStdinPath(prev.Path) {
+                return errors.New("stdin can only be used as one source")
+            }
+        }
+    }
+    *s = append(*s, sourceArg{Path: parts[0], Depth: depth, MinDepth: minDepth})
     return nil
 }
 
@@ -35,6 +56,9 @@ func (s *sourceArgs) String() string {
     parts := make([]string, len(*s))
     for i, src := range *s {
         parts[i] = fmt.Sprintf("%s:%d", src.Path, src.Depth)
+        if src.MinDepth > 0 {
+            parts[i] = fmt.Sprintf("%s:%d-%d", src.Path, src.MinDepth, src.Depth)
+        }
     }
     return strings.Join(parts, ", ")
 }
@@ -49,48 +73,60 @@ func (s *sepArgs) String() string {
     return strings.Join(*s, ",")
 }
 
-type permutator struct {
-    allItems    []string
-    srcOfItem   []int
-    srcDepths   []int
-    seps        []string
-    prefix, suffix string
-    noRepeats   bool
-    output      func(string) // for testability
-}
-
 // Patch points for testability (must be defined at package level)
 var (
     osOpen          = func(name string) (*os.File, error) { return os.Open(name) }
     bufioNewScanner = func(file *os.File) *bufio.Scanner { return bufio.NewScanner(file) }
 )
 
-func NewPermutatorFromFiles(sources []sourceArg, seps []string, prefix, suffix string, noRepeats bool, output func(string)) error {
-    p := &permutator{
-        seps:      seps,
-        prefix:    prefix,
-        suffix:    suffix,
-        noRepeats: noRepeats,
-        output:    output,
+// isStdinPath reports whether a source path names standard input.
+func isStdinPath(path string) bool {
+    return path == "-" || path == "/dev/stdin"
+}
+
+// openSource opens a source, handing out os.Stdin for "-". Each mode loads
+// the sources once, so stdin is only consumed once.
+func openSource(path string) (*os.File, error) {
+    if isStdinPath(path) {
+        return os.Stdin, nil
     }
+    return osOpen(path)
+}
+
+// loadSources reads every source through the patch points.
+func loadSources(sources []sourceArg) ([]alchemy.Source, error) {
+    loaded := make([]alchemy.Source, len(sources))
     for srcIdx, src := range sources {
-        file, err := osOpen(src.Path) // Use patch point
+        file, err := openSource(src.Path) // Use patch point
         if err != nil {
-            return fmt.Errorf("ERROR opening %s: %v", src.Path, err)
+            return nil, fmt.Errorf("ERROR opening %s: %v", src.Path, err)
         }
+        items := []string{}
         scanner := bufioNewScanner(file) // Use patch point
         for scanner.Scan() {
             line := scanner.Text()
             if line == "" {
                 continue
             }
-            p.allItems = append(p.allItems, line)
-            p.srcOfItem = append(p.srcOfItem, srcIdx)
+            items = append(items, line)
         }
         file.Close()
-        p.srcDepths = append(p.srcDepths, src.Depth)
+        loaded[srcIdx] = alchemy.Source{Path: src.Path, Items: items, Depth: src.Depth, MinDepth: src.MinDepth}
     }
-    p.generate()
+    return loaded, nil
+}
+
+func NewPermutatorFromFiles(sources []sourceArg, seps []string, prefix, suffix string, noRepeats bool, output func(string)) error {
+    loaded, err := loadSources(sources)
+    if err != nil {
+        return err
+    }
+    p, err := alchemy.New(alchemy.Config{Sources: loaded, Seps: seps, Prefix: prefix, Suffix: suffix, NoRepeats: noRepeats})
+    if err != nil {
+        return err
+    }
+    p.Output = output
+    p.Generate()
     return nil
 }
 
@@ -99,134 +135,23 @@ func RunPermutator(sources []sourceArg, seps []string, prefix, suffix string, no
     return NewPermutatorFromFiles(sources, seps, prefix, suffix, noRepeats, output)
 }
 
-func (p *permutator) generate() {
-    n := len(p.allItems)
-    used := make([]bool, n)
-    for i := 0; i < n; i++ {
-        src := p.srcOfItem[i]
-        maxDepth := p.srcDepths[src]
-        p.dfs([]int{i}, used, maxDepth)
-    }
-}
-
-func (p *permutator) dfs(path []int, used []bool, maxDepth int) {
-    depth := len(path)
-    last := path[depth-1]
-    if p.noRepeats {
-        used[last] = true
-        defer func() { used[last] = false }()
-    }
-    if depth >= 1 && depth <= maxDepth {
-        for _, sep := range p.seps {
-            var b strings.Builder
-            b.WriteString(p.prefix)
-            for j, idx := range path {
-                if j > 0 {
-                    b.WriteString(sep)
-                }
-                b.WriteString(p.allItems[idx])
-            }
-            b.WriteString(p.suffix)
-            if p.output != nil {
-                p.output(b.String())
-            } else {
-                fmt.Println(b.String())
-            }
-        }
-    }
-    if depth == maxDepth {
-        return
-    }
-    for next := 0; next < len(p.allItems); next++ {
-        if p.noRepeats && used[next] {
-            continue
-        }
-        p.dfs(append(path, next), used, maxDepth)
-    }
-}
-
-
-
 // CalculateOutputLines returns the number of output lines (permutations) as *big.Int
 func CalculateOutputLines(sources []sourceArg, seps []string, noRepeats bool) (*big.Int, error) {
-    // Gather all items and their source/depth
-    var allItems []string
-    var srcOfItem []int
-    var srcDepths []int
-
-    for srcIdx, src := range sources {
-        f, err := osOpen(src.Path)
-        if err != nil {
-            return nil, fmt.Errorf("ERROR opening %s: %v", src.Path, err)
-        }
-        sc := bufioNewScanner(f)
-        for sc.Scan() {
-            txt := sc.Text()
-            if txt == "" {
-                continue
-            }
-            allItems = append(allItems, txt)
-            srcOfItem = append(srcOfItem, srcIdx)
-        }
-        f.Close()
-        srcDepths = append(srcDepths, src.Depth)
-    }
-
-    n := len(allItems)
-    if n == 0 || len(seps) == 0 {
-        return big.NewInt(0), nil
-    }
-
-    // Helper: nPr (order matters, no repeats)
-    perm := func(n, r int) *big.Int {
-        if r < 0 || n < 0 || n < r {
-            return big.NewInt(0)
-        }
-        res := big.NewInt(1)
-        for i := 0; i < r; i++ {
-            res.Mul(res, big.NewInt(int64(n-i)))
-        }
-        return res
-    }
-    // Helper: base^exp (repeats allowed)
-    pow := func(base, exp int) *big.Int {
-        if exp < 0 || base < 0 {
-            return big.NewInt(0)
-        }
-        res := big.NewInt(1)
-        b := big.NewInt(int64(base))
-        for i := 0; i < exp; i++ {
-            res.Mul(res, b)
-        }
-        return res
+    loaded, err := loadSources(sources)
+    if err != nil {
+        return nil, err
     }
-
-    total := big.NewInt(0)
-    sepFactor := big.NewInt(int64(len(seps)))
-
-    for i := 0; i < n; i++ {
-        maxDepth := srcDepths[srcOfItem[i]]
-        for l := 1; l <= maxDepth; l++ {
-            var cnt *big.Int
-            if noRepeats {
-                // pick l-1 more items out of (n-1) without repetition
-                cnt = perm(n-1, l-1)
-            } else {
-                // any of (n-1) items can occupy each of (l-1) positions
-                cnt = pow(n-1, l-1)
-            }
-            cnt.Mul(cnt, sepFactor)
-            total.Add(total, cnt)
-        }
+    p, err := alchemy.New(alchemy.Config{Sources: loaded, Seps: seps, NoRepeats: noRepeats})
+    if err != nil {
+        return nil, err
     }
-    return total, nil
+    return p.Count(), nil
 }
 
-
 func printUsage() {
     fmt.Println(`Usage: perms [options]
 Options:
-  -source file.txt:depth   Input file and depth (repeatable, required)
+  -source file.txt:depth   Input file and depth (repeatable, required; "-" reads stdin); file.txt:min-max skips shorter sequences
   -sep separator           Separator string (repeatable, default: "")
   -prefix string           Prefix string for each output
   -suffix string           Suffix string for each output
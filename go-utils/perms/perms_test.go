@@ -146,6 +146,13 @@ func TestSourceArgInvalidFormat(t *testing.T) {
 	if err == nil || !strings.Contains(err.Error(), "invalid depth") {
 		t.Errorf("Expected error for depth < 1, got: %v", err)
 	}
+	if err := s.Set("-:2"); err != nil {
+		t.Fatalf("Unexpected error for stdin source: %v", err)
+	}
+	err = s.Set("/dev/stdin:1")
+	if err == nil || !strings.Contains(err.Error(), "stdin") {
+		t.Errorf("Expected error for a second stdin source, got: %v", err)
+	}
 }
 
 func TestPermutatorFileOpenError(t *testing.T) {
@@ -166,6 +173,96 @@ func TestPermutatorFileOpenError(t *testing.T) {
 	}
 }
 
+func TestPermutatorWritesSingleItemsOncePerLine(t *testing.T) {
+	src, lines := makeSourceArg("./tests/file1.txt", 2, []string{"a", "b"})
+
+	origOpen := osOpen
+	origScanner := bufioNewScanner
+	defer func() {
+		osOpen = origOpen
+		bufioNewScanner = origScanner
+	}()
+	osOpen = func(name string) (*os.File, error) {
+		return &os.File{}, nil
+	}
+	bufioNewScanner = func(file *os.File) *bufio.Scanner {
+		return newMockScanner(lines)
+	}
+
+	seps := []string{"-", "_"}
+	for _, noRepeats := range []bool{false, true} {
+		var got []string
+		err := RunPermutator([]sourceArg{src}, seps, "", "", noRepeats, func(s string) {
+			got = append(got, s)
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		want := "a,a-a,a_a,a-b,a_b,b,b-a,b_a,b-b,b_b"
+		if noRepeats {
+			want = "a,a-b,a_b,b,b-a,b_a"
+		}
+		if strings.Join(got, ",") != want {
+			t.Errorf("noRepeats=%v: expected %s, got %s", noRepeats, want, strings.Join(got, ","))
+		}
+
+		total, err := CalculateOutputLines([]sourceArg{src}, seps, noRepeats)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if total.Int64() != int64(len(got)) {
+			t.Errorf("noRepeats=%v: expected count %d, got %s", noRepeats, len(got), total)
+		}
+	}
+}
+
+func TestSourceDepthRangeSkipsShortSequences(t *testing.T) {
+	var sources sourceArgs
+	if err := sources.Set("./tests/file1.txt:2-3"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if sources[0].MinDepth != 2 || sources[0].Depth != 3 {
+		t.Fatalf("expected range 2-3, got %+v", sources[0])
+	}
+	if err := sources.Set("./tests/file1.txt:3-2"); err == nil {
+		t.Error("expected an error for an inverted range")
+	}
+
+	origOpen := osOpen
+	origScanner := bufioNewScanner
+	defer func() {
+		osOpen = origOpen
+		bufioNewScanner = origScanner
+	}()
+	osOpen = func(name string) (*os.File, error) {
+		return &os.File{}, nil
+	}
+	bufioNewScanner = func(file *os.File) *bufio.Scanner {
+		return newMockScanner([]string{"a", "b"})
+	}
+
+	var got []string
+	err := RunPermutator(sources, []string{"-"}, "", "", false, func(s string) {
+		got = append(got, s)
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, line := range got {
+		if n := strings.Count(line, "-") + 1; n < 2 || n > 3 {
+			t.Errorf("line %q has %d items, want 2-3", line, n)
+		}
+	}
+	total, err := CalculateOutputLines(sources, []string{"-"}, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// 2 starts x (2 + 4) continuations.
+	if total.Int64() != 12 || len(got) != 12 {
+		t.Errorf("expected 12 lines, counted %s and generated %d", total, len(got))
+	}
+}
+
 // --- Patch points for mocks and helpers ---
 
 // newMockScanner returns a bufio.Scanner for a slice of lines.
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressionSuffixes maps -out file name endings to the -compress format
+// they select when -compress is not given.
+var compressionSuffixes = map[string]string{
+	".gz":  "gzip",
+	".zst": "zstd",
+}
+
+// checkCompression reports whether format is a -compress value.
+func checkCompression(format string) error {
+	switch format {
+	case "", "none", "gzip", "zstd":
+		return nil
+	}
+	return fmt.Errorf("unknown compression %q (want gzip, zstd or none)", format)
+}
+
+// compressionFor resolves the format an output named path is written in:
+// format itself when given, otherwise the one its suffix implies ("" for
+// none).
+func compressionFor(path, format string) string {
+	if format == "none" {
+		return ""
+	}
+	if format != "" {
+		return format
+	}
+	for suffix, f := range compressionSuffixes {
+		if strings.HasSuffix(path, suffix) {
+			return f
+		}
+	}
+	return ""
+}
+
+// newCompressor streams writes to w through format. Close flushes the
+// stream without closing w.
+func newCompressor(w io.Writer, format string) (io.WriteCloser, error) {
+	switch format {
+	case "gzip":
+		return gzip.NewWriter(w), nil
+	case "zstd":
+		return zstd.NewWriter(w)
+	}
+	return nil, checkCompression(format)
+}
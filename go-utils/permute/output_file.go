@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// outputFile is the -out destination: a file, compressed with -compress or
+// when its name ends in .gz or .zst. It is written under a temporary name next to path and renamed
+// over path by Close, so readers never see a partial file. Close must be
+// called once generation is over, or nothing is written.
+type outputFile struct {
+	path  string
+	file  *os.File
+	w     io.Writer      // file, or comp on top of it
+	comp  io.WriteCloser // nil unless compressing
+	bytes int64          // bytes written, before compression
+	lines int64          // lines written
+}
+
+// output is an -out destination, a single file or split in parts.
+type output interface {
+	io.WriteCloser
+	abort()
+	report(w io.Writer)
+}
+
+// createOutput starts writing path in the -compress format compress ("" =
+// by suffix). An existing file is only replaced once Close succeeds.
+func createOutput(path, compress string) (*outputFile, error) {
+	return openOutput(path, compress, false)
+}
+
+// appendOutput is createOutput keeping what path already holds, for
+// -resume: the new lines go after it, compressed as a stream of their own,
+// which gzip and zstd readers decode as one. A missing path starts empty.
+func appendOutput(path, compress string) (*outputFile, error) {
+	return openOutput(path, compress, true)
+}
+
+func openOutput(path, compress string, keep bool) (*outputFile, error) {
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("creating %s: %v", path, err)
+	}
+	out := &outputFile{path: path, file: file, w: file}
+	if keep {
+		if err := copyExisting(file, path); err != nil {
+			file.Close()
+			os.Remove(file.Name())
+			return nil, fmt.Errorf("reading %s: %v", path, err)
+		}
+	}
+	if format := compressionFor(path, compress); format != "" {
+		if out.comp, err = newCompressor(file, format); err != nil {
+			file.Close()
+			os.Remove(file.Name())
+			return nil, fmt.Errorf("creating %s: %v", path, err)
+		}
+		out.w = out.comp
+	}
+	return out, nil
+}
+
+// copyExisting copies the file at path, if there is one, to w.
+func copyExisting(w io.Writer, path string) error {
+	in, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	_, err = io.Copy(w, in)
+	return err
+}
+
+// finishOutput ends out after a run that returned err. What was written is
+// kept when the run succeeded, was interrupted (Ctrl-C) or has its progress
+// in a -checkpoint, which counts those lines as written; any other failure
+// discards it and leaves the target as it was.
+func finishOutput(out output, err error, checkpointed bool) error {
+	if err != nil && !errors.Is(err, context.Canceled) && !checkpointed {
+		out.abort()
+		return nil
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	out.report(os.Stderr)
+	return nil
+}
+
+func (o *outputFile) Write(p []byte) (int, error) {
+	n, err := o.w.Write(p)
+	o.bytes += int64(n)
+	o.lines += int64(bytes.Count(p[:n], []byte{'\n'}))
+	return n, err
+}
+
+// Close flushes the compressed stream, if any, closes the file and moves it to
+// path. On failure the temporary file is removed and path is left untouched.
+func (o *outputFile) Close() error {
+	var errs []error
+	if o.comp != nil {
+		errs = append(errs, o.comp.Close())
+	}
+	// CreateTemp makes the file private; give it the usual permissions.
+	errs = append(errs, o.file.Chmod(0o644), o.file.Close())
+	if err := errors.Join(errs...); err != nil {
+		os.Remove(o.file.Name())
+		return fmt.Errorf("writing %s: %v", o.path, err)
+	}
+	if err := os.Rename(o.file.Name(), o.path); err != nil {
+		os.Remove(o.file.Name())
+		return fmt.Errorf("writing %s: %v", o.path, err)
+	}
+	return nil
+}
+
+// abort discards what was written after a failed run: the temporary file is
+// removed and path is left untouched.
+func (o *outputFile) abort() {
+	if o.comp != nil {
+		o.comp.Close()
+	}
+	o.file.Close()
+	os.Remove(o.file.Name())
+}
+
+// report writes what was written to w, e.g. "wrote 12 lines (96 bytes) to out.txt".
+func (o *outputFile) report(w io.Writer) {
+	fmt.Fprintf(w, "wrote %d lines (%d bytes) to %s\n", o.lines, o.bytes, o.path)
+}
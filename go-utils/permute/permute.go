@@ -1,46 +1,42 @@
 package main
 
 import (
-	"bufio"
+	"context"
 	"errors"
 	"flag"
 	"fmt"
-	"io"
+	"math/big"
 	"os"
-	"strconv"
+	"os/signal"
 	"strings"
-	"sync"
-	"math/big"
+	"time"
+
+	"github.com/marcrow/listAlchemy/pkg/alchemy"
 )
 
 // --- Argument Types ---
 
-type sourceArg struct {
-	Path  string
-	Depth int
+// optionalString is a string flag that remembers whether it was given, so
+// an explicitly empty value can be told apart from an absent flag.
+type optionalString struct {
+	val string
+	set bool
 }
 
-type sourceArgs []sourceArg
-
-func (s *sourceArgs) Set(val string) error {
-	parts := strings.SplitN(val, ":", 2)
-	if len(parts) != 2 {
-		return errors.New("source must be in format file:depth")
-	}
-	depth, err := strconv.Atoi(parts[1])
-	if err != nil || depth < 1 {
-		return errors.New("invalid depth in source")
-	}
-	*s = append(*s, sourceArg{Path: parts[0], Depth: depth})
+func (o *optionalString) Set(val string) error {
+	o.val, o.set = val, true
 	return nil
 }
+func (o *optionalString) String() string {
+	return o.val
+}
 
-func (s *sourceArgs) String() string {
-	parts := make([]string, len(*s))
-	for i, src := range *s {
-		parts[i] = fmt.Sprintf("%s:%d", src.Path, src.Depth)
+// value returns the flag's value, or nil if it was never given.
+func (o *optionalString) value() *string {
+	if !o.set {
+		return nil
 	}
-	return strings.Join(parts, ", ")
+	return &o.val
 }
 
 type sepArgs []string
@@ -53,316 +49,155 @@ func (s *sepArgs) String() string {
 	return strings.Join(*s, ",")
 }
 
-// --- Patch points for testability (must be defined at package level) ---
+// repeatedArgs collects every value of a repeatable flag (-match,
+// -exclude-match, -exclude-file).
+type repeatedArgs []string
 
-var (
-	osOpen          = func(name string) (*os.File, error) { return os.Open(name) }
-	bufioNewScanner = func(file *os.File) *bufio.Scanner { return bufio.NewScanner(file) }
-)
-
-// --- Fast Permutator Implementation ---
-
-type PermutatorFast struct {
-	allItems    []string
-	srcOfItem   []int
-	srcDepths   []int
-	seps        []string
-	prefix      string
-	suffix      string
-	noRepeats   bool
-
-	out *bufio.Writer
-	mu  sync.Mutex // protects out
-
-	pool sync.Pool // for *strings.Builder
-}
-
-func NewPermutatorFast(
-	allItems []string, srcOfItem []int, srcDepths []int,
-	seps []string, prefix, suffix string, noRepeats bool,
-	writer io.Writer,
-) *PermutatorFast {
-	p := &PermutatorFast{
-		allItems:  allItems,
-		srcOfItem: srcOfItem,
-		srcDepths: srcDepths,
-		seps:      seps,
-		prefix:    prefix,
-		suffix:    suffix,
-		noRepeats: noRepeats,
-		out:       bufio.NewWriterSize(writer, 64*1024), // 64 KiB buffer
-	}
-	p.pool.New = func() any { return &strings.Builder{} }
-	return p
+func (p *repeatedArgs) Set(val string) error {
+	*p = append(*p, val)
+	return nil
 }
 
-func (p *PermutatorFast) writeLine(s string) {
-	p.mu.Lock()
-	p.out.WriteString(s)
-	p.out.WriteByte('\n')
-	p.mu.Unlock()
+func (p *repeatedArgs) String() string {
+	return strings.Join(*p, ",")
 }
 
-func (p *PermutatorFast) dfs(path []int, depth, maxDepth int, used []bool) {
-	last := path[depth-1]
+// slotArgs collects -slot files. In slot mode every line has one item per
+// slot, position d drawing only from slot d: a cartesian product of the
+// files in order, e.g. <name><year><symbol>.
+type slotArgs []string
 
-	if p.noRepeats {
-		used[last] = true
-		defer func() { used[last] = false }()
+func (s *slotArgs) Set(val string) error {
+	if val == "" {
+		return errors.New("slot needs a file")
 	}
-
-	if depth >= 1 {
-		for _, sep := range p.seps {
-			builder := p.pool.Get().(*strings.Builder)
-			builder.Reset()
-
-			builder.WriteString(p.prefix)
-			builder.WriteString(p.allItems[path[0]])
-			for i := 1; i < depth; i++ {
-				builder.WriteString(sep)
-				builder.WriteString(p.allItems[path[i]])
+	if alchemy.IsStdinPath(val) {
+		for _, prev := range *s {
+			if alchemy.IsStdinPath(prev) {
+				return alchemy.ErrDuplicateStdin
 			}
-			builder.WriteString(p.suffix)
-
-			p.writeLine(builder.String())
-			p.pool.Put(builder)
-		}
-	}
-
-	if depth == maxDepth {
-		return
-	}
-
-	n := len(p.allItems)
-	for next := 0; next < n; next++ {
-		if p.noRepeats && used[next] {
-			continue
 		}
-		path[depth] = next
-		p.dfs(path, depth+1, maxDepth, used)
-	}
-}
-
-func (p *PermutatorFast) Generate() {
-	var wg sync.WaitGroup
-	n := len(p.allItems)
-
-	for i := 0; i < n; i++ {
-		wg.Add(1)
-		go func(start int) {
-			defer wg.Done()
-
-			maxDepth := p.srcDepths[p.srcOfItem[start]]
-			path := make([]int, maxDepth)
-			used := make([]bool, n)
-			path[0] = start
-			p.dfs(path, 1, maxDepth, used)
-		}(i)
-	}
-
-	wg.Wait()
-	p.out.Flush()
-}
-
-// --- Original Permutator (for testability/callbacks) ---
-
-type permutator struct {
-	allItems    []string
-	srcOfItem   []int
-	srcDepths   []int
-	seps        []string
-	prefix      string
-	suffix      string
-	noRepeats   bool
-	output      func(string)
-}
-
-func (p *permutator) generate() {
-	n := len(p.allItems)
-	used := make([]bool, n)
-	for i := 0; i < n; i++ {
-		src := p.srcOfItem[i]
-		maxDepth := p.srcDepths[src]
-		p.dfs([]int{i}, used, maxDepth)
 	}
+	*s = append(*s, val)
+	return nil
 }
 
-func (p *permutator) dfs(path []int, used []bool, maxDepth int) {
-	depth := len(path)
-	last := path[depth-1]
-	if p.noRepeats {
-		used[last] = true
-		defer func() { used[last] = false }()
-	}
-	if depth >= 1 && depth <= maxDepth {
-		for _, sep := range p.seps {
-			var b strings.Builder
-			b.WriteString(p.prefix)
-			for j, idx := range path {
-				if j > 0 {
-					b.WriteString(sep)
-				}
-				b.WriteString(p.allItems[idx])
-			}
-			b.WriteString(p.suffix)
-			if p.output != nil {
-				p.output(b.String())
-			} else {
-				fmt.Println(b.String())
-			}
-		}
-	}
-	if depth == maxDepth {
-		return
-	}
-	for next := 0; next < len(p.allItems); next++ {
-		if p.noRepeats && used[next] {
-			continue
-		}
-		p.dfs(append(path, next), used, maxDepth)
-	}
+func (s *slotArgs) String() string {
+	return strings.Join(*s, ",")
 }
 
-// --- Fast Permutator Entry Point ---
-
-func RunPermutatorFast(sources []sourceArg, seps []string, prefix, suffix string, noRepeats bool, output func(string)) error {
-	var allItems []string
-	var srcOfItem []int
-	var srcDepths []int
+// minFromArgs collects repeatable -min-from source=K values.
+type minFromArgs []string
 
-	for srcIdx, src := range sources {
-		file, err := osOpen(src.Path)
-		if err != nil {
-			return fmt.Errorf("ERROR opening %s: %v", src.Path, err)
-		}
-		scanner := bufioNewScanner(file)
-		for scanner.Scan() {
-			line := scanner.Text()
-			if line == "" {
-				continue
-			}
-			allItems = append(allItems, line)
-			srcOfItem = append(srcOfItem, srcIdx)
-		}
-		file.Close()
-		srcDepths = append(srcDepths, src.Depth)
-	}
-
-	if output != nil {
-		p := &permutator{
-			allItems:  allItems,
-			srcOfItem: srcOfItem,
-			srcDepths: srcDepths,
-			seps:      seps,
-			prefix:    prefix,
-			suffix:    suffix,
-			noRepeats: noRepeats,
-			output:    output,
-		}
-		p.generate()
-		return nil
+func (m *minFromArgs) Set(val string) error {
+	if _, _, err := alchemy.SplitMinFrom(val); err != nil {
+		return err
 	}
-
-	fast := NewPermutatorFast(allItems, srcOfItem, srcDepths, seps, prefix, suffix, noRepeats, os.Stdout)
-	fast.Generate()
+	*m = append(*m, val)
 	return nil
 }
 
-// --- Counting Logic (unchanged) ---
-
-// CalculateOutputLines returns the number of output lines (permutations) as *big.Int
-func CalculateOutputLines(sources []sourceArg, seps []string, noRepeats bool) (*big.Int, error) {
-    // Gather all items and their source/depth
-    var allItems []string
-    var srcOfItem []int
-    var srcDepths []int
-
-    for srcIdx, src := range sources {
-        f, err := osOpen(src.Path)
-        if err != nil {
-            return nil, fmt.Errorf("ERROR opening %s: %v", src.Path, err)
-        }
-        sc := bufioNewScanner(f)
-        for sc.Scan() {
-            txt := sc.Text()
-            if txt == "" {
-                continue
-            }
-            allItems = append(allItems, txt)
-            srcOfItem = append(srcOfItem, srcIdx)
-        }
-        f.Close()
-        srcDepths = append(srcDepths, src.Depth)
-    }
-
-    n := len(allItems)
-    if n == 0 || len(seps) == 0 {
-        return big.NewInt(0), nil
-    }
-
-    // Helper: nPr (order matters, no repeats)
-    perm := func(n, r int) *big.Int {
-        if r < 0 || n < 0 || n < r {
-            return big.NewInt(0)
-        }
-        res := big.NewInt(1)
-        for i := 0; i < r; i++ {
-            res.Mul(res, big.NewInt(int64(n-i)))
-        }
-        return res
-    }
-    // Helper: base^exp (repeats allowed)
-    pow := func(base, exp int) *big.Int {
-        if exp < 0 || base < 0 {
-            return big.NewInt(0)
-        }
-        res := big.NewInt(1)
-        b := big.NewInt(int64(base))
-        for i := 0; i < exp; i++ {
-            res.Mul(res, b)
-        }
-        return res
-    }
-
-    total := big.NewInt(0)
-    sepFactor := big.NewInt(int64(len(seps)))
-
-    for i := 0; i < n; i++ {
-        maxDepth := srcDepths[srcOfItem[i]]
-        for l := 1; l <= maxDepth; l++ {
-            var cnt *big.Int
-            if noRepeats {
-                // pick l-1 more items out of (n-1) without repetition
-                cnt = perm(n-1, l-1)
-            } else {
-                // any of (n-1) items can occupy each of (l-1) positions
-                cnt = pow(n-1, l-1)
-            }
-            cnt.Mul(cnt, sepFactor)
-            total.Add(total, cnt)
-        }
-    }
-    return total, nil
+func (m *minFromArgs) String() string {
+	return strings.Join(*m, ",")
 }
 
-
 // --- CLI and Usage ---
 
 func printUsage() {
 	fmt.Println(`Usage: perms [options]
 Options:
-  -source file.txt:depth   Input file and depth (repeatable, required)
+  -source file.txt:depth   Input file and depth (repeatable, required); file.txt:min-max also sets a minimum; .gz, .zst and .bz2 files are decompressed; "-" reads stdin; "mask:?l?d:depth" expands a hashcat mask; ":prefix=X"/":suffix=X" wrap lines starting/ending with the source's items; a trailing ":sep=X" writes X instead of -sep before them
+  -combinations            Emit each unordered set of items once (a-b but not b-a); counted
+  -product                 Cross-join the -source files in order (file1 x file2 x ...) instead of permuting a merged pool
+  -template layout         Template mode naming sources: "{users}{sep}{years}!" (placeholders: -source path, file stem or index)
+  -slot file.txt           Template mode: position d of every line comes from the d-th -slot file (repeatable)
+  -min-depth n             Shortest sequence to emit for sources without their own minimum (default: 1)
+  -max-depth n             Cap every source's depth at n
   -sep separator           Separator string (repeatable, default: "")
   -prefix string           Prefix string for each output
   -suffix string           Suffix string for each output
   -no-repeats              Use each word only once per sequence
+  -no-cross-source         Only combine items coming from the same source
+  -no-consecutive-source   Never put two items from the same source next to each other
+  -dfs-order order         Try items forward (default), reverse or random; changes which lines come first
+  -dfs-seed n              Seed of -dfs-order random (default: 1)
+  -min-from source=K       Only emit lines with at least K items from source (path or 1-based index; repeatable)
+  -reverse-sources         Start sequences from the last source's items first (order only)
+  -ordered-by-weight       Read items as word<TAB>weight (default weight 1); emit lines by decreasing product of their weights
+  -max-depth-auto n        Override every depth with the largest one producing at most n lines
   -count                   Print the number of generated permutations and exit
+  -count-bytes             With -count, also print the output size, e.g. "4.2e12 lines, 87.3 TiB (...)"
+  -count-format fmt        Print -count as plain digits (default), human (1.2 quadrillion), grouped (1,234,567) or compact (1.23e4567)
+  -count-cache dir         Reuse -count results stored in dir while sources are unchanged
+  -count-assert n          Exit 0 if the line count equals n, else print expected vs actual and exit 1
+  -count-exact             Enumerate without output and print the exact line count after every filter
+  -count-exact-max n       Refuse -count-exact above n unfiltered lines (default: 100000000)
+  -out file, -o file       Write the output to file instead of stdout, replacing it atomically once done; compressed if file ends in .gz or .zst
+  -compress format         Compress the output (stdout or -out) with gzip or zstd; none turns off the .gz/.zst suffix detection
+  -split-lines n           Rotate -out into numbered parts (out.0001.txt, ...) of at most n lines
+  -split-size size         Rotate -out into numbered parts of at most size bytes, e.g. 500M or 1G
+  -workers n               Generate with n goroutines (default: one per CPU)
+  -sorted, -ordered        Write lines in sequential generation order, identical on every run (slower)
+  -gen-and-count           Generate normally and print the exact number of lines written to stderr
+  -report-unreachable      Warn on stderr about source lengths that produce no lines (e.g. depth > items with -no-repeats)
+  -list-sources            Print each source's resolved path, depth and item count after filtering, then exit
+  -count-per-source        Print each source's line count and counting time to stderr and exit
+  -count-histogram         Print how many lines have each length (bytes) to stderr and exit
+  -histogram-json          Same as -count-histogram, as JSON on stdout
+  -limit-time duration     Stop generating after this long, e.g. 30s (output stays valid)
+  -progress                Report lines written, lines/s, MB/s, percent of the count and ETA to stderr every 2s
+  -checkpoint file         Save the progress to file every 10s and on exit (implies -sorted)
+  -resume file             Continue from a -checkpoint file, writing only the lines not written yet
+  -format fmt              Write text (default, one line each) or json (one streamed array of strings)
+  -output-encoding enc     Transcode output to latin1, iso-8859-15, windows-1252, utf-16le or utf-16be (default: utf-8)
+  -output-encoding-replace Substitute characters the encoding cannot represent instead of failing
+  -line-buffered           Flush after every line so pipes see output immediately (lower throughput)
+  -reverse-output          Emit permutations in reverse generation order (buffers output unless plain sequences)
+  -reverse-output-max n    Refuse a buffered -reverse-output above n unfiltered lines (default: 10000000)
+  -min-token-len n         Drop input items shorter than n runes
+  -max-token-len n         Drop input items longer than n runes
+  -max-total-items n       Stop loading after n items across all sources, in source order
+  -dedup-input             Load an item found more than once only once, from the deepest source, and report how many were collapsed
+  -charset set             Drop input items with characters outside set (ranges allowed: "a-z0-9_")
+  -mutate list             Add variants of every item: comma list of lower, cap, upper, leet (counted)
+  -read-retries n          Rescan a source up to n times after a read error (flaky network mounts)
+  -incremental charset     Append every suffix over charset ("", "a", "b", .., "aa", ..) to each line
+  -incremental-max n       Longest incremental suffix (default: 1)
+  -leet n|all              Also write leet variants of every line with up to n characters substituted, or all combinations (counted)
+  -leet-table table        Substitutions used by -leet and -mutate leet, e.g. "a=4@,e=3,o=0" (default: a=4@,b=8,e=3,g=9,i=1!,l=1,o=0,s=5$,t=7; for -mutate leet: a=@,e=3,i=1,o=0,s=$)
+  -mutate-case list        Write every line in each listed case: comma list of capitalize, upper, lower, toggle (counted)
+  -rules file.rule         Write every line once per hashcat rule in the file (c, u, l, $X, ^X, sXY, r, d, ...)
+  -sort-external           Sort and de-duplicate output using temp files (bounded memory)
+  -sort-memory size        Memory budget before spilling a sorted run, e.g. 256M (default: 256M)
+  -limit-unique n          Stop once n distinct lines were written; repeats pass but do not count
+  -diff-against file       Only emit lines not already present in file (e.g. a previous run)
+  -exclude-file file       Suppress lines listed in file of already tried candidates (repeatable; .gz/.zst/.bz2 read)
+  -hash-shard i/n          Only emit lines whose content hash falls in shard i of n (0-based, stable across runs)
+  -min-len n / -max-len n  Only emit lines of n runes or more / at most, prefix and suffix included
+  -exclude-chars chars     Only emit lines containing none of chars
+  -match regex             Only emit lines matching regex (repeatable: all must match), e.g. '^[a-z]'
+  -exclude-match regex     Drop lines matching regex (repeatable)
+  -unique                  Drop lines already written (exact, memory grows with the output)
+  -unique-bloom rate       Like -unique in bounded memory: a bloom filter with this false positive rate
+  -unique-exact-max n      With -unique-bloom, dedupe the first n distinct lines exactly, then switch to the filter
+  -skip n / -limit n       Discard the first n output lines / stop after n lines (implies -sorted)
+  -sample n                Write n lines drawn uniformly at random from the whole space, in generation order
+  -seed n                  Seed of -sample (default: 1)
+  -token-map file          Write items through a canonical<TAB>display mapping (unmapped items unchanged)
+  -sanitize-sep string     Replace separator occurrences inside items with string (lossy)
+  -token-wrap markers      Wrap every item: first half opens, second half closes ("[]" gives [a]-[b])
+  -output-prefix-line s    Write line s once before the first permutation (e.g. a comment or BEGIN;)
+  -output-footer-line s    Write line s once after the last permutation, unless generation failed
+  -fail-on-duplicate       Exit non-zero, reporting the line, as soon as any output line repeats
+  -cpuprofile file         Write a pprof CPU profile of the generation to file
+  -memprofile file         Write a pprof heap profile, taken when generation ends, to file
+  -repl                    Keep sources loaded and read commands from stdin (type help)
   -help                    Show this help message and exit`)
 }
 
 func main() {
-	var sources sourceArgs
-	flag.Var(&sources, "source", "input file and depth in format file.txt:3 (repeatable)")
+	var sources alchemy.Sources
+	flag.Var(&sources, "source", "input file and depth in format file.txt:3, file.txt:3:transform=lower,title, file.txt:3:prefix=adm_ or file.txt:3:sep=. (repeatable)")
 
 	var seps sepArgs
 	flag.Var(&seps, "sep", "separator string (can be specified multiple times)")
@@ -377,6 +212,221 @@ func main() {
 	var countOnly bool
 	flag.BoolVar(&countOnly, "count", false, "print the number of generated permutations and exit")
 
+	var countBytes bool
+	flag.BoolVar(&countBytes, "count-bytes", false, "with -count, also print the output size in bytes (implies -count)")
+
+	var countFormat string
+	flag.StringVar(&countFormat, "count-format", "plain", "how -count prints the total: plain, human, grouped or compact")
+
+	var countCache string
+	flag.StringVar(&countCache, "count-cache", "", "directory caching -count results between runs")
+
+	var slots slotArgs
+	flag.Var(&slots, "slot", "file supplying the next position of every line (repeatable; replaces -source)")
+
+	var combinations bool
+	flag.BoolVar(&combinations, "combinations", false, "emit each unordered set of items once (a-b but not b-a)")
+
+	var product bool
+	flag.BoolVar(&product, "product", false, "cross-join the -source files in order: one item of each per line (depths ignored)")
+
+	var template string
+	flag.StringVar(&template, "template", "", `line layout binding positions to sources, e.g. "{users}{sep}{years}!"`)
+
+	var noConsecutiveSource bool
+	flag.BoolVar(&noConsecutiveSource, "no-consecutive-source", false, "never put two items from the same source next to each other")
+
+	var minDepth int
+	flag.IntVar(&minDepth, "min-depth", 1, "shortest sequence to emit (per source: file.txt:min-max)")
+	var maxDepth int
+	flag.IntVar(&maxDepth, "max-depth", 0, "cap every source's depth at this length (0 = per-source depths)")
+
+	var maxDepthAuto string
+	flag.StringVar(&maxDepthAuto, "max-depth-auto", "", "use the largest uniform depth producing at most this many lines")
+
+	var dfsOrder string
+	var dfsSeed int64
+	flag.StringVar(&dfsOrder, "dfs-order", "forward", "order items are tried in: forward, reverse or random")
+	flag.Int64Var(&dfsSeed, "dfs-seed", 1, "seed of -dfs-order random")
+
+	var minFromVals minFromArgs
+	flag.Var(&minFromVals, "min-from", "require at least K items from a source in every line, as source=K (repeatable)")
+
+	var reverseSources bool
+	flag.BoolVar(&reverseSources, "reverse-sources", false, "start sequences from the last source's items first")
+
+	var orderedByWeight bool
+	flag.BoolVar(&orderedByWeight, "ordered-by-weight", false, "read items as word<TAB>weight and emit lines by decreasing product of weights")
+
+	var noCrossSource bool
+	flag.BoolVar(&noCrossSource, "no-cross-source", false, "only combine items coming from the same source")
+
+	var reportUnreachable bool
+	flag.BoolVar(&reportUnreachable, "report-unreachable", false, "warn on stderr about configured lengths that can never be produced")
+
+	var listSources bool
+	flag.BoolVar(&listSources, "list-sources", false, "print each source's path, depth and item count after filtering, then exit")
+
+	var countPerSource bool
+	flag.BoolVar(&countPerSource, "count-per-source", false, "print each source's share of the count and its timing to stderr and exit")
+
+	var countHistogram, histogramJSON bool
+	flag.BoolVar(&countHistogram, "count-histogram", false, "print the distribution of output line lengths to stderr and exit")
+	flag.BoolVar(&histogramJSON, "histogram-json", false, "print the line length distribution as JSON on stdout and exit")
+
+	var countAssert string
+	flag.StringVar(&countAssert, "count-assert", "", "exit 0 only if the line count equals this value (for CI)")
+
+	var countExactMode bool
+	var countExactMax uint64
+	flag.BoolVar(&countExactMode, "count-exact", false, "enumerate without output and print the exact number of lines after filters")
+	flag.Uint64Var(&countExactMax, "count-exact-max", 100_000_000, "refuse -count-exact when the unfiltered count exceeds this")
+
+	var cpuProfile, memProfile string
+	flag.StringVar(&cpuProfile, "cpuprofile", "", "write a pprof CPU profile of the generation to this file")
+	flag.StringVar(&memProfile, "memprofile", "", "write a pprof heap profile taken after generation to this file")
+
+	var outPath string
+	flag.StringVar(&outPath, "out", "", "write the output to this file instead of stdout (gzip-compressed if it ends in .gz)")
+	flag.StringVar(&outPath, "o", "", "shorthand for -out")
+	var splitLines int64
+	var splitSize string
+	var compress string
+	flag.StringVar(&compress, "compress", "", "compress the output: gzip, zstd or none (default: by -out suffix, .gz or .zst)")
+	flag.Int64Var(&splitLines, "split-lines", 0, "rotate -out into numbered part files of at most this many lines")
+	flag.StringVar(&splitSize, "split-size", "", "rotate -out into numbered part files of at most this size, e.g. 1G")
+	var genAndCount bool
+	flag.BoolVar(&genAndCount, "gen-and-count", false, "generate, then print the exact number of lines written to stderr")
+
+	var progress bool
+	flag.BoolVar(&progress, "progress", false, "report lines written, throughput, percent done and ETA to stderr every 2s")
+
+	var checkpointPath, resumePath string
+	flag.StringVar(&checkpointPath, "checkpoint", "", "save the progress to this file periodically and on exit, for -resume")
+	flag.StringVar(&resumePath, "resume", "", "continue a run from a -checkpoint file without repeating its lines")
+
+	var limitTime time.Duration
+	flag.DurationVar(&limitTime, "limit-time", 0, "stop generating after this duration (e.g. 30s)")
+
+	var format string
+	flag.StringVar(&format, "format", "text", "output encoding: text (one line each) or json (a single array of strings)")
+
+	var outputEncoding string
+	var outputEncodingReplace bool
+	flag.StringVar(&outputEncoding, "output-encoding", "", "character encoding of the output: utf-8 (default), latin1, iso-8859-15, windows-1252, utf-16le or utf-16be")
+	flag.BoolVar(&outputEncodingReplace, "output-encoding-replace", false, "substitute characters the output encoding cannot represent instead of failing")
+
+	var workers int
+	flag.IntVar(&workers, "workers", 0, "goroutines generating concurrently (0 = one per CPU)")
+
+	var sorted bool
+	flag.BoolVar(&sorted, "sorted", false, "write lines in the same order on every run (sequential generation order)")
+	flag.BoolVar(&sorted, "ordered", false, "shorthand for -sorted")
+
+	var mutate string
+	flag.StringVar(&mutate, "mutate", "", "add variants of every item: comma list of lower, cap, upper, leet")
+
+	var lineBuffered bool
+	flag.BoolVar(&lineBuffered, "line-buffered", false, "flush output after every line (slower, for live consumers)")
+
+	var reverse bool
+	var reverseMax uint64
+	flag.BoolVar(&reverse, "reverse-output", false, "emit permutations in reverse generation order")
+	flag.Uint64Var(&reverseMax, "reverse-output-max", 10_000_000, "refuse a buffered -reverse-output when the unfiltered count exceeds this")
+
+	var minTokenLen, maxTokenLen int
+	flag.IntVar(&minTokenLen, "min-token-len", 0, "drop input items shorter than this many runes")
+	flag.IntVar(&maxTokenLen, "max-token-len", 0, "drop input items longer than this many runes (0 = no limit)")
+
+	var dedupInput bool
+	flag.BoolVar(&dedupInput, "dedup-input", false, "load an item found more than once (in one or several sources) only once")
+
+	var maxTotalItems int
+	flag.IntVar(&maxTotalItems, "max-total-items", 0, "stop loading once this many items are read across all sources (0 = no cap)")
+
+	var charset string
+	flag.StringVar(&charset, "charset", "", `drop input items with characters outside this set (ranges allowed, e.g. "a-z0-9_")`)
+
+	var readRetries int
+	flag.IntVar(&readRetries, "read-retries", 0, "rescan a source up to this many times after a read error")
+
+	var incremental string
+	var incrementalMax int
+	flag.StringVar(&incremental, "incremental", "", "charset appended incrementally to every line")
+	flag.IntVar(&incrementalMax, "incremental-max", 1, "longest incremental suffix")
+
+	var leet, leetTable string
+	flag.StringVar(&leet, "leet", "", "also write leet variants of every line with up to n characters substituted, or all")
+	flag.StringVar(&leetTable, "leet-table", "", "substitutions used by -leet and -mutate leet, e.g. a=4@,e=3,o=0")
+
+	var mutateCase string
+	flag.StringVar(&mutateCase, "mutate-case", "", "write every line in each listed case: comma list of capitalize, upper, lower, toggle")
+
+	var rulesPath string
+	flag.StringVar(&rulesPath, "rules", "", "file of hashcat rules applied to every line (one output line per rule)")
+
+	var sortExternal bool
+	var sortMemory string
+	flag.BoolVar(&sortExternal, "sort-external", false, "sort and de-duplicate output using temp files")
+	flag.StringVar(&sortMemory, "sort-memory", "256M", "memory budget before spilling a sorted run")
+
+	var failOnDuplicate bool
+	flag.BoolVar(&failOnDuplicate, "fail-on-duplicate", false, "exit non-zero on the first duplicate output line")
+
+	var limitUnique int
+	flag.IntVar(&limitUnique, "limit-unique", 0, "stop once this many distinct lines were written (0 = no limit)")
+
+	var diffAgainst string
+	flag.StringVar(&diffAgainst, "diff-against", "", "only emit lines not present in this previous output file")
+	var excludeFiles repeatedArgs
+	flag.Var(&excludeFiles, "exclude-file", "suppress lines listed in this file of already tried candidates (repeatable)")
+
+	var hashShard string
+	flag.StringVar(&hashShard, "hash-shard", "", "only emit lines whose content hashes to shard i of n (format i/n)")
+
+	var minLen, maxLen int
+	flag.IntVar(&minLen, "min-len", 0, "only emit lines of at least this many runes, prefix and suffix included")
+	flag.IntVar(&maxLen, "max-len", 0, "only emit lines of at most this many runes, prefix and suffix included (0 = no limit)")
+
+	var excludeChars string
+	flag.StringVar(&excludeChars, "exclude-chars", "", "only emit lines containing none of these characters")
+
+	var match, excludeMatch repeatedArgs
+	flag.Var(&match, "match", "only emit lines matching this regular expression (repeatable, all must match)")
+	flag.Var(&excludeMatch, "exclude-match", "drop lines matching this regular expression (repeatable)")
+
+	var unique bool
+	flag.BoolVar(&unique, "unique", false, "drop lines already written (tracked exactly in memory)")
+	var uniqueBloom float64
+	flag.Float64Var(&uniqueBloom, "unique-bloom", 0, "like -unique with a bloom filter of this false positive rate (e.g. 0.001)")
+	var uniqueExactMax int
+	flag.IntVar(&uniqueExactMax, "unique-exact-max", 0, "with -unique-bloom, track the first N distinct lines exactly before switching to the filter")
+
+	var skip, limit int
+	flag.IntVar(&skip, "skip", 0, "discard the first N output lines (after filters), e.g. to resume a run")
+	flag.IntVar(&limit, "limit", 0, "stop after writing N lines (0 = no limit)")
+
+	var sample int
+	var sampleSeed int64
+	flag.IntVar(&sample, "sample", 0, "write N lines drawn uniformly at random from the whole space (0 = off)")
+	flag.Int64Var(&sampleSeed, "seed", 1, "seed of -sample")
+
+	var tokenMap string
+	flag.StringVar(&tokenMap, "token-map", "", "file of canonical<TAB>display lines; items are written in their display form")
+
+	var sanitizeSep optionalString
+	flag.Var(&sanitizeSep, "sanitize-sep", "replace separator occurrences inside items with this string")
+
+	var tokenWrap string
+	flag.StringVar(&tokenWrap, "token-wrap", "", `wrap every item, first half opening and second half closing (e.g. "[]" or "<<>>")`)
+
+	var headerLine, footerLine string
+	flag.StringVar(&headerLine, "output-prefix-line", "", "line written once before the first permutation")
+	flag.StringVar(&footerLine, "output-footer-line", "", "line written once after the last permutation (successful runs only)")
+
+	var replMode bool
+	flag.BoolVar(&replMode, "repl", false, "read interactive commands from stdin (type help)")
+
 	var showHelp bool
 	flag.BoolVar(&showHelp, "help", false, "show help message and exit")
 
@@ -387,8 +437,36 @@ func main() {
 		os.Exit(0)
 	}
 
+	if len(slots) > 0 {
+		if len(sources) > 0 || maxDepthAuto != "" {
+			fmt.Fprintln(os.Stderr, "ERROR: -slot sets the line length and cannot be combined with -source or -max-depth-auto")
+			os.Exit(1)
+		}
+		sources = alchemy.SlotSources(slots)
+	}
+	if product {
+		if len(slots) > 0 || template != "" || maxDepthAuto != "" {
+			fmt.Fprintln(os.Stderr, "ERROR: -product cannot be combined with -slot, -template or -max-depth-auto")
+			os.Exit(1)
+		}
+		sources = alchemy.AsSlots(sources)
+	}
+
+	var tpl *alchemy.Template
+	if template != "" {
+		var err error
+		if len(slots) > 0 || maxDepthAuto != "" {
+			err = errors.New("-template sets the line layout and cannot be combined with -slot or -max-depth-auto")
+		} else if tpl, err = alchemy.ParseTemplate(template); err == nil {
+			sources, err = tpl.Sources(sources)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "ERROR:", err)
+			os.Exit(1)
+		}
+	}
 	if len(sources) == 0 {
-		fmt.Fprintln(os.Stderr, "ERROR: at least one -source must be provided")
+		fmt.Fprintln(os.Stderr, "ERROR: at least one -source or -slot must be provided")
 		printUsage()
 		os.Exit(1)
 	}
@@ -396,19 +474,349 @@ func main() {
 		seps = append(seps, "")
 	}
 
-	if countOnly {
-		total, err := CalculateOutputLines(sources, seps, noRepeats)
+	sortBudget, err := alchemy.ParseSize(sortMemory)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ERROR:", err)
+		os.Exit(1)
+	}
+
+	opts := alchemy.Options{
+		Seps:        seps,
+		Prefix:      prefix,
+		Suffix:      suffix,
+		NoRepeats:   noRepeats,
+		LimitTime:   limitTime,
+		Reverse:     reverse,
+		ReverseMax:  reverseMax,
+		MinTokenLen: minTokenLen,
+		MaxTokenLen: maxTokenLen,
+		Charset:     charset,
+		Mutate:      mutate,
+		Leet:        leet,
+		LeetTable:   leetTable,
+		MutateCase:  mutateCase,
+		ReadRetries: readRetries,
+
+		LineBuffered:  lineBuffered,
+		Workers:       workers,
+		Sorted:        sorted,
+		Format:        format,
+		MaxTotalItems: maxTotalItems,
+		DedupInput:    dedupInput,
+
+		OutputEncoding:        outputEncoding,
+		OutputEncodingReplace: outputEncodingReplace,
+
+		Incremental:    incremental,
+		IncrementalMax: incrementalMax,
+
+		SortExternal: sortExternal,
+		SortMemory:   int(sortBudget),
+
+		NoCrossSource:       noCrossSource,
+		NoConsecutiveSource: noConsecutiveSource,
+		Slots:               len(slots) > 0 || product,
+		Combinations:        combinations,
+		Checkpoint:          checkpointPath,
+		Resume:              resumePath,
+		Progress:            progress,
+
+		MinDepth: minDepth,
+
+		DFSOrder:        dfsOrder,
+		DFSSeed:         dfsSeed,
+		ReverseSources:  reverseSources,
+		OrderedByWeight: orderedByWeight,
+
+		FailOnDuplicate: failOnDuplicate,
+		LimitUnique:     limitUnique,
+		DiffAgainst:     diffAgainst,
+		ExcludeFiles:    excludeFiles,
+		HashShard:       hashShard,
+		MinLen:          minLen,
+		MaxLen:          maxLen,
+		ExcludeChars:    excludeChars,
+		Match:           match,
+		ExcludeMatch:    excludeMatch,
+		Unique:          unique,
+		UniqueBloom:     uniqueBloom,
+		UniqueExactMax:  uniqueExactMax,
+		Skip:            skip,
+		Limit:           limit,
+		Sample:          sample,
+		SampleSeed:      sampleSeed,
+		SanitizeSep:     sanitizeSep.value(),
+		TokenMap:        tokenMap,
+		TokenWrap:       tokenWrap,
+		HeaderLine:      headerLine,
+		FooterLine:      footerLine,
+	}
+
+	minFrom, err := alchemy.ResolveMinFrom(minFromVals, sources)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ERROR:", err)
+		os.Exit(1)
+	}
+	opts.MinFrom = minFrom
+
+	if rulesPath != "" {
+		if opts.Rules, err = alchemy.LoadRules(rulesPath); err != nil {
+			fmt.Fprintln(os.Stderr, "ERROR:", err)
+			os.Exit(1)
+		}
+	}
+
+	if tpl != nil {
+		opts = tpl.Apply(opts)
+	}
+
+	if maxDepth != 0 {
+		if maxDepth < 1 || maxDepthAuto != "" || opts.Slots {
+			fmt.Fprintln(os.Stderr, "ERROR: -max-depth must be at least 1 and cannot be combined with -max-depth-auto, -slot or -template")
+			os.Exit(1)
+		}
+		if minDepth > maxDepth {
+			fmt.Fprintf(os.Stderr, "ERROR: -min-depth (%d) is greater than -max-depth (%d)\n", minDepth, maxDepth)
+			os.Exit(1)
+		}
+		alchemy.CapDepths(sources, maxDepth)
+	}
+
+	if maxDepthAuto != "" {
+		budget, ok := new(big.Int).SetString(maxDepthAuto, 10)
+		if !ok || budget.Sign() <= 0 {
+			fmt.Fprintln(os.Stderr, "ERROR: invalid -max-depth-auto:", maxDepthAuto)
+			os.Exit(1)
+		}
+		depth, err := alchemy.AutoDepth(sources, opts, budget)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "ERROR:", err)
+			os.Exit(1)
+		}
+		fmt.Fprintf(os.Stderr, "max-depth-auto: using depth %d\n", depth)
+		for i := range sources {
+			sources[i].Depth = depth
+		}
+	}
+
+	if err := alchemy.Validate(sources, opts); err != nil {
+		for _, msg := range strings.Split(err.Error(), "\n") {
+			fmt.Fprintln(os.Stderr, "ERROR:", msg)
+		}
+		os.Exit(1)
+	}
+
+	if reportUnreachable {
+		found, err := alchemy.FindUnreachableLengths(sources, opts)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "ERROR:", err)
+			os.Exit(1)
+		}
+		alchemy.PrintUnreachable(os.Stderr, found)
+	}
+
+	if replMode {
+		for _, src := range sources {
+			if alchemy.IsStdinPath(src.Path) {
+				fmt.Fprintln(os.Stderr, "ERROR: -repl reads commands from stdin, so stdin cannot also be a source")
+				os.Exit(1)
+			}
+		}
+		if err := alchemy.RunREPL(sources, opts, os.Stdin, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, "ERROR:", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if countAssert != "" {
+		want, err := alchemy.ParseCountAssert(countAssert)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "ERROR: -count-assert:", err)
+			os.Exit(1)
+		}
+		if err := alchemy.AssertCount(sources, opts, want); err != nil {
+			fmt.Fprintln(os.Stderr, "ERROR:", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if countOnly || countBytes {
+		count := alchemy.CalculateOutputLines
+		if countCache != "" {
+			count = func(sources []alchemy.Source, opts alchemy.Options) (*big.Int, error) {
+				return alchemy.CachedOutputLines(countCache, sources, opts)
+			}
+		}
+		total, err := count(sources, opts)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "ERROR:", err)
+			os.Exit(1)
+		}
+		formatted, err := alchemy.FormatCount(total, countFormat)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "ERROR:", err)
+			os.Exit(1)
+		}
+		if !countBytes {
+			fmt.Println(formatted)
+			os.Exit(0)
+		}
+		size, err := alchemy.CalculateOutputBytes(sources, opts)
+		if errors.Is(err, alchemy.ErrBytesUnavailable) {
+			// The count stands on its own; only the size is unknown.
+			fmt.Printf("%s lines, bytes unavailable (%v)\n", formatted, err)
+			os.Exit(0)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "ERROR:", err)
+			os.Exit(1)
+		}
+		sizeBytes, _ := alchemy.FormatCount(size, countFormat)
+		fmt.Printf("%s lines, %s (%s bytes)\n", formatted, alchemy.HumanBytes(size), sizeBytes)
+		os.Exit(0)
+	}
+
+	if countExactMode {
+		lines, err := alchemy.CountExact(sources, opts, countExactMax)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "ERROR:", err)
+			os.Exit(1)
+		}
+		formatted, err := alchemy.FormatCount(new(big.Int).SetUint64(lines), countFormat)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "ERROR:", err)
+			os.Exit(1)
+		}
+		fmt.Println(formatted)
+		os.Exit(0)
+	}
+
+	if listSources {
+		summaries, err := alchemy.SummarizeSources(sources, opts)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "ERROR:", err)
+			os.Exit(1)
+		}
+		alchemy.PrintSourceSummaries(os.Stdout, summaries)
+		os.Exit(0)
+	}
+
+	if countPerSource {
+		counts, err := alchemy.CalculateOutputLinesBySource(sources, opts)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "ERROR:", err)
+			os.Exit(1)
+		}
+		alchemy.PrintSourceCounts(os.Stderr, counts)
+		os.Exit(0)
+	}
+
+	if countHistogram || histogramJSON {
+		buckets, exact, err := alchemy.CalculateLengthHistogram(sources, opts)
 		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
+			fmt.Fprintln(os.Stderr, "ERROR:", err)
 			os.Exit(1)
 		}
-		fmt.Println(total)
+		if histogramJSON {
+			alchemy.PrintHistogramJSON(os.Stdout, buckets, exact)
+		} else {
+			alchemy.PrintHistogram(os.Stderr, buckets, exact)
+		}
 		os.Exit(0)
 	}
 
-	err := RunPermutatorFast(sources, seps, prefix, suffix, noRepeats, nil)
+	// closeOutput finishes the output after a run that returned err;
+	// discardOutput drops it when the run could not start.
+	closeOutput := func(err error) error { return nil }
+	discardOutput := func() {}
+	if err := checkCompression(compress); err != nil {
+		fmt.Fprintln(os.Stderr, "ERROR: -compress:", err)
+		os.Exit(1)
+	}
+	if (splitLines != 0 || splitSize != "") && outPath == "" {
+		fmt.Fprintln(os.Stderr, "ERROR: -split-lines and -split-size need -out")
+		os.Exit(1)
+	}
+	if outPath != "" {
+		var out output
+		if splitLines != 0 || splitSize != "" {
+			var maxBytes int64
+			if splitSize != "" {
+				if maxBytes, err = alchemy.ParseSize(splitSize); err != nil {
+					fmt.Fprintln(os.Stderr, "ERROR: -split-size:", err)
+					os.Exit(1)
+				}
+			}
+			if splitLines < 0 {
+				fmt.Fprintf(os.Stderr, "ERROR: -split-lines must not be negative, got %d\n", splitLines)
+				os.Exit(1)
+			}
+			if opts.Resume != "" {
+				out, err = resumeSplitOutput(outPath, compress, splitLines, maxBytes)
+			} else {
+				out, err = createSplitOutput(outPath, compress, splitLines, maxBytes)
+			}
+		} else if opts.Resume != "" {
+			out, err = appendOutput(outPath, compress)
+		} else {
+			out, err = createOutput(outPath, compress)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "ERROR:", err)
+			os.Exit(1)
+		}
+		opts.Stdout = out
+		closeOutput = func(err error) error { return finishOutput(out, err, opts.Checkpoint != "") }
+		discardOutput = out.abort
+	} else if format := compressionFor("", compress); format != "" {
+		cw, err := newCompressor(os.Stdout, format)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "ERROR:", err)
+			os.Exit(1)
+		}
+		opts.Stdout = cw
+		closeOutput = func(error) error { return cw.Close() }
+	}
+
+	stopProfiles, err := startProfiles(cpuProfile, memProfile)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
+		discardOutput()
+		fmt.Fprintln(os.Stderr, "ERROR:", err)
 		os.Exit(1)
 	}
-}
\ No newline at end of file
+
+	if genAndCount {
+		lines, err := alchemy.GenerateAndCount(sources, opts)
+		if perr := stopProfiles(); perr != nil {
+			fmt.Fprintln(os.Stderr, "ERROR:", perr)
+		}
+		if cerr := closeOutput(err); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "ERROR:", err)
+			os.Exit(1)
+		}
+		fmt.Fprintln(os.Stderr, lines)
+		os.Exit(0)
+	}
+
+	// Ctrl-C stops generation cleanly: written lines are flushed and the
+	// progress reached is reported.
+	ctx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stopSignals()
+	opts.Context = ctx
+	err = alchemy.RunPermutatorFast(sources, opts, nil)
+	if perr := stopProfiles(); perr != nil {
+		fmt.Fprintln(os.Stderr, "ERROR:", perr)
+	}
+	if cerr := closeOutput(err); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ERROR:", err)
+		os.Exit(1)
+	}
+}
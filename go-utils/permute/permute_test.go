@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/marcrow/listAlchemy/pkg/alchemy"
+)
+
+func TestProfilesAreWritten(t *testing.T) {
+	dir := t.TempDir()
+	cpu, mem := filepath.Join(dir, "cpu.pprof"), filepath.Join(dir, "mem.pprof")
+	stop, err := startProfiles(cpu, mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	words := make([]string, 20)
+	for i := range words {
+		words[i] = fmt.Sprintf("w%d", i)
+	}
+	err = alchemy.RunPermutatorFast([]alchemy.Source{{Path: "words.txt", Items: words, Depth: 3}}, alchemy.Options{Seps: []string{"-"}}, func(string) {})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := stop(); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{cpu, mem} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() == 0 {
+			t.Errorf("%s is empty", path)
+		}
+	}
+
+	stop, err = startProfiles("", "")
+	if err != nil || stop() != nil {
+		t.Errorf("disabled profiles should be a no-op")
+	}
+}
+
+func TestOutFileGzipRoundTrips(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.txt.gz")
+	out, err := createOutput(path, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	err = alchemy.RunPermutatorFast([]alchemy.Source{{Path: "a.txt", Items: []string{"a", "b"}, Depth: 2}}, alchemy.Options{Seps: []string{"-"}, Stdout: out}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := out.Close(); err != nil {
+		t.Fatalf("unexpected close error: %v", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("output is not gzip: %v", err)
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("truncated archive: %v", err)
+	}
+	if got := strings.Count(string(data), "\n"); got != 6 {
+		t.Errorf("expected 6 lines, got %d: %q", got, data)
+	}
+
+	if _, err := createOutput(filepath.Join(t.TempDir(), "missing", "out.txt"), ""); err == nil {
+		t.Error("expected an error creating a file in a missing directory")
+	}
+}
+
+func TestOutFileAbortLeavesTargetUntouched(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "out.txt")
+	if err := os.WriteFile(path, []byte("previous run\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	out, err := createOutput(path, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	split, err := createSplitOutput(filepath.Join(dir, "parts.txt"), "", 10, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	w := io.MultiWriter(out, split)
+	fmt.Fprintln(w, "partial")
+	sources := []alchemy.Source{{Path: "a.txt", Items: []string{"a", "b"}, Depth: 2}, {Path: filepath.Join(t.TempDir(), "missing.txt"), Depth: 1}}
+	err = alchemy.RunPermutatorFast(sources, alchemy.Options{Seps: []string{"-"}, Stdout: w}, nil)
+	if err == nil {
+		t.Fatal("expected the run to fail on a missing source")
+	}
+	out.abort()
+	split.abort()
+
+	if data, err := os.ReadFile(path); err != nil || string(data) != "previous run\n" {
+		t.Errorf("expected the target to be left untouched, got %q (%v)", data, err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected only the target to remain, got %v", entries)
+	}
+}
+
+// cancelAfter cancels a context once it has received n writes.
+type cancelAfter struct {
+	w      io.Writer
+	n      int
+	cancel context.CancelFunc
+}
+
+func (c *cancelAfter) Write(p []byte) (int, error) {
+	if c.n--; c.n == 0 {
+		c.cancel()
+	}
+	return c.w.Write(p)
+}
+
+func TestResumeWritesTheRestToAnotherOutFile(t *testing.T) {
+	dir := t.TempDir()
+	var items []string
+	for i := 0; i < 12; i++ {
+		items = append(items, fmt.Sprintf("w%02d", i))
+	}
+	sources := []alchemy.Source{{Path: "a.txt", Items: items, Depth: 3}}
+	opts := alchemy.Options{Seps: []string{"-"}, NoRepeats: true, LineBuffered: true}
+
+	var full bytes.Buffer
+	reference := opts
+	reference.Sorted, reference.Stdout = true, &full
+	if err := alchemy.RunPermutatorFast(sources, reference, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	state := filepath.Join(dir, "state.json")
+	first, err := createOutput(filepath.Join(dir, "first.txt"), "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	run := opts
+	run.Checkpoint, run.Context = state, ctx
+	run.Stdout = &cancelAfter{w: first, n: 50, cancel: cancel}
+	if err := alchemy.RunPermutatorFast(sources, run, nil); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the run to be interrupted, got %v", err)
+	}
+	if err := first.Close(); err != nil {
+		t.Fatalf("unexpected close error: %v", err)
+	}
+
+	second, err := createOutput(filepath.Join(dir, "second.txt"), "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resumed := opts
+	resumed.Checkpoint, resumed.Resume, resumed.Stdout = state, state, second
+	if err := alchemy.RunPermutatorFast(sources, resumed, nil); err != nil {
+		t.Fatalf("unexpected resume error: %v", err)
+	}
+	if err := second.Close(); err != nil {
+		t.Fatalf("unexpected close error: %v", err)
+	}
+
+	a, _ := os.ReadFile(first.path)
+	b, _ := os.ReadFile(second.path)
+	if got := string(a) + string(b); got != full.String() {
+		t.Errorf("interrupted run plus resumed run differ from a full run (%d+%d vs %d bytes)", len(a), len(b), full.Len())
+	}
+}
+
+func TestInterruptedOutFileIsKeptAndResumeAppends(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "out.txt.gz")
+	var items []string
+	for i := 0; i < 12; i++ {
+		items = append(items, fmt.Sprintf("w%02d", i))
+	}
+	sources := []alchemy.Source{{Path: "a.txt", Items: items, Depth: 3}}
+	opts := alchemy.Options{Seps: []string{"-"}, NoRepeats: true, LineBuffered: true}
+
+	var full bytes.Buffer
+	reference := opts
+	reference.Sorted, reference.Stdout = true, &full
+	if err := alchemy.RunPermutatorFast(sources, reference, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Ctrl-C: the lines written are kept, as the checkpoint counts them.
+	state := filepath.Join(dir, "state.json")
+	out, err := createOutput(path, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	run := opts
+	run.Checkpoint, run.Context = state, ctx
+	run.Stdout = &cancelAfter{w: out, n: 50, cancel: cancel}
+	err = alchemy.RunPermutatorFast(sources, run, nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the run to be interrupted, got %v", err)
+	}
+	if err := finishOutput(out, err, true); err != nil {
+		t.Fatalf("unexpected finish error: %v", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("expected the interrupted output to be kept: %v", err)
+	}
+
+	out, err = appendOutput(path, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resumed := opts
+	resumed.Checkpoint, resumed.Resume, resumed.Stdout = state, state, out
+	err = alchemy.RunPermutatorFast(sources, resumed, nil)
+	if err := finishOutput(out, err, true); err != nil {
+		t.Fatalf("unexpected resume error: %v", err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("not gzip: %v", err)
+	}
+	got, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("bad gzip stream: %v", err)
+	}
+	if string(got) != full.String() {
+		t.Errorf("interrupted plus resumed output differs from a full run (%d vs %d bytes)", len(got), full.Len())
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 2 {
+		t.Errorf("expected only the output and the checkpoint, got %v", entries)
+	}
+}
+
+func TestResumedSplitOutputNumbersAfterExistingParts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.txt")
+	s, err := createSplitOutput(path, "", 2, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	fmt.Fprint(s, "a\nb\nc\n")
+	if err := finishOutput(s, context.Canceled, false); err != nil {
+		t.Fatalf("unexpected finish error: %v", err)
+	}
+	s, err = resumeSplitOutput(path, "", 2, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	fmt.Fprint(s, "d\n")
+	if err := s.Close(); err != nil {
+		t.Fatalf("unexpected close error: %v", err)
+	}
+	for part, want := range map[int]string{1: "a\nb\n", 2: "c\n", 3: "d\n"} {
+		if data, err := os.ReadFile(partPath(path, part)); err != nil || string(data) != want {
+			t.Errorf("part %d: expected %q, got %q (%v)", part, want, data, err)
+		}
+	}
+	var report bytes.Buffer
+	s.report(&report)
+	if want := "wrote 1 lines (2 bytes) to 1 files " + partPath(path, 3) + " .. " + partPath(path, 3) + "\n"; report.String() != want {
+		t.Errorf("expected report %q, got %q", want, report.String())
+	}
+}
+
+func TestOutFileIsReplacedOnClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.txt")
+	if err := os.WriteFile(path, []byte("previous\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	out, err := createOutput(path, "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	fmt.Fprint(out, "a-b\nb-")
+	fmt.Fprint(out, "a\n")
+	if data, _ := os.ReadFile(path); string(data) != "previous\n" {
+		t.Errorf("expected the previous file until Close, got %q", data)
+	}
+	if err := out.Close(); err != nil {
+		t.Fatalf("unexpected close error: %v", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "a-b\nb-a\n" {
+		t.Errorf("expected the new output after Close, got %q", data)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Errorf("expected no temporary file left behind, got %d entries", len(entries))
+	}
+	var report bytes.Buffer
+	out.report(&report)
+	if want := "wrote 2 lines (8 bytes) to " + path + "\n"; report.String() != want {
+		t.Errorf("expected report %q, got %q", want, report.String())
+	}
+}
+
+func TestSplitOutputRotatesOnLineBoundaries(t *testing.T) {
+	if got := partPath("dir/out.txt.gz", 12); got != "dir/out.0012.txt.gz" {
+		t.Errorf("unexpected part name %q", got)
+	}
+	if got := partPath("out", 1); got != "out.0001" {
+		t.Errorf("unexpected part name %q", got)
+	}
+
+	dir := t.TempDir()
+	out, err := createSplitOutput(filepath.Join(dir, "out.txt"), "", 3, 10)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Lines split across writes must not be cut between parts.
+	for _, chunk := range []string{"a\nb", "\nc\nd\n", "0123456789abc\ne", "f\ngh"} {
+		if _, err := io.WriteString(out, chunk); err != nil {
+			t.Fatalf("unexpected write error: %v", err)
+		}
+	}
+	if err := out.Close(); err != nil {
+		t.Fatalf("unexpected close error: %v", err)
+	}
+	want := []string{"a\nb\nc\n", "d\n", "0123456789abc\n", "ef\ngh"}
+	for i, w := range want {
+		data, err := os.ReadFile(partPath(filepath.Join(dir, "out.txt"), i+1))
+		if err != nil {
+			t.Fatalf("part %d: %v", i+1, err)
+		}
+		if string(data) != w {
+			t.Errorf("part %d: expected %q, got %q", i+1, w, data)
+		}
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != len(want) {
+		t.Errorf("expected %d parts, got %d entries", len(want), len(entries))
+	}
+	var report bytes.Buffer
+	out.report(&report)
+	if !strings.HasPrefix(report.String(), "wrote 6 lines (27 bytes) to 4 files ") {
+		t.Errorf("unexpected report %q", report.String())
+	}
+}
+
+func TestCompressStreamsOutputThroughZstd(t *testing.T) {
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		name, compress string
+		decode         func(io.Reader) (io.Reader, error)
+	}{
+		{"out.txt.zst", "", func(r io.Reader) (io.Reader, error) { return zstd.NewReader(r) }},
+		{"out.txt", "gzip", func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) }},
+		{"out.txt.gz", "none", func(r io.Reader) (io.Reader, error) { return r, nil }},
+	} {
+		path := filepath.Join(dir, tc.name)
+		out, err := createOutput(path, tc.compress)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tc.name, err)
+		}
+		err = alchemy.RunPermutatorFast([]alchemy.Source{{Path: "a.txt", Items: []string{"a", "b"}, Depth: 2}}, alchemy.Options{Seps: []string{"-"}, Stdout: out}, nil)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tc.name, err)
+		}
+		if err := out.Close(); err != nil {
+			t.Fatalf("%s: unexpected close error: %v", tc.name, err)
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := tc.decode(f)
+		if err != nil {
+			t.Fatalf("%s: not in the expected format: %v", tc.name, err)
+		}
+		data, err := io.ReadAll(r)
+		f.Close()
+		if err != nil {
+			t.Fatalf("%s: truncated stream: %v", tc.name, err)
+		}
+		if got := strings.Count(string(data), "\n"); got != 6 {
+			t.Errorf("%s: expected 6 lines, got %d: %q", tc.name, got, data)
+		}
+	}
+	if err := checkCompression("bzip2"); err == nil {
+		t.Error("expected an unknown compression to be rejected")
+	}
+	if got := partPath("out.txt.zst", 3); got != "out.0003.txt.zst" {
+		t.Errorf("unexpected part name %q", got)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/pprof"
+)
+
+// startProfiles starts a CPU profile into cpuPath and arranges for a heap
+// profile to be written to memPath. The returned function stops the CPU
+// profile and writes the heap profile; it must be called once generation is
+// over. Empty paths disable the matching profile, and with both empty nothing
+// is set up at all.
+func startProfiles(cpuPath, memPath string) (stop func() error, err error) {
+	var cpuFile *os.File
+	if cpuPath != "" {
+		cpuFile, err = os.Create(cpuPath)
+		if err != nil {
+			return nil, fmt.Errorf("creating %s: %v", cpuPath, err)
+		}
+		if err := pprof.StartCPUProfile(cpuFile); err != nil {
+			cpuFile.Close()
+			return nil, fmt.Errorf("starting CPU profile: %v", err)
+		}
+	}
+
+	return func() error {
+		var errs []error
+		if cpuFile != nil {
+			pprof.StopCPUProfile()
+			if err := cpuFile.Close(); err != nil {
+				errs = append(errs, fmt.Errorf("writing %s: %v", cpuPath, err))
+			}
+		}
+		if memPath != "" {
+			errs = append(errs, writeHeapProfile(memPath))
+		}
+		return errors.Join(errs...)
+	}, nil
+}
+
+func writeHeapProfile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("creating %s: %v", path, err)
+	}
+	defer f.Close()
+	runtime.GC() // report live allocations as of the end of generation
+	if err := pprof.WriteHeapProfile(f); err != nil {
+		return fmt.Errorf("writing %s: %v", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// splitOutput is an -out destination rotated into numbered part files
+// (-split-lines, -split-size): out.txt becomes out.0001.txt, out.0002.txt, ...
+// Parts only ever end on a line boundary, and each one is an outputFile, so
+// it is compressed on its own and appears once complete.
+type splitOutput struct {
+	path     string
+	compress string // -compress format of every part ("" = by suffix)
+	maxLines int64  // lines per part (0 = no limit)
+	maxBytes int64  // bytes per part; a longer line gets a part of its own (0 = no limit)
+
+	start   int         // parts already there before this run (-resume)
+	part    int         // number of the current part
+	cur     *outputFile // nil before the first line and right after a rotation
+	pending []byte      // start of a line whose newline was not written yet
+	first   string      // name of the first part
+	lines   int64       // lines written, all parts
+	bytes   int64       // bytes written, all parts
+}
+
+// createSplitOutput starts writing path as parts of at most maxLines lines
+// and maxBytes bytes.
+func createSplitOutput(path, compress string, maxLines, maxBytes int64) (*splitOutput, error) {
+	s := &splitOutput{path: path, compress: compress, maxLines: maxLines, maxBytes: maxBytes}
+	if err := s.rotate(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// resumeSplitOutput is createSplitOutput for -resume: the parts of the
+// interrupted run are kept and numbering goes on after the last one.
+func resumeSplitOutput(path, compress string, maxLines, maxBytes int64) (*splitOutput, error) {
+	s := &splitOutput{path: path, compress: compress, maxLines: maxLines, maxBytes: maxBytes}
+	for {
+		if _, err := os.Stat(partPath(path, s.start+1)); err != nil {
+			break
+		}
+		s.start++
+	}
+	s.part = s.start
+	if err := s.rotate(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// partPath numbers path before its extension, keeping a compression suffix
+// last: out.txt.gz part 2 is out.0002.txt.gz.
+func partPath(path string, part int) string {
+	stem, suffix := path, ""
+	for s := range compressionSuffixes {
+		if strings.HasSuffix(path, s) {
+			stem, suffix = strings.TrimSuffix(path, s), s
+		}
+	}
+	ext := filepath.Ext(stem)
+	return fmt.Sprintf("%s.%04d%s%s", strings.TrimSuffix(stem, ext), part, ext, suffix)
+}
+
+// rotate closes the current part, if any, and opens the next one.
+func (s *splitOutput) rotate() error {
+	if s.cur != nil {
+		if err := s.cur.Close(); err != nil {
+			return err
+		}
+	}
+	s.part++
+	cur, err := createOutput(partPath(s.path, s.part), s.compress)
+	if err != nil {
+		return err
+	}
+	if s.part == s.start+1 {
+		s.first = cur.path
+	}
+	s.cur = cur
+	return nil
+}
+
+func (s *splitOutput) Write(p []byte) (int, error) {
+	s.pending = append(s.pending, p...)
+	rest := s.pending
+	for {
+		i := bytes.IndexByte(rest, '\n')
+		if i < 0 {
+			break
+		}
+		if err := s.writeLine(rest[:i+1]); err != nil {
+			return 0, err
+		}
+		rest = rest[i+1:]
+	}
+	// Keep the partial line at the start of the buffer for reuse.
+	s.pending = s.pending[:copy(s.pending, rest)]
+	return len(p), nil
+}
+
+// writeLine writes one line, opening a new part first when it would take
+// the current one over a limit.
+func (s *splitOutput) writeLine(line []byte) error {
+	full := s.cur.lines > 0 && s.maxLines > 0 && s.cur.lines >= s.maxLines
+	if s.cur.bytes > 0 && s.maxBytes > 0 && s.cur.bytes+int64(len(line)) > s.maxBytes {
+		full = true
+	}
+	if full {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	if _, err := s.cur.Write(line); err != nil {
+		return fmt.Errorf("writing %s: %v", s.cur.path, err)
+	}
+	s.lines += int64(bytes.Count(line, []byte{'\n'}))
+	s.bytes += int64(len(line))
+	return nil
+}
+
+// Close writes a last line left without a newline and closes the current
+// part.
+func (s *splitOutput) Close() error {
+	if len(s.pending) > 0 {
+		if err := s.writeLine(s.pending); err != nil {
+			return err
+		}
+		s.pending = nil
+	}
+	return s.cur.Close()
+}
+
+// abort discards the current part after a failed run. Parts completed
+// before it are kept.
+func (s *splitOutput) abort() {
+	s.cur.abort()
+}
+
+// report writes what was written to w, e.g. "wrote 12 lines (96 bytes) to 2
+// files out.0001.txt .. out.0002.txt".
+func (s *splitOutput) report(w io.Writer) {
+	fmt.Fprintf(w, "wrote %d lines (%d bytes) to %d files %s .. %s\n", s.lines, s.bytes, s.part-s.start, s.first, s.cur.path)
+}
@@ -0,0 +1,3263 @@
+package alchemy
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/text/encoding/charmap"
+)
+
+// --- Helper functions ---
+
+// withFakeSources patches osOpen/bufioNewScanner so that each path in
+// contents is served from memory. The returned func restores the originals.
+func withFakeSources(contents map[string][]string) func() {
+	origOpen := osOpen
+	origScanner := bufioNewScanner
+	var lastOpened string
+	osOpen = func(name string) (*os.File, error) {
+		if _, ok := contents[name]; ok {
+			lastOpened = name
+			return &os.File{}, nil
+		}
+		return nil, errors.New("file not found")
+	}
+	bufioNewScanner = func(file *os.File) *bufio.Scanner {
+		return newMockScanner(contents[lastOpened])
+	}
+	return func() {
+		osOpen = origOpen
+		bufioNewScanner = origScanner
+	}
+}
+
+// newMockScanner returns a bufio.Scanner for a slice of lines.
+func newMockScanner(lines []string) *bufio.Scanner {
+	r := strings.NewReader(strings.Join(lines, "\n"))
+	return bufio.NewScanner(r)
+}
+
+// syntheticLines returns n distinct items "w0".."w<n-1>".
+func syntheticLines(n int) []string {
+	lines := make([]string, n)
+	for i := range lines {
+		lines[i] = fmt.Sprintf("w%d", i)
+	}
+	return lines
+}
+
+// collect runs RunPermutatorFast through the callback path and returns the lines.
+func collect(t *testing.T, sources []Source, opts Options) []string {
+	t.Helper()
+	var out []string
+	err := RunPermutatorFast(sources, opts, func(s string) {
+		out = append(out, s)
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return out
+}
+
+// --- Test Cases ---
+
+func TestLimitTimeStopsGeneration(t *testing.T) {
+	// 300 items at depth 5 is ~2.4e12 lines: only the time limit can end this.
+	defer withFakeSources(map[string][]string{"big.txt": syntheticLines(300)})()
+
+	opts := Options{Seps: []string{"-"}, LimitTime: 20 * time.Millisecond}
+	start := time.Now()
+	lines := collect(t, []Source{{Path: "big.txt", Depth: 5}}, opts)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("generation did not stop in time, took %v", elapsed)
+	}
+	if len(lines) == 0 {
+		t.Fatalf("expected partial output before the time limit")
+	}
+	for _, l := range lines {
+		if strings.Count(l, "-")+1 > 5 || strings.HasSuffix(l, "-") {
+			t.Fatalf("invalid partial line %q", l)
+		}
+	}
+}
+
+func TestLimitTimeFlushesFastPath(t *testing.T) {
+	defer withFakeSources(map[string][]string{"big.txt": syntheticLines(300)})()
+
+	var buf bytes.Buffer
+	origStdout := stdout
+	stdout = &buf
+	defer func() { stdout = origStdout }()
+
+	opts := Options{Seps: []string{"-"}, LimitTime: 20 * time.Millisecond}
+	if err := RunPermutatorFast([]Source{{Path: "big.txt", Depth: 5}}, opts, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	out := buf.String()
+	if out == "" || !strings.HasSuffix(out, "\n") {
+		t.Fatalf("expected flushed, newline-terminated output")
+	}
+	for _, l := range strings.Split(strings.TrimSuffix(out, "\n"), "\n") {
+		if !strings.HasPrefix(l, "w") || strings.HasSuffix(l, "-") {
+			t.Fatalf("invalid partial line %q", l)
+		}
+	}
+}
+
+func TestReverseOutputMirrorsForwardOrder(t *testing.T) {
+	defer withFakeSources(map[string][]string{
+		"a.txt": {"a", "b", "c"},
+		"b.txt": {"x"},
+	})()
+	sources := []Source{{Path: "a.txt", Depth: 2}, {Path: "b.txt", Depth: 1}}
+
+	forward := collect(t, sources, Options{Seps: []string{"-", "_"}})
+	reversed := collect(t, sources, Options{Seps: []string{"-", "_"}, Reverse: true})
+
+	if len(forward) != len(reversed) {
+		t.Fatalf("expected %d lines, got %d", len(forward), len(reversed))
+	}
+	for i := range forward {
+		if forward[i] != reversed[len(reversed)-1-i] {
+			t.Fatalf("line %d: expected %q, got %q", i, forward[len(forward)-1-i], reversed[i])
+		}
+	}
+
+	// -skip and -limit cut the reversed output, not the forward one.
+	cut := collect(t, sources, Options{Seps: []string{"-", "_"}, Reverse: true, Skip: 1, Limit: 3})
+	if got, want := strings.Join(cut, ","), strings.Join(reversed[1:4], ","); got != want {
+		t.Errorf("-skip 1 -limit 3: expected %s, got %s", want, got)
+	}
+
+	// Modes that cannot be unranked are buffered and reversed the same way.
+	combos := collect(t, sources, Options{Seps: []string{"-"}, Combinations: true})
+	reversedCombos := collect(t, sources, Options{Seps: []string{"-"}, Combinations: true, Reverse: true})
+	slices.Reverse(combos)
+	if got, want := strings.Join(reversedCombos, ","), strings.Join(combos, ","); got != want {
+		t.Errorf("-combinations: expected %s, got %s", want, got)
+	}
+}
+
+func TestReverseOutputLimitDoesNotBufferTheSpace(t *testing.T) {
+	defer withFakeSources(map[string][]string{"a.txt": syntheticLines(30)})()
+	// 30^12 lines: only unranking from the last one lets this finish.
+	sources := []Source{{Path: "a.txt", Depth: 12}}
+	opts := Options{Seps: []string{"-"}, Reverse: true, ReverseMax: 1000, Skip: 1, Limit: 3}
+	got := collect(t, sources, opts)
+	// The last line is w29 twelve times, preceded by the children of w29 eleven times.
+	stem := strings.Repeat("w29-", 11)
+	if want := []string{stem + "w28", stem + "w27", stem + "w26"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestTokenLenFiltersDropItemsAtLoad(t *testing.T) {
+	// "é" is one rune but two bytes: the bounds must count runes.
+	defer withFakeSources(map[string][]string{
+		"words.txt": {"a", "bb", "éé", "cccc", "ddddd"},
+	})()
+	sources := []Source{{Path: "words.txt", Depth: 1}}
+	opts := Options{Seps: []string{""}, MinTokenLen: 2, MaxTokenLen: 4}
+
+	lines := collect(t, sources, opts)
+	want := []string{"bb", "éé", "cccc"}
+	if strings.Join(lines, ",") != strings.Join(want, ",") {
+		t.Fatalf("expected %v, got %v", want, lines)
+	}
+
+	total, err := CalculateOutputLines(sources, opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if total.Int64() != int64(len(want)) {
+		t.Errorf("expected count %d, got %s", len(want), total)
+	}
+}
+
+func TestIncrementalSuffixesFanOutEachLine(t *testing.T) {
+	defer withFakeSources(map[string][]string{"words.txt": {"pw"}})()
+	sources := []Source{{Path: "words.txt", Depth: 1}}
+	opts := Options{Seps: []string{""}, Incremental: "ab", IncrementalMax: 2}
+
+	lines := collect(t, sources, opts)
+	want := []string{"pw", "pwa", "pwb", "pwaa", "pwab", "pwba", "pwbb"}
+	if strings.Join(lines, ",") != strings.Join(want, ",") {
+		t.Fatalf("expected %v, got %v", want, lines)
+	}
+
+	total, err := CalculateOutputLines(sources, opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if total.Int64() != int64(len(want)) {
+		t.Errorf("expected count %d, got %s", len(want), total)
+	}
+}
+
+func TestSortExternalSortsAndDedupsBeyondBudget(t *testing.T) {
+	// "ab" is produced twice (a+b and the item "ab"), so dedup must kick in.
+	defer withFakeSources(map[string][]string{
+		"words.txt": {"b", "a", "ab", "c"},
+	})()
+	sources := []Source{{Path: "words.txt", Depth: 2}}
+
+	unsorted := collect(t, sources, Options{Seps: []string{""}})
+	lines := collect(t, sources, Options{Seps: []string{""}, SortExternal: true, SortMemory: 64})
+
+	seen := map[string]bool{}
+	for _, l := range unsorted {
+		seen[l] = true
+	}
+	if len(lines) != len(seen) {
+		t.Fatalf("expected %d unique lines, got %d: %v", len(seen), len(lines), lines)
+	}
+	for i := 1; i < len(lines); i++ {
+		if lines[i-1] >= lines[i] {
+			t.Fatalf("output not strictly sorted at %d: %q >= %q", i, lines[i-1], lines[i])
+		}
+	}
+
+	cut := collect(t, sources, Options{Seps: []string{""}, SortExternal: true, SortMemory: 64, Skip: 2, Limit: 3})
+	if got, want := strings.Join(cut, ","), strings.Join(lines[2:5], ","); got != want {
+		t.Errorf("-skip 2 -limit 3: expected %s, got %s", want, got)
+	}
+}
+
+func TestExternalSorterSpillsMultipleRuns(t *testing.T) {
+	dir := t.TempDir()
+	sorter := newExternalSorter(dir, 32)
+	sorter.fanIn = 2                     // force intermediate merge passes
+	long := strings.Repeat("z", 100_000) // beyond bufio.Scanner's default limit
+	for _, l := range []string{"d", "b", long, "d", "a", "c", "b", "e", "a"} {
+		if err := sorter.add(l); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if len(sorter.runs) < 4 {
+		t.Fatalf("expected several runs with a 32 byte budget, got %d", len(sorter.runs))
+	}
+
+	var out []string
+	if err := sorter.finish(func(s string) { out = append(out, s) }); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := strings.Join(out, ","); got != "a,b,c,d,e,"+long {
+		t.Errorf("expected a,b,c,d,e and the long line, got %.40s...", got)
+	}
+	if left, _ := os.ReadDir(dir); len(left) != 0 {
+		t.Errorf("expected temp runs to be removed, %d left", len(left))
+	}
+}
+
+func TestValidateAcceptsGoodConfig(t *testing.T) {
+	defer withFakeSources(map[string][]string{"words.txt": {"a"}})()
+	err := Validate([]Source{{Path: "words.txt", Depth: 2}}, Options{Seps: []string{""}})
+	if err != nil {
+		t.Errorf("expected no error, got: %v", err)
+	}
+}
+
+func TestValidateReportsAllProblems(t *testing.T) {
+	defer withFakeSources(map[string][]string{"words.txt": {"a"}})()
+
+	sources := []Source{
+		{Path: "words.txt", Depth: 0},
+		{Path: "missing.txt", Depth: 1},
+	}
+	opts := Options{
+		MinTokenLen:  5,
+		MaxTokenLen:  2,
+		Incremental:  "ab",
+		SortExternal: true,
+		Reverse:      true,
+	}
+	err := Validate(sources, opts)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	for _, want := range []string{
+		"words.txt: depth must be at least 1",
+		"missing.txt: cannot be read",
+		"-min-token-len (5) is greater than -max-token-len (2)",
+		"-incremental-max must be at least 1",
+		"-sort-memory must be positive",
+		"cannot be combined",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected error to mention %q, got:\n%v", want, err)
+		}
+	}
+}
+
+func TestValidateRequiresASource(t *testing.T) {
+	err := Validate(nil, Options{})
+	if err == nil || !strings.Contains(err.Error(), "at least one source") {
+		t.Errorf("expected missing source error, got: %v", err)
+	}
+}
+
+func TestCountCacheHitMissAndInvalidation(t *testing.T) {
+	dir := t.TempDir()
+	cacheDir := filepath.Join(dir, "cache")
+	src := filepath.Join(dir, "words.txt")
+	if err := os.WriteFile(src, []byte("a\nb\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	sources := []Source{{Path: src, Depth: 2}}
+	opts := Options{Seps: []string{"-"}, NoRepeats: true}
+
+	// Miss: computed and stored.
+	total, err := CachedOutputLines(cacheDir, sources, opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if total.Int64() != 4 {
+		t.Fatalf("expected 4, got %s", total)
+	}
+	entries, _ := os.ReadDir(cacheDir)
+	if len(entries) != 1 {
+		t.Fatalf("expected one cache entry, got %d", len(entries))
+	}
+
+	// Hit: a tampered entry is returned as-is, proving no recount happened.
+	entry := filepath.Join(cacheDir, entries[0].Name())
+	os.WriteFile(entry, []byte("12345\n"), 0o644)
+	total, err = CachedOutputLines(cacheDir, sources, opts)
+	if err != nil || total.Int64() != 12345 {
+		t.Fatalf("expected cached 12345, got %v (err %v)", total, err)
+	}
+
+	// Hit from another identical run: writers and freshly allocated
+	// pointers are not part of the key.
+	sanitize, again := "_", "_"
+	withSanitize := opts
+	withSanitize.SanitizeSep = &sanitize
+	if _, err := CachedOutputLines(cacheDir, sources, withSanitize); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	rerun := opts
+	rerun.SanitizeSep, rerun.Stdout, rerun.Stderr = &again, io.Discard, io.Discard
+	before, _ := os.ReadDir(cacheDir)
+	if _, err := CachedOutputLines(cacheDir, sources, rerun); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if after, _ := os.ReadDir(cacheDir); len(after) != len(before) {
+		t.Errorf("expected an identical run to hit, got %d entries instead of %d", len(after), len(before))
+	}
+
+	// Miss: a source transform is part of the key.
+	upper := []Source{{Path: src, Depth: 2, Transforms: "upper"}}
+	total, err = CachedOutputLines(cacheDir, upper, opts)
+	if err != nil || total.Int64() != 4 {
+		t.Fatalf("expected a recount of 4 with a transform, got %v (err %v)", total, err)
+	}
+
+	// Invalidation: modifying the source changes the key.
+	os.WriteFile(src, []byte("a\nb\nc\n"), 0o644)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(src, later, later)
+	total, err = CachedOutputLines(cacheDir, sources, opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if total.Int64() != 9 {
+		t.Errorf("expected recount of 9 after modification, got %s", total)
+	}
+}
+
+func TestGenAndCountMatchesEmittedLines(t *testing.T) {
+	defer withFakeSources(map[string][]string{
+		"words.txt": {"a", "bb", "ccc", "dddd"},
+	})()
+	var buf bytes.Buffer
+	origStdout := stdout
+	stdout = &buf
+	defer func() { stdout = origStdout }()
+
+	sources := []Source{{Path: "words.txt", Depth: 3}}
+	opts := Options{Seps: []string{"-"}, MaxTokenLen: 3, Incremental: "xy", IncrementalMax: 1}
+	lines, err := GenerateAndCount(sources, opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := uint64(strings.Count(buf.String(), "\n")); got != lines {
+		t.Errorf("reported %d lines but %d were written", lines, got)
+	}
+	if lines == 0 {
+		t.Errorf("expected some output")
+	}
+	if stdout != &buf {
+		t.Errorf("expected stdout to be restored")
+	}
+
+	// The JSON array's brackets are not candidates.
+	buf.Reset()
+	opts.Format = "json"
+	jsonLines, err := GenerateAndCount(sources, opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if jsonLines != lines {
+		t.Errorf("-format json: reported %d lines, expected %d", jsonLines, lines)
+	}
+
+	// Neither are the header and footer.
+	opts.HeaderLine, opts.FooterLine = "BEGIN;", "COMMIT;"
+	framed, err := GenerateAndCount(sources, opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if framed != lines || !strings.Contains(buf.String(), "COMMIT;") {
+		t.Errorf("with header and footer: reported %d lines, expected %d", framed, lines)
+	}
+}
+
+func TestLengthHistogramMatchesEnumeration(t *testing.T) {
+	defer withFakeSources(map[string][]string{
+		"a.txt": {"a", "bb", "ccc"},
+		"b.txt": {"xy"},
+	})()
+	sources := []Source{{Path: "a.txt", Depth: 2}, {Path: "b.txt", Depth: 1}}
+	opts := Options{Seps: []string{"-", "+++"}, Prefix: "<", Incremental: "z", IncrementalMax: 1}
+
+	want := map[int]int64{}
+	for _, l := range collect(t, sources, opts) {
+		want[len(l)]++
+	}
+
+	buckets, exact, err := CalculateLengthHistogram(sources, opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !exact {
+		t.Errorf("expected an exact histogram with repeats allowed")
+	}
+	got := map[int]int64{}
+	for _, b := range buckets {
+		got[b.Length] = b.Count.Int64()
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestLengthHistogramExactForFixedLengthNoRepeats(t *testing.T) {
+	defer withFakeSources(map[string][]string{"a.txt": {"aa", "bb", "cc"}})()
+	sources := []Source{{Path: "a.txt", Depth: 3}}
+	opts := Options{Seps: []string{"."}, NoRepeats: true}
+
+	want := map[int]int64{}
+	for _, l := range collect(t, sources, opts) {
+		want[len(l)]++
+	}
+	buckets, exact, err := CalculateLengthHistogram(sources, opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !exact {
+		t.Errorf("expected fixed-length items to give an exact histogram")
+	}
+	got := map[int]int64{}
+	for _, b := range buckets {
+		got[b.Length] = b.Count.Int64()
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestNoCrossSourceNeverMixesSources(t *testing.T) {
+	defer withFakeSources(map[string][]string{
+		"a.txt": {"a1", "a2", "a3"},
+		"b.txt": {"b1", "b2"},
+	})()
+	sources := []Source{{Path: "a.txt", Depth: 3}, {Path: "b.txt", Depth: 2}}
+
+	for _, noRepeats := range []bool{false, true} {
+		opts := Options{Seps: []string{"-"}, NoRepeats: noRepeats, NoCrossSource: true}
+		lines := collect(t, sources, opts)
+		for _, l := range lines {
+			if strings.Contains(l, "a") && strings.Contains(l, "b") {
+				t.Fatalf("sequence %q mixes sources", l)
+			}
+		}
+
+		total, err := CalculateOutputLines(sources, opts)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if total.Int64() != int64(len(lines)) {
+			t.Errorf("noRepeats=%v: expected count %d, got %s", noRepeats, len(lines), total)
+		}
+
+		buckets, _, err := CalculateLengthHistogram(sources, opts)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		var histTotal int64
+		for _, b := range buckets {
+			histTotal += b.Count.Int64()
+		}
+		if histTotal != int64(len(lines)) {
+			t.Errorf("noRepeats=%v: expected histogram total %d, got %d", noRepeats, len(lines), histTotal)
+		}
+	}
+}
+
+func TestCountMatchesEnumerationWithRepeats(t *testing.T) {
+	defer withFakeSources(map[string][]string{
+		"a.txt": {"a", "b", "c"},
+		"b.txt": {"x"},
+	})()
+	sources := []Source{{Path: "a.txt", Depth: 3}, {Path: "b.txt", Depth: 2}}
+	opts := Options{Seps: []string{"-"}}
+
+	lines := collect(t, sources, opts)
+	total, err := CalculateOutputLines(sources, opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if total.Int64() != int64(len(lines)) {
+		t.Errorf("expected count %d, got %s", len(lines), total)
+	}
+}
+
+func TestAutoDepthStaysUnderBudget(t *testing.T) {
+	defer withFakeSources(map[string][]string{"a.txt": {"a", "b", "c"}})()
+	sources := []Source{{Path: "a.txt", Depth: 1}}
+	opts := Options{Seps: []string{""}}
+
+	// Cumulative lines: depth 1 = 3, 2 = 12, 3 = 39, 4 = 120.
+	depth, err := AutoDepth(sources, opts, big.NewInt(40))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if depth != 3 {
+		t.Fatalf("expected depth 3, got %d", depth)
+	}
+
+	sources[0].Depth = depth
+	if lines := collect(t, sources, opts); len(lines) > 40 {
+		t.Errorf("expected at most 40 lines, got %d", len(lines))
+	}
+
+	if _, err := AutoDepth(sources, opts, big.NewInt(2)); err == nil {
+		t.Errorf("expected an error when depth 1 already exceeds the budget")
+	}
+}
+
+func TestAutoDepthStopsWhenNoRepeatsRunsOut(t *testing.T) {
+	defer withFakeSources(map[string][]string{"a.txt": {"a", "b"}})()
+	sources := []Source{{Path: "a.txt", Depth: 1}}
+	depth, err := AutoDepth(sources, Options{Seps: []string{""}, NoRepeats: true}, big.NewInt(1000))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if depth != 2 {
+		t.Errorf("expected depth 2 with two items and no repeats, got %d", depth)
+	}
+}
+
+func TestCalculateOutputLinesByDepth(t *testing.T) {
+	defer withFakeSources(map[string][]string{
+		"a.txt": {"a", "b"},
+		"b.txt": {"x"},
+	})()
+	sources := []Source{{Path: "a.txt", Depth: 3}, {Path: "b.txt", Depth: 1}}
+	byDepth, err := CalculateOutputLinesByDepth(sources, Options{Seps: []string{""}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Length 1: all 3 items; length 2 and 3: only a/b may start, 3 choices each.
+	want := []int64{3, 6, 18}
+	if len(byDepth) != len(want) {
+		t.Fatalf("expected %d depths, got %d", len(want), len(byDepth))
+	}
+	for i, w := range want {
+		if byDepth[i].Int64() != w {
+			t.Errorf("depth %d: expected %d, got %s", i+1, w, byDepth[i])
+		}
+	}
+}
+
+func TestLineFilterTransformsAndDropsInput(t *testing.T) {
+	defer withFakeSources(map[string][]string{
+		"words.txt": {"# comment", "Foo", "BAR", "#skip"},
+	})()
+	sources := []Source{{Path: "words.txt", Depth: 1}}
+	opts := Options{
+		Seps: []string{""},
+		LineFilter: func(raw string) (string, bool) {
+			if strings.HasPrefix(raw, "#") {
+				return "", false
+			}
+			return strings.ToLower(raw), true
+		},
+	}
+
+	lines := collect(t, sources, opts)
+	if got := strings.Join(lines, ","); got != "foo,bar" {
+		t.Errorf("expected foo,bar, got %s", got)
+	}
+	total, err := CalculateOutputLines(sources, opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if total.Int64() != 2 {
+		t.Errorf("expected count 2, got %s", total)
+	}
+}
+
+func TestFormatCount(t *testing.T) {
+	n, _ := new(big.Int).SetString("1234567890123456", 10)
+	huge := new(big.Int).Exp(big.NewInt(10), big.NewInt(45), nil)
+	huge.Mul(huge, big.NewInt(12))
+
+	cases := []struct {
+		n      *big.Int
+		format string
+		want   string
+	}{
+		{n, "plain", "1234567890123456"},
+		{n, "grouped", "1,234,567,890,123,456"},
+		{n, "human", "1.2 quadrillion"},
+		{big.NewInt(999), "human", "999"},
+		{big.NewInt(999960), "human", "1.0 million"},
+		{huge, "human", "1.2e46"},
+		{big.NewInt(12), "grouped", "12"},
+		{n, "compact", "1.23e15"},
+		{big.NewInt(999), "compact", "999"},
+		{big.NewInt(999600), "compact", "1.00e6"},
+	}
+	for _, c := range cases {
+		got, err := FormatCount(c.n, c.format)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.format, err)
+		}
+		if got != c.want {
+			t.Errorf("%s(%s): expected %q, got %q", c.format, c.n, c.want, got)
+		}
+	}
+
+	if _, err := FormatCount(n, "roman"); err == nil {
+		t.Errorf("expected an error for an unknown format")
+	}
+}
+
+func TestCompactCountMatchesExactMagnitude(t *testing.T) {
+	for _, n := range []*big.Int{
+		new(big.Int).Exp(big.NewInt(2), big.NewInt(10000), nil),
+		new(big.Int).Exp(big.NewInt(7), big.NewInt(5000), nil),
+		new(big.Int).Sub(new(big.Int).Exp(big.NewInt(10), big.NewInt(300), nil), big.NewInt(1)),
+		big.NewInt(123456789),
+	} {
+		got := compactCount(n)
+		m, e, _ := strings.Cut(got, "e")
+		mantissa, err := strconv.ParseFloat(m, 64)
+		if err != nil {
+			t.Fatalf("unparsable compact count %q: %v", got, err)
+		}
+		exp, err := strconv.Atoi(e)
+		if err != nil {
+			t.Fatalf("unparsable compact count %q: %v", got, err)
+		}
+
+		// Compare against the leading digits of the exact decimal expansion.
+		digits := n.String()
+		want, _, _ := new(big.Float).Parse(digits[:1]+"."+digits[1:8], 10)
+		wantMantissa, _ := want.Float64()
+		wantExp := len(digits) - 1
+		if math.Round(wantMantissa*100) >= 1000 {
+			wantMantissa /= 10
+			wantExp++
+		}
+		if exp != wantExp || math.Abs(mantissa-wantMantissa) > 0.006 {
+			t.Errorf("compact %q does not match %.4fe%d", got, wantMantissa, wantExp)
+		}
+	}
+}
+
+func TestNoConsecutiveSourceAlternatesSources(t *testing.T) {
+	defer withFakeSources(map[string][]string{
+		"adj.txt":  {"big", "red"},
+		"noun.txt": {"car", "dog", "hat"},
+		"num.txt":  {"1"},
+	})()
+	sources := []Source{
+		{Path: "adj.txt", Depth: 4},
+		{Path: "noun.txt", Depth: 3},
+		{Path: "num.txt", Depth: 2},
+	}
+	srcOf := map[string]int{"big": 0, "red": 0, "car": 1, "dog": 1, "hat": 1, "1": 2}
+
+	for _, noRepeats := range []bool{false, true} {
+		opts := Options{Seps: []string{" "}, NoRepeats: noRepeats, NoConsecutiveSource: true}
+		lines := collect(t, sources, opts)
+		for _, l := range lines {
+			words := strings.Split(l, " ")
+			for i := 1; i < len(words); i++ {
+				if srcOf[words[i]] == srcOf[words[i-1]] {
+					t.Fatalf("%q has adjacent items from the same source", l)
+				}
+			}
+		}
+
+		total, err := CalculateOutputLines(sources, opts)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if total.Int64() != int64(len(lines)) {
+			t.Errorf("noRepeats=%v: expected count %d, got %s", noRepeats, len(lines), total)
+		}
+	}
+}
+
+func TestREPLDrivesEngineWithScriptedCommands(t *testing.T) {
+	defer withFakeSources(map[string][]string{
+		"a.txt": {"a", "b"},
+		"b.txt": {"x"},
+	})()
+	sources := []Source{{Path: "a.txt", Depth: 1}, {Path: "b.txt", Depth: 1}}
+
+	script := strings.Join([]string{
+		"show count",
+		"set depth 1 2",
+		"set sep - \"\"",
+		"show count",
+		"generate 4",
+		"set no-repeats on",
+		"show count",
+		"bogus",
+		"quit",
+		"show count",
+	}, "\n")
+	var out bytes.Buffer
+	if err := RunREPL(sources, Options{Seps: []string{""}}, strings.NewReader(script), &out); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []string{
+		"3",  // a, b, x
+		"15", // 3 singles, written once, + a/b followed by any of 3 items times 2 separators
+		"a", "a-a", "aa", "a-b",
+		"11", // a-a, aa, b-b, bb dropped
+	}
+	got := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(got) != len(want)+1 {
+		t.Fatalf("expected %d output lines, got %d:\n%s", len(want)+1, len(got), out.String())
+	}
+	for i, w := range want {
+		if got[i] != w {
+			t.Errorf("line %d: expected %q, got %q", i, w, got[i])
+		}
+	}
+	if !strings.HasPrefix(got[len(want)], "error: unknown command") {
+		t.Errorf("expected an error for the bogus command, got %q", got[len(want)])
+	}
+}
+
+func TestREPLWritesItemsAndLinesLikeARun(t *testing.T) {
+	defer withFakeSources(map[string][]string{
+		"a.txt": {"a-b", "c"},
+	})()
+	sources := []Source{{Path: "a.txt", Depth: 2, MinDepth: 2}}
+	repl := "_"
+	opts := Options{Seps: []string{"-"}, SanitizeSep: &repl, TokenWrap: "[]", ExcludeChars: "c"}
+
+	want := collect(t, sources, opts)
+	script := strings.Join([]string{
+		"set depth 1",
+		"generate 10",
+		"set sep .",
+		"generate 1",
+	}, "\n")
+	var out bytes.Buffer
+	if err := RunREPL(sources, opts, strings.NewReader(script), &out); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(got) != len(want)+2 {
+		t.Fatalf("expected %d output lines, got %d:\n%s", len(want)+2, len(got), out.String())
+	}
+	if !strings.HasPrefix(got[0], "error: depth 1 is below the minimum depth 2") {
+		t.Errorf("expected set depth to respect the minimum depth, got %q", got[0])
+	}
+	for i, w := range want {
+		if got[i+1] != w {
+			t.Errorf("line %d: expected %q, got %q", i, w, got[i+1])
+		}
+	}
+	if last := got[len(got)-1]; last != "[a-b].[a-b]" {
+		t.Errorf("expected items sanitized against the new separator, got %q", last)
+	}
+}
+
+func TestSplitCommandHonorsQuotes(t *testing.T) {
+	args, err := splitCommand(`set sep "" "a b" -`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fmt.Sprintf("%q", args) != `["set" "sep" "" "a b" "-"]` {
+		t.Errorf("unexpected split: %q", args)
+	}
+	if _, err := splitCommand(`set sep "oops`); err == nil {
+		t.Errorf("expected an error for an unterminated quote")
+	}
+}
+
+func TestFailOnDuplicateReportsFirstDuplicate(t *testing.T) {
+	// With an empty separator "a"+"b" collides with the item "ab".
+	defer withFakeSources(map[string][]string{"words.txt": {"a", "b", "ab"}})()
+	sources := []Source{{Path: "words.txt", Depth: 2}}
+
+	var lines []string
+	err := RunPermutatorFast(sources, Options{Seps: []string{""}, FailOnDuplicate: true}, func(s string) {
+		lines = append(lines, s)
+	})
+	if err == nil || !strings.Contains(err.Error(), `duplicate output line "ab"`) {
+		t.Fatalf("expected a duplicate error for \"ab\", got: %v", err)
+	}
+	seen := map[string]bool{}
+	for _, l := range lines {
+		if seen[l] {
+			t.Errorf("duplicate %q was emitted before failing", l)
+		}
+		seen[l] = true
+	}
+
+	// The fast path reports it too.
+	origStdout := stdout
+	stdout = io.Discard
+	defer func() { stdout = origStdout }()
+	err = RunPermutatorFast(sources, Options{Seps: []string{""}, FailOnDuplicate: true}, nil)
+	if err == nil || !strings.Contains(err.Error(), "duplicate output line") {
+		t.Errorf("expected a duplicate error from the fast path, got: %v", err)
+	}
+
+	// A distinct separator makes the config duplicate-free.
+	if err := RunPermutatorFast(sources, Options{Seps: []string{"-"}, FailOnDuplicate: true}, nil); err != nil {
+		t.Errorf("expected no duplicates with a separator, got: %v", err)
+	}
+}
+
+func TestPerSourceCountsSumToTotal(t *testing.T) {
+	defer withFakeSources(map[string][]string{
+		"a.txt": {"a", "b", "c"},
+		"b.txt": {"x", "y"},
+		"c.txt": {"1"},
+	})()
+	sources := []Source{
+		{Path: "a.txt", Depth: 3},
+		{Path: "b.txt", Depth: 2},
+		{Path: "c.txt", Depth: 1},
+	}
+
+	for _, opts := range []Options{
+		{Seps: []string{"-", "_"}},
+		{Seps: []string{"-"}, NoRepeats: true},
+		{Seps: []string{"-"}, NoConsecutiveSource: true},
+	} {
+		counts, err := CalculateOutputLinesBySource(sources, opts)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		total, err := CalculateOutputLines(sources, opts)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		sum := big.NewInt(0)
+		for i, c := range counts {
+			if c.Source.Path != sources[i].Path {
+				t.Errorf("row %d: expected source %v, got %v", i, sources[i], c.Source)
+			}
+			sum.Add(sum, c.Count)
+		}
+		if sum.Cmp(total) != 0 {
+			t.Errorf("%+v: per-source counts sum to %s, total is %s", opts, sum, total)
+		}
+		if counts[0].Items != 3 || counts[2].Items != 1 {
+			t.Errorf("unexpected item counts: %d, %d", counts[0].Items, counts[2].Items)
+		}
+	}
+}
+
+func TestCharsetDropsItemsWithDisallowedCharacters(t *testing.T) {
+	defer withFakeSources(map[string][]string{
+		"words.txt": {"admin", "root42", "Admin", "dev-ops", "café", "-x-"},
+	})()
+	sources := []Source{{Path: "words.txt", Depth: 1}}
+	opts := Options{Seps: []string{""}, Charset: "a-z0-9-"}
+
+	lines := collect(t, sources, opts)
+	if got := strings.Join(lines, ","); got != "admin,root42,dev-ops,-x-" {
+		t.Errorf("expected admin,root42,dev-ops,-x-, got %s", got)
+	}
+	total, err := CalculateOutputLines(sources, opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if total.Int64() != 4 {
+		t.Errorf("expected count 4, got %s", total)
+	}
+}
+
+func TestParseCharsetRejectsReversedRange(t *testing.T) {
+	if _, err := parseCharset("z-a"); err == nil {
+		t.Errorf("expected an error for a reversed range")
+	}
+}
+
+// flakyReader serves its content but fails once after the first line.
+type flakyReader struct {
+	data   string
+	failed *bool
+	pos    int
+}
+
+func (f *flakyReader) Read(p []byte) (int, error) {
+	if !*f.failed && f.pos > 0 {
+		*f.failed = true
+		return 0, errors.New("transient network error")
+	}
+	if f.pos >= len(f.data) {
+		return 0, io.EOF
+	}
+	n := copy(p[:min(len(p), 2)], f.data[f.pos:])
+	f.pos += n
+	return n, nil
+}
+
+func TestReadRetriesRecoverFromTransientError(t *testing.T) {
+	origOpen, origScanner, origDelay := osOpen, bufioNewScanner, readRetryDelay
+	defer func() { osOpen, bufioNewScanner, readRetryDelay = origOpen, origScanner, origDelay }()
+	readRetryDelay = 0
+
+	failed := false
+	attempts := 0
+	osOpen = func(name string) (*os.File, error) { return &os.File{}, nil }
+	bufioNewScanner = func(file *os.File) *bufio.Scanner {
+		attempts++
+		return bufio.NewScanner(&flakyReader{data: "a\nb\nc\n", failed: &failed})
+	}
+	sources := []Source{{Path: "remote.txt", Depth: 1}}
+
+	lines := collect(t, sources, Options{Seps: []string{""}, ReadRetries: 2})
+	if got := strings.Join(lines, ","); got != "a,b,c" {
+		t.Errorf("expected a,b,c without partial duplicates, got %s", got)
+	}
+	if attempts != 2 {
+		t.Errorf("expected 2 read attempts, got %d", attempts)
+	}
+
+	// Without retries the error surfaces.
+	failed = false
+	err := RunPermutatorFast(sources, Options{Seps: []string{""}}, func(string) {})
+	if err == nil || !strings.Contains(err.Error(), "transient network error") {
+		t.Errorf("expected the read error without retries, got: %v", err)
+	}
+	var rerr *SourceReadError
+	if !errors.As(err, &rerr) || rerr.Path != "remote.txt" || rerr.Retries != 0 {
+		t.Errorf("expected a SourceReadError for remote.txt, got %#v", err)
+	}
+}
+
+func TestFlushCallbackReportsDeliveredBytes(t *testing.T) {
+	items := syntheticLines(300)
+	srcOfItem := make([]int, len(items))
+	var buf bytes.Buffer
+	var flushes []int
+	p := NewPermutatorFast(items, srcOfItem, []int{2}, []string{"-"}, "", "", false, &buf).
+		WithFlushCallback(func(n int) { flushes = append(flushes, n) })
+	p.Generate()
+
+	if len(flushes) < 2 {
+		t.Fatalf("expected several flushes for ~800 KiB of output, got %d", len(flushes))
+	}
+	total := 0
+	for i, n := range flushes {
+		if n <= 0 {
+			t.Fatalf("flush %d reported %d bytes", i, n)
+		}
+		total += n
+	}
+	if total != buf.Len() {
+		t.Errorf("callbacks reported %d bytes, writer received %d", total, buf.Len())
+	}
+}
+
+func TestSanitizeSepReplacesSeparatorsInsideItems(t *testing.T) {
+	defer withFakeSources(map[string][]string{
+		"words.txt": {"dev-ops", "a.b", "plain"},
+	})()
+	sources := []Source{{Path: "words.txt", Depth: 2}}
+	repl := "_"
+	opts := Options{Seps: []string{"-", "."}, SanitizeSep: &repl}
+
+	lines := collect(t, sources, opts)
+	for _, want := range []string{"dev_ops-a_b", "dev_ops.plain", "plain-dev_ops"} {
+		found := false
+		for _, l := range lines {
+			found = found || l == want
+		}
+		if !found {
+			t.Errorf("expected %q in output", want)
+		}
+	}
+	for _, l := range lines {
+		if strings.Contains(l, "dev-ops") || strings.Contains(l, "a.b") {
+			t.Errorf("unsanitized item in %q", l)
+		}
+	}
+
+	// Off by default.
+	lines = collect(t, sources, Options{Seps: []string{"-"}})
+	if lines[0] != "dev-ops" {
+		t.Errorf("expected items untouched without -sanitize-sep, got %q", lines[0])
+	}
+}
+
+func TestFindUnreachableLengthsUnderNoRepeats(t *testing.T) {
+	defer withFakeSources(map[string][]string{
+		"a.txt": {"a", "b"},
+		"b.txt": {"x"},
+	})()
+	sources := []Source{{Path: "a.txt", Depth: 5}, {Path: "b.txt", Depth: 2}}
+
+	found, err := FindUnreachableLengths(sources, Options{Seps: []string{""}, NoRepeats: true, NoCrossSource: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var buf bytes.Buffer
+	PrintUnreachable(&buf, found)
+	want := "unreachable: a.txt lengths 3-5 produce no lines\n" +
+		"unreachable: b.txt length 2 produces no lines\n"
+	if buf.String() != want {
+		t.Errorf("expected:\n%sgot:\n%s", want, buf.String())
+	}
+
+	// Pooling all sources makes length 3 reachable for a.txt.
+	found, err = FindUnreachableLengths(sources, Options{Seps: []string{""}, NoRepeats: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(found) != 2 || found[0].Length != 4 || found[1].Length != 5 {
+		t.Errorf("expected a.txt lengths 4 and 5, got %+v", found)
+	}
+}
+
+func TestTokenWrapSurroundsEachItem(t *testing.T) {
+	defer withFakeSources(map[string][]string{"words.txt": {"a", "b"}})()
+	sources := []Source{{Path: "words.txt", Depth: 2}}
+
+	lines := collect(t, sources, Options{Seps: []string{"-"}, Prefix: "^", TokenWrap: "[]", NoRepeats: true})
+	if got := strings.Join(lines, ","); got != "^[a],^[a]-[b],^[b],^[b]-[a]" {
+		t.Errorf("unexpected output: %s", got)
+	}
+
+	lines = collect(t, sources, Options{Seps: []string{""}, TokenWrap: "<<>>"})
+	if lines[0] != "<<a>>" {
+		t.Errorf("expected multi-char wrap <<a>>, got %q", lines[0])
+	}
+
+	if _, _, err := parseTokenWrap("[]]"); err == nil {
+		t.Errorf("expected an error for an odd-length wrap")
+	}
+}
+
+func TestDiffAgainstEmitsOnlyNovelLines(t *testing.T) {
+	prev := filepath.Join(t.TempDir(), "previous.txt")
+	if err := os.WriteFile(prev, []byte("a\na-b\nb\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	defer withFakeSources(map[string][]string{"words.txt": {"a", "b", "c"}})()
+	sources := []Source{{Path: "words.txt", Depth: 2}}
+
+	lines := collect(t, sources, Options{Seps: []string{"-"}, NoRepeats: true, DiffAgainst: prev})
+	want := "a-c,b-a,b-c,c,c-a,c-b"
+	if got := strings.Join(lines, ","); got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+
+	err := RunPermutatorFast(sources, Options{Seps: []string{"-"}, DiffAgainst: prev + ".missing"}, func(string) {})
+	if err == nil {
+		t.Errorf("expected an error for a missing -diff-against file")
+	}
+}
+
+func TestExcludeFilesSuppressTriedLines(t *testing.T) {
+	dir := t.TempDir()
+	tried := filepath.Join(dir, "tried.txt")
+	if err := os.WriteFile(tried, []byte("a\nb-a\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte("c-b\nnot-a-candidate\n"))
+	zw.Close()
+	triedGz := filepath.Join(dir, "tried2.txt.gz")
+	if err := os.WriteFile(triedGz, gz.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	defer withFakeSources(map[string][]string{"words.txt": {"a", "b", "c"}})()
+	sources := []Source{{Path: "words.txt", Depth: 2}}
+
+	lines := collect(t, sources, Options{Seps: []string{"-"}, NoRepeats: true, ExcludeFiles: []string{tried, triedGz}})
+	want := "a-b,a-c,b,b-c,c,c-a"
+	if got := strings.Join(lines, ","); got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+}
+
+func TestHashShardsAreDisjointAndComplete(t *testing.T) {
+	defer withFakeSources(map[string][]string{"words.txt": syntheticLines(8)})()
+	sources := []Source{{Path: "words.txt", Depth: 3}}
+	opts := Options{Seps: []string{"-", "_"}}
+
+	all := make(map[string]struct{})
+	for _, line := range collect(t, sources, opts) {
+		all[line] = struct{}{}
+	}
+	seen := make(map[string]int)
+	const shards = 3
+	for i := 0; i < shards; i++ {
+		sharded := opts
+		sharded.HashShard = fmt.Sprintf("%d/%d", i, shards)
+		for _, line := range collect(t, sources, sharded) {
+			if prev, dup := seen[line]; dup && prev != i {
+				t.Fatalf("line %q emitted by shards %d and %d", line, prev, i)
+			}
+			seen[line] = i
+		}
+	}
+	if len(seen) != len(all) {
+		t.Fatalf("shards emitted %d distinct lines, expected %d", len(seen), len(all))
+	}
+	for line := range all {
+		if _, ok := seen[line]; !ok {
+			t.Errorf("line %q missing from every shard", line)
+		}
+	}
+}
+
+func TestParseHashShardRejectsBadSpecs(t *testing.T) {
+	for _, spec := range []string{"1", "a/3", "1/x", "3/3", "-1/3", "0/0"} {
+		if _, _, err := parseHashShard(spec); err == nil {
+			t.Errorf("expected an error for %q", spec)
+		}
+	}
+}
+
+func TestCountExactMatchesFilteredEnumeration(t *testing.T) {
+	defer withFakeSources(map[string][]string{"words.txt": syntheticLines(6)})()
+	sources := []Source{{Path: "words.txt", Depth: 3}}
+	opts := Options{Seps: []string{"-"}, NoRepeats: true, HashShard: "1/2"}
+
+	want := uint64(len(collect(t, sources, opts)))
+	got, err := CountExact(sources, opts, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != want {
+		t.Errorf("expected %d lines, got %d", want, got)
+	}
+	opts.Format = "json"
+	if got, err := CountExact(sources, opts, 1000); err != nil || got != want {
+		t.Errorf("-format json: expected %d lines, got %d (%v)", want, got, err)
+	}
+	opts.Format = ""
+
+	if _, err := CountExact(sources, opts, 10); err == nil {
+		t.Errorf("expected -count-exact to refuse a space above its maximum")
+	}
+}
+
+func TestHeaderAndFooterLines(t *testing.T) {
+	defer withFakeSources(map[string][]string{"words.txt": {"a", "b"}})()
+	sources := []Source{{Path: "words.txt", Depth: 1}}
+	opts := Options{Seps: []string{"-"}, HeaderLine: "BEGIN;", FooterLine: "COMMIT;"}
+
+	lines := collect(t, sources, opts)
+	if got := strings.Join(lines, ","); got != "BEGIN;,a,b,COMMIT;" {
+		t.Errorf("unexpected callback output %s", got)
+	}
+
+	var buf bytes.Buffer
+	orig := stdout
+	stdout = &buf
+	defer func() { stdout = orig }()
+	if err := RunPermutatorFast(sources, opts, nil); err != nil {
+		t.Fatal(err)
+	}
+	out := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(out) != 4 || out[0] != "BEGIN;" || out[3] != "COMMIT;" {
+		t.Errorf("unexpected stdout %q", buf.String())
+	}
+
+	// A failed run keeps the header but must not look complete.
+	var failed []string
+	defer withFakeSources(map[string][]string{"words.txt": {"a", "a"}})()
+	opts.FailOnDuplicate = true
+	if err := RunPermutatorFast(sources, opts, func(s string) { failed = append(failed, s) }); err == nil {
+		t.Fatal("expected a duplicate error")
+	}
+	if got := strings.Join(failed, ","); got != "BEGIN;,a" {
+		t.Errorf("unexpected output of a failed run %s", got)
+	}
+}
+
+func TestTokenMapEmitsDisplayForms(t *testing.T) {
+	mapping := filepath.Join(t.TempDir(), "map.tsv")
+	if err := os.WriteFile(mapping, []byte("cat\tCat\ndog\tDoggo\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	defer withFakeSources(map[string][]string{"words.txt": {"cat", "dog", "owl"}})()
+	sources := []Source{{Path: "words.txt", Depth: 2}}
+
+	// The length filter sees the canonical "dog", not the 5-rune display form.
+	lines := collect(t, sources, Options{Seps: []string{"-"}, NoRepeats: true, MaxTokenLen: 3, TokenMap: mapping})
+	want := "Cat-Doggo,Cat-owl,Doggo-Cat,Doggo-owl,owl-Cat,owl-Doggo"
+	var pairs []string
+	for _, l := range lines {
+		if strings.Contains(l, "-") {
+			pairs = append(pairs, l)
+		}
+	}
+	if got := strings.Join(pairs, ","); got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+
+	bad := filepath.Join(t.TempDir(), "bad.tsv")
+	if err := os.WriteFile(bad, []byte("no tab here\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := RunPermutatorFast(sources, Options{Seps: []string{"-"}, TokenMap: bad}, func(string) {}); err == nil {
+		t.Errorf("expected an error for a malformed token map")
+	}
+}
+
+func TestDFSOrderReverseMirrorsForward(t *testing.T) {
+	defer withFakeSources(map[string][]string{"words.txt": {"a", "b", "c", "d"}})()
+	sources := []Source{{Path: "words.txt", Depth: 3}}
+
+	// Lines are written before their extensions, so only full-length lines
+	// are exactly mirrored.
+	full := func(opts Options) []string {
+		var out []string
+		for _, l := range collect(t, sources, opts) {
+			if strings.Count(l, "-") == 2 {
+				out = append(out, l)
+			}
+		}
+		return out
+	}
+	forward := full(Options{Seps: []string{"-"}, NoRepeats: true})
+	reverse := full(Options{Seps: []string{"-"}, NoRepeats: true, DFSOrder: "reverse"})
+	if len(forward) != 24 || len(reverse) != len(forward) {
+		t.Fatalf("expected 24 lines each, got %d and %d", len(forward), len(reverse))
+	}
+	for i := range forward {
+		if forward[i] != reverse[len(reverse)-1-i] {
+			t.Fatalf("line %d: %q does not mirror %q", i, reverse[len(reverse)-1-i], forward[i])
+		}
+	}
+
+	random := collect(t, sources, Options{Seps: []string{"-"}, DFSOrder: "random", DFSSeed: 7})
+	again := collect(t, sources, Options{Seps: []string{"-"}, DFSOrder: "random", DFSSeed: 7})
+	if strings.Join(random, ",") != strings.Join(again, ",") {
+		t.Errorf("random order is not reproducible from its seed")
+	}
+	if got, want := len(random), len(collect(t, sources, Options{Seps: []string{"-"}})); got != want {
+		t.Errorf("random order produced %d lines, expected %d", got, want)
+	}
+}
+
+// lineWriter records each Write it receives.
+type lineWriter struct {
+	mu     sync.Mutex
+	writes []string
+}
+
+func (w *lineWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.writes = append(w.writes, string(b))
+	return len(b), nil
+}
+
+func TestLineBufferedDeliversEveryLine(t *testing.T) {
+	defer withFakeSources(map[string][]string{"words.txt": syntheticLines(5)})()
+	sources := []Source{{Path: "words.txt", Depth: 2}}
+
+	for _, reverse := range []bool{false, true} {
+		w := &lineWriter{}
+		orig := stdout
+		stdout = w
+		err := RunPermutatorFast(sources, Options{Seps: []string{"-"}, LineBuffered: true, Reverse: reverse}, nil)
+		stdout = orig
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Each line reaches the writer on its own, i.e. before the run ends.
+		if len(w.writes) != 30 {
+			t.Fatalf("reverse=%v: expected 30 writes, got %d", reverse, len(w.writes))
+		}
+		for _, s := range w.writes {
+			if strings.Count(s, "\n") != 1 || !strings.HasSuffix(s, "\n") {
+				t.Errorf("reverse=%v: write %q is not exactly one line", reverse, s)
+			}
+		}
+	}
+}
+
+func TestMaxTotalItemsStopsLoadingAcrossSources(t *testing.T) {
+	defer withFakeSources(map[string][]string{
+		"a.txt": {"a1", "a2"},
+		"b.txt": {"b1", "b2", "b3"},
+		"c.txt": {"c1"},
+	})()
+	sources := []Source{{Path: "a.txt", Depth: 2}, {Path: "b.txt", Depth: 2}, {Path: "c.txt", Depth: 2}}
+	opts := Options{Seps: []string{"-"}, MaxTotalItems: 3}
+
+	items, srcOfItem, srcDepths, err := loadSources(sources, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(items, ","); got != "a1,a2,b1" {
+		t.Errorf("expected a1,a2,b1, got %s", got)
+	}
+	if fmt.Sprint(srcOfItem) != "[0 0 1]" || len(srcDepths) != 3 {
+		t.Errorf("unexpected sources %v / depths %v", srcOfItem, srcDepths)
+	}
+
+	// 3 single items plus 3*3 pairs.
+	total, err := CalculateOutputLines(sources, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total.Int64() != 12 || len(collect(t, sources, opts)) != 12 {
+		t.Errorf("expected 12 lines from the truncated pool, got count %s", total)
+	}
+}
+
+func TestSourceErrorsAreTyped(t *testing.T) {
+	var sources Sources
+	for _, val := range []string{"words.txt", "words.txt:x", "words.txt:0"} {
+		err := sources.Set(val)
+		var perr *SourceParseError
+		if !errors.As(err, &perr) || perr.Value != val {
+			t.Errorf("%s: expected a SourceParseError, got %v", val, err)
+		}
+	}
+	if err := sources.Set("words.txt:0"); !errors.Is(err, ErrInvalidDepth) {
+		t.Errorf("expected errInvalidDepth, got %v", err)
+	}
+
+	missing := filepath.Join(t.TempDir(), "missing.txt")
+	err := RunPermutatorFast([]Source{{Path: missing, Depth: 1}}, Options{Seps: []string{""}}, func(string) {})
+	var oerr *SourceOpenError
+	if !errors.As(err, &oerr) || oerr.Path != missing {
+		t.Fatalf("expected a SourceOpenError for %s, got %v", missing, err)
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected the open error to wrap os.ErrNotExist")
+	}
+	if want := "opening " + missing; !strings.HasPrefix(err.Error(), want) {
+		t.Errorf("expected the CLI message to start with %q, got %q", want, err.Error())
+	}
+}
+
+func TestCountAssert(t *testing.T) {
+	defer withFakeSources(map[string][]string{"words.txt": {"a", "b", "c"}})()
+	sources := []Source{{Path: "words.txt", Depth: 2}}
+	opts := Options{Seps: []string{"-"}, NoRepeats: true}
+
+	want, err := ParseCountAssert("9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := AssertCount(sources, opts, want); err != nil {
+		t.Errorf("expected the assertion to hold, got %v", err)
+	}
+
+	err = AssertCount(sources, opts, big.NewInt(10))
+	if err == nil || !strings.Contains(err.Error(), "expected 10 lines, got 9") {
+		t.Errorf("expected a mismatch naming both values, got %v", err)
+	}
+
+	for _, bad := range []string{"", "-1", "1e3", "x"} {
+		if _, err := ParseCountAssert(bad); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestFormatJSONStreamsAStringArray(t *testing.T) {
+	defer withFakeSources(map[string][]string{"words.txt": {`"quoted"`, `a<b>&c`, `back\slash`}})()
+	sources := []Source{{Path: "words.txt", Depth: 2}}
+	opts := Options{Seps: []string{"-"}, NoRepeats: true}
+	want := collect(t, sources, opts)
+
+	for _, lineBuffered := range []bool{false, true} {
+		var buf bytes.Buffer
+		orig := stdout
+		stdout = &buf
+		opts.Format, opts.LineBuffered = "json", lineBuffered
+		err := RunPermutatorFast(sources, opts, nil)
+		stdout = orig
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got []string
+		if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+			t.Fatalf("output is not a JSON array: %v\n%s", err, buf.String())
+		}
+		if len(got) != len(want) {
+			t.Fatalf("expected %d elements, got %d", len(want), len(got))
+		}
+		gotSet := make(map[string]bool)
+		for _, s := range got {
+			gotSet[s] = true
+		}
+		for _, s := range want {
+			if !gotSet[s] {
+				t.Errorf("missing element %q", s)
+			}
+		}
+	}
+
+	// Empty output is still a valid document, and split writes reassemble.
+	var buf bytes.Buffer
+	jw := newJSONArrayWriter(&buf)
+	jw.Close()
+	if buf.String() != "[]\n" {
+		t.Errorf("expected [] for no lines, got %q", buf.String())
+	}
+	buf.Reset()
+	jw = newJSONArrayWriter(&buf)
+	io.WriteString(jw, "ab")
+	io.WriteString(jw, "c\nd")
+	jw.Close()
+	var got []string
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil || strings.Join(got, ",") != "abc,d" {
+		t.Errorf("expected [abc d], got %q (%v)", buf.String(), err)
+	}
+}
+
+func TestSourceTransformsApplyPerSource(t *testing.T) {
+	var sources Sources
+	for _, spec := range []string{"users.txt:1:transform=lower", "domains.txt:1", "titles.txt:1:transform=lower,title"} {
+		if err := sources.Set(spec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := sources.String(); got != "users.txt:1:transform=lower, domains.txt:1, titles.txt:1:transform=lower,title" {
+		t.Errorf("unexpected String() %q", got)
+	}
+	defer withFakeSources(map[string][]string{
+		"users.txt":   {"Alice", "BOB"},
+		"domains.txt": {"Example.COM"},
+		"titles.txt":  {"dR"},
+	})()
+
+	lines := collect(t, sources, Options{Seps: []string{""}})
+	if got := strings.Join(lines, ","); got != "alice,bob,Example.COM,Dr" {
+		t.Errorf("expected alice,bob,Example.COM,Dr, got %s", got)
+	}
+
+	for _, spec := range []string{"users.txt:1:transform=shout", "users.txt:1:reverse"} {
+		err := sources.Set(spec)
+		var perr *SourceParseError
+		if !errors.As(err, &perr) {
+			t.Errorf("%s: expected a SourceParseError, got %v", spec, err)
+		}
+	}
+	if err := sources.Set("users.txt:1:transform=shout"); !errors.Is(err, ErrUnknownTransform) {
+		t.Errorf("expected errUnknownTransform, got %v", err)
+	}
+}
+
+func TestSourceSepScopesSeparators(t *testing.T) {
+	var sources Sources
+	for _, spec := range []string{"words.txt:2", "tlds.txt:2:transform=upper:sep=."} {
+		if err := sources.Set(spec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := sources.String(); got != "words.txt:2, tlds.txt:2:transform=upper:sep=." {
+		t.Errorf("unexpected String() %q", got)
+	}
+	defer withFakeSources(map[string][]string{
+		"words.txt": {"a", "b"},
+		"tlds.txt":  {"com"},
+	})()
+
+	for _, opts := range []Options{
+		{Seps: []string{"-", "_"}},
+		{Seps: []string{"-", "_"}, NoRepeats: true},
+		{Seps: []string{"-", "_"}, NoCrossSource: true},
+	} {
+		lines := collect(t, sources, opts)
+		seen := map[string]int{}
+		for _, line := range lines {
+			seen[line]++
+			if strings.Contains(line, "-COM") || strings.Contains(line, "_COM") {
+				t.Errorf("-sep written before a scoped item in %q", line)
+			}
+		}
+		if !opts.NoCrossSource && (seen["a.COM"] != 1 || seen["COM-a"] != 1 || seen["COM_a"] != 1) {
+			t.Errorf("expected a.COM once and COM-a, COM_a, got %v", lines)
+		}
+		total, err := CalculateOutputLines(sources, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total.Int64() != int64(len(lines)) {
+			t.Errorf("noRepeats=%v noCrossSource=%v: count %s, generated %d lines", opts.NoRepeats, opts.NoCrossSource, total, len(lines))
+		}
+	}
+
+	if err := Validate(sources, Options{Seps: []string{"-"}, Combinations: true}); err == nil {
+		t.Error("expected sep= with -combinations to be rejected")
+	}
+}
+
+func TestSourceAffixesWrapFirstAndLastItems(t *testing.T) {
+	var sources Sources
+	for _, spec := range []string{"users.txt:2:prefix=adm_", "years.txt:1:suffix=!:transform=upper"} {
+		if err := sources.Set(spec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := sources.String(); got != "users.txt:2:prefix=adm_, years.txt:1:transform=upper:suffix=!" {
+		t.Errorf("unexpected String() %q", got)
+	}
+	defer withFakeSources(map[string][]string{
+		"users.txt": {"al"},
+		"years.txt": {"y1"},
+	})()
+
+	opts := Options{Seps: []string{"-"}, Prefix: "<", Suffix: ">", NoRepeats: true}
+	lines := collect(t, sources, opts)
+	if got := strings.Join(lines, ","); got != "<adm_al>,<adm_al-Y1!>,<Y1!>" {
+		t.Errorf("expected <adm_al>,<adm_al-Y1!>,<Y1!>, got %s", got)
+	}
+	total, err := CalculateOutputLines(sources, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total.Int64() != int64(len(lines)) {
+		t.Errorf("count %s, generated %d lines", total, len(lines))
+	}
+}
+
+func TestOrderedByWeightEmitsHeaviestFirst(t *testing.T) {
+	defer withFakeSources(map[string][]string{
+		"w.txt":   {"a\t3", "b\t2", "c"},
+		"bad.txt": {"a\theavy"},
+	})()
+	sources := []Source{{Path: "w.txt", Depth: 2}}
+
+	opts := Options{Seps: []string{"-"}, OrderedByWeight: true}
+	lines := collect(t, sources, opts)
+	want := "a-a,a-b,b-a,b-b,a,a-c,c-a,b,b-c,c-b,c,c-c"
+	if got := strings.Join(lines, ","); got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+	total, err := CalculateOutputLines(sources, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total.Int64() != int64(len(lines)) {
+		t.Errorf("count %s, generated %d lines", total, len(lines))
+	}
+
+	opts.NoRepeats = true
+	if got := strings.Join(collect(t, sources, opts), ","); got != "a-b,b-a,a,a-c,c-a,b,b-c,c-b,c" {
+		t.Errorf("-no-repeats: unexpected order %s", got)
+	}
+
+	err = RunPermutatorFast([]Source{{Path: "bad.txt", Depth: 1}}, opts, func(string) {})
+	if err == nil || !strings.Contains(err.Error(), "invalid weight") {
+		t.Errorf("expected an invalid weight error, got %v", err)
+	}
+
+	// Under -product only one item of each slot fits each position, and
+	// tuples whose fixed items break that are never expanded.
+	weighted := func(prefix string) []string {
+		items := make([]string, 20)
+		for i := range items {
+			items[i] = fmt.Sprintf("%s%d\t%d", prefix, i, i+1)
+		}
+		return items
+	}
+	defer withFakeSources(map[string][]string{"x.txt": weighted("x"), "y.txt": weighted("y"), "z.txt": weighted("z")})()
+	slots := AsSlots([]Source{{Path: "x.txt"}, {Path: "y.txt"}, {Path: "z.txt"}})
+	product := collect(t, slots, Options{Seps: []string{"-"}, Slots: true, OrderedByWeight: true})
+	if len(product) != 8000 || product[0] != "x19-y19-z19" || product[len(product)-1] != "x0-y0-z0" {
+		t.Errorf("-product: unexpected %d lines from %s to %s", len(product), product[0], product[len(product)-1])
+	}
+}
+
+func TestLimitUniqueIgnoresRepeats(t *testing.T) {
+	// "a" and "b" each appear in both sources, so depth-1 lines repeat.
+	defer withFakeSources(map[string][]string{"x.txt": {"a", "b"}, "y.txt": {"a", "b", "c"}})()
+	sources := []Source{{Path: "x.txt", Depth: 1}, {Path: "y.txt", Depth: 1}}
+
+	lines := collect(t, sources, Options{Seps: []string{"-"}, LimitUnique: 3})
+	if got := strings.Join(lines, ","); got != "a,b,a,b,c" {
+		t.Errorf("expected a,b,a,b,c, got %s", got)
+	}
+
+	// With -unique-bloom the filter alone tells repeats apart.
+	g, err := newOutputGate(Options{LimitUnique: 3, UniqueBloom: 0.01})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.seen != nil {
+		t.Error("expected no exact set next to the bloom filter")
+	}
+	bloomed := collect(t, sources, Options{Seps: []string{"-"}, LimitUnique: 3, UniqueBloom: 0.01})
+	if got := strings.Join(bloomed, ","); got != "a,b,c" {
+		t.Errorf("expected a,b,c, got %s", got)
+	}
+
+	var buf bytes.Buffer
+	orig := stdout
+	stdout = &buf
+	defer func() { stdout = orig }()
+	defer withFakeSources(map[string][]string{"words.txt": syntheticLines(10)})()
+	if err := RunPermutatorFast([]Source{{Path: "words.txt", Depth: 3}}, Options{Seps: []string{"-"}, LimitUnique: 25}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(buf.String(), "\n"); n != 25 {
+		t.Errorf("expected exactly 25 lines from the concurrent path, got %d", n)
+	}
+}
+
+func TestReverseSourcesFlipsStartOrder(t *testing.T) {
+	defer withFakeSources(map[string][]string{"x.txt": {"a", "b"}, "y.txt": {"c"}})()
+	sources := []Source{{Path: "x.txt", Depth: 2}, {Path: "y.txt", Depth: 2}}
+
+	forward := collect(t, sources, Options{Seps: []string{"-"}})
+	reversed := collect(t, sources, Options{Seps: []string{"-"}, ReverseSources: true})
+	if got := strings.Join(forward, ","); got != "a,a-a,a-b,a-c,b,b-a,b-b,b-c,c,c-a,c-b,c-c" {
+		t.Fatalf("unexpected forward order %s", got)
+	}
+	if got := strings.Join(reversed, ","); got != "c,c-a,c-b,c-c,a,a-a,a-b,a-c,b,b-a,b-b,b-c" {
+		t.Errorf("expected y.txt's items to start first, got %s", got)
+	}
+}
+
+func TestMinFromRequiresItemsFromSource(t *testing.T) {
+	defer withFakeSources(map[string][]string{"adj.txt": {"big", "red"}, "noun.txt": {"car", "dog", "hat"}})()
+	sources := []Source{{Path: "adj.txt", Depth: 3}, {Path: "noun.txt", Depth: 3}}
+	minFrom, err := ResolveMinFrom([]string{"noun.txt=2"}, sources)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nouns := map[string]bool{"car": true, "dog": true, "hat": true}
+
+	for _, base := range []Options{
+		{Seps: []string{"-"}},
+		{Seps: []string{"-", "_"}, NoRepeats: true},
+		{Seps: []string{"-"}, NoConsecutiveSource: true},
+		{Seps: []string{"-"}, NoCrossSource: true},
+	} {
+		opts := base
+		opts.MinFrom = minFrom
+		lines := collect(t, sources, opts)
+		for _, line := range lines {
+			n := 0
+			for _, item := range strings.FieldsFunc(line, func(r rune) bool { return r == '-' || r == '_' }) {
+				if nouns[item] {
+					n++
+				}
+			}
+			if n < 2 {
+				t.Errorf("%+v: line %q has fewer than 2 nouns", base, line)
+			}
+		}
+		total, err := CalculateOutputLines(sources, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total.Int64() != int64(len(lines)) {
+			t.Errorf("%+v: count %s does not match %d generated lines", base, total, len(lines))
+		}
+	}
+
+	// The concurrent path applies the same constraint.
+	var buf bytes.Buffer
+	orig := stdout
+	stdout = &buf
+	err = RunPermutatorFast(sources, Options{Seps: []string{"-"}, MinFrom: minFrom}, nil)
+	stdout = orig
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Count(buf.String(), "\n"), len(collect(t, sources, Options{Seps: []string{"-"}, MinFrom: minFrom})); got != want {
+		t.Errorf("concurrent path wrote %d lines, expected %d", got, want)
+	}
+
+	byIndex, err := ResolveMinFrom([]string{"2=2"}, sources)
+	if err != nil || byIndex[1] != 2 {
+		t.Errorf("expected source 2 to resolve to index 1, got %v (%v)", byIndex, err)
+	}
+	if _, err := ResolveMinFrom([]string{"verbs.txt=1"}, sources); err == nil {
+		t.Errorf("expected an error for an unknown source")
+	}
+}
+
+func TestOutputEncodingLatin1RoundTrip(t *testing.T) {
+	defer withFakeSources(map[string][]string{"words.txt": {"café", "naïve"}})()
+	sources := []Source{{Path: "words.txt", Depth: 1}}
+
+	run := func(opts Options) ([]byte, error) {
+		var buf bytes.Buffer
+		orig := stdout
+		stdout = &buf
+		defer func() { stdout = orig }()
+		err := RunPermutatorFast(sources, opts, nil)
+		return buf.Bytes(), err
+	}
+
+	out, err := run(Options{Seps: []string{""}, OutputEncoding: "latin1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(out, []byte("caf\xe9\n")) {
+		t.Errorf("expected latin1 bytes, got %q", out)
+	}
+	decoded, err := charmap.ISO8859_1.NewDecoder().Bytes(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Fields(string(decoded))
+	sort.Strings(lines)
+	if got := strings.Join(lines, ","); got != "café,naïve" {
+		t.Errorf("round trip gave %s", got)
+	}
+
+	defer withFakeSources(map[string][]string{"words.txt": {"日本"}})()
+	if _, err := run(Options{Seps: []string{""}, OutputEncoding: "latin1"}); err == nil {
+		t.Errorf("expected an error for a rune latin1 cannot encode")
+	}
+	if _, err := run(Options{Seps: []string{""}, OutputEncoding: "latin1", OutputEncodingReplace: true}); err != nil {
+		t.Errorf("expected -output-encoding-replace to substitute, got %v", err)
+	}
+}
+
+func TestListSourcesReflectsFilters(t *testing.T) {
+	defer withFakeSources(map[string][]string{
+		"short.txt": {"a", "bb", "ccc", "dddd"},
+		"long.txt":  {"eeeee", "ff", "ggg"},
+	})()
+	sources := []Source{{Path: "short.txt", Depth: 2}, {Path: "long.txt", Depth: 1}}
+
+	summaries, err := SummarizeSources(sources, Options{MinTokenLen: 2, MaxTokenLen: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(summaries) != 2 || summaries[0].Items != 2 || summaries[1].Items != 2 {
+		t.Fatalf("expected 2 items per source after filtering, got %+v", summaries)
+	}
+	if !filepath.IsAbs(summaries[0].Resolved) {
+		t.Errorf("expected an absolute path, got %q", summaries[0].Resolved)
+	}
+
+	var buf bytes.Buffer
+	PrintSourceSummaries(&buf, summaries)
+	out := buf.String()
+	if !strings.Contains(out, "short.txt") || !strings.HasSuffix(strings.TrimSpace(out), "4") {
+		t.Errorf("unexpected table:\n%s", out)
+	}
+}
+
+func TestMinDepthSkipsShortSequences(t *testing.T) {
+	var sources Sources
+	for _, spec := range []string{"a.txt:2-3", "b.txt:2"} {
+		if err := sources.Set(spec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if sources[0].MinDepth != 2 || sources[0].Depth != 3 || sources[1].MinDepth != 0 {
+		t.Fatalf("unexpected parse %+v", sources)
+	}
+	if got := sources.String(); got != "a.txt:2-3, b.txt:2" {
+		t.Errorf("unexpected String() %q", got)
+	}
+	for _, bad := range []string{"a.txt:3-2", "a.txt:0-2", "a.txt:x-2"} {
+		var perr *SourceParseError
+		if err := sources.Set(bad); !errors.As(err, &perr) {
+			t.Errorf("%s: expected a SourceParseError, got %v", bad, err)
+		}
+	}
+
+	defer withFakeSources(map[string][]string{"a.txt": {"x", "y"}, "b.txt": {"z"}})()
+	for _, opts := range []Options{
+		{Seps: []string{"-"}},
+		{Seps: []string{"-"}, NoRepeats: true},
+		{Seps: []string{"-"}, NoConsecutiveSource: true},
+		{Seps: []string{"-"}, MinDepth: 2},
+	} {
+		lines := collect(t, sources, opts)
+		for _, line := range lines {
+			n := strings.Count(line, "-") + 1
+			first := line[:1]
+			if first != "z" && (n < 2 || n > 3) {
+				t.Errorf("%+v: a.txt line %q outside 2-3", opts, line)
+			}
+			if first == "z" && n < max(opts.MinDepth, 1) {
+				t.Errorf("%+v: b.txt line %q shorter than -min-depth", opts, line)
+			}
+		}
+		total, err := CalculateOutputLines(sources, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total.Int64() != int64(len(lines)) {
+			t.Errorf("%+v: count %s does not match %d generated lines", opts, total, len(lines))
+		}
+
+		var buf bytes.Buffer
+		orig := stdout
+		stdout = &buf
+		err = RunPermutatorFast(sources, opts, nil)
+		stdout = orig
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := strings.Count(buf.String(), "\n"); n != len(lines) {
+			t.Errorf("%+v: concurrent path wrote %d lines, expected %d", opts, n, len(lines))
+		}
+	}
+}
+
+func TestSingleItemsAreWrittenOnceWithSeveralSeparators(t *testing.T) {
+	defer withFakeSources(map[string][]string{"words.txt": {"a", "b"}})()
+	sources := []Source{{Path: "words.txt", Depth: 2}}
+
+	for _, noRepeats := range []bool{false, true} {
+		opts := Options{Seps: []string{"-", "_"}, NoRepeats: noRepeats}
+		lines := collect(t, sources, opts)
+		want := "a,a-a,a_a,a-b,a_b,b,b-a,b_a,b-b,b_b"
+		if noRepeats {
+			want = "a,a-b,a_b,b,b-a,b_a"
+		}
+		if got := strings.Join(lines, ","); got != want {
+			t.Errorf("noRepeats=%v: expected %s, got %s", noRepeats, want, got)
+		}
+
+		total, err := CalculateOutputLines(sources, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total.Int64() != int64(len(lines)) {
+			t.Errorf("noRepeats=%v: expected count %d, got %s", noRepeats, len(lines), total)
+		}
+
+		var buf bytes.Buffer
+		orig := stdout
+		stdout = &buf
+		err = RunPermutatorFast(sources, opts, nil)
+		stdout = orig
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := strings.Count(buf.String(), "\n"); n != len(lines) {
+			t.Errorf("noRepeats=%v: concurrent path wrote %d lines, expected %d", noRepeats, n, len(lines))
+		}
+	}
+}
+
+func TestStdinSourceIsReadOnce(t *testing.T) {
+	defer withFakeSources(map[string][]string{"x.txt": {"x"}})()
+	origStdin, origCache := stdin, stdinCache
+	defer func() { stdin, stdinCache = origStdin, origCache }()
+	stdin = strings.NewReader("a\nb\n")
+	stdinCache = &stdinBuffer{}
+
+	var sources Sources
+	if err := sources.Set("-:2"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := sources.Set("x.txt:1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	opts := Options{Seps: []string{"-"}}
+	if err := Validate(sources, opts); err != nil {
+		t.Fatalf("unexpected validation error: %v", err)
+	}
+
+	// Counting and generating both load the sources: the second load must
+	// see the buffered stdin rather than an exhausted reader.
+	total, err := CalculateOutputLines(sources, opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	lines := collect(t, sources, opts)
+	if total.Int64() != int64(len(lines)) || len(lines) == 0 {
+		t.Fatalf("count %v does not match %d generated lines", total, len(lines))
+	}
+	if lines[0] != "a" {
+		t.Errorf("expected stdin items first, got %q", lines[0])
+	}
+
+	err = sources.Set("/dev/stdin:1")
+	var parseErr *SourceParseError
+	if !errors.As(err, &parseErr) || !errors.Is(err, ErrDuplicateStdin) {
+		t.Errorf("expected a duplicate stdin error, got %v", err)
+	}
+	dup := []Source{{Path: "-", Depth: 1}, {Path: "-", Depth: 2}}
+	if err := Validate(dup, opts); !errors.Is(err, ErrDuplicateStdin) {
+		t.Errorf("expected Validate to reject a duplicate stdin source, got %v", err)
+	}
+}
+
+func TestWorkerPoolMatchesSequentialUnderNoRepeats(t *testing.T) {
+	defer withFakeSources(map[string][]string{
+		"a.txt": syntheticLines(7),
+		"b.txt": {"x", "y", "z"},
+	})()
+	sources := []Source{{Path: "a.txt", Depth: 3}, {Path: "b.txt", Depth: 2}}
+	opts := Options{Seps: []string{"-"}, NoRepeats: true}
+
+	want := collect(t, sources, opts)
+	sort.Strings(want)
+
+	// Fewer workers than starts, so every worker reuses its used buffer.
+	for _, workers := range []int{1, 2, 3} {
+		var buf bytes.Buffer
+		orig := stdout
+		stdout = &buf
+		opts.Workers = workers
+		err := RunPermutatorFast(sources, opts, nil)
+		stdout = orig
+		if err != nil {
+			t.Fatalf("workers=%d: unexpected error: %v", workers, err)
+		}
+		got := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+		sort.Strings(got)
+		if strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Errorf("workers=%d: output differs from sequential generation (%d vs %d lines)", workers, len(got), len(want))
+		}
+	}
+}
+
+func TestSortedMatchesSequentialOrder(t *testing.T) {
+	defer withFakeSources(map[string][]string{
+		"a.txt": syntheticLines(9),
+		"b.txt": {"x", "y"},
+	})()
+	sources := []Source{{Path: "a.txt", Depth: 3}, {Path: "b.txt", Depth: 2}}
+	opts := Options{Seps: []string{"-", "_"}, NoRepeats: true}
+	want := collect(t, sources, opts)
+
+	opts.Sorted = true
+	opts.Workers = 4
+	for run := 0; run < 3; run++ {
+		var buf bytes.Buffer
+		orig := stdout
+		stdout = &buf
+		err := RunPermutatorFast(sources, opts, nil)
+		stdout = orig
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got := strings.Join(want, "\n") + "\n"; buf.String() != got {
+			t.Fatalf("run %d: -sorted output differs from sequential order", run)
+		}
+	}
+}
+
+func TestOutputLengthFiltersCountRunes(t *testing.T) {
+	defer withFakeSources(map[string][]string{"a.txt": {"é", "ab"}})()
+	sources := []Source{{Path: "a.txt", Depth: 2}}
+
+	// "<é>" is 3 runes but 4 bytes: a byte count would drop it.
+	opts := Options{Seps: []string{""}, Prefix: "<", Suffix: ">", MinLen: 3, MaxLen: 4}
+	lines := collect(t, sources, opts)
+	want := []string{"<é>", "<éé>", "<ab>"}
+	if strings.Join(lines, ",") != strings.Join(want, ",") {
+		t.Errorf("expected %v, got %v", want, lines)
+	}
+
+	opts = Options{Seps: []string{" ", "-"}, ExcludeChars: " \t"}
+	for _, line := range collect(t, sources, opts) {
+		if strings.ContainsAny(line, " \t") {
+			t.Errorf("line %q contains an excluded character", line)
+		}
+	}
+}
+
+func TestSkipAndLimitSelectExactLines(t *testing.T) {
+	defer withFakeSources(map[string][]string{"a.txt": {"a", "b", "c"}})()
+	sources := []Source{{Path: "a.txt", Depth: 2}}
+	// Sequential order: a a-a a-b a-c b b-a b-b b-c c ...
+	opts := Options{Seps: []string{"-"}, Skip: 5, Limit: 3, Workers: 3}
+	want := "b-a\nb-b\nb-c\n"
+
+	if got := strings.Join(collect(t, sources, opts), "\n") + "\n"; got != want {
+		t.Errorf("callback path: expected %q, got %q", want, got)
+	}
+	var buf bytes.Buffer
+	orig := stdout
+	stdout = &buf
+	err := RunPermutatorFast(sources, opts, nil)
+	stdout = orig
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if buf.String() != want {
+		t.Errorf("fast path: expected %q, got %q", want, buf.String())
+	}
+}
+
+func TestSlotsBuildTemplateLines(t *testing.T) {
+	defer withFakeSources(map[string][]string{
+		"names.txt":   {"bob", "eve"},
+		"years.txt":   {"1990", "2024"},
+		"symbols.txt": {"!", "#", "$"},
+	})()
+	sources := SlotSources([]string{"names.txt", "years.txt", "symbols.txt"})
+	opts := Options{Seps: []string{"", "."}, Prefix: "<", Suffix: ">", Slots: true}
+	if err := Validate(sources, opts); err != nil {
+		t.Fatalf("unexpected validation error: %v", err)
+	}
+
+	lines := collect(t, sources, opts)
+	if lines[0] != "<bob1990!>" || lines[1] != "<bob.1990.!>" {
+		t.Errorf("unexpected first lines: %v", lines[:2])
+	}
+	for _, line := range lines {
+		if len(strings.ReplaceAll(line, ".", "")) != len("<bob1990!>") {
+			t.Errorf("line %q does not follow the name/year/symbol template", line)
+		}
+	}
+	total, err := CalculateOutputLines(sources, opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// 2 names x 2 years x 3 symbols x 2 separators.
+	if total.Int64() != 24 || len(lines) != 24 {
+		t.Errorf("expected 24 lines, counted %v and generated %d", total, len(lines))
+	}
+
+	var buf bytes.Buffer
+	orig := stdout
+	stdout = &buf
+	err = RunPermutatorFast(sources, Options{Seps: []string{"-"}, Slots: true, Sorted: true}, nil)
+	stdout = orig
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(buf.String(), "bob-1990-!\nbob-1990-#\n") || strings.Count(buf.String(), "\n") != 12 {
+		t.Errorf("unexpected fast path output:\n%s", buf.String())
+	}
+}
+
+func TestMutateExpandsItemsAtLoadTime(t *testing.T) {
+	defer withFakeSources(map[string][]string{"a.txt": {"pass", "2024", "café"}})()
+	sources := []Source{{Path: "a.txt", Depth: 1}}
+	opts := Options{Seps: []string{""}, Mutate: "cap,upper,leet"}
+	if err := Validate(sources, opts); err != nil {
+		t.Fatalf("unexpected validation error: %v", err)
+	}
+
+	lines := collect(t, sources, opts)
+	// Without -leet-table, leet keeps its basic table: a→@ e→3 i→1 o→0 s→$.
+	want := []string{"pass", "Pass", "PASS", "p@$$", "2024", "café", "Café", "CAFÉ", "c@fé"}
+	if strings.Join(lines, ",") != strings.Join(want, ",") {
+		t.Errorf("expected %v, got %v", want, lines)
+	}
+	total, err := CalculateOutputLines([]Source{{Path: "a.txt", Depth: 2}}, opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// 9 items, then 9*9 pairs.
+	if total.Int64() != 9+81 {
+		t.Errorf("expected the count over 9 expanded items, got %v", total)
+	}
+
+	if err := Validate(sources, Options{Mutate: "cap,rot13"}); err == nil {
+		t.Error("expected an unknown mutation to be rejected")
+	}
+}
+
+func TestUniqueDropsRepeatedLines(t *testing.T) {
+	defer withFakeSources(map[string][]string{
+		"a.txt": {"admin", "root"},
+		"b.txt": {"admin", "guest"},
+	})()
+	sources := []Source{{Path: "a.txt", Depth: 1}, {Path: "b.txt", Depth: 1}}
+
+	for _, opts := range []Options{
+		{Seps: []string{""}, Unique: true},
+		{Seps: []string{""}, UniqueBloom: 1e-6},
+	} {
+		var buf bytes.Buffer
+		orig := stdout
+		stdout = &buf
+		err := RunPermutatorFast(sources, opts, nil)
+		stdout = orig
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		got := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+		sort.Strings(got)
+		if strings.Join(got, ",") != "admin,guest,root" {
+			t.Errorf("bloom=%g: expected each line once, got %v", opts.UniqueBloom, got)
+		}
+	}
+
+	lines := collect(t, sources, Options{Seps: []string{""}, Unique: true})
+	if strings.Join(lines, ",") != "admin,root,guest" {
+		t.Errorf("callback path: expected admin,root,guest, got %v", lines)
+	}
+}
+
+func TestGenerateContextStopsAndReportsProgress(t *testing.T) {
+	items := syntheticLines(200)
+	srcOfItem := make([]int, len(items))
+	var buf bytes.Buffer
+	p := NewPermutatorFast(items, srcOfItem, []int{5}, []string{"-"}, "", "", false, &buf)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	start := time.Now()
+	progress, err := p.GenerateContext(ctx)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("generation did not stop on cancel, took %v", elapsed)
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if progress.Total != 200 || progress.Starts >= progress.Total {
+		t.Errorf("unexpected progress %+v", progress)
+	}
+	// Everything reported as written was flushed, as whole lines.
+	if got := uint64(strings.Count(buf.String(), "\n")); got != progress.Lines || progress.Lines == 0 {
+		t.Errorf("progress reports %d lines, output holds %d", progress.Lines, got)
+	}
+	if buf.Len() > 0 && !strings.HasSuffix(buf.String(), "\n") {
+		t.Error("output ends with a partial line")
+	}
+
+	p = NewPermutatorFast(items[:3], srcOfItem[:3], []int{2}, []string{"-"}, "", "", false, io.Discard)
+	progress, err = p.GenerateContext(context.Background())
+	if err != nil || progress.Starts != 3 || progress.Lines != 12 {
+		t.Errorf("complete run: got %+v, %v", progress, err)
+	}
+}
+
+func TestItemsSourcesWriteToTheGivenWriters(t *testing.T) {
+	sources := []Source{{Path: "words", Items: []string{"a", "b", "a"}, Depth: 2}}
+	opts := Options{Seps: []string{"-"}, DedupInput: true}
+	if err := Validate(sources, opts); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var out, errOut bytes.Buffer
+	opts.Stdout, opts.Stderr, opts.Sorted = &out, &errOut, true
+	if err := RunPermutatorFast(sources, opts, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := "a\na-a\na-b\nb\nb-a\nb-b\n"; out.String() != want {
+		t.Errorf("expected %q, got %q", want, out.String())
+	}
+	if !strings.Contains(errOut.String(), "collapsed 1 duplicate") {
+		t.Errorf("expected the dedup report on Stderr, got %q", errOut.String())
+	}
+}
+
+func TestCapDepthsBoundsEverySource(t *testing.T) {
+	defer withFakeSources(map[string][]string{"a.txt": {"a", "b"}, "b.txt": {"c"}})()
+	sources := []Source{{Path: "a.txt", Depth: 4}, {Path: "b.txt", Depth: 1}}
+	CapDepths(sources, 2)
+	if sources[0].Depth != 2 || sources[1].Depth != 1 {
+		t.Fatalf("unexpected depths after capping: %+v", sources)
+	}
+
+	opts := Options{Seps: []string{"-"}, MinDepth: 2}
+	lines := collect(t, sources, opts)
+	for _, line := range lines {
+		if strings.Count(line, "-") != 1 {
+			t.Errorf("line %q is not two items long", line)
+		}
+	}
+	total, err := CalculateOutputLines(sources, opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Only a.txt reaches depth 2: 2 starts x 3 items.
+	if total.Int64() != 6 || len(lines) != 6 {
+		t.Errorf("expected 6 lines, counted %v and generated %d", total, len(lines))
+	}
+}
+
+func TestTemplateBindsPositionsToNamedSources(t *testing.T) {
+	defer withFakeSources(map[string][]string{
+		"lists/users.txt": {"bob", "eve"},
+		"years.txt":       {"1990", "2024"},
+	})()
+	given := []Source{{Path: "lists/users.txt", Depth: 3}, {Path: "years.txt", Depth: 1}}
+	tpl, err := ParseTemplate("<{users}{sep}{2}#{users}>")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	sources, err := tpl.Sources(given)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	opts := Options{
+		Seps:   []string{"-", "_"},
+		Prefix: tpl.lead,
+		Suffix: tpl.trail,
+		Gaps:   tpl.gaps,
+		Slots:  true,
+	}
+	if err := Validate(sources, opts); err != nil {
+		t.Fatalf("unexpected validation error: %v", err)
+	}
+
+	lines := collect(t, sources, opts)
+	if lines[0] != "<bob-1990#bob>" || lines[1] != "<bob_1990#bob>" {
+		t.Errorf("unexpected first lines: %v", lines[:2])
+	}
+	total, err := CalculateOutputLines(sources, opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// 2 users x 2 years x 2 users x 2 separators.
+	if total.Int64() != 16 || len(lines) != 16 {
+		t.Errorf("expected 16 lines, counted %v and generated %d", total, len(lines))
+	}
+
+	for _, bad := range []string{"{users", "{sep}{users}", "plain", "{nobody}"} {
+		tpl, err := ParseTemplate(bad)
+		if err == nil {
+			_, err = tpl.Sources(given)
+		}
+		if err == nil {
+			t.Errorf("template %q: expected an error", bad)
+		}
+	}
+}
+
+func TestProductCrossJoinsSourcesInOrder(t *testing.T) {
+	defer withFakeSources(map[string][]string{
+		"a.txt": {"a1", "a2"},
+		"b.txt": {"b1"},
+		"c.txt": {"c1", "c2", "c3"},
+	})()
+	given := []Source{{Path: "a.txt", Depth: 1}, {Path: "b.txt", Depth: 5}, {Path: "c.txt", Depth: 2, Transforms: "upper"}}
+	sources := AsSlots(given)
+	if given[1].Depth != 5 {
+		t.Fatal("asSlots modified its input")
+	}
+	opts := Options{Seps: []string{"+"}, Slots: true}
+
+	lines := collect(t, sources, opts)
+	want := []string{"a1+b1+C1", "a1+b1+C2", "a1+b1+C3", "a2+b1+C1", "a2+b1+C2", "a2+b1+C3"}
+	if strings.Join(lines, ",") != strings.Join(want, ",") {
+		t.Errorf("expected %v, got %v", want, lines)
+	}
+	total, err := CalculateOutputLines(sources, opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if total.Int64() != 6 {
+		t.Errorf("expected a count of 2x1x3 = 6, got %v", total)
+	}
+}
+
+func TestCombinationsEmitEachSetOnce(t *testing.T) {
+	defer withFakeSources(map[string][]string{
+		"a.txt": {"a", "b", "c"},
+		"b.txt": {"x", "y"},
+	})()
+	sources := []Source{{Path: "a.txt", Depth: 3}, {Path: "b.txt", Depth: 2}}
+
+	lines := collect(t, sources[:1], Options{Seps: []string{"-"}, NoRepeats: true, Combinations: true})
+	want := []string{"a", "a-b", "a-b-c", "a-c", "b", "b-c", "c"}
+	if strings.Join(lines, ",") != strings.Join(want, ",") {
+		t.Errorf("expected %v, got %v", want, lines)
+	}
+
+	for _, opts := range []Options{
+		{Seps: []string{"-"}, NoRepeats: true, Combinations: true},
+		{Seps: []string{"-"}, Combinations: true},
+		{Seps: []string{"-", ""}, NoCrossSource: true, Combinations: true},
+		{Seps: []string{"-"}, NoRepeats: true, NoCrossSource: true, Combinations: true},
+	} {
+		lines := collect(t, sources, opts)
+		sets := map[string]bool{}
+		for _, line := range lines {
+			parts := strings.Split(strings.ReplaceAll(line, "-", ""), "")
+			sort.Strings(parts)
+			key := strings.Join(parts, "")
+			if len(opts.Seps) == 1 && sets[key] {
+				t.Errorf("%+v: set %q emitted twice", opts, key)
+			}
+			sets[key] = true
+		}
+		total, err := CalculateOutputLines(sources, opts)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if total.Int64() != int64(len(lines)) {
+			t.Errorf("%+v: counted %v lines, generated %d", opts, total, len(lines))
+		}
+	}
+}
+
+func TestMaskSourceExpandsLikeAFile(t *testing.T) {
+	defer withFakeSources(map[string][]string{"w.txt": {"pw"}})()
+	var sources Sources
+	for _, val := range []string{"w.txt:1", "mask:?d??:1-2"} {
+		if err := sources.Set(val); err != nil {
+			t.Fatalf("Set(%q): %v", val, err)
+		}
+	}
+	if src := sources[1]; src.Path != "mask:?d??" || src.MinDepth != 1 || src.Depth != 2 {
+		t.Fatalf("unexpected mask source %+v", src)
+	}
+	for _, bad := range []string{"mask:?x:1", "mask:?d?:1", "mask:?d"} {
+		if err := sources.Set(bad); err == nil {
+			t.Errorf("Set(%q): expected an error", bad)
+		}
+	}
+	if err := Validate(sources, Options{Seps: []string{""}}); err != nil {
+		t.Fatalf("unexpected validation error: %v", err)
+	}
+
+	lines := collect(t, AsSlots(sources), Options{Seps: []string{""}, Slots: true})
+	if len(lines) != 10 || lines[0] != "pw0?" || lines[9] != "pw9?" {
+		t.Errorf("expected pw0? .. pw9?, got %v", lines)
+	}
+
+	items, err := readSource(Source{Path: "mask:a?l?d", Depth: 1}, Options{}, func(string) bool { return true }, -1)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(items) != 260 || items[0] != "aa0" || items[1] != "aa1" || items[259] != "az9" {
+		t.Errorf("expected 260 candidates aa0 .. az9, got %d", len(items))
+	}
+}
+
+func TestRulesRewriteEveryLine(t *testing.T) {
+	for rule, want := range map[string]string{
+		":":        "pAss1",
+		"l":        "pass1",
+		"u":        "PASS1",
+		"c":        "Pass1",
+		"C":        "pASS1",
+		"t T0":     "paSS1",
+		"r":        "1ssAp",
+		"d":        "pAss1pAss1",
+		"f":        "pAss11ssAp",
+		"p1":       "pAss1pAss1",
+		"{}":       "pAss1",
+		"$!^#":     "#pAss1!",
+		"[]":       "Ass",
+		"D1'3":     "pss",
+		"x13":      "Ass",
+		"O12":      "ps1",
+		"i2-o0P":   "PA-ss1",
+		"ss$@1":    "pA$$",
+		"z2Z1":     "pppAss11",
+		"q":        "ppAAssss11",
+		"kK":       "Aps1s",
+		"c $2 $0 ": "Pass120",
+		"'Z":       "pAss1",
+	} {
+		r, err := parseRule(rule)
+		if err != nil {
+			t.Errorf("parseRule(%q): %v", rule, err)
+			continue
+		}
+		if got := r.apply("pAss1"); got != want {
+			t.Errorf("rule %q: expected %q, got %q", rule, want, got)
+		}
+	}
+	for _, bad := range []string{"<5", "$", "TX!", "sa"} {
+		if _, err := parseRule(bad); err == nil {
+			t.Errorf("parseRule(%q): expected an error", bad)
+		}
+	}
+
+	defer withFakeSources(map[string][]string{"w.txt": {"ab", "cd"}})()
+	sources := []Source{{Path: "w.txt", Depth: 2}}
+	opts := Options{Seps: []string{"-"}, NoRepeats: true, Rules: []string{":", "u", "$1"}}
+	if err := Validate(sources, opts); err != nil {
+		t.Fatalf("unexpected validation error: %v", err)
+	}
+	want := []string{"ab", "AB", "ab1", "ab-cd", "AB-CD", "ab-cd1", "cd", "CD", "cd1", "cd-ab", "CD-AB", "cd-ab1"}
+	lines := collect(t, sources, opts)
+	if strings.Join(lines, ",") != strings.Join(want, ",") {
+		t.Errorf("expected %v, got %v", want, lines)
+	}
+
+	var buf bytes.Buffer
+	orig := stdout
+	stdout = &buf
+	err := RunPermutatorFast(sources, opts, nil)
+	stdout = orig
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := strings.Fields(buf.String()); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("fast path: expected %v, got %v", want, got)
+	}
+	total, err := CalculateOutputLines(sources, opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if total.Int64() != int64(len(want)) {
+		t.Errorf("expected a count of %d, got %v", len(want), total)
+	}
+	if err := Validate(sources, Options{Seps: []string{"-"}, Rules: []string{"c", "<5"}}); err == nil {
+		t.Error("expected an unsupported rule to fail validation")
+	}
+}
+
+func TestMutateCaseWritesEveryLineInEachCase(t *testing.T) {
+	defer withFakeSources(map[string][]string{"w.txt": {"ÉTÉ", "jOb"}})()
+	sources := []Source{{Path: "w.txt", Depth: 2}}
+	opts := Options{Seps: []string{"-"}, NoRepeats: true, MutateCase: "capitalize,toggle", Rules: []string{":", "$!"}}
+	if err := Validate(sources, opts); err != nil {
+		t.Fatalf("unexpected validation error: %v", err)
+	}
+	want := []string{
+		"Été", "Été!", "été", "été!", "Été-job", "Été-job!", "été-JoB", "été-JoB!",
+		"Job", "Job!", "JoB", "JoB!", "Job-été", "Job-été!", "JoB-été", "JoB-été!",
+	}
+	lines := collect(t, sources, opts)
+	if strings.Join(lines, ",") != strings.Join(want, ",") {
+		t.Errorf("expected %v, got %v", want, lines)
+	}
+
+	var buf bytes.Buffer
+	orig := stdout
+	stdout = &buf
+	err := RunPermutatorFast(sources, opts, nil)
+	stdout = orig
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := strings.Fields(buf.String()); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("fast path: expected %v, got %v", want, got)
+	}
+	total, err := CalculateOutputLines(sources, opts)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if total.Int64() != int64(len(want)) {
+		t.Errorf("expected a count of %d, got %v", len(want), total)
+	}
+	if err := Validate(sources, Options{Seps: []string{"-"}, MutateCase: "upper,title"}); err == nil {
+		t.Error("expected an unknown case to fail validation")
+	}
+}
+
+func TestLeetWritesVariantsOfEveryLine(t *testing.T) {
+	table, err := parseLeetTable("a=4@,S=5")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	variants := func(line string, maxSubs int) []string {
+		var got []string
+		leetVariants(line, table, maxSubs, func(v string) { got = append(got, v) })
+		return got
+	}
+	for _, tc := range []struct {
+		maxSubs int
+		want    int
+	}{{1, 5}, {2, 10}, {-1, 12}} {
+		if got := variants("paSs", tc.maxSubs); len(got) != tc.want || got[0] != "paSs" {
+			t.Errorf("level %d: expected %d variants starting with the line, got %v", tc.maxSubs, tc.want, got)
+		}
+	}
+	if got := variants("paSs", 1); strings.Join(got, ",") != "paSs,p4Ss,p@Ss,pa5s,paS5" {
+		t.Errorf("unexpected level 1 variants %v", got)
+	}
+
+	// The level caps the substitutions of a whole line, not of each item.
+	defer withFakeSources(map[string][]string{"w.txt": {"as", "b"}, "x.txt": {"so", "t"}})()
+	sources := []Source{{Path: "w.txt", Depth: 2}}
+	opts := Options{Seps: []string{"-"}, Leet: "1", LeetTable: "a=4,s=5"}
+	if err := Validate(sources, opts); err != nil {
+		t.Fatalf("unexpected validation error: %v", err)
+	}
+	lines := collect(t, sources, opts)
+	got := strings.Join(lines, ",")
+	if !strings.Contains(got, ",4s-as,") || strings.Contains(got, "4s-4s") {
+		t.Errorf("expected at most one substitution per line, got %s", got)
+	}
+	// as (3 variants), b (1), as-as (5), as-b (3), b-as (3), b-b (1).
+	total, err := CalculateOutputLines(sources, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 16 || total.Int64() != 16 {
+		t.Errorf("expected 16 lines and a count of 16, got %d and %v", len(lines), total)
+	}
+
+	// The count follows every generation mode.
+	two := []Source{{Path: "w.txt", Depth: 3}, {Path: "x.txt", Depth: 2, MinDepth: 2}}
+	tpl, err := ParseTemplate("{w}{sep}{x}#a")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	minFrom := map[int]int{1: 1}
+	for _, leet := range []string{"2", "all"} {
+		for _, tc := range []struct {
+			sources []Source
+			opts    Options
+		}{
+			{two, Options{Seps: []string{"-", "s"}, Prefix: "a", Suffix: "!"}},
+			{two, Options{Seps: []string{"-"}, NoRepeats: true}},
+			{two, Options{Seps: []string{"-", "o"}, NoCrossSource: true}},
+			{two, Options{Seps: []string{"-"}, NoRepeats: true, NoCrossSource: true}},
+			{AsSlots(two), Options{Seps: []string{"-", "a"}, Slots: true}},
+			{AsSlots(two), Options{Seps: []string{"-", "a"}, Prefix: tpl.lead, Suffix: tpl.trail, Gaps: tpl.gaps, Slots: true}},
+			{two, Options{Seps: []string{"-"}, Combinations: true}},
+			{two, Options{Seps: []string{"-", "s"}, Combinations: true, NoRepeats: true, NoCrossSource: true}},
+			{two, Options{Seps: []string{"-"}, NoConsecutiveSource: true}},
+			{two, Options{Seps: []string{"-", "o"}, NoConsecutiveSource: true, NoRepeats: true}},
+			{two, Options{Seps: []string{"-"}, MinFrom: minFrom, NoRepeats: true}},
+			{two, Options{Seps: []string{"-"}, Incremental: "ao", IncrementalMax: 1, MutateCase: "upper,lower"}},
+		} {
+			opts := tc.opts
+			opts.Leet = leet
+			if err := Validate(tc.sources, opts); err != nil {
+				t.Fatalf("%+v: unexpected validation error: %v", opts, err)
+			}
+			lines := collect(t, tc.sources, opts)
+			total, err := CalculateOutputLines(tc.sources, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var out bytes.Buffer
+			orig := stdout
+			stdout = &out
+			err = RunPermutatorFast(tc.sources, opts, nil)
+			stdout = orig
+			if err != nil {
+				t.Fatalf("%+v: unexpected error: %v", opts, err)
+			}
+			if n := strings.Count(out.String(), "\n"); total.Int64() != int64(len(lines)) || n != len(lines) {
+				t.Errorf("%+v: count %v, %d lines collected, %d written", opts, total, len(lines), n)
+			}
+		}
+	}
+
+	// -mutate leet writes every letter as its first substitute in the same table.
+	if got := collect(t, []Source{{Path: "w.txt", Depth: 1}}, Options{Seps: []string{""}, Mutate: "leet", LeetTable: "a=@4,s=$"}); strings.Join(got, ",") != "as,@$,b" {
+		t.Errorf("expected -mutate leet to use the -leet-table, got %v", got)
+	}
+
+	sep := "."
+	for _, bad := range []struct {
+		sources []Source
+		opts    Options
+	}{
+		{sources, Options{Leet: "0"}},
+		{sources, Options{Leet: "some"}},
+		{sources, Options{Leet: "1", LeetTable: "ab=4"}},
+		{sources, Options{Leet: "1", LeetTable: "a="}},
+		{sources, Options{Seps: []string{"-"}, Leet: "1", Sample: 3}},
+		{[]Source{{Path: "w.txt", Depth: 2, Sep: &sep}}, Options{Seps: []string{"-"}, Leet: "1"}},
+		{[]Source{{Path: "w.txt", Depth: 2, Prefix: "x"}}, Options{Seps: []string{"-"}, Leet: "1"}},
+	} {
+		if err := Validate(bad.sources, bad.opts); err == nil {
+			t.Errorf("%+v: expected a validation error", bad.opts)
+		}
+	}
+}
+
+func TestCompressedSourcesAreDecompressed(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, compress func(io.Writer) io.WriteCloser, text string) string {
+		path := filepath.Join(dir, name)
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := compress(f)
+		io.WriteString(w, text)
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		return path
+	}
+	gzPath := write("words.txt.gz", func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }, "gz-1\ngz-2\n")
+	zstPath := write("words.zst", func(w io.Writer) io.WriteCloser {
+		enc, err := zstd.NewWriter(w)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return enc
+	}, "zst-1\n")
+	// bz2.compress(b"bz-1\nbz-2\n"): the standard library only decompresses bzip2.
+	bz2Path := filepath.Join(dir, "words.bz2")
+	bz2Data := "\x42\x5a\x68\x39\x31\x41\x59\x26\x53\x59\x08\xe0\xd5\x4b\x00\x00\x03\x59\x80\x00\x10\x00\x02\x30\x00\x10\x00\x00\x10\x20\x00\x30\xc0\x04\xa6\x98\x37\x48\x42\x98\x5d\xc9\x14\xe1\x42\x40\x23\x83\x55\x2c"
+	if err := os.WriteFile(bz2Path, []byte(bz2Data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	sources := []Source{{Path: gzPath, Depth: 1}, {Path: zstPath, Depth: 1}, {Path: bz2Path, Depth: 1}}
+	lines := collect(t, sources, Options{Seps: []string{""}})
+	if want := "gz-1,gz-2,zst-1,bz-1,bz-2"; strings.Join(lines, ",") != want {
+		t.Errorf("expected %s, got %v", want, lines)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "plain.gz"), []byte("not gzip\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := readSource(Source{Path: filepath.Join(dir, "plain.gz"), Depth: 1}, Options{}, func(string) bool { return true }, -1)
+	var readErr *SourceReadError
+	if !errors.As(err, &readErr) {
+		t.Errorf("expected a SourceReadError for a corrupt archive, got %v", err)
+	}
+}
+
+// cancelAfterWriter cancels a context once it has received n writes.
+type cancelAfterWriter struct {
+	buf    bytes.Buffer
+	n      int
+	cancel context.CancelFunc
+}
+
+func (w *cancelAfterWriter) Write(p []byte) (int, error) {
+	if w.n--; w.n == 0 {
+		w.cancel()
+	}
+	return w.buf.Write(p)
+}
+
+func TestCheckpointKeyCoversEveryOutputOption(t *testing.T) {
+	// Options that steer a run without changing its lines.
+	runOnly := map[string]bool{
+		"LimitTime": true, "ReverseMax": true, "Workers": true, "Sorted": true, "Context": true,
+		"Checkpoint": true, "Resume": true, "Progress": true, "LineBuffered": true,
+		"Stdout": true, "Stderr": true, "ReadRetries": true, "SortMemory": true, "LineFilter": true,
+	}
+	sources := []Source{{Path: "a.txt", Depth: 2}}
+	base := checkpointKey(sources, Options{})
+	typ := reflect.TypeOf(Options{})
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		var opts Options
+		v := reflect.ValueOf(&opts).Elem().Field(i)
+		switch f.Type.Kind() {
+		case reflect.String:
+			v.SetString("x")
+		case reflect.Bool:
+			v.SetBool(true)
+		case reflect.Int, reflect.Int64:
+			v.SetInt(3)
+		case reflect.Uint64:
+			v.SetUint(3)
+		case reflect.Float64:
+			v.SetFloat(0.5)
+		case reflect.Slice:
+			v.Set(reflect.ValueOf([]string{"x"}))
+		case reflect.Map:
+			v.Set(reflect.ValueOf(map[int]int{0: 1}))
+		case reflect.Pointer:
+			sep := "x"
+			v.Set(reflect.ValueOf(&sep))
+		case reflect.Interface:
+			switch f.Type {
+			case reflect.TypeOf((*io.Writer)(nil)).Elem():
+				v.Set(reflect.ValueOf(io.Discard))
+			case reflect.TypeOf((*context.Context)(nil)).Elem():
+				v.Set(reflect.ValueOf(context.Background()))
+			}
+		case reflect.Func:
+			v.Set(reflect.ValueOf(LineFilter(func(s string) (string, bool) { return s, true })))
+		default:
+			t.Fatalf("no test value for option %s of type %s", f.Name, f.Type)
+		}
+		if changed := checkpointKey(sources, opts) != base; changed == runOnly[f.Name] {
+			t.Errorf("option %s: key changed = %t, want %t", f.Name, changed, !runOnly[f.Name])
+		}
+	}
+}
+
+func TestResumeContinuesWhereTheCheckpointStopped(t *testing.T) {
+	defer withFakeSources(map[string][]string{"a.txt": syntheticLines(12)})()
+	sources := []Source{{Path: "a.txt", Depth: 3}}
+	opts := Options{Seps: []string{"-"}, NoRepeats: true, Workers: 3, LineBuffered: true}
+
+	// -checkpoint implies -sorted, so the reference run is sorted too.
+	var full bytes.Buffer
+	orig := stdout
+	defer func() { stdout = orig }()
+	stdout = &full
+	if err := RunPermutatorFast(sources, Options{Seps: opts.Seps, NoRepeats: true, Sorted: true}, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	state := filepath.Join(t.TempDir(), "state.json")
+	first := opts
+	first.Checkpoint, first.LimitTime = state, time.Hour
+	if err := Validate(sources, first); err != nil {
+		t.Fatalf("unexpected validation error: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	first.Context = ctx
+	w := &cancelAfterWriter{n: 50, cancel: cancel}
+	stdout = w
+	if err := RunPermutatorFast(sources, first, nil); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the run to be interrupted, got %v", err)
+	}
+	data, err := os.ReadFile(state)
+	if err != nil {
+		t.Fatalf("no checkpoint saved: %v", err)
+	}
+	var st checkpointState
+	if err := json.Unmarshal(data, &st); err != nil {
+		t.Fatalf("bad checkpoint: %v", err)
+	}
+	if st.Lines != uint64(strings.Count(w.buf.String(), "\n")) || st.Starts >= st.TotalStarts {
+		t.Fatalf("checkpoint %+v does not match %d written lines", st, strings.Count(w.buf.String(), "\n"))
+	}
+
+	// Run-only options may change between the runs.
+	second := opts
+	second.Checkpoint, second.Resume = state, state
+	second.LimitTime, second.Workers, second.LineBuffered = time.Minute, 1, false
+	var rest bytes.Buffer
+	stdout = &rest
+	if err := RunPermutatorFast(sources, second, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := w.buf.String() + rest.String(); got != full.String() {
+		t.Errorf("interrupted run plus resumed run differ from a full run (%d+%d vs %d bytes)", w.buf.Len(), rest.Len(), full.Len())
+	}
+
+	other := opts
+	other.Seps, other.Resume = []string{"+"}, state
+	if err := RunPermutatorFast(sources, other, nil); err == nil {
+		t.Error("expected a checkpoint of other options to be refused")
+	}
+	if err := Validate(sources, Options{Seps: []string{"-"}, Checkpoint: state, Unique: true}); err == nil {
+		t.Error("expected -checkpoint with -unique to fail validation")
+	}
+}
+
+func TestSkipJumpsOverWholeStartsByCount(t *testing.T) {
+	defer withFakeSources(map[string][]string{
+		"a.txt": {"a", "b", "c", "d"},
+		"b.txt": {"x", "y"},
+	})()
+	sources := []Source{{Path: "a.txt", Depth: 3}, {Path: "b.txt", Depth: 2}}
+	for _, opts := range []Options{
+		{Seps: []string{"-", "."}},
+		{Seps: []string{"-"}, NoRepeats: true, NoCrossSource: true},
+		{Seps: []string{"-"}, NoConsecutiveSource: true, Incremental: "01"},
+		{Seps: []string{"-"}, MinFrom: map[int]int{1: 1}, Rules: []string{":", "u"}},
+		{Seps: []string{""}, Slots: true},
+	} {
+		opts.Sorted = true
+		srcs := sources
+		if opts.Slots {
+			srcs = AsSlots(sources)
+		}
+		var full bytes.Buffer
+		orig := stdout
+		stdout = &full
+		err := RunPermutatorFast(srcs, opts, nil)
+		stdout = orig
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		lines := strings.SplitAfter(full.String(), "\n")
+		lines = lines[:len(lines)-1]
+
+		allItems, srcOfItem, srcDepths, err := loadSources(srcs, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts = opts.withSources(srcs)
+		order, _ := candidateOrder(len(allItems), "", 0)
+		starts := opts.startOrder(order, srcOfItem, len(srcDepths))
+		if starts == nil {
+			starts = order
+		}
+		for _, skip := range []int{1, len(lines) / 3, len(lines) - 1, len(lines)} {
+			if rest, _ := skipWholeStarts(starts, srcOfItem, srcDepths, opts, skip); skip > len(lines)/2 && len(rest) == len(starts) {
+				t.Errorf("%+v skip %d: no start item was jumped over", opts, skip)
+			}
+
+			windowed := opts
+			windowed.Skip, windowed.Limit = skip, 4
+			var buf bytes.Buffer
+			stdout = &buf
+			err := RunPermutatorFast(srcs, windowed, nil)
+			stdout = orig
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			want := strings.Join(lines[skip:min(skip+4, len(lines))], "")
+			if buf.String() != want {
+				t.Errorf("%+v skip %d: expected %q, got %q", opts, skip, want, buf.String())
+			}
+		}
+	}
+}
+
+func TestSampleDrawsDistinctLinesFromTheSpace(t *testing.T) {
+	defer withFakeSources(map[string][]string{
+		"a.txt": {"a", "b", "c", "d"},
+		"b.txt": {"x", "y"},
+	})()
+	sources := []Source{{Path: "a.txt", Depth: 3, MinDepth: 2}, {Path: "b.txt", Depth: 2}}
+	run := func(opts Options) []string {
+		var out bytes.Buffer
+		orig := stdout
+		stdout = &out
+		err := RunPermutatorFast(sources, opts, nil)
+		stdout = orig
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return strings.Fields(out.String())
+	}
+	base := Options{Seps: []string{"-", "."}, NoRepeats: true, Sorted: true}
+	all := run(base)
+	index := make(map[string]int)
+	for i, line := range all {
+		index[line] = i
+	}
+
+	base.Sample, base.SampleSeed = 10, 42
+	sample := run(base)
+	if len(sample) != 10 {
+		t.Fatalf("expected 10 lines, got %d: %v", len(sample), sample)
+	}
+	last := -1
+	for _, line := range sample {
+		i, ok := index[line]
+		if !ok {
+			t.Fatalf("%q is not a line of the space", line)
+		}
+		if i <= last {
+			t.Errorf("sample not in generation order or repeated: %v", sample)
+		}
+		last = i
+	}
+	if again := run(base); strings.Join(again, ",") != strings.Join(sample, ",") {
+		t.Errorf("same seed drew %v, then %v", sample, again)
+	}
+
+	base.Sample = len(all) + 1
+	if got := run(base); strings.Join(got, ",") != strings.Join(all, ",") {
+		t.Errorf("a sample larger than the space should be the whole space, got %v", got)
+	}
+
+	// The draw follows the forward order only.
+	for _, opts := range []Options{
+		{Seps: []string{"-"}, Sample: 3, DFSOrder: "reverse"},
+		{Seps: []string{"-"}, Sample: 3, DFSOrder: "random"},
+		{Seps: []string{"-"}, Sample: 3, ReverseSources: true},
+	} {
+		if err := Validate(sources, opts); err == nil {
+			t.Errorf("expected -sample with %+v to be rejected", opts)
+		}
+	}
+	if err := Validate(sources, Options{Seps: []string{"-"}, Sample: 3, DFSOrder: "forward"}); err != nil {
+		t.Errorf("unexpected error with -dfs-order forward: %v", err)
+	}
+}
+
+func TestProgressReportsToStderr(t *testing.T) {
+	defer withFakeSources(map[string][]string{"a.txt": {"a", "b", "c"}})()
+	var out, errOut bytes.Buffer
+	origOut, origErr := stdout, stderr
+	stdout, stderr = &out, &errOut
+	defer func() { stdout, stderr = origOut, origErr }()
+
+	err := RunPermutatorFast([]Source{{Path: "a.txt", Depth: 2}}, Options{Seps: []string{"-"}, Progress: true, Limit: 10}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n := strings.Count(out.String(), "\n"); n != 10 {
+		t.Errorf("expected 10 lines on stdout, got %d", n)
+	}
+	// The last report is written once generation ends.
+	reports := strings.Split(strings.TrimSpace(errOut.String()), "\n")
+	last := reports[len(reports)-1]
+	if !strings.HasPrefix(last, "progress: 10 lines, ") || !strings.HasSuffix(last, ", 100.0% of 10, done") {
+		t.Errorf("unexpected final report %q", last)
+	}
+}
+
+func TestCountBytesMatchesGeneratedOutput(t *testing.T) {
+	defer withFakeSources(map[string][]string{
+		"a.txt": {"a", "bb", "ccc"},
+		"b.txt": {"1", "22"},
+	})()
+	sources := []Source{{Path: "a.txt", Depth: 3, MinDepth: 2}, {Path: "b.txt", Depth: 2}}
+	sep := "+"
+	scoped := []Source{{Path: "a.txt", Depth: 3}, {Path: "b.txt", Depth: 3, Sep: &sep}}
+	wrapped := []Source{{Path: "a.txt", Depth: 2, Prefix: "((", Suffix: ")"}, {Path: "b.txt", Depth: 2, Suffix: "!"}}
+	tpl, err := ParseTemplate("<{a}{sep}{b}#>")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, tc := range []struct {
+		sources []Source
+		opts    Options
+	}{
+		{sources, Options{Seps: []string{"", "--"}, Prefix: "<", Suffix: ">"}},
+		{sources, Options{Seps: []string{"-"}, TokenWrap: "[]", NoCrossSource: true, Incremental: "!é", IncrementalMax: 2}},
+		{sources, Options{Seps: []string{"-", "__"}, NoRepeats: true}},
+		{sources, Options{Seps: []string{"-"}, NoRepeats: true, NoCrossSource: true}},
+		{AsSlots(sources), Options{Seps: []string{"-", ""}, Slots: true}},
+		{AsSlots(sources), Options{Seps: []string{"-", "::"}, Prefix: tpl.lead, Suffix: tpl.trail, Gaps: tpl.gaps, Slots: true}},
+		{AsSlots(wrapped), Options{Seps: []string{"-"}, Slots: true}},
+		{sources, Options{Seps: []string{"-", "__"}, Combinations: true}},
+		{sources, Options{Seps: []string{"-"}, Combinations: true, NoRepeats: true}},
+		{sources, Options{Seps: []string{"-", "__"}, NoConsecutiveSource: true}},
+		{sources, Options{Seps: []string{"-"}, NoConsecutiveSource: true, NoRepeats: true}},
+		{sources, Options{Seps: []string{"-"}, MinFrom: map[int]int{1: 1}, NoRepeats: true}},
+		{scoped, Options{Seps: []string{"-", "__"}}},
+		{scoped, Options{Seps: []string{"-", "__"}, NoRepeats: true}},
+		{scoped, Options{Seps: []string{"-", "__"}, NoCrossSource: true}},
+		{wrapped, Options{Seps: []string{"-", "__"}, Prefix: "<"}},
+		{wrapped, Options{Seps: []string{"-"}, NoRepeats: true}},
+		{sources, Options{Seps: []string{"-"}, MutateCase: "upper,toggle"}},
+	} {
+		var out bytes.Buffer
+		orig := stdout
+		stdout = &out
+		err := RunPermutatorFast(tc.sources, tc.opts, nil)
+		stdout = orig
+		if err != nil {
+			t.Fatalf("%+v: unexpected error: %v", tc.opts, err)
+		}
+		size, err := CalculateOutputBytes(tc.sources, tc.opts)
+		if err != nil {
+			t.Fatalf("%+v: unexpected error: %v", tc.opts, err)
+		}
+		if size.Int64() != int64(out.Len()) {
+			t.Errorf("%+v: expected %d bytes, got %v", tc.opts, out.Len(), size)
+		}
+	}
+
+	// Rules rewrite lines to lengths that cannot be summed ahead.
+	if _, err := CalculateOutputBytes(sources, Options{Seps: []string{"-"}, Rules: []string{"$1", "d"}}); !errors.Is(err, ErrBytesUnavailable) {
+		t.Errorf("expected the size to be unavailable with -rules, got %v", err)
+	}
+
+	for n, want := range map[int64]string{1023: "1023 B", 1536: "1.5 KiB", 87 << 40: "87.0 TiB"} {
+		if got := HumanBytes(big.NewInt(n)); got != want {
+			t.Errorf("humanBytes(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
+
+func TestUniqueSpillsIntoBloomAfterExactMax(t *testing.T) {
+	defer withFakeSources(map[string][]string{"a.txt": {"a", "aa", "b"}})()
+	sources := []Source{{Path: "a.txt", Depth: 3}}
+	run := func(opts Options) (string, string) {
+		var out, errOut bytes.Buffer
+		origOut, origErr := stdout, stderr
+		stdout, stderr = &out, &errOut
+		err := RunPermutatorFast(sources, opts, nil)
+		stdout, stderr = origOut, origErr
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return out.String(), errOut.String()
+	}
+	exact, report := run(Options{Seps: []string{""}, Unique: true, Sorted: true})
+	if report != "" {
+		t.Errorf("exact -unique should not report, got %q", report)
+	}
+	got, report := run(Options{Seps: []string{""}, Unique: true, UniqueBloom: 1e-6, UniqueExactMax: 5, Sorted: true})
+	if got != exact {
+		t.Errorf("expected the exact -unique output\n%s\ngot\n%s", exact, got)
+	}
+	if !strings.HasPrefix(report, "unique: ") || !strings.Contains(report, "repeated lines dropped, bloom filter false positive rate about ") {
+		t.Errorf("unexpected report %q", report)
+	}
+}
+
+func TestDedupInputKeepsTheDeepestCopy(t *testing.T) {
+	defer withFakeSources(map[string][]string{
+		"a.txt": {"cat", "dog", "cat"},
+		"b.txt": {"dog", "owl"},
+	})()
+	sources := []Source{{Path: "a.txt", Depth: 1}, {Path: "b.txt", Depth: 2}}
+	opts := Options{Seps: []string{"-"}, DedupInput: true, Sorted: true}
+
+	var out, errOut bytes.Buffer
+	origOut, origErr := stdout, stderr
+	stdout, stderr = &out, &errOut
+	defer func() { stdout, stderr = origOut, origErr }()
+	if err := RunPermutatorFast(sources, opts, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// dog moved to b.txt, the deeper source, so it starts pairs too.
+	want := "cat\ndog\ndog-cat\ndog-dog\ndog-owl\nowl\nowl-cat\nowl-dog\nowl-owl\n"
+	if out.String() != want {
+		t.Errorf("expected\n%s\ngot\n%s", want, out.String())
+	}
+	if !strings.Contains(errOut.String(), "dedup-input: collapsed 2 duplicate items") {
+		t.Errorf("expected the collapsed items to be reported, got %q", errOut.String())
+	}
+	if total, err := CalculateOutputLines(sources, opts); err != nil || total.Int64() != 9 {
+		t.Errorf("expected a count of 9, got %v (%v)", total, err)
+	}
+}
+
+func TestMatchFiltersLinesByRegex(t *testing.T) {
+	defer withFakeSources(map[string][]string{"a.txt": {"ab", "1", "cd"}})()
+	sources := []Source{{Path: "a.txt", Depth: 2}}
+	opts := Options{Seps: []string{""}, Match: []string{"^[a-z]", "[0-9]$"}, ExcludeMatch: []string{"cd"}, Sorted: true}
+
+	var out bytes.Buffer
+	orig := stdout
+	stdout = &out
+	defer func() { stdout = orig }()
+	if err := RunPermutatorFast(sources, opts, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := "ab1\n"; out.String() != want {
+		t.Errorf("expected %q, got %q", want, out.String())
+	}
+
+	opts.Match = []string{"("}
+	if err := Validate(sources, opts); err == nil || !strings.Contains(err.Error(), "-match: ") {
+		t.Errorf("expected an invalid -match to be rejected, got %v", err)
+	}
+}
+
+func TestMaxLenPrunesLongSequences(t *testing.T) {
+	defer withFakeSources(map[string][]string{"a.txt": {"a", "bb"}})()
+	// 2^60 sequences: only pruning lets this finish.
+	sources := []Source{{Path: "a.txt", Depth: 60}}
+	want := "<a>\n<a-a>\n<bb>\n"
+	for _, opts := range []Options{
+		{Seps: []string{"-", "--"}, Prefix: "<", Suffix: ">", MaxLen: 5, Sorted: true},
+		{Seps: []string{"-", "--"}, Prefix: "<", Suffix: ">", MaxLen: 5, Reverse: true},
+	} {
+		var out bytes.Buffer
+		orig := stdout
+		stdout = &out
+		err := RunPermutatorFast(sources, opts, nil)
+		stdout = orig
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		got := out.String()
+		if opts.Reverse {
+			lines := strings.Split(strings.TrimSuffix(got, "\n"), "\n")
+			slices.Reverse(lines)
+			got = strings.Join(lines, "\n") + "\n"
+		}
+		if got != want {
+			t.Errorf("expected\n%s\ngot\n%s", want, got)
+		}
+	}
+}
+
+func TestGenerateConfigFromItemsAndFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "actions.txt")
+	if err := os.WriteFile(path, []byte("jump\n\nrun\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{
+		Sources: []Source{
+			{Path: "pets", Items: []string{"cat", "dog"}, Depth: 2},
+			{Path: path, Depth: 1},
+		},
+		Seps:      []string{"-"},
+		NoRepeats: true,
+	}
+
+	var buf bytes.Buffer
+	if err := Generate(cfg, &buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if lines[0] != "cat" || lines[1] != "cat-dog" || lines[len(lines)-1] != "run" {
+		t.Errorf("unexpected output: %v", lines)
+	}
+
+	// The same engine as a run: lines and count match RunPermutatorFast.
+	var run bytes.Buffer
+	if err := RunPermutatorFast(cfg.Sources, Options{Seps: cfg.Seps, NoRepeats: true, Sorted: true, Stdout: &run}, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if run.String() != buf.String() {
+		t.Errorf("Generate wrote %q, RunPermutatorFast %q", buf.String(), run.String())
+	}
+	p, err := New(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if p.Count().Int64() != int64(len(lines)) {
+		t.Errorf("count %v does not match %d generated lines", p.Count(), len(lines))
+	}
+}
+
+func TestPermutatorStreamsToOutput(t *testing.T) {
+	p, err := New(Config{Sources: []Source{{Path: "ab", Items: []string{"a", "b"}, Depth: 2}}, Seps: []string{"", "_"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var got []string
+	p.Output = func(s string) { got = append(got, s) }
+	p.Generate()
+	want := "a,aa,a_a,ab,a_b,b,ba,b_a,bb,b_b"
+	if strings.Join(got, ",") != want {
+		t.Errorf("expected %s, got %s", want, strings.Join(got, ","))
+	}
+	if p.Count().Int64() != int64(len(got)) {
+		t.Errorf("count %v does not match %d lines", p.Count(), len(got))
+	}
+
+	if _, err := New(Config{Sources: []Source{{Path: "a", Items: []string{"a"}}}}); err == nil {
+		t.Error("expected a source without depth to be rejected")
+	}
+	sep := "."
+	if _, err := New(Config{Sources: []Source{{Path: "a", Items: []string{"a"}, Depth: 1, Sep: &sep}}}); err == nil {
+		t.Error("expected a per-source separator to be rejected")
+	}
+}
+
+func TestIteratorMatchesGenerate(t *testing.T) {
+	cfg := Config{
+		Sources:   []Source{{Path: "abc", Items: []string{"a", "b", "c"}, Depth: 3, MinDepth: 2}, {Path: "x", Items: []string{"x"}, Depth: 1}},
+		Seps:      []string{"", "-"},
+		NoRepeats: true,
+	}
+	p, err := New(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var want []string
+	p.Output = func(s string) { want = append(want, s) }
+	p.Generate()
+
+	var got []string
+	for it := p.Iter(); it.Next(); {
+		got = append(got, it.Candidate())
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("iterator order differs from Generate:\n got %v\nwant %v", got, want)
+	}
+
+	if p.Count().Int64() != int64(len(want)) {
+		t.Errorf("count %v does not match %d lines", p.Count(), len(want))
+	}
+
+	// Stopping early is just not calling Next again.
+	it := p.Iter()
+	for i := 0; i < 3; i++ {
+		it.Next()
+	}
+	if it.Candidate() != want[2] {
+		t.Errorf("expected %q after three lines, got %q", want[2], it.Candidate())
+	}
+}
+
+func TestCandidateAtMatchesIterator(t *testing.T) {
+	for _, cfg := range []Config{
+		{Sources: []Source{{Path: "abc", Items: []string{"a", "b", "c"}, Depth: 3, MinDepth: 2}, {Path: "x", Items: []string{"x"}, Depth: 1}}, Seps: []string{"", "-"}, NoRepeats: true},
+		{Sources: []Source{{Path: "ab", Items: []string{"a", "b"}, Depth: 3}, {Path: "xy", Items: []string{"x", "y"}, Depth: 2, MinDepth: 2}}, Seps: []string{"_", "."}, Prefix: "<", Suffix: ">"},
+		{Sources: []Source{{Path: "abcd", Items: []string{"a", "b", "c", "d"}, Depth: 4}}, NoRepeats: true},
+	} {
+		p, err := New(cfg)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		i := int64(0)
+		for it := p.Iter(); it.Next(); i++ {
+			got, err := p.CandidateAt(big.NewInt(i))
+			if err != nil {
+				t.Fatalf("candidate %d: unexpected error: %v", i, err)
+			}
+			if got != it.Candidate() {
+				t.Errorf("candidate %d: got %q, want %q", i, got, it.Candidate())
+			}
+		}
+		if _, err := p.CandidateAt(big.NewInt(i)); err != ErrIndexOutOfRange {
+			t.Errorf("candidate %d past the end: expected ErrIndexOutOfRange, got %v", i, err)
+		}
+		if _, err := p.CandidateAt(big.NewInt(-1)); err != ErrIndexOutOfRange {
+			t.Errorf("candidate -1: expected ErrIndexOutOfRange, got %v", err)
+		}
+	}
+}
+
+func TestIndexOfInvertsCandidateAt(t *testing.T) {
+	for _, cfg := range []Config{
+		{Sources: []Source{{Path: "abc", Items: []string{"a", "b", "c"}, Depth: 3, MinDepth: 2}, {Path: "x", Items: []string{"x"}, Depth: 1}}, Seps: []string{"", "-"}, NoRepeats: true},
+		{Sources: []Source{{Path: "ab", Items: []string{"a", "b"}, Depth: 3}, {Path: "xy", Items: []string{"x", "y"}, Depth: 2, MinDepth: 2}}, Seps: []string{"_", "."}, Prefix: "<", Suffix: ">"},
+		// "ab" reads as one item or as "a" then "b": the first line wins.
+		{Sources: []Source{{Path: "ab", Items: []string{"a", "b", "ab"}, Depth: 2}}},
+	} {
+		p, err := New(cfg)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		first := make(map[string]int64)
+		i := int64(0)
+		for it := p.Iter(); it.Next(); i++ {
+			if _, seen := first[it.Candidate()]; !seen {
+				first[it.Candidate()] = i
+			}
+		}
+		for line, want := range first {
+			got, err := p.IndexOf(line)
+			if err != nil {
+				t.Fatalf("%q: unexpected error: %v", line, err)
+			}
+			if got.Int64() != want {
+				t.Errorf("%q: got index %v, want %d", line, got, want)
+			}
+		}
+	}
+
+	p, err := New(Config{Sources: []Source{{Path: "ab", Items: []string{"a", "b"}, Depth: 2}}, NoRepeats: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, line := range []string{"aa", "abc", "c", "aba", ""} {
+		if _, err := p.IndexOf(line); err != ErrNotCandidate {
+			t.Errorf("%q: expected ErrNotCandidate, got %v", line, err)
+		}
+	}
+}
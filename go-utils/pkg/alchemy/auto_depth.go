@@ -0,0 +1,52 @@
+package alchemy
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+)
+
+// AutoDepth returns the largest depth which, applied uniformly to every
+// source, keeps the total number of output lines at or below budget.
+func AutoDepth(sources []Source, opts Options, budget *big.Int) (int, error) {
+	allItems, srcOfItem, srcDepths, err := loadWrittenSources(sources, opts)
+	if err != nil {
+		return 0, err
+	}
+	opts = opts.withSources(sources)
+	minDepth := 1
+	for i := range sources {
+		minDepth = max(minDepth, opts.minDepthOf(i))
+	}
+
+	// Lines of length l do not depend on depths beyond l, so one pass at a
+	// growing uniform depth gives every cumulative total.
+	cumulative := big.NewInt(0)
+	for depth := 1; ; depth++ {
+		for i := range srcDepths {
+			srcDepths[i] = depth
+		}
+		added := countByDepth(allItems, srcOfItem, srcDepths, opts)[depth-1]
+		if added.Sign() == 0 && depth >= minDepth {
+			// Deeper sequences are unreachable (e.g. -no-repeats ran out of items).
+			return max(depth-1, 1), nil
+		}
+		cumulative.Add(cumulative, added)
+		if cumulative.Cmp(budget) > 0 {
+			if depth == 1 {
+				return 0, fmt.Errorf("even depth 1 produces %s lines, more than the budget of %s", cumulative, budget)
+			}
+			return depth - 1, nil
+		}
+		if len(srcOfItem) == 1 && !opts.NoRepeats {
+			// A single item grows linearly from its minimum depth: jump
+			// straight to the answer.
+			depth := new(big.Int).Quo(budget, added)
+			depth.Add(depth, big.NewInt(int64(opts.minDepthOf(srcOfItem[0])-1)))
+			if !depth.IsInt64() || depth.Int64() > math.MaxInt32 {
+				return 0, fmt.Errorf("a budget of %s lines needs an unreasonable depth", budget)
+			}
+			return int(depth.Int64()), nil
+		}
+	}
+}
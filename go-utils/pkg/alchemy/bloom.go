@@ -0,0 +1,66 @@
+package alchemy
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"math/bits"
+)
+
+// maxBloomBytes bounds the filter -unique-bloom may allocate.
+const maxBloomBytes = 8 << 30
+
+// bloomFilter is the memory-bounded seen-set of -unique-bloom: a line it has
+// not seen may be reported as seen (and dropped) with the configured false
+// positive rate, but a repeated line is always caught.
+type bloomFilter struct {
+	bits []uint64
+	m    uint64 // number of bits
+	k    uint64 // probes per line
+}
+
+// newBloomFilter sizes a filter for n lines at false positive rate p.
+func newBloomFilter(n *big.Int, p float64) (*bloomFilter, error) {
+	if n.Sign() == 0 {
+		n = big.NewInt(1)
+	}
+	fn, _ := new(big.Float).SetInt(n).Float64()
+	m := math.Ceil(-fn * math.Log(p) / (math.Ln2 * math.Ln2))
+	if m/8 > maxBloomBytes {
+		return nil, fmt.Errorf("-unique-bloom needs %.0f MiB for %s lines at rate %g; raise the rate or bound the run with -limit", m/8/(1<<20), n, p)
+	}
+	m = max(m, 64)
+	k := max(math.Round(m/fn*math.Ln2), 1)
+	return &bloomFilter{
+		bits: make([]uint64, (uint64(m)+63)/64),
+		m:    uint64(m),
+		k:    uint64(k),
+	}, nil
+}
+
+// testAndAdd records line and reports whether it was (probably) seen before.
+// Probes use double hashing over the two halves of a 128-bit FNV-1a hash.
+func (b *bloomFilter) testAndAdd(line string) bool {
+	h := hashLine(line)
+	h1, h2 := h[0], h[1]
+	seen := true
+	for i := uint64(0); i < b.k; i++ {
+		bit := (h1 + i*h2) % b.m
+		word, mask := bit/64, uint64(1)<<(bit%64)
+		if b.bits[word]&mask == 0 {
+			seen = false
+			b.bits[word] |= mask
+		}
+	}
+	return seen
+}
+
+// falsePositiveRate estimates the probability that a line not seen yet is
+// reported as seen, from the share of bits set so far.
+func (b *bloomFilter) falsePositiveRate() float64 {
+	set := 0
+	for _, w := range b.bits {
+		set += bits.OnesCount64(w)
+	}
+	return math.Pow(float64(set)/float64(b.m), float64(b.k))
+}
@@ -0,0 +1,46 @@
+package alchemy
+
+import "fmt"
+
+// charSet is a set of allowed runes built from a spec like "a-z0-9_".
+type charSet struct {
+	ranges [][2]rune
+}
+
+// parseCharset parses single characters and "x-y" ranges. A '-' at the very
+// start or end of the spec is taken literally.
+func parseCharset(spec string) (*charSet, error) {
+	runes := []rune(spec)
+	set := &charSet{}
+	for i := 0; i < len(runes); i++ {
+		lo, hi := runes[i], runes[i]
+		if i+2 < len(runes) && runes[i+1] == '-' {
+			hi = runes[i+2]
+			i += 2
+		}
+		if lo > hi {
+			return nil, fmt.Errorf("invalid range %c-%c in charset %q", lo, hi, spec)
+		}
+		set.ranges = append(set.ranges, [2]rune{lo, hi})
+	}
+	return set, nil
+}
+
+func (c *charSet) contains(r rune) bool {
+	for _, rg := range c.ranges {
+		if r >= rg[0] && r <= rg[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// containsAll reports whether every rune of s is in the set.
+func (c *charSet) containsAll(s string) bool {
+	for _, r := range s {
+		if !c.contains(r) {
+			return false
+		}
+	}
+	return true
+}
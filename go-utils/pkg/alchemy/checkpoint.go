@@ -0,0 +1,174 @@
+package alchemy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// checkpointInterval is how often -checkpoint saves the progress (patch
+// point for tests).
+var checkpointInterval = 10 * time.Second
+
+// checkpointState is a -checkpoint file. Output is written in sequential
+// order under -checkpoint, so the lines written so far are always a prefix
+// of it: Starts start items in full, then the first StartLines lines of the
+// next one.
+type checkpointState struct {
+	Config      string `json:"config"`       // checkpointKey of the run
+	Starts      int    `json:"starts"`       // start items written in full
+	StartLines  uint64 `json:"start_lines"`  // lines of the next start item already written
+	Lines       uint64 `json:"lines"`        // lines written in total
+	TotalStarts int    `json:"total_starts"` // start items of the run
+}
+
+// checkpointKey identifies the sources and every option shaping the output,
+// so a checkpoint is only resumed by the same run. Options that only steer
+// how a run goes (time limit, workers, flushing, progress, where the output
+// goes) are left out: a run cut short by -limit-time may resume with another
+// one, and into another -out file. Unlike the count cache key, sources are
+// not stat'ed: stdin and masks can be resumed too.
+func checkpointKey(sources []Source, opts Options) string {
+	h := sha256.New()
+	writeOptionsKey(h, opts)
+	for _, src := range sources {
+		fmt.Fprintf(h, "source=%q:%d-%d:%q\n", src.Path, src.MinDepth, src.Depth, src.Transforms)
+		if src.Items != nil {
+			fmt.Fprintf(h, "items=%q\n", src.Items)
+		}
+		if src.Sep != nil {
+			fmt.Fprintf(h, "sep=%q\n", *src.Sep)
+		}
+		if src.Prefix != "" || src.Suffix != "" {
+			fmt.Fprintf(h, "affixes=%q:%q\n", src.Prefix, src.Suffix)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// writeOptionsKey writes the options shaping the output to h, one per line.
+// The list is explicit so writers, funcs and pointers never end up in a key:
+// an option added to Options must be added here too if it changes the lines
+// written.
+func writeOptionsKey(h io.Writer, opts Options) {
+	fmt.Fprintf(h, "seps=%q prefix=%q suffix=%q norepeats=%t\n", opts.Seps, opts.Prefix, opts.Suffix, opts.NoRepeats)
+	fmt.Fprintf(h, "reverse=%t format=%q encoding=%q:%t\n", opts.Reverse, opts.Format, opts.OutputEncoding, opts.OutputEncodingReplace)
+	fmt.Fprintf(h, "tokenlen=%d-%d charset=%q\n", opts.MinTokenLen, opts.MaxTokenLen, opts.Charset)
+	fmt.Fprintf(h, "mutate=%q leet=%q leettable=%q\n", opts.Mutate, opts.Leet, opts.LeetTable)
+	fmt.Fprintf(h, "maxitems=%d dedupinput=%t\n", opts.MaxTotalItems, opts.DedupInput)
+	fmt.Fprintf(h, "incremental=%q:%d\n", opts.Incremental, opts.IncrementalMax)
+	fmt.Fprintf(h, "mutatecase=%q rules=%q sortexternal=%t\n", opts.MutateCase, opts.Rules, opts.SortExternal)
+	fmt.Fprintf(h, "nocross=%t noconsecutive=%t slots=%t gaps=%q combinations=%t\n",
+		opts.NoCrossSource, opts.NoConsecutiveSource, opts.Slots, opts.Gaps, opts.Combinations)
+	fmt.Fprintf(h, "minfrom=%v mindepth=%d\n", opts.MinFrom, opts.MinDepth) // %v prints maps sorted by key
+	fmt.Fprintf(h, "dfs=%q:%d reversesources=%t weighted=%t\n", opts.DFSOrder, opts.DFSSeed, opts.ReverseSources, opts.OrderedByWeight)
+	fmt.Fprintf(h, "failondup=%t limitunique=%d diff=%q shard=%q\n", opts.FailOnDuplicate, opts.LimitUnique, opts.DiffAgainst, opts.HashShard)
+	fmt.Fprintf(h, "len=%d-%d excludechars=%q\n", opts.MinLen, opts.MaxLen, opts.ExcludeChars)
+	fmt.Fprintf(h, "unique=%t:%v:%d\n", opts.Unique, opts.UniqueBloom, opts.UniqueExactMax)
+	fmt.Fprintf(h, "skip=%d limit=%d sample=%d:%d\n", opts.Skip, opts.Limit, opts.Sample, opts.SampleSeed)
+	fmt.Fprintf(h, "excludefiles=%q match=%q excludematch=%q\n", opts.ExcludeFiles, opts.Match, opts.ExcludeMatch)
+	fmt.Fprintf(h, "tokenmap=%q tokenwrap=%q\n", opts.TokenMap, opts.TokenWrap)
+	if opts.SanitizeSep != nil {
+		fmt.Fprintf(h, "sanitize=%q\n", *opts.SanitizeSep)
+	}
+	fmt.Fprintf(h, "header=%q footer=%q\n", opts.HeaderLine, opts.FooterLine)
+}
+
+// loadCheckpoint reads a -resume file and checks it belongs to this run.
+func loadCheckpoint(path, key string) (checkpointState, error) {
+	var st checkpointState
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return st, fmt.Errorf("opening %s: %v", path, err)
+	}
+	if err := json.Unmarshal(data, &st); err != nil {
+		return st, fmt.Errorf("reading %s: %v", path, err)
+	}
+	if st.Config != key {
+		return st, fmt.Errorf("%s was saved by a run with other sources or options", path)
+	}
+	return st, nil
+}
+
+// saveCheckpoint writes st to path through a temporary file, so an
+// interruption never leaves a torn checkpoint behind.
+func saveCheckpoint(path string, st checkpointState) error {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("creating %s: %v", path, err)
+	}
+	_, werr := tmp.Write(append(data, '\n'))
+	if err := errors.Join(werr, tmp.Close()); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("writing %s: %v", path, err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("writing %s: %v", path, err)
+	}
+	return nil
+}
+
+// checkpointer saves the progress of a sorted PermutatorFast that started
+// from base.
+type checkpointer struct {
+	path string
+	base checkpointState
+	p    *PermutatorFast
+}
+
+// state flushes what was written so far and returns where the run stands.
+func (c *checkpointer) state() checkpointState {
+	p := c.p
+	p.mu.Lock()
+	p.out.Flush()
+	flushed, flushedLines, written := p.flushedStarts, p.flushedLines, p.written
+	p.mu.Unlock()
+
+	st := c.base
+	st.Starts += flushed
+	st.Lines += written
+	if flushed > 0 {
+		st.StartLines = written - flushedLines
+	} else {
+		st.StartLines += written
+	}
+	return st
+}
+
+// start saves the progress every checkpointInterval until the returned
+// func is called, which saves it a last time.
+func (c *checkpointer) start() func() error {
+	ticker := time.NewTicker(checkpointInterval)
+	quit := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		var err error
+		for {
+			select {
+			case <-ticker.C:
+				if serr := saveCheckpoint(c.path, c.state()); err == nil {
+					err = serr
+				}
+			case <-quit:
+				done <- err
+				return
+			}
+		}
+	}()
+	return func() error {
+		ticker.Stop()
+		close(quit)
+		return errors.Join(<-done, saveCheckpoint(c.path, c.state()))
+	}
+}
@@ -0,0 +1,54 @@
+package alchemy
+
+import "math/big"
+
+// countCombinationsByDepth counts -combinations lines. A sequence started by
+// item i continues with items loaded after it (or, with repeats allowed, i
+// itself again) in non-decreasing order, so each unordered selection of l
+// items is written once: C(after, l-1) without repeats, and the multiset
+// count C(after+l-1, l-1) with them, where after is the number of pool items
+// loaded after i.
+func countCombinationsByDepth(srcOfItem []int, srcDepths []int, opts Options, from int) []*big.Int {
+	maxDepth := 0
+	for _, d := range srcDepths {
+		maxDepth = max(maxDepth, d)
+	}
+	byDepth := make([]*big.Int, maxDepth)
+	for l := range byDepth {
+		byDepth[l] = big.NewInt(0)
+	}
+	sepFactor, singleFactor := opts.lineFactors()
+
+	// Items of one source are contiguous, so under -no-cross-source the pool
+	// items after i are the rest of its source.
+	remaining := make([]int, len(srcDepths))
+	for _, src := range srcOfItem {
+		remaining[src]++
+	}
+	n := len(srcOfItem)
+	for i, src := range srcOfItem {
+		remaining[src]--
+		if from >= 0 && src != from {
+			continue
+		}
+		after := n - 1 - i
+		if opts.NoCrossSource {
+			after = remaining[src]
+		}
+		for l := opts.minDepthOf(src); l <= srcDepths[src]; l++ {
+			var cnt *big.Int
+			if opts.NoRepeats {
+				cnt = new(big.Int).Binomial(int64(after), int64(l-1))
+			} else {
+				cnt = new(big.Int).Binomial(int64(after+l-1), int64(l-1))
+			}
+			if l == 1 {
+				cnt.Mul(cnt, singleFactor)
+			} else {
+				cnt.Mul(cnt, sepFactor)
+			}
+			byDepth[l-1].Add(byDepth[l-1], cnt)
+		}
+	}
+	return byDepth
+}
@@ -0,0 +1,28 @@
+package alchemy
+
+import (
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// newDecompressor returns a reader decompressing a source file named path
+// by its suffix (.gz, .zst or .bz2), or nil for a plain file.
+func newDecompressor(path string, r io.Reader) (io.ReadCloser, error) {
+	switch {
+	case strings.HasSuffix(path, ".gz"):
+		return gzip.NewReader(r)
+	case strings.HasSuffix(path, ".zst"):
+		dec, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return dec.IOReadCloser(), nil
+	case strings.HasSuffix(path, ".bz2"):
+		return io.NopCloser(bzip2.NewReader(r)), nil
+	}
+	return nil, nil
+}
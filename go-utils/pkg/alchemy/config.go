@@ -0,0 +1,96 @@
+package alchemy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+)
+
+// Config describes a plain generation: every sequence of items drawn from
+// the sources, up to each source's depth, joined with each separator and
+// wrapped in a prefix and suffix. It is the part of Options whose lines can
+// be streamed, counted and addressed by index; RunPermutatorFast takes the
+// rest.
+type Config struct {
+	Sources   []Source // read from Path, or from Items when not nil
+	Seps      []string // each separator gives its own line (nil = [""])
+	Prefix    string
+	Suffix    string
+	NoRepeats bool // use each item at most once per sequence
+}
+
+// options returns the Options generating cfg.
+func (c Config) options() Options {
+	opts := Options{Seps: c.Seps, Prefix: c.Prefix, Suffix: c.Suffix, NoRepeats: c.NoRepeats}
+	if len(opts.Seps) == 0 {
+		opts.Seps = []string{""}
+	}
+	return opts
+}
+
+// Permutator generates the lines of a Config through the same engine as
+// RunPermutatorFast. Output, when set, receives every line for streaming
+// consumers; otherwise lines go to stdout.
+type Permutator struct {
+	Output func(string)
+
+	allItems  []string
+	srcOfItem []int
+	srcDepths []int
+	opts      Options
+}
+
+// New validates cfg and loads every source of it.
+func New(cfg Config) (*Permutator, error) {
+	opts := cfg.options()
+	var errs []error
+	for _, src := range cfg.Sources {
+		if src.Sep != nil || src.Prefix != "" || src.Suffix != "" {
+			errs = append(errs, fmt.Errorf("source %s: a Config source has no separator, prefix or suffix of its own; use RunPermutatorFast", src.Path))
+		}
+	}
+	if err := errors.Join(append(errs, Validate(cfg.Sources, opts))...); err != nil {
+		return nil, err
+	}
+	allItems, srcOfItem, srcDepths, err := loadWrittenSources(cfg.Sources, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Permutator{allItems: allItems, srcOfItem: srcOfItem, srcDepths: srcDepths, opts: opts.withSources(cfg.Sources)}, nil
+}
+
+// Generate writes every line of cfg to w, one per line.
+func Generate(cfg Config, w io.Writer) error {
+	p, err := New(cfg)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriterSize(w, 64*1024)
+	p.Output = writeLines(bw)
+	p.Generate()
+	return bw.Flush()
+}
+
+// Generate calls Output with every line, in sequential generation order: for
+// each item in order, the sequences it starts, depth first.
+func (p *Permutator) Generate() {
+	output := p.Output
+	if output == nil {
+		bw := bufio.NewWriterSize(p.opts.stdout(), 64*1024)
+		defer bw.Flush()
+		output = writeLines(bw)
+	}
+	newPermutatorFor(p.allItems, p.srcOfItem, p.srcDepths, p.opts, output).generate()
+}
+
+// Count returns the number of lines Generate writes, without generating
+// them.
+func (p *Permutator) Count() *big.Int {
+	total := big.NewInt(0)
+	for _, cnt := range countByDepth(p.allItems, p.srcOfItem, p.srcDepths, p.opts) {
+		total.Add(total, cnt)
+	}
+	return total
+}
@@ -0,0 +1,29 @@
+package alchemy
+
+import (
+	"fmt"
+	"math/big"
+)
+
+// ParseCountAssert parses the expected -count-assert value. Counts routinely
+// exceed 64 bits, so any non-negative decimal integer is accepted.
+func ParseCountAssert(s string) (*big.Int, error) {
+	want, ok := new(big.Int).SetString(s, 10)
+	if !ok || want.Sign() < 0 {
+		return nil, fmt.Errorf("count %q is not a non-negative integer", s)
+	}
+	return want, nil
+}
+
+// AssertCount computes the output line count and returns an error naming the
+// expected and actual values unless it equals want.
+func AssertCount(sources []Source, opts Options, want *big.Int) error {
+	got, err := CalculateOutputLines(sources, opts)
+	if err != nil {
+		return err
+	}
+	if got.Cmp(want) != 0 {
+		return fmt.Errorf("count assertion failed: expected %s lines, got %s", want, got)
+	}
+	return nil
+}
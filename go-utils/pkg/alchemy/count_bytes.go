@@ -0,0 +1,489 @@
+package alchemy
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// ErrBytesUnavailable reports a configuration whose output size cannot be
+// computed without generating it.
+var ErrBytesUnavailable = errors.New("byte size unavailable")
+
+// CalculateOutputBytes returns the exact size of the output in bytes,
+// newlines included, without enumerating it. It is the text written before
+// -output-encoding, -format json and -compress. Configurations whose line
+// lengths cannot be summed ahead (-rules, -leet, or -mutate-case over
+// non-ASCII text) return an error wrapping errBytesUnavailable.
+func CalculateOutputBytes(sources []Source, opts Options) (*big.Int, error) {
+	if opts.Rules != nil {
+		return nil, fmt.Errorf("%w: -rules changes line lengths", ErrBytesUnavailable)
+	}
+	if opts.Leet != "" {
+		return nil, fmt.Errorf("%w: -leet writes a varying number of variants per line", ErrBytesUnavailable)
+	}
+	// Lengths are those of the items as written.
+	allItems, srcOfItem, srcDepths, err := loadWrittenSources(sources, opts)
+	if err != nil {
+		return nil, err
+	}
+	opts = opts.withSources(sources)
+	if opts.MutateCase != "" && !opts.asciiOnly(allItems) {
+		return nil, fmt.Errorf("%w: -mutate-case may change the length of non-ASCII text", ErrBytesUnavailable)
+	}
+	if len(allItems) == 0 || len(opts.Seps) == 0 {
+		return big.NewInt(0), nil
+	}
+
+	s := &byteSizer{opts: opts, srcOfItem: srcOfItem, srcDepths: srcDepths, fixed: int64(len(opts.Prefix) + len(opts.Suffix))}
+	s.lens = make([]int64, len(allItems))
+	for i, item := range allItems {
+		s.lens[i] = int64(len(item))
+	}
+	for _, sep := range opts.Seps {
+		s.sepLens += int64(len(sep))
+	}
+
+	var lines, text *big.Int
+	switch {
+	case opts.Slots:
+		lines, text = s.slotBytes()
+	case opts.srcAffixes != nil && (opts.Combinations || opts.NoConsecutiveSource || len(opts.MinFrom) > 0):
+		return nil, fmt.Errorf("%w: per-source prefix= and suffix= with -combinations, -no-consecutive-source or -min-from", ErrBytesUnavailable)
+	case opts.Combinations:
+		lines, text = s.combinationBytes()
+	case opts.NoConsecutiveSource || len(opts.MinFrom) > 0:
+		lines, text = s.transitionBytes()
+	default:
+		lines, text = s.sequenceBytes()
+	}
+
+	// Every line is written once per incremental suffix, then once per case.
+	suffixes, suffixBytes := big.NewInt(1), big.NewInt(0)
+	if opts.Incremental != "" {
+		suffixes = incrementalCardinality(opts.Incremental, opts.IncrementalMax)
+		suffixBytes = incrementalBytes(opts.Incremental, opts.IncrementalMax)
+	}
+	total := new(big.Int).Mul(text, suffixes)
+	total.Add(total, new(big.Int).Mul(lines, suffixBytes))
+	total.Add(total, new(big.Int).Mul(lines, suffixes)) // newlines
+	if opts.MutateCase != "" {
+		total.Mul(total, big.NewInt(int64(len(strings.Split(opts.MutateCase, ",")))))
+	}
+	return total, nil
+}
+
+// asciiOnly reports whether every piece of text a line is made of is ASCII,
+// so that changing its case keeps its length.
+func (o Options) asciiOnly(items []string) bool {
+	parts := append([]string{o.Prefix, o.Suffix, o.Incremental}, o.Seps...)
+	parts = append(parts, o.Gaps...)
+	for _, a := range o.srcAffixes {
+		parts = append(parts, a.prefix, a.suffix)
+	}
+	for _, s := range append(parts, items...) {
+		for i := 0; i < len(s); i++ {
+			if s[i] >= 0x80 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// incrementalBytes returns the summed length of every incremental suffix:
+// the strings of length k over c characters of b bytes in all hold
+// k*c^(k-1)*b bytes.
+func incrementalBytes(charset string, maxLen int) *big.Int {
+	chars := []rune(charset)
+	c := big.NewInt(int64(len(chars)))
+	b := big.NewInt(int64(len(string(chars))))
+	total := big.NewInt(0)
+	power := big.NewInt(1) // c^(k-1)
+	for k := 1; k <= maxLen && len(chars) > 0; k++ {
+		term := new(big.Int).Mul(power, b)
+		total.Add(total, term.Mul(term, big.NewInt(int64(k))))
+		power.Mul(power, c)
+	}
+	return total
+}
+
+// byteSizer sums the lengths of the lines a configuration generates, before
+// the incremental and case fan-outs: lines counts them and text sums their
+// lengths, newlines excluded.
+type byteSizer struct {
+	opts      Options
+	srcOfItem []int
+	srcDepths []int
+	lens      []int64 // byte length of every item as written
+	fixed     int64   // bytes of -prefix and -suffix
+	sepLens   int64   // bytes of all -sep values together
+}
+
+// affixLens returns the per-source prefix and suffix lengths of item i.
+func (s *byteSizer) affixLens(i int) (prefix, suffix int64) {
+	if s.opts.srcAffixes == nil {
+		return 0, 0
+	}
+	a := s.opts.srcAffixes[s.srcOfItem[i]]
+	return int64(len(a.prefix)), int64(len(a.suffix))
+}
+
+// itemSet sums item values over a set of items: their number, their
+// lengths, their sources' suffix lengths and their sources' separator
+// lengths.
+type itemSet struct {
+	n, lens, suffixes, seps int64
+}
+
+func (a itemSet) add(b itemSet) itemSet {
+	return itemSet{a.n + b.n, a.lens + b.lens, a.suffixes + b.suffixes, a.seps + b.seps}
+}
+
+func (a itemSet) sub(b itemSet) itemSet {
+	return itemSet{a.n - b.n, a.lens - b.lens, a.suffixes - b.suffixes, a.seps - b.seps}
+}
+
+func (s *byteSizer) item(i int) itemSet {
+	_, suffix := s.affixLens(i)
+	var sep int64
+	if s.opts.srcSeps != nil {
+		if own := s.opts.srcSeps[s.srcOfItem[i]]; own != nil {
+			sep = int64(len(*own))
+		}
+	}
+	return itemSet{1, s.lens[i], suffix, sep}
+}
+
+// sequenceBytes covers the plain sequences counted by countByDepthFrom,
+// per-source separators and affixes included. For a start item and a
+// length l, the l-1 following items are drawn from a set Q of m items (Q
+// excluding the start item under -no-repeats), and over all those tails
+// each position holds every item of Q equally often: the tails number
+// N = m^(l-1) (or m!/(m-l+1)!), and the items of one position sum to
+// N/m times the sum over Q. Lines whose following items all bring their own
+// separator are written once instead of once per -sep, so those tails (drawn
+// from the scoped items only) are summed apart.
+func (s *byteSizer) sequenceBytes() (lines, text *big.Int) {
+	opts := s.opts
+	lines, text = big.NewInt(0), big.NewInt(0)
+	k := big.NewInt(int64(len(opts.Seps)))
+
+	// Sums over the whole pool, or per source for -no-cross-source; scoped
+	// only those items with their own separator.
+	all := make([]itemSet, len(s.srcDepths))
+	scoped := make([]itemSet, len(s.srcDepths))
+	var allPool, scopedPool itemSet
+	for i, src := range s.srcOfItem {
+		v := s.item(i)
+		all[src] = all[src].add(v)
+		allPool = allPool.add(v)
+		if opts.srcSeps != nil && opts.srcSeps[src] != nil {
+			scoped[src] = scoped[src].add(v)
+			scopedPool = scopedPool.add(v)
+		}
+	}
+
+	// perItem returns in how many tails of l-1 items over q a given item of
+	// q holds a given position.
+	perItem := func(q itemSet, l int) *big.Int {
+		if opts.NoRepeats {
+			return fallingOrPow(q.n-1, l-2, true)
+		}
+		return fallingOrPow(q.n, l-2, false)
+	}
+	// bare returns, over all tails of l-1 items over q, the bytes of a line
+	// without separators: the start, the following items and the suffix of
+	// the last one.
+	bare := func(q itemSet, l int, base *big.Int) *big.Int {
+		per := perItem(q, l)
+		t := new(big.Int).Mul(fallingOrPow(q.n, l-1, opts.NoRepeats), base)
+		t.Add(t, new(big.Int).Mul(per, big.NewInt(q.lens*int64(l-1))))
+		return t.Add(t, new(big.Int).Mul(per, big.NewInt(q.suffixes)))
+	}
+	// ownSeps returns the bytes of the items' own separators over all tails.
+	ownSeps := func(q itemSet, l int) *big.Int {
+		return new(big.Int).Mul(perItem(q, l), big.NewInt(q.seps*int64(l-1)))
+	}
+
+	for i, src := range s.srcOfItem {
+		pool, scopedSet := allPool, scopedPool
+		if opts.NoCrossSource {
+			pool, scopedSet = all[src], scoped[src]
+		}
+		own := s.item(i)
+		if opts.NoRepeats {
+			pool = pool.sub(own)
+			if opts.srcSeps != nil && opts.srcSeps[src] != nil {
+				scopedSet = scopedSet.sub(own)
+			}
+		}
+		prefix, suffix := s.affixLens(i)
+		base := big.NewInt(s.fixed + s.lens[i] + prefix)
+		for l := opts.minDepthOf(src); l <= s.srcDepths[src]; l++ {
+			if l == 1 {
+				lines.Add(lines, big.NewInt(1))
+				text.Add(text, new(big.Int).Add(base, big.NewInt(suffix)))
+				continue
+			}
+			// Tails of scoped items only are written once, the others once
+			// per -sep.
+			tails := fallingOrPow(pool.n, l-1, opts.NoRepeats)
+			once := fallingOrPow(scopedSet.n, l-1, opts.NoRepeats)
+			multi := new(big.Int).Sub(tails, once)
+			lines.Add(lines, new(big.Int).Mul(multi, k))
+			lines.Add(lines, once)
+
+			t := new(big.Int).Sub(bare(pool, l, base), bare(scopedSet, l, base))
+			t.Sub(t, ownSeps(scopedSet, l))
+			t.Add(t, ownSeps(pool, l))
+			text.Add(text, t.Mul(t, k))
+			text.Add(text, bare(scopedSet, l, base))
+			text.Add(text, ownSeps(scopedSet, l))
+			// Positions holding an unscoped item write each -sep once.
+			unscoped := new(big.Int).Mul(perItem(pool, l), big.NewInt((pool.n-scopedSet.n)*int64(l-1)))
+			text.Add(text, unscoped.Mul(unscoped, big.NewInt(s.sepLens)))
+		}
+	}
+	return lines, text
+}
+
+// fallingOrPow returns n^r, or n!/(n-r)! when falling; zero for r < 0 or
+// n < r (falling).
+func fallingOrPow(n int64, r int, falling bool) *big.Int {
+	if r < 0 || n < 0 || (falling && n < int64(r)) {
+		return big.NewInt(0)
+	}
+	res := big.NewInt(1)
+	for i := 0; i < r; i++ {
+		f := n
+		if falling {
+			f = n - int64(i)
+		}
+		res.Mul(res, big.NewInt(f))
+	}
+	return res
+}
+
+// slotBytes covers -slot, -template and -product lines: every combination
+// of one item per slot, each slot's items appearing with every combination
+// of the other slots.
+func (s *byteSizer) slotBytes() (lines, text *big.Int) {
+	slots := len(s.srcDepths)
+	sizes := make([]int64, slots)
+	sums := make([]int64, slots)
+	for i, src := range s.srcOfItem {
+		sizes[src]++
+		sums[src] += s.lens[i]
+	}
+	combos := big.NewInt(1)
+	for _, n := range sizes {
+		combos.Mul(combos, big.NewInt(n))
+	}
+	items := big.NewInt(0)
+	for p := range sizes {
+		others := big.NewInt(sums[p])
+		for q, n := range sizes {
+			if q != p {
+				others.Mul(others, big.NewInt(n))
+			}
+		}
+		items.Add(items, others)
+	}
+	var fixed int64 = s.fixed
+	if a := s.opts.srcAffixes; a != nil {
+		fixed += int64(len(a[0].prefix) + len(a[slots-1].suffix))
+	}
+
+	lines, text = big.NewInt(0), big.NewInt(0)
+	for _, sep := range lineSeps(s.opts.Seps, slots) {
+		gaps := int64(0)
+		for p := 1; p < slots; p++ {
+			if s.opts.Gaps != nil {
+				gaps += int64(len(templateGap(s.opts.Gaps[p-1], sep)))
+			} else {
+				gaps += int64(len(sep))
+			}
+		}
+		lines.Add(lines, combos)
+		text.Add(text, new(big.Int).Mul(combos, big.NewInt(fixed+gaps)))
+		text.Add(text, items)
+	}
+	return lines, text
+}
+
+// combinationBytes covers -combinations: after a start item, the l-1
+// following items are a subset of the a items loaded after it (or, with
+// repeats, a multiset over those and the start item itself, m = a+1 of
+// them). Over all subsets each item appears C(a-1, l-2) times; over all
+// multisets C(m+l-2, l-2) times.
+func (s *byteSizer) combinationBytes() (lines, text *big.Int) {
+	opts := s.opts
+	k := big.NewInt(int64(len(opts.Seps)))
+	n := len(s.srcOfItem)
+	// after[i] sums the pool items loaded after i: the whole pool, or the
+	// rest of its source under -no-cross-source (sources are contiguous).
+	afterN := make([]int64, n)
+	afterLens := make([]int64, n)
+	var runN, runLens int64
+	for i := n - 1; i >= 0; i-- {
+		if opts.NoCrossSource && i+1 < n && s.srcOfItem[i+1] != s.srcOfItem[i] {
+			runN, runLens = 0, 0
+		}
+		afterN[i], afterLens[i] = runN, runLens
+		runN++
+		runLens += s.lens[i]
+	}
+
+	lines, text = big.NewInt(0), big.NewInt(0)
+	for i, src := range s.srcOfItem {
+		base := big.NewInt(s.fixed + s.lens[i])
+		for l := opts.minDepthOf(src); l <= s.srcDepths[src]; l++ {
+			if l == 1 {
+				lines.Add(lines, big.NewInt(1))
+				text.Add(text, base)
+				continue
+			}
+			var tails, each *big.Int
+			sum := afterLens[i]
+			if opts.NoRepeats {
+				tails = new(big.Int).Binomial(afterN[i], int64(l-1))
+				each = binomialOrZero(afterN[i]-1, int64(l-2))
+			} else {
+				m := afterN[i] + 1
+				tails = new(big.Int).Binomial(m+int64(l)-2, int64(l-1))
+				each = binomialOrZero(m+int64(l)-2, int64(l-2))
+				sum += s.lens[i]
+			}
+			t := new(big.Int).Mul(tails, base)
+			t.Add(t, new(big.Int).Mul(each, big.NewInt(sum)))
+			t.Mul(t, k)
+			seps := new(big.Int).Mul(tails, big.NewInt(int64(l-1)*s.sepLens))
+			text.Add(text, t.Add(t, seps))
+			lines.Add(lines, new(big.Int).Mul(tails, k))
+		}
+	}
+	return lines, text
+}
+
+// binomialOrZero returns C(n, r), zero when n < 0 or r < 0.
+func binomialOrZero(n, r int64) *big.Int {
+	if n < 0 || r < 0 || r > n {
+		return big.NewInt(0)
+	}
+	return new(big.Int).Binomial(n, r)
+}
+
+// transitionBytes covers -no-consecutive-source and -min-from, extending the
+// count of countTransitionsByDepth with the summed item lengths. Items of a
+// source are interchangeable there, so over all lines a position drawn from
+// a source holds each of its items equally often: it adds the source's
+// average item length per line.
+func (s *byteSizer) transitionBytes() (lines, text *big.Int) {
+	opts := s.opts
+	k := big.NewInt(int64(len(opts.Seps)))
+	sizes := make([]int, len(s.srcDepths))
+	sums := make([]int64, len(s.srcDepths))
+	for i, src := range s.srcOfItem {
+		sizes[src]++
+		sums[src] += s.lens[i]
+	}
+	c := &transitionSizer{
+		transitionCounter: transitionCounter{sizes: sizes, opts: opts, minFrom: opts.minimums(len(sizes)), memo: map[string]*big.Int{}},
+		sums:              sums,
+		lens:              map[string]*big.Rat{},
+	}
+
+	lines, text = big.NewInt(0), big.NewInt(0)
+	rat := new(big.Rat)
+	for start, size := range sizes {
+		if size == 0 {
+			continue
+		}
+		used := make([]int, len(sizes))
+		used[start] = 1
+		for l := opts.minDepthOf(start); l <= s.srcDepths[start]; l++ {
+			cnt, lens := c.waysLens(start, start, used, l-1)
+			// size start items, each followed by cnt tails.
+			t := new(big.Rat).SetInt(new(big.Int).Mul(cnt, big.NewInt(s.fixed*int64(size)+sums[start])))
+			t.Add(t, new(big.Rat).Mul(lens, new(big.Rat).SetInt64(int64(size))))
+			n := new(big.Int).Mul(cnt, big.NewInt(int64(size)))
+			if l > 1 {
+				t.Mul(t, new(big.Rat).SetInt(k))
+				t.Add(t, new(big.Rat).SetInt(new(big.Int).Mul(n, big.NewInt(int64(l-1)*s.sepLens))))
+				n.Mul(n, k)
+			}
+			rat.Add(rat, t)
+			lines.Add(lines, n)
+		}
+	}
+	// The averages add up to whole bytes over all lines.
+	text.Quo(rat.Num(), rat.Denom())
+	return lines, text
+}
+
+// transitionSizer memoizes, next to the tail counts of transitionCounter,
+// the summed item lengths of those tails.
+type transitionSizer struct {
+	transitionCounter
+	sums []int64
+	lens map[string]*big.Rat
+}
+
+// waysLens returns ways and the total item length over those tails.
+func (c *transitionSizer) waysLens(start, last int, used []int, remaining int) (*big.Int, *big.Rat) {
+	cnt := c.ways(start, last, used, remaining)
+	if remaining == 0 {
+		return cnt, new(big.Rat)
+	}
+	key := c.key(start, last, used, remaining)
+	if v, ok := c.lens[key]; ok {
+		return cnt, v
+	}
+	total := new(big.Rat)
+	for next, size := range c.sizes {
+		if (c.opts.NoConsecutiveSource && next == last) || (c.opts.NoCrossSource && next != start) {
+			continue
+		}
+		choices := size
+		if c.opts.NoRepeats {
+			choices -= used[next]
+		}
+		if choices <= 0 {
+			continue
+		}
+		used[next]++
+		subCnt, subLens := c.waysLens(start, next, used, remaining-1)
+		used[next]--
+		// choices items, each of the source's average length, each followed
+		// by subCnt tails summing subLens.
+		avg := new(big.Rat).SetFrac(big.NewInt(c.sums[next]), big.NewInt(int64(size)))
+		add := new(big.Rat).Mul(avg, new(big.Rat).SetInt(subCnt))
+		add.Add(add, subLens)
+		total.Add(total, add.Mul(add, new(big.Rat).SetInt64(int64(choices))))
+	}
+	c.lens[key] = total
+	return cnt, total
+}
+
+var byteUnits = []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB", "EiB", "ZiB", "YiB"}
+
+// HumanBytes formats n bytes in binary units with one decimal ("87.3 TiB");
+// sizes past YiB fall back to compactCount ("1.23e30 B").
+func HumanBytes(n *big.Int) string {
+	if n.CmpAbs(big.NewInt(1024)) < 0 {
+		return n.String() + " B"
+	}
+	f := new(big.Float).SetInt(n)
+	k := big.NewFloat(1024)
+	unit := 0
+	for unit < len(byteUnits)-1 && new(big.Float).Abs(f).Cmp(k) >= 0 {
+		f.Quo(f, k)
+		unit++
+	}
+	if new(big.Float).Abs(f).Cmp(k) >= 0 {
+		return compactCount(n) + " B"
+	}
+	return f.Text('f', 1) + " " + byteUnits[unit]
+}
@@ -0,0 +1,94 @@
+package alchemy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// CachedOutputLines is CalculateOutputLines memoized on disk under dir. The
+// cache key covers every option that affects the count plus each source's
+// path, size and mtime, so editing a source invalidates its entries.
+func CachedOutputLines(dir string, sources []Source, opts Options) (*big.Int, error) {
+	if opts.LineFilter != nil {
+		// A custom filter cannot be part of the key, so never cache it.
+		return CalculateOutputLines(sources, opts)
+	}
+	for _, src := range sources {
+		if src.Items != nil || IsStdinPath(src.Path) || isMaskPath(src.Path) {
+			// Given items, stdin and masks have no size or mtime to key on.
+			return CalculateOutputLines(sources, opts)
+		}
+	}
+	key, err := countCacheKey(sources, opts)
+	if err != nil {
+		return nil, err
+	}
+	entry := filepath.Join(dir, key+".count")
+
+	if data, err := os.ReadFile(entry); err == nil {
+		if total, ok := new(big.Int).SetString(strings.TrimSpace(string(data)), 10); ok {
+			return total, nil
+		}
+	}
+
+	total, err := CalculateOutputLines(sources, opts)
+	if err != nil {
+		return nil, err
+	}
+	// The cache is best effort: failing to store must not fail the count.
+	if err := os.MkdirAll(dir, 0o755); err == nil {
+		os.WriteFile(entry, []byte(total.String()+"\n"), 0o644)
+	}
+	return total, nil
+}
+
+// countCacheKey hashes the options shaping the output, each source's
+// settings and metadata, and the metadata of the files options read.
+func countCacheKey(sources []Source, opts Options) (string, error) {
+	h := sha256.New()
+	writeOptionsKey(h, opts)
+	for _, src := range sources {
+		abs, info, err := statForKey(src.Path)
+		if err != nil {
+			return "", &SourceOpenError{Path: src.Path, Err: err}
+		}
+		fmt.Fprintf(h, "source=%q:%d-%d:%q size=%d mtime=%d\n", abs, src.MinDepth, src.Depth, src.Transforms, info.Size(), info.ModTime().UnixNano())
+		if src.Sep != nil {
+			fmt.Fprintf(h, "sep=%q\n", *src.Sep)
+		}
+		if src.Prefix != "" || src.Suffix != "" {
+			fmt.Fprintf(h, "affixes=%q:%q\n", src.Prefix, src.Suffix)
+		}
+	}
+	// Options naming files only hash their names; editing one must miss too.
+	files := append([]string{opts.TokenMap, opts.DiffAgainst}, opts.ExcludeFiles...)
+	for _, path := range files {
+		if path == "" {
+			continue
+		}
+		abs, info, err := statForKey(path)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "file=%q size=%d mtime=%d\n", abs, info.Size(), info.ModTime().UnixNano())
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// statForKey resolves path and stats it.
+func statForKey(path string) (string, os.FileInfo, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", nil, fmt.Errorf("resolving %s: %v", path, err)
+	}
+	info, err := os.Stat(abs)
+	if err != nil {
+		return "", nil, err
+	}
+	return abs, info, nil
+}
@@ -0,0 +1,100 @@
+package alchemy
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+)
+
+// countScales names the short-scale powers of 1000 used by the human format.
+var countScales = []string{
+	"", "thousand", "million", "billion", "trillion", "quadrillion",
+	"quintillion", "sextillion", "septillion", "octillion", "nonillion", "decillion",
+}
+
+// FormatCount renders a count as plain digits, human-readable ("1.2
+// quadrillion", falling back to "1.2e45" past the named scales), grouped
+// with thousands separators ("1,234,567") or compact ("1.23e4567").
+func FormatCount(n *big.Int, format string) (string, error) {
+	switch format {
+	case "", "plain":
+		return n.String(), nil
+	case "grouped":
+		return groupDigits(n.String()), nil
+	case "human":
+		return humanCount(n), nil
+	case "compact":
+		return compactCount(n), nil
+	}
+	return "", fmt.Errorf("unknown count format %q (want plain, human, grouped or compact)", format)
+}
+
+func groupDigits(digits string) string {
+	sign := ""
+	if strings.HasPrefix(digits, "-") {
+		sign, digits = "-", digits[1:]
+	}
+	var b strings.Builder
+	for i, d := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			b.WriteByte(',')
+		}
+		b.WriteRune(d)
+	}
+	return sign + b.String()
+}
+
+func humanCount(n *big.Int) string {
+	if n.CmpAbs(big.NewInt(1000)) < 0 {
+		return n.String()
+	}
+	exp := len(new(big.Int).Abs(n).String()) - 1
+	group := exp / 3
+	mantissa := scaledMantissa(n, group*3)
+	if mantissa == "1000.0" || mantissa == "-1000.0" {
+		// Rounding carried into the next scale.
+		group++
+		mantissa = scaledMantissa(n, group*3)
+	}
+	if group < len(countScales) {
+		return mantissa + " " + countScales[group]
+	}
+	return scaledMantissa(n, exp) + fmt.Sprintf("e%d", exp)
+}
+
+// scaledMantissa formats n / 10^exp with one decimal.
+func scaledMantissa(n *big.Int, exp int) string {
+	f := new(big.Float).SetInt(n)
+	f.Quo(f, new(big.Float).SetInt(new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(exp)), nil)))
+	return f.Text('f', 1)
+}
+
+// compactCount formats n as a three-digit mantissa and a decimal exponent
+// ("1.23e4567"). Unlike the other formats it never converts n to decimal:
+// the exponent is derived from the binary one, so counts with millions of
+// digits print instantly. Values below 1000 are printed exactly.
+func compactCount(n *big.Int) string {
+	if n.CmpAbs(big.NewInt(1000)) < 0 {
+		return n.String()
+	}
+	sign := ""
+	if n.Sign() < 0 {
+		sign = "-"
+	}
+	// |n| = frac * 2^exp2 with frac in [0.5, 1).
+	frac := new(big.Float).SetInt(n)
+	frac.Abs(frac)
+	exp2 := frac.MantExp(frac)
+	f, _ := frac.Float64()
+	log10 := math.Log10(f) + float64(exp2)*math.Log10(2)
+
+	exp := math.Floor(log10)
+	mantissa := math.Pow(10, log10-exp)
+	if math.Round(mantissa*100) >= 1000 {
+		// Rounding carried into the next power of ten.
+		mantissa /= 10
+		exp++
+	}
+	return fmt.Sprintf("%s%.2fe%d", sign, mantissa, int64(exp))
+}
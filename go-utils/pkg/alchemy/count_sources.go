@@ -0,0 +1,115 @@
+package alchemy
+
+import (
+	"fmt"
+	"io"
+	"math/big"
+	"path/filepath"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// SourceCount is one source's share of the output: the lines starting with
+// one of its items, and how long counting them took.
+type SourceCount struct {
+	Source  Source
+	Items   int
+	Count   *big.Int
+	Elapsed time.Duration
+}
+
+// CalculateOutputLinesBySource counts, concurrently, the lines started by each
+// source. The counts add up to CalculateOutputLines.
+func CalculateOutputLinesBySource(sources []Source, opts Options) ([]SourceCount, error) {
+	allItems, srcOfItem, srcDepths, err := loadWrittenSources(sources, opts)
+	if err != nil {
+		return nil, err
+	}
+	opts = opts.withSources(sources)
+
+	counts := make([]SourceCount, len(sources))
+	for _, src := range srcOfItem {
+		counts[src].Items++
+	}
+
+	var wg sync.WaitGroup
+	for i := range sources {
+		wg.Add(1)
+		go func(src int) {
+			defer wg.Done()
+			start := time.Now()
+			total := big.NewInt(0)
+			for _, cnt := range countByDepthFrom(allItems, srcOfItem, srcDepths, opts, src) {
+				total.Add(total, cnt)
+			}
+			counts[src].Source = sources[src]
+			counts[src].Count = total
+			counts[src].Elapsed = time.Since(start)
+		}(i)
+	}
+	wg.Wait()
+	return counts, nil
+}
+
+// PrintSourceCounts writes the per-source counts as an aligned table.
+func PrintSourceCounts(w io.Writer, counts []SourceCount) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SOURCE\tDEPTH\tITEMS\tLINES\tTIME")
+	total := big.NewInt(0)
+	for _, c := range counts {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%v\n", c.Source.Path, c.Source.Depth, c.Items, c.Count, c.Elapsed)
+		total.Add(total, c.Count)
+	}
+	fmt.Fprintf(tw, "total\t\t\t%s\t\n", total)
+	tw.Flush()
+}
+
+// SourceSummary describes one source as loaded: where it resolved to and how
+// many items survived the load-time filters.
+type SourceSummary struct {
+	Source   Source
+	Resolved string // absolute path
+	Items    int
+}
+
+// SummarizeSources runs only the loaders and reports each source's final item
+// count.
+func SummarizeSources(sources []Source, opts Options) ([]SourceSummary, error) {
+	_, srcOfItem, _, err := loadSources(sources, opts)
+	if err != nil {
+		return nil, err
+	}
+	summaries := make([]SourceSummary, len(sources))
+	for i, src := range sources {
+		resolved, err := filepath.Abs(src.Path)
+		if err != nil {
+			resolved = src.Path
+		}
+		if src.Items != nil {
+			resolved = "(items)"
+		} else if IsStdinPath(src.Path) {
+			resolved = "(stdin)"
+		} else if isMaskPath(src.Path) {
+			resolved = src.Path
+		}
+		summaries[i] = SourceSummary{Source: src, Resolved: resolved}
+	}
+	for _, src := range srcOfItem {
+		summaries[src].Items++
+	}
+	return summaries, nil
+}
+
+// PrintSourceSummaries writes the loaded sources as an aligned table.
+func PrintSourceSummaries(w io.Writer, summaries []SourceSummary) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SOURCE\tPATH\tDEPTH\tITEMS")
+	total := 0
+	for _, s := range summaries {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\n", s.Source.Path, s.Resolved, s.Source.Depth, s.Items)
+		total += s.Items
+	}
+	fmt.Fprintf(tw, "total\t\t\t%d\n", total)
+	tw.Flush()
+}
@@ -0,0 +1,111 @@
+package alchemy
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// countTransitionsByDepth counts lines per length when adjacent items must
+// come from different sources, or when -min-from requires items from given
+// sources. Only the last source and how many items of each source are already
+// used matter, so sequences are counted by memoizing over that state instead
+// of enumerating them. A non-negative from restricts the count to lines
+// starting in that source.
+func countTransitionsByDepth(srcOfItem []int, srcDepths []int, opts Options, from int) []*big.Int {
+	maxDepth := 0
+	for _, d := range srcDepths {
+		maxDepth = max(maxDepth, d)
+	}
+	byDepth := make([]*big.Int, maxDepth)
+	for l := range byDepth {
+		byDepth[l] = big.NewInt(0)
+	}
+
+	sizes := make([]int, len(srcDepths))
+	for _, src := range srcOfItem {
+		sizes[src]++
+	}
+
+	sepFactor, singleFactor := opts.lineFactors()
+
+	c := &transitionCounter{sizes: sizes, opts: opts, minFrom: opts.minimums(len(sizes)), memo: map[string]*big.Int{}}
+	for start, size := range sizes {
+		if size == 0 || (from >= 0 && start != from) {
+			continue
+		}
+		used := make([]int, len(sizes))
+		used[start] = 1
+		for l := opts.minDepthOf(start); l <= srcDepths[start]; l++ {
+			cnt := c.ways(start, start, used, l-1)
+			cnt = new(big.Int).Mul(cnt, big.NewInt(int64(size)))
+			if l == 1 {
+				cnt.Mul(cnt, singleFactor)
+			} else {
+				cnt.Mul(cnt, sepFactor)
+			}
+			byDepth[l-1].Add(byDepth[l-1], cnt)
+		}
+	}
+	return byDepth
+}
+
+type transitionCounter struct {
+	sizes   []int
+	opts    Options
+	minFrom sourceMinimums
+	memo    map[string]*big.Int
+}
+
+// ways returns how many ways remaining more items can follow an item of
+// source last in a sequence that started in source start.
+func (c *transitionCounter) ways(start, last int, used []int, remaining int) *big.Int {
+	if remaining == 0 {
+		if c.minFrom != nil && !c.minFrom.satisfied(used) {
+			return big.NewInt(0)
+		}
+		return big.NewInt(1)
+	}
+	key := c.key(start, last, used, remaining)
+	if v, ok := c.memo[key]; ok {
+		return v
+	}
+
+	total := big.NewInt(0)
+	for next, size := range c.sizes {
+		if (c.opts.NoConsecutiveSource && next == last) || (c.opts.NoCrossSource && next != start) {
+			continue
+		}
+		choices := size
+		if c.opts.NoRepeats {
+			choices -= used[next]
+		}
+		if choices <= 0 {
+			continue
+		}
+		used[next]++
+		sub := c.ways(start, next, used, remaining-1)
+		used[next]--
+		total.Add(total, new(big.Int).Mul(sub, big.NewInt(int64(choices))))
+	}
+	c.memo[key] = total
+	return total
+}
+
+func (c *transitionCounter) key(start, last int, used []int, remaining int) string {
+	if !c.opts.NoCrossSource {
+		start = -1 // the start source only matters when it restricts the next one
+	}
+	var b strings.Builder
+	if !c.opts.NoConsecutiveSource {
+		last = -1 // likewise for the last source without -no-consecutive-source
+	}
+	fmt.Fprintf(&b, "%d/%d/%d", start, last, remaining)
+	if c.opts.NoRepeats || c.minFrom != nil {
+		// Usage only affects the count under -no-repeats or -min-from.
+		for _, u := range used {
+			fmt.Fprintf(&b, ",%d", u)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,26 @@
+package alchemy
+
+// dedupItems keeps one copy of every item (-dedup-input): the one loaded by
+// the source with the greatest depth, the first of them on ties, so merging
+// never shortens the sequences an item can start. It returns the remaining
+// items in load order and how many copies were dropped.
+func dedupItems(allItems []string, srcOfItem, srcDepths []int) ([]string, []int, int) {
+	kept := make(map[string]int, len(allItems)) // item -> index of the copy kept
+	for i, item := range allItems {
+		if k, ok := kept[item]; !ok || srcDepths[srcOfItem[i]] > srcDepths[srcOfItem[k]] {
+			kept[item] = i
+		}
+	}
+	if len(kept) == len(allItems) {
+		return allItems, srcOfItem, 0
+	}
+	items := make([]string, 0, len(kept))
+	srcs := make([]int, 0, len(kept))
+	for i, item := range allItems {
+		if kept[item] == i {
+			items = append(items, item)
+			srcs = append(srcs, srcOfItem[i])
+		}
+	}
+	return items, srcs, len(allItems) - len(items)
+}
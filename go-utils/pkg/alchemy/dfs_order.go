@@ -0,0 +1,60 @@
+package alchemy
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+// candidateOrder returns the order in which item indices 0..n-1 are tried as
+// first and next items during generation: ascending for "forward" (or ""),
+// descending for "reverse", and a permutation drawn from seed for "random".
+// The same order is used at every step, so a run is reproducible from its
+// seed.
+func candidateOrder(n int, order string, seed int64) ([]int, error) {
+	switch order {
+	case "", "forward":
+		idx := make([]int, n)
+		for i := range idx {
+			idx[i] = i
+		}
+		return idx, nil
+	case "reverse":
+		idx := make([]int, n)
+		for i := range idx {
+			idx[i] = n - 1 - i
+		}
+		return idx, nil
+	case "random":
+		return rand.New(rand.NewSource(seed)).Perm(n), nil
+	}
+	return nil, fmt.Errorf("unknown dfs order %q (want forward, reverse or random)", order)
+}
+
+// startOrder returns the order in which first items are started. It is the
+// candidate order, except that -reverse-sources moves the last source's items
+// to the front, then the previous source's, keeping the candidate order within
+// each source.
+func (o Options) startOrder(order, srcOfItem []int, sources int) []int {
+	if o.Slots {
+		// Every line starts in the first slot.
+		starts := make([]int, 0, len(order))
+		for _, i := range order {
+			if srcOfItem[i] == 0 {
+				starts = append(starts, i)
+			}
+		}
+		return starts
+	}
+	if !o.ReverseSources {
+		return order
+	}
+	starts := make([]int, 0, len(order))
+	for src := sources - 1; src >= 0; src-- {
+		for _, i := range order {
+			if srcOfItem[i] == src {
+				starts = append(starts, i)
+			}
+		}
+	}
+	return starts
+}
@@ -0,0 +1,61 @@
+package alchemy
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// ErrInvalidDepth is wrapped by a SourceParseError whose depth is not a
+// positive integer.
+var ErrInvalidDepth = errors.New("depth must be a positive integer")
+
+// SourceParseError reports a -source value that is not in file:depth format
+// or carries an invalid option.
+type SourceParseError struct {
+	Value string // the -source value as given
+	Path  string // the file part, when one could be split off
+	Err   error
+}
+
+func (e *SourceParseError) Error() string {
+	if e.Path == "" {
+		return "source must be in format file:depth"
+	}
+	var numErr *strconv.NumError
+	if errors.As(e.Err, &numErr) || errors.Is(e.Err, ErrInvalidDepth) {
+		return "invalid depth in source"
+	}
+	return fmt.Sprintf("invalid source %s: %v", e.Value, e.Err)
+}
+
+func (e *SourceParseError) Unwrap() error { return e.Err }
+
+// SourceOpenError reports a source file that could not be opened.
+type SourceOpenError struct {
+	Path string
+	Err  error
+}
+
+func (e *SourceOpenError) Error() string {
+	return fmt.Sprintf("opening %s: %v", e.Path, e.Err)
+}
+
+func (e *SourceOpenError) Unwrap() error { return e.Err }
+
+// SourceReadError reports a source that failed while being read, after
+// Retries rescans.
+type SourceReadError struct {
+	Path    string
+	Retries int
+	Err     error
+}
+
+func (e *SourceReadError) Error() string {
+	if e.Retries > 0 {
+		return fmt.Sprintf("reading %s after %d retries: %v", e.Path, e.Retries, e.Err)
+	}
+	return fmt.Sprintf("reading %s: %v", e.Path, e.Err)
+}
+
+func (e *SourceReadError) Unwrap() error { return e.Err }
@@ -0,0 +1,86 @@
+package alchemy
+
+import (
+	"bufio"
+	"cmp"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"slices"
+)
+
+// lineHash is the 128-bit FNV-1a hash of a line.
+type lineHash [2]uint64
+
+func hashLine(line string) lineHash {
+	h := fnv.New128a()
+	io.WriteString(h, line)
+	sum := h.Sum(nil)
+	var lh lineHash
+	for i := 0; i < 8; i++ {
+		lh[0] = lh[0]<<8 | uint64(sum[i])
+		lh[1] = lh[1]<<8 | uint64(sum[8+i])
+	}
+	return lh
+}
+
+// lineHashSet holds the lines of -exclude-file and -diff-against lists as
+// sorted 128-bit hashes: 16 bytes per line however long the lines are, so
+// lists of hundreds of millions of lines fit in RAM. Two different lines
+// sharing a hash, and a candidate being wrongly suppressed, is negligible
+// (about n*m/2^128 for n listed lines and m candidates).
+type lineHashSet []lineHash
+
+// loadLineHashes reads every line of the files at paths, decompressing
+// .gz, .zst and .bz2 ones like sources.
+func loadLineHashes(paths []string) (lineHashSet, error) {
+	var set lineHashSet
+	for _, path := range paths {
+		if err := set.addFile(path); err != nil {
+			return nil, err
+		}
+	}
+	slices.SortFunc(set, compareLineHashes)
+	return slices.Compact(set), nil
+}
+
+func (s *lineHashSet) addFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("opening %s: %v", path, err)
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	dec, err := newDecompressor(path, f)
+	if err != nil {
+		return fmt.Errorf("reading %s: %v", path, err)
+	}
+	if dec != nil {
+		defer dec.Close()
+		r = dec
+	}
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		*s = append(*s, hashLine(sc.Text()))
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("reading %s: %v", path, err)
+	}
+	return nil
+}
+
+// contains reports whether line is (by its hash) in the set.
+func (s lineHashSet) contains(line string) bool {
+	_, found := slices.BinarySearchFunc(s, hashLine(line), compareLineHashes)
+	return found
+}
+
+func compareLineHashes(a, b lineHash) int {
+	if c := cmp.Compare(a[0], b[0]); c != 0 {
+		return c
+	}
+	return cmp.Compare(a[1], b[1])
+}
@@ -0,0 +1,256 @@
+package alchemy
+
+import (
+	"fmt"
+	"io"
+	"math/big"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// outputGate applies the emit-time checks to every finished line. Its state
+// is unsynchronized: PermutatorFast consults it with the writer lock held and
+// the sequential permutator from a single goroutine.
+type outputGate struct {
+	seen            map[string]struct{} // lines emitted so far (-fail-on-duplicate, -limit-unique, -unique)
+	failOnDuplicate bool
+	unique          bool         // drop repeated lines
+	bloom           *bloomFilter // approximate seen-set of -unique-bloom (nil = exact)
+	limitUnique     int          // stop after this many distinct lines (0 = no limit)
+	distinct        int          // lines let through by bloom, counted toward limitUnique
+	exclude         lineHashSet  // lines of previous runs (-exclude-file, -diff-against)
+
+	exactMax int                          // distinct lines -unique tracks exactly before spilling into bloom (0 = no limit)
+	spill    func() (*bloomFilter, error) // creates the bloom filter once exactMax is reached
+	repeats  int                          // repeated lines dropped by -unique
+
+	shard, shards int // keep only lines hashing to shard of shards (-hash-shard)
+
+	minLen, maxLen int    // rune length bounds of a written line (maxLen 0 = none)
+	excludeChars   string // characters a written line must not contain
+
+	match, excludeMatch []*regexp.Regexp // expressions a written line must all match / must not match
+
+	skip, limit int // drop the first skip passing lines, stop after limit (0 = none)
+	skipped     int
+	written     int
+
+	err  error  // first failure; once set, nothing else is emitted
+	done bool   // -limit-unique or -limit reached; nothing else is emitted
+	stop func() // halts the running generation on failure or completion
+}
+
+// newOutputGate returns the gate for opts, or nil when no emit-time check is
+// enabled. A nil gate allows everything.
+func newOutputGate(opts Options) (*outputGate, error) {
+	if !opts.FailOnDuplicate && opts.LimitUnique == 0 && opts.DiffAgainst == "" && len(opts.ExcludeFiles) == 0 && opts.HashShard == "" &&
+		opts.MinLen == 0 && opts.MaxLen == 0 && opts.ExcludeChars == "" && opts.Skip == 0 && opts.Limit == 0 &&
+		!opts.Unique && opts.UniqueBloom == 0 && len(opts.Match) == 0 && len(opts.ExcludeMatch) == 0 {
+		return nil, nil
+	}
+	g := &outputGate{
+		failOnDuplicate: opts.FailOnDuplicate,
+		unique:          opts.Unique || opts.UniqueBloom > 0,
+		limitUnique:     opts.LimitUnique,
+		minLen:          opts.MinLen,
+		maxLen:          opts.MaxLen,
+		excludeChars:    opts.ExcludeChars,
+		skip:            opts.Skip,
+		limit:           opts.Limit,
+		exactMax:        opts.UniqueExactMax,
+	}
+	if opts.HashShard != "" {
+		shard, shards, err := parseHashShard(opts.HashShard)
+		if err != nil {
+			return nil, fmt.Errorf("-hash-shard: %v", err)
+		}
+		g.shard, g.shards = shard, shards
+	}
+	var err error
+	if g.match, err = compilePatterns(opts.Match); err != nil {
+		return nil, fmt.Errorf("-match: %v", err)
+	}
+	if g.excludeMatch, err = compilePatterns(opts.ExcludeMatch); err != nil {
+		return nil, fmt.Errorf("-exclude-match: %v", err)
+	}
+	// -unique-bloom replaces the exact set unless another check needs it;
+	// -limit-unique then counts the lines it lets through.
+	if opts.FailOnDuplicate || opts.UniqueExactMax > 0 || (opts.UniqueBloom == 0 && (opts.Unique || opts.LimitUnique > 0)) {
+		g.seen = make(map[string]struct{})
+	}
+	if excludes := opts.excludeLists(); excludes != nil {
+		if g.exclude, err = loadLineHashes(excludes); err != nil {
+			return nil, err
+		}
+	}
+	return g, nil
+}
+
+// newSizedOutputGate is newOutputGate with the -unique-bloom filter sized
+// for every line the loaded items can produce, bounded by -skip and -limit.
+func newSizedOutputGate(allItems []string, srcOfItem, srcDepths []int, opts Options) (*outputGate, error) {
+	g, err := newOutputGate(opts)
+	if err != nil || opts.UniqueBloom == 0 {
+		return g, err
+	}
+	expected := big.NewInt(0)
+	for _, cnt := range countByDepth(allItems, srcOfItem, srcDepths, opts) {
+		expected.Add(expected, cnt)
+	}
+	if opts.Limit > 0 {
+		if bound := big.NewInt(int64(opts.Skip + opts.Limit)); bound.Cmp(expected) < 0 {
+			expected = bound
+		}
+	}
+	if opts.UniqueExactMax > 0 {
+		g.spill = func() (*bloomFilter, error) { return newBloomFilter(expected, opts.UniqueBloom) }
+	} else if g.bloom, err = newBloomFilter(expected, opts.UniqueBloom); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// excludeLists returns the files of already tried lines: every -exclude-file,
+// then -diff-against (nil = none).
+func (o Options) excludeLists() []string {
+	paths := slices.Clone(o.ExcludeFiles)
+	if o.DiffAgainst != "" {
+		paths = append(paths, o.DiffAgainst)
+	}
+	return paths
+}
+
+// allow reports whether line may be written.
+func (g *outputGate) allow(line string) bool {
+	if g == nil {
+		return true
+	}
+	if g.err != nil || g.done {
+		return false
+	}
+	if g.minLen > 0 || g.maxLen > 0 {
+		n := utf8.RuneCountInString(line)
+		if n < g.minLen || (g.maxLen > 0 && n > g.maxLen) {
+			return false
+		}
+	}
+	if g.excludeChars != "" && strings.ContainsAny(line, g.excludeChars) {
+		return false
+	}
+	if !matchesPatterns(line, g.match, g.excludeMatch) {
+		return false
+	}
+	if g.shards > 1 && hashShardOf(line, g.shards) != g.shard {
+		return false
+	}
+	if g.exclude != nil && g.exclude.contains(line) {
+		return false
+	}
+	if g.bloom != nil {
+		if g.bloom.testAndAdd(line) {
+			g.repeats++
+			return false
+		}
+		if g.distinct++; g.limitUnique > 0 && g.distinct >= g.limitUnique {
+			g.finish()
+		}
+	}
+	if g.seen != nil {
+		if _, dup := g.seen[line]; dup {
+			if g.failOnDuplicate {
+				g.fail(fmt.Errorf("duplicate output line %q", line))
+				return false
+			}
+			if g.unique {
+				g.repeats++
+				return false
+			}
+			// Repeats are written but do not count toward -limit-unique.
+			return g.position()
+		}
+		g.seen[line] = struct{}{}
+		if g.limitUnique > 0 && len(g.seen) >= g.limitUnique {
+			g.finish()
+		}
+		if g.exactMax > 0 && len(g.seen) >= g.exactMax {
+			if err := g.spillSeen(); err != nil {
+				g.fail(err)
+				return false
+			}
+		}
+	}
+	return g.position()
+}
+
+// spillSeen moves the exact -unique set into a bloom filter once it holds
+// -unique-exact-max lines, bounding memory from then on.
+func (g *outputGate) spillSeen() error {
+	bloom, err := g.spill()
+	if err != nil {
+		return err
+	}
+	for line := range g.seen {
+		bloom.testAndAdd(line)
+	}
+	g.bloom, g.seen = bloom, nil
+	return nil
+}
+
+// reportUnique writes how many repeats -unique dropped and, once a bloom
+// filter is in use, the false positive rate it reached.
+func (g *outputGate) reportUnique(w io.Writer) {
+	if g == nil || g.bloom == nil {
+		return
+	}
+	fmt.Fprintf(w, "unique: %d repeated lines dropped, bloom filter false positive rate about %.2g\n", g.repeats, g.bloom.falsePositiveRate())
+}
+
+// position applies -skip and -limit to a line that passed every filter.
+func (g *outputGate) position() bool {
+	if g.skipped < g.skip {
+		g.skipped++
+		return false
+	}
+	g.written++
+	if g.limit > 0 && g.written >= g.limit {
+		g.finish()
+	}
+	return true
+}
+
+// finish ends the output once a limit is reached.
+func (g *outputGate) finish() {
+	g.done = true
+	if g.stop != nil {
+		g.stop()
+	}
+}
+
+func (g *outputGate) fail(err error) {
+	g.err = err
+	if g.stop != nil {
+		g.stop()
+	}
+}
+
+// wrap filters output through the gate.
+func (g *outputGate) wrap(output func(string)) func(string) {
+	if g == nil {
+		return output
+	}
+	return func(s string) {
+		if g.allow(s) {
+			output(s)
+		}
+	}
+}
+
+// result returns the failure recorded during generation, if any.
+func (g *outputGate) result() error {
+	if g == nil {
+		return nil
+	}
+	return g.err
+}
@@ -0,0 +1,50 @@
+package alchemy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/big"
+)
+
+// lineCountingWriter counts the lines passing through to w. RunPermutatorFast
+// sets w when it is given one as options.counted.
+type lineCountingWriter struct {
+	w     io.Writer
+	lines uint64
+}
+
+func (c *lineCountingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.lines += uint64(bytes.Count(b[:n], []byte{'\n'}))
+	return n, err
+}
+
+// GenerateAndCount runs a normal generation to stdout and returns the exact
+// number of lines written, so the reported count always matches the output
+// whatever filters or fan-outs were applied.
+func GenerateAndCount(sources []Source, opts Options) (uint64, error) {
+	cw := &lineCountingWriter{}
+	opts.counted = cw
+	err := RunPermutatorFast(sources, opts, nil)
+	return cw.lines, err
+}
+
+// CountExact enumerates the whole space into io.Discard and returns the exact
+// number of lines surviving every filter. It refuses when the unfiltered count
+// exceeds maxLines, since the enumeration would take as long as a real run.
+func CountExact(sources []Source, opts Options, maxLines uint64) (uint64, error) {
+	total, err := CalculateOutputLines(sources, opts)
+	if err != nil {
+		return 0, err
+	}
+	if total.Cmp(new(big.Int).SetUint64(maxLines)) > 0 {
+		return 0, fmt.Errorf("-count-exact would enumerate %s lines, more than -count-exact-max %d; use -count for the unfiltered total", total, maxLines)
+	}
+
+	opts.Stdout = io.Discard
+	cw := &lineCountingWriter{}
+	opts.counted = cw
+	err = RunPermutatorFast(sources, opts, nil)
+	return cw.lines, err
+}
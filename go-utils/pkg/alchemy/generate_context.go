@@ -0,0 +1,47 @@
+package alchemy
+
+import (
+	"context"
+	"fmt"
+)
+
+// Progress reports how far a generation got, e.g. when it was cancelled.
+type Progress struct {
+	Lines  uint64 // lines written
+	Starts int    // start items whose sequences were all generated
+	Total  int    // start items of the run
+}
+
+func (p Progress) String() string {
+	return fmt.Sprintf("%d lines written, %d of %d start items done", p.Lines, p.Starts, p.Total)
+}
+
+// GenerateContext is Generate stopping early once ctx is done. Lines written
+// before the cancellation stay complete and are flushed; the returned
+// progress says how far the run got, and the error is ctx.Err() when it was
+// cut short.
+func (p *PermutatorFast) GenerateContext(ctx context.Context) (Progress, error) {
+	defer stopOnDone(ctx, p.Stop)()
+	p.Generate()
+
+	p.mu.Lock()
+	lines := p.written
+	p.mu.Unlock()
+	progress := Progress{Lines: lines, Starts: int(p.startsDone.Load()), Total: len(p.startItems())}
+	return progress, ctx.Err()
+}
+
+// stopOnDone arranges for stop to be called once ctx is done and returns a
+// func disarming it, like stopAfter.
+func stopOnDone(ctx context.Context, stop func()) func() {
+	release := context.AfterFunc(ctx, stop)
+	return func() { release() }
+}
+
+// context returns the context generation runs under (SIGINT in the CLI).
+func (o Options) context() context.Context {
+	if o.Context == nil {
+		return context.Background()
+	}
+	return o.Context
+}
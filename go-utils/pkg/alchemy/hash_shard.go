@@ -0,0 +1,37 @@
+package alchemy
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+)
+
+// parseHashShard parses a -hash-shard value "i/n" into the zero-based shard
+// index and the shard count.
+func parseHashShard(spec string) (index, count int, err error) {
+	is, ns, ok := strings.Cut(spec, "/")
+	if !ok {
+		return 0, 0, fmt.Errorf("hash shard %q must be in format i/n", spec)
+	}
+	index, err = strconv.Atoi(is)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid shard index in %q", spec)
+	}
+	count, err = strconv.Atoi(ns)
+	if err != nil || count < 1 {
+		return 0, 0, fmt.Errorf("invalid shard count in %q", spec)
+	}
+	if index < 0 || index >= count {
+		return 0, 0, fmt.Errorf("shard index in %q must be between 0 and %d", spec, count-1)
+	}
+	return index, count, nil
+}
+
+// hashShardOf returns the shard a line belongs to among count shards. It only
+// depends on the line's bytes, so every run and machine agrees on it.
+func hashShardOf(line string, count int) int {
+	h := fnv.New64a()
+	h.Write([]byte(line))
+	return int(h.Sum64() % uint64(count))
+}
@@ -0,0 +1,235 @@
+package alchemy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+)
+
+// LengthBucket is the number of output lines having a given length in bytes.
+type LengthBucket struct {
+	Length int      `json:"length"`
+	Count  *big.Int `json:"count"`
+}
+
+// CalculateLengthHistogram returns the distribution of output line lengths
+// (in bytes, newline excluded) without enumerating the lines. The counts are
+// exact when repeats are allowed or every item has the same length; under
+// -no-repeats with mixed lengths each depth is scaled from the repeats case,
+// and exact is false.
+func CalculateLengthHistogram(sources []Source, opts Options) (buckets []LengthBucket, exact bool, err error) {
+	if opts.NoConsecutiveSource {
+		return nil, false, errors.New("the length histogram does not support -no-consecutive-source")
+	}
+	if len(opts.MinFrom) > 0 {
+		return nil, false, errors.New("the length histogram does not support -min-from")
+	}
+	if opts.Slots {
+		return nil, false, errors.New("the length histogram does not support -slot")
+	}
+	if opts.Combinations {
+		return nil, false, errors.New("the length histogram does not support -combinations")
+	}
+	if opts.Rules != nil || opts.MutateCase != "" || opts.Leet != "" {
+		return nil, false, errors.New("the length histogram does not support -rules, -mutate-case or -leet")
+	}
+	allItems, srcOfItem, srcDepths, err := loadSources(sources, opts)
+	if err != nil {
+		return nil, false, err
+	}
+	opts = opts.withSources(sources)
+	if opts.usesSourceSeps() || opts.srcAffixes != nil {
+		return nil, false, errors.New("the length histogram does not support per-source separators, prefixes or suffixes")
+	}
+	// Lengths are those of the items as written.
+	if allItems, err = opts.writtenItems(sources, allItems, srcOfItem); err != nil {
+		return nil, false, err
+	}
+	n := len(allItems)
+	exact = true
+	if n == 0 || len(opts.Seps) == 0 {
+		return nil, exact, nil
+	}
+
+	maxDepth := 0
+	for _, d := range srcDepths {
+		maxDepth = max(maxDepth, d)
+	}
+
+	// Sequences continue from the whole pool, or from their own source only
+	// under -no-cross-source; each such group is counted separately.
+	group := func(i int) int { return 0 }
+	groups := 1
+	if opts.NoCrossSource {
+		group = func(i int) int { return srcOfItem[i] }
+		groups = len(srcDepths)
+	}
+
+	// all[g][k] counts items of byte length k in group g; starts[g][l] only
+	// those allowed to start a sequence of length l (source min depth <= l <=
+	// source depth).
+	all := make([]lengthPoly, groups)
+	starts := make([][]lengthPoly, groups)
+	sizes := make([]int, groups)
+	for g := range starts {
+		starts[g] = make([]lengthPoly, maxDepth+1)
+	}
+	for i, item := range allItems {
+		g := group(i)
+		sizes[g]++
+		all[g] = all[g].addAt(len(item), big.NewInt(1))
+		for l := opts.minDepthOf(srcOfItem[i]); l <= srcDepths[srcOfItem[i]]; l++ {
+			starts[g][l] = starts[g][l].addAt(len(item), big.NewInt(1))
+		}
+	}
+
+	fixed := len(opts.Prefix) + len(opts.Suffix)
+	var total lengthPoly
+	for g := range all {
+		if sizes[g] == 0 {
+			continue
+		}
+		if opts.NoRepeats && !all[g].single() {
+			exact = false
+		}
+		tail := lengthPoly{big.NewInt(1)} // all^(l-1)
+		size := big.NewInt(int64(sizes[g]))
+		for l := 1; l <= maxDepth; l++ {
+			if l > 1 {
+				tail = tail.mul(all[g])
+			}
+			depthPoly := starts[g][l].mul(tail)
+			if opts.NoRepeats {
+				// Scale size^(l-1) free tails down to (size-1)!/(size-l)! distinct ones.
+				num, den := big.NewInt(1), big.NewInt(1)
+				for k := 1; k < l; k++ {
+					num.Mul(num, big.NewInt(int64(max(sizes[g]-k, 0))))
+					den.Mul(den, size)
+				}
+				depthPoly = depthPoly.scale(num, den)
+			}
+			for _, sep := range lineSeps(opts.Seps, l) {
+				total = total.add(depthPoly.shift(fixed + (l-1)*len(sep)))
+			}
+		}
+	}
+
+	if opts.Incremental != "" {
+		var chars lengthPoly
+		for _, c := range opts.Incremental {
+			chars = chars.addAt(len(string(c)), big.NewInt(1))
+		}
+		suffixes := lengthPoly{big.NewInt(1)}
+		level := lengthPoly{big.NewInt(1)}
+		for k := 1; k <= opts.IncrementalMax; k++ {
+			level = level.mul(chars)
+			suffixes = suffixes.add(level)
+		}
+		total = total.mul(suffixes)
+	}
+
+	for length, cnt := range total {
+		if cnt != nil && cnt.Sign() > 0 {
+			buckets = append(buckets, LengthBucket{Length: length, Count: cnt})
+		}
+	}
+	return buckets, exact, nil
+}
+
+// PrintHistogram writes one "length<TAB>count" line per bucket.
+func PrintHistogram(w io.Writer, buckets []LengthBucket, exact bool) {
+	if !exact {
+		fmt.Fprintln(w, "# approximate: -no-repeats with items of different lengths")
+	}
+	for _, b := range buckets {
+		fmt.Fprintf(w, "%d\t%s\n", b.Length, b.Count)
+	}
+}
+
+// PrintHistogramJSON writes the histogram as a single JSON document.
+func PrintHistogramJSON(w io.Writer, buckets []LengthBucket, exact bool) error {
+	if buckets == nil {
+		buckets = []LengthBucket{}
+	}
+	return json.NewEncoder(w).Encode(struct {
+		Exact   bool           `json:"exact"`
+		Buckets []LengthBucket `json:"buckets"`
+	}{exact, buckets})
+}
+
+// lengthPoly is a polynomial over line lengths: p[k] counts strings of length k.
+type lengthPoly []*big.Int
+
+func (p lengthPoly) at(k int) *big.Int {
+	if k < len(p) && p[k] != nil {
+		return p[k]
+	}
+	return new(big.Int)
+}
+
+func (p lengthPoly) addAt(k int, v *big.Int) lengthPoly {
+	for len(p) <= k {
+		p = append(p, new(big.Int))
+	}
+	p[k] = new(big.Int).Add(p.at(k), v)
+	return p
+}
+
+func (p lengthPoly) add(q lengthPoly) lengthPoly {
+	for k := range q {
+		p = p.addAt(k, q.at(k))
+	}
+	return p
+}
+
+// mul convolves p and q: the lengths of every p-string followed by a q-string.
+func (p lengthPoly) mul(q lengthPoly) lengthPoly {
+	if len(p) == 0 || len(q) == 0 {
+		return nil
+	}
+	out := make(lengthPoly, len(p)+len(q)-1)
+	for i := range out {
+		out[i] = new(big.Int)
+	}
+	tmp := new(big.Int)
+	for i := range p {
+		if p.at(i).Sign() == 0 {
+			continue
+		}
+		for j := range q {
+			out[i+j].Add(out[i+j], tmp.Mul(p.at(i), q.at(j)))
+		}
+	}
+	return out
+}
+
+func (p lengthPoly) shift(by int) lengthPoly {
+	out := make(lengthPoly, by, by+len(p))
+	for i := range out {
+		out[i] = new(big.Int)
+	}
+	return append(out, p...)
+}
+
+// scale multiplies every count by num/den, rounding down.
+func (p lengthPoly) scale(num, den *big.Int) lengthPoly {
+	out := make(lengthPoly, len(p))
+	for k := range p {
+		v := new(big.Int).Mul(p.at(k), num)
+		out[k] = v.Quo(v, den)
+	}
+	return out
+}
+
+// single reports whether all counted strings share one length.
+func (p lengthPoly) single() bool {
+	seen := 0
+	for k := range p {
+		if p.at(k).Sign() > 0 {
+			seen++
+		}
+	}
+	return seen <= 1
+}
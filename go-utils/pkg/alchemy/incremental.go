@@ -0,0 +1,50 @@
+package alchemy
+
+import "math/big"
+
+// incrementalSuffixes lists every string over charset of length 0..maxLen,
+// shortest first and in charset order within a length ("", "a", "b", ..,
+// "aa", "ab", ..), like john's incremental append.
+func incrementalSuffixes(charset string, maxLen int) []string {
+	chars := []rune(charset)
+	suffixes := []string{""}
+	level := []string{""}
+	for l := 1; l <= maxLen && len(chars) > 0; l++ {
+		next := make([]string, 0, len(level)*len(chars))
+		for _, base := range level {
+			for _, c := range chars {
+				next = append(next, base+string(c))
+			}
+		}
+		suffixes = append(suffixes, next...)
+		level = next
+	}
+	return suffixes
+}
+
+// incrementalCardinality returns how many suffixes incrementalSuffixes yields,
+// i.e. the factor every base line is multiplied by.
+func incrementalCardinality(charset string, maxLen int) *big.Int {
+	k := big.NewInt(int64(len([]rune(charset))))
+	total := big.NewInt(1)
+	term := big.NewInt(1)
+	for l := 1; l <= maxLen && k.Sign() > 0; l++ {
+		term.Mul(term, k)
+		total.Add(total, term)
+	}
+	return total
+}
+
+// fanOut wraps output so each line is emitted once per incremental suffix.
+// Without -incremental it returns output unchanged.
+func (o Options) fanOut(output func(string)) func(string) {
+	if o.Incremental == "" {
+		return output
+	}
+	suffixes := incrementalSuffixes(o.Incremental, o.IncrementalMax)
+	return func(s string) {
+		for _, sfx := range suffixes {
+			output(s + sfx)
+		}
+	}
+}
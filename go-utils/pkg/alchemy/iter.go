@@ -0,0 +1,120 @@
+package alchemy
+
+import "strings"
+
+// Iterator pulls the lines of a Permutator one at a time, in the order
+// Generate writes them. It keeps its own DFS state instead of running a
+// goroutine, so a consumer may stop at any point without cleanup.
+//
+//	it := p.Iter()
+//	for it.Next() {
+//		use(it.Candidate())
+//	}
+type Iterator struct {
+	p    *Permutator
+	root int    // next item to start a sequence from
+	path []int  // current sequence
+	used []bool // items in path, under NoRepeats
+
+	seps    []string // separators the current sequence is written with
+	pending int      // next separator of seps to write
+	line    string
+}
+
+// Iter returns an iterator positioned before the first line.
+func (p *Permutator) Iter() *Iterator {
+	return &Iterator{p: p, used: make([]bool, len(p.allItems))}
+}
+
+// Next advances to the next line and reports whether there is one.
+func (it *Iterator) Next() bool {
+	for it.pending >= len(it.seps) {
+		if !it.advance() {
+			it.line = ""
+			return false
+		}
+	}
+	sep := it.seps[it.pending]
+	it.pending++
+
+	var b strings.Builder
+	b.WriteString(it.p.opts.Prefix)
+	for j, idx := range it.path {
+		if j > 0 {
+			b.WriteString(sep)
+		}
+		b.WriteString(it.p.allItems[idx])
+	}
+	b.WriteString(it.p.opts.Suffix)
+	it.line = b.String()
+	return true
+}
+
+// Candidate returns the line Next advanced to.
+func (it *Iterator) Candidate() string {
+	return it.line
+}
+
+// advance moves to the next sequence in depth-first order: the first child
+// of the current one, else the next sibling of it or of an ancestor, else
+// the next root.
+func (it *Iterator) advance() bool {
+	if len(it.path) > 0 && len(it.path) < it.p.srcDepths[it.p.srcOfItem[it.path[0]]] {
+		if c := it.nextChild(0); c >= 0 {
+			it.push(c)
+			return true
+		}
+	}
+	for len(it.path) > 1 {
+		last := it.pop()
+		if c := it.nextChild(last + 1); c >= 0 {
+			it.push(c)
+			return true
+		}
+	}
+	if len(it.path) == 1 {
+		it.pop()
+	}
+	if it.root >= len(it.p.allItems) {
+		return false
+	}
+	it.push(it.root)
+	it.root++
+	return true
+}
+
+// nextChild returns the first item at or after from that may extend the
+// current sequence, or -1.
+func (it *Iterator) nextChild(from int) int {
+	for c := from; c < len(it.p.allItems); c++ {
+		if !it.p.opts.NoRepeats || !it.used[c] {
+			return c
+		}
+	}
+	return -1
+}
+
+func (it *Iterator) push(item int) {
+	it.path = append(it.path, item)
+	if it.p.opts.NoRepeats {
+		it.used[item] = true
+	}
+	it.seps = it.p.opts.Seps
+	if len(it.path) < it.p.opts.minDepthOf(it.p.srcOfItem[it.path[0]]) {
+		// Too short to be written: only extended.
+		it.seps = nil
+	} else if len(it.path) == 1 && len(it.seps) > 1 {
+		// A single item has no separator to vary: write it once.
+		it.seps = it.seps[:1]
+	}
+	it.pending = 0
+}
+
+func (it *Iterator) pop() int {
+	last := it.path[len(it.path)-1]
+	it.path = it.path[:len(it.path)-1]
+	if it.p.opts.NoRepeats {
+		it.used[last] = false
+	}
+	return last
+}
@@ -0,0 +1,87 @@
+package alchemy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// jsonArrayWriter turns the newline-terminated lines written to it into a
+// single JSON array of strings on w, streaming: "[" before the first element,
+// "," between elements and "]" on Close. Lines may arrive split across
+// writes; the unterminated tail is held until its newline.
+type jsonArrayWriter struct {
+	w       io.Writer
+	partial []byte
+	started bool
+	enc     bytes.Buffer
+}
+
+func newJSONArrayWriter(w io.Writer) *jsonArrayWriter {
+	return &jsonArrayWriter{w: w}
+}
+
+func (j *jsonArrayWriter) Write(b []byte) (int, error) {
+	n := len(b)
+	for {
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			j.partial = append(j.partial, b...)
+			return n, nil
+		}
+		line := b[:i]
+		if len(j.partial) > 0 {
+			line = append(j.partial, line...)
+			j.partial = j.partial[:0]
+		}
+		if err := j.element(string(line)); err != nil {
+			return 0, err
+		}
+		b = b[i+1:]
+	}
+}
+
+func (j *jsonArrayWriter) element(s string) error {
+	j.enc.Reset()
+	if j.started {
+		j.enc.WriteByte(',')
+	} else {
+		j.enc.WriteByte('[')
+		j.started = true
+	}
+	enc := json.NewEncoder(&j.enc)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(s); err != nil {
+		return err
+	}
+	// Encode ends with a newline; keep one element per line for readability.
+	_, err := j.w.Write(j.enc.Bytes())
+	return err
+}
+
+// Close writes any unterminated last line as an element and ends the array.
+// An empty output is written as "[]".
+func (j *jsonArrayWriter) Close() error {
+	if len(j.partial) > 0 {
+		if err := j.element(string(j.partial)); err != nil {
+			return err
+		}
+		j.partial = nil
+	}
+	end := "]\n"
+	if !j.started {
+		end = "[]\n"
+	}
+	_, err := io.WriteString(j.w, end)
+	return err
+}
+
+// checkOutputFormat validates a -format value.
+func checkOutputFormat(format string) error {
+	switch format {
+	case "", "text", "json":
+		return nil
+	}
+	return fmt.Errorf("unknown output format %q (want text or json)", format)
+}
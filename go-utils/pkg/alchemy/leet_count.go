@@ -0,0 +1,536 @@
+package alchemy
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// Under -leet every line is written once per variant, and how many variants
+// a line has depends on its letters: a line whose characters have c1, c2,
+// ... substitutes has the coefficients up to x^n of (1+c1x)(1+c2x)... as
+// variants with 0..n substitutions. Those polynomials multiply along the
+// line, so lines are counted by summing the polynomials of their parts
+// instead of counting them one each, and the coefficients are added up at
+// the end. Under -leet all only their value at x=1 matters.
+
+// leetPoly holds, per number of substitutions, how many ways a piece of
+// text can be written with that many.
+type leetPoly []*big.Int
+
+// leetCounter builds and combines leetPolys truncated to the -leet level.
+type leetCounter struct {
+	table  map[rune][]rune
+	degree int // highest substitution count kept; 0 under -leet all
+	all    bool
+}
+
+func (o Options) leetCounter() *leetCounter {
+	// Rejected by Validate.
+	maxSubs, _ := parseLeetLevel(o.Leet)
+	c := &leetCounter{table: o.leetSubstitutions(), degree: maxSubs}
+	if maxSubs < 0 {
+		c.degree, c.all = 0, true
+	}
+	return c
+}
+
+func (c *leetCounter) zero() leetPoly {
+	p := make(leetPoly, c.degree+1)
+	for k := range p {
+		p[k] = big.NewInt(0)
+	}
+	return p
+}
+
+func (c *leetCounter) one() leetPoly {
+	p := c.zero()
+	p[0].SetInt64(1)
+	return p
+}
+
+// text returns the polynomial of s.
+func (c *leetCounter) text(s string) leetPoly {
+	p := c.one()
+	for _, r := range s {
+		n := big.NewInt(int64(len(leetSubs(c.table, r))))
+		if n.Sign() == 0 {
+			continue
+		}
+		if c.all {
+			p[0].Mul(p[0], n.Add(n, big.NewInt(1)))
+			continue
+		}
+		// Multiply by 1 + n x in place.
+		for k := c.degree; k > 0; k-- {
+			p[k].Add(p[k], new(big.Int).Mul(n, p[k-1]))
+		}
+	}
+	return p
+}
+
+func (c *leetCounter) add(a, b leetPoly) leetPoly {
+	sum := c.zero()
+	for k := range sum {
+		sum[k].Add(a[k], b[k])
+	}
+	return sum
+}
+
+func (c *leetCounter) sub(a, b leetPoly) leetPoly {
+	diff := c.zero()
+	for k := range diff {
+		diff[k].Sub(a[k], b[k])
+	}
+	return diff
+}
+
+func (c *leetCounter) mul(a, b leetPoly) leetPoly {
+	prod := c.zero()
+	for i, x := range a {
+		if x.Sign() == 0 {
+			continue
+		}
+		for j := 0; i+j <= c.degree; j++ {
+			prod[i+j].Add(prod[i+j], new(big.Int).Mul(x, b[j]))
+		}
+	}
+	return prod
+}
+
+func (c *leetCounter) scale(a leetPoly, n *big.Int) leetPoly {
+	scaled := c.zero()
+	for k := range scaled {
+		scaled[k].Mul(a[k], n)
+	}
+	return scaled
+}
+
+func (c *leetCounter) pow(a leetPoly, e int) leetPoly {
+	p := c.one()
+	for range e {
+		p = c.mul(p, a)
+	}
+	return p
+}
+
+// total returns how many variants the lines summed into p have.
+func (c *leetCounter) total(p leetPoly) *big.Int {
+	t := big.NewInt(0)
+	for _, x := range p {
+		t.Add(t, x)
+	}
+	return t
+}
+
+// key identifies a polynomial, to group items that count alike.
+func (p leetPoly) key() string {
+	var b strings.Builder
+	for _, x := range p {
+		fmt.Fprintf(&b, "%s,", x)
+	}
+	return b.String()
+}
+
+// leetSeries is a polynomial in y whose coefficients are leetPolys: element
+// k sums the products of k items. Only the first depth elements are kept.
+type leetSeries []leetPoly
+
+func (c *leetCounter) series(depth int) leetSeries {
+	s := make(leetSeries, depth)
+	for k := range s {
+		s[k] = c.zero()
+	}
+	s[0] = c.one()
+	return s
+}
+
+// withItem returns s times (1 + y q): every subset also with the item q.
+func (c *leetCounter) withItem(s leetSeries, q leetPoly) leetSeries {
+	next := make(leetSeries, len(s))
+	next[0] = s[0]
+	for k := 1; k < len(s); k++ {
+		next[k] = c.add(s[k], c.mul(q, s[k-1]))
+	}
+	return next
+}
+
+// withoutItem undoes withItem: s divided by (1 + y q).
+func (c *leetCounter) withoutItem(s leetSeries, q leetPoly) leetSeries {
+	prev := make(leetSeries, len(s))
+	prev[0] = s[0]
+	for k := 1; k < len(s); k++ {
+		prev[k] = c.sub(s[k], c.mul(q, prev[k-1]))
+	}
+	return prev
+}
+
+// withRepeats returns s divided by (1 - y q): every multiset also with any
+// number of copies of the item q.
+func (c *leetCounter) withRepeats(s leetSeries, q leetPoly) leetSeries {
+	next := make(leetSeries, len(s))
+	next[0] = s[0]
+	for k := 1; k < len(s); k++ {
+		next[k] = c.add(s[k], c.mul(q, next[k-1]))
+	}
+	return next
+}
+
+// subsets returns the series of the subsets of items: element k sums the
+// products of every k distinct items.
+func (c *leetCounter) subsets(items []leetPoly, depth int) leetSeries {
+	s := c.series(depth)
+	for _, q := range items {
+		s = c.withItem(s, q)
+	}
+	return s
+}
+
+// countLeetByDepth is countByDepthFrom under -leet, given the items as
+// written.
+func countLeetByDepth(allItems []string, srcOfItem []int, srcDepths []int, opts Options, from int) []*big.Int {
+	maxDepth := 0
+	for _, d := range srcDepths {
+		maxDepth = max(maxDepth, d)
+	}
+	byDepth := make([]*big.Int, maxDepth)
+	for l := range byDepth {
+		byDepth[l] = big.NewInt(0)
+	}
+	if len(allItems) == 0 || len(opts.Seps) == 0 {
+		return byDepth
+	}
+
+	c := opts.leetCounter()
+	items := make([]leetPoly, len(allItems))
+	for i, item := range allItems {
+		items[i] = c.text(item)
+	}
+	// Parts every line has: -prefix, -suffix and, summed, the incremental
+	// suffixes. -mutate-case and -rules rewrite each variant once per case
+	// and rule.
+	fixed := c.mul(c.text(opts.Prefix), c.text(opts.Suffix))
+	if opts.Incremental != "" {
+		chars := c.zero()
+		for _, ch := range opts.Incremental {
+			chars = c.add(chars, c.text(string(ch)))
+		}
+		suffixes := c.zero()
+		for k := 0; k <= opts.IncrementalMax; k++ {
+			suffixes = c.add(suffixes, c.pow(chars, k))
+		}
+		fixed = c.mul(fixed, suffixes)
+	}
+	rewrites := big.NewInt(int64(max(len(opts.lineRewrites()), 1)))
+	add := func(l int, lines leetPoly) {
+		total := c.total(c.mul(lines, fixed))
+		byDepth[l-1].Add(byDepth[l-1], total.Mul(total, rewrites))
+	}
+	// seps returns the separators of a line of l items: each -sep written
+	// l-1 times, once per line.
+	sepsOf := make([]leetPoly, maxDepth+1)
+	seps := func(l int) leetPoly {
+		if l == 1 {
+			return c.one()
+		}
+		if sepsOf[l] == nil {
+			sepsOf[l] = c.zero()
+			for _, sep := range opts.Seps {
+				sepsOf[l] = c.add(sepsOf[l], c.pow(c.text(sep), l-1))
+			}
+		}
+		return sepsOf[l]
+	}
+
+	lc := &leetLines{c: c, items: items, srcOfItem: srcOfItem, srcDepths: srcDepths, opts: opts, from: from, maxDepth: maxDepth, seps: seps, add: add}
+	switch {
+	case opts.Slots:
+		lc.slots()
+	case opts.Combinations:
+		lc.combinations()
+	case opts.NoConsecutiveSource || len(opts.MinFrom) > 0:
+		lc.transitions()
+	default:
+		lc.sequences()
+	}
+	return byDepth
+}
+
+// leetLines sums the polynomials of the lines of each generation mode,
+// mirroring the plain counts: item counts become sums of item polynomials.
+type leetLines struct {
+	c         *leetCounter
+	items     []leetPoly
+	srcOfItem []int
+	srcDepths []int
+	opts      Options
+	from      int
+	maxDepth  int
+	seps      func(l int) leetPoly
+	add       func(l int, lines leetPoly)
+}
+
+// sourceSums returns the sum of the item polynomials of every source.
+func (lc *leetLines) sourceSums() []leetPoly {
+	sums := make([]leetPoly, len(lc.srcDepths))
+	for src := range sums {
+		sums[src] = lc.c.zero()
+	}
+	for i, src := range lc.srcOfItem {
+		sums[src] = lc.c.add(sums[src], lc.items[i])
+	}
+	return sums
+}
+
+// slots covers -slot, -template and -product: one item of each slot, every
+// combination, once per separator.
+func (lc *leetLines) slots() {
+	c, slots := lc.c, len(lc.srcDepths)
+	if slots == 0 || lc.from > 0 {
+		return
+	}
+	lines := c.one()
+	for _, sum := range lc.sourceSums() {
+		lines = c.mul(lines, sum)
+	}
+	gaps := c.zero()
+	for _, sep := range lineSeps(lc.opts.Seps, slots) {
+		g := c.one()
+		for p := 1; p < slots; p++ {
+			if lc.opts.Gaps != nil {
+				g = c.mul(g, c.text(templateGap(lc.opts.Gaps[p-1], sep)))
+			} else {
+				g = c.mul(g, c.text(sep))
+			}
+		}
+		gaps = c.add(gaps, g)
+	}
+	lc.add(slots, c.mul(lines, gaps))
+}
+
+// sequences covers plain sequences: l-1 items of the pool after the start
+// item, any of them (m^(l-1) sequences, here the pool sum to the power l-1)
+// or, under -no-repeats, distinct ones other than the start item ((l-1)!
+// times the sum over the subsets of l-1 items).
+func (lc *leetLines) sequences() {
+	c, opts := lc.c, lc.opts
+	// The pools: the whole one, or each source under -no-cross-source.
+	pools := [][]int{nil}
+	poolOf := func(src int) int { return 0 }
+	if opts.NoCrossSource {
+		pools = make([][]int, len(lc.srcDepths))
+		poolOf = func(src int) int { return src }
+	}
+	for i, src := range lc.srcOfItem {
+		pools[poolOf(src)] = append(pools[poolOf(src)], i)
+	}
+
+	for _, pool := range pools {
+		if opts.NoRepeats {
+			lc.distinctSequences(pool)
+			continue
+		}
+		sum := c.zero()
+		for _, i := range pool {
+			sum = c.add(sum, lc.items[i])
+		}
+		// Start items grouped by source, which sets their lengths.
+		starts := map[int]leetPoly{}
+		for _, i := range pool {
+			src := lc.srcOfItem[i]
+			if lc.from >= 0 && src != lc.from {
+				continue
+			}
+			if starts[src] == nil {
+				starts[src] = c.zero()
+			}
+			starts[src] = c.add(starts[src], lc.items[i])
+		}
+		for src, start := range starts {
+			for l := opts.minDepthOf(src); l <= lc.srcDepths[src]; l++ {
+				lc.add(l, c.mul(c.mul(start, c.pow(sum, l-1)), lc.seps(l)))
+			}
+		}
+	}
+}
+
+// distinctSequences covers the -no-repeats sequences of one pool. Items
+// counting alike share their tails, so the subsets are computed once per
+// source and kind of start item.
+func (lc *leetLines) distinctSequences(pool []int) {
+	c, opts := lc.c, lc.opts
+	all := make([]leetPoly, len(pool))
+	for k, i := range pool {
+		all[k] = lc.items[i]
+	}
+	subsets := c.subsets(all, lc.maxDepth)
+
+	type startKind struct {
+		src int
+		key string
+	}
+	kinds := map[startKind]int{}
+	var order []int // one item of each kind, in load order
+	for _, i := range pool {
+		src := lc.srcOfItem[i]
+		if lc.from >= 0 && src != lc.from {
+			continue
+		}
+		kind := startKind{src, lc.items[i].key()}
+		if kinds[kind] == 0 {
+			order = append(order, i)
+		}
+		kinds[kind]++
+	}
+	for _, i := range order {
+		src, q := lc.srcOfItem[i], lc.items[i]
+		tails := c.withoutItem(subsets, q)
+		start := c.scale(q, big.NewInt(int64(kinds[startKind{src, q.key()}])))
+		arrangements := big.NewInt(1) // (l-1)!
+		for l := 1; l <= lc.srcDepths[src]; l++ {
+			if l > 1 {
+				arrangements.Mul(arrangements, big.NewInt(int64(l-1)))
+			}
+			if l < opts.minDepthOf(src) {
+				continue
+			}
+			lines := c.mul(start, c.scale(tails[l-1], arrangements))
+			lc.add(l, c.mul(lines, lc.seps(l)))
+		}
+	}
+}
+
+// combinations covers -combinations: a start item followed by a subset of
+// the pool items loaded after it or, with repeats, a multiset of those and
+// itself. Walking the items backwards grows those sets one item at a time.
+func (lc *leetLines) combinations() {
+	c, opts := lc.c, lc.opts
+	after := c.series(lc.maxDepth)
+	for i := len(lc.items) - 1; i >= 0; i-- {
+		src, q := lc.srcOfItem[i], lc.items[i]
+		if opts.NoCrossSource && i+1 < len(lc.items) && lc.srcOfItem[i+1] != src {
+			after = c.series(lc.maxDepth)
+		}
+		var tails leetSeries
+		if opts.NoRepeats {
+			tails = after
+			after = c.withItem(after, q)
+		} else {
+			after = c.withRepeats(after, q)
+			tails = after
+		}
+		if lc.from >= 0 && src != lc.from {
+			continue
+		}
+		for l := opts.minDepthOf(src); l <= lc.srcDepths[src]; l++ {
+			lc.add(l, c.mul(c.mul(q, tails[l-1]), lc.seps(l)))
+		}
+	}
+}
+
+// transitions covers -no-consecutive-source and -min-from. As in
+// countTransitionsByDepth, sequences are counted by their sources; the
+// items of a source then contribute its sum at every position, or under
+// -no-repeats, for a source used k times, k! times its subsets of k items
+// (less the start item for the start source).
+func (lc *leetLines) transitions() {
+	c, opts := lc.c, lc.opts
+	sources := len(lc.srcDepths)
+	sums := lc.sourceSums()
+	members := make([][]leetPoly, sources)
+	for i, src := range lc.srcOfItem {
+		members[src] = append(members[src], lc.items[i])
+	}
+	subsets := make([]leetSeries, sources)
+	for src := range subsets {
+		subsets[src] = c.subsets(members[src], lc.maxDepth+1)
+	}
+	minFrom := opts.minimums(sources)
+
+	for start := range sources {
+		if len(members[start]) == 0 || (lc.from >= 0 && start != lc.from) {
+			continue
+		}
+		// Start items counting alike have the same tails; without
+		// -no-repeats they all do.
+		kinds := map[string]int{}
+		var starts []leetPoly
+		for _, q := range members[start] {
+			if kinds[q.key()] == 0 {
+				starts = append(starts, q)
+			}
+			kinds[q.key()]++
+		}
+		if !opts.NoRepeats {
+			starts = starts[:1]
+		}
+		for _, q := range starts {
+			startSum := c.scale(q, big.NewInt(int64(kinds[q.key()])))
+			if !opts.NoRepeats {
+				startSum = sums[start]
+			}
+			// pick returns the products of k distinct items of src, in any
+			// order: k! times its subsets of k.
+			own := c.withoutItem(subsets[start], q)
+			pick := func(src, k int) leetPoly {
+				s := subsets[src]
+				if src == start {
+					s, k = own, k-1 // the start item is placed already
+				}
+				if k >= len(s) {
+					return c.zero()
+				}
+				f := big.NewInt(1)
+				for j := 2; j <= k; j++ {
+					f.Mul(f, big.NewInt(int64(j)))
+				}
+				return c.scale(s[k], f)
+			}
+			memo := map[string]leetPoly{}
+			var ways func(last int, used []int, remaining int) leetPoly
+			ways = func(last int, used []int, remaining int) leetPoly {
+				if remaining == 0 {
+					if minFrom != nil && !minFrom.satisfied(used) {
+						return c.zero()
+					}
+					if !opts.NoRepeats {
+						return c.one()
+					}
+					w := c.one()
+					for src, k := range used {
+						w = c.mul(w, pick(src, k))
+					}
+					return w
+				}
+				key := fmt.Sprint(last, used, remaining)
+				if v, ok := memo[key]; ok {
+					return v
+				}
+				total := c.zero()
+				for next := range sources {
+					if (opts.NoConsecutiveSource && next == last) || (opts.NoCrossSource && next != start) {
+						continue
+					}
+					if opts.NoRepeats && used[next] >= len(members[next]) {
+						continue
+					}
+					used[next]++
+					sub := ways(next, used, remaining-1)
+					used[next]--
+					if !opts.NoRepeats {
+						sub = c.mul(sub, sums[next])
+					}
+					total = c.add(total, sub)
+				}
+				memo[key] = total
+				return total
+			}
+			used := make([]int, sources)
+			used[start] = 1
+			for l := opts.minDepthOf(start); l <= lc.srcDepths[start]; l++ {
+				lines := c.mul(ways(start, used, l-1), startSum)
+				lc.add(l, c.mul(lines, lc.seps(l)))
+			}
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package alchemy
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// maskPrefix marks a source that is a hashcat-style mask rather than a file:
+// -source 'mask:?l?l?d?d:1' reads every candidate of the mask as an item.
+const maskPrefix = "mask:"
+
+// maskCharsets are the built-in hashcat charsets. ?b (every byte) is left out:
+// items are lines, so a newline cannot be part of one.
+var maskCharsets = map[byte]string{
+	'l': "abcdefghijklmnopqrstuvwxyz",
+	'u': "ABCDEFGHIJKLMNOPQRSTUVWXYZ",
+	'd': "0123456789",
+	'h': "0123456789abcdef",
+	'H': "0123456789ABCDEF",
+	's': " !\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~",
+	'a': "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789 !\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~",
+}
+
+// isMaskPath reports whether a source path is a mask.
+func isMaskPath(path string) bool {
+	return strings.HasPrefix(path, maskPrefix)
+}
+
+// parseMask splits a mask into the characters allowed at each position.
+// ?l ?u ?d ?h ?H ?s ?a are charsets, ?? is a literal '?', anything else is
+// taken literally.
+func parseMask(mask string) ([]string, error) {
+	if mask == "" {
+		return nil, fmt.Errorf("empty mask")
+	}
+	var positions []string
+	for i := 0; i < len(mask); i++ {
+		if mask[i] != '?' {
+			positions = append(positions, mask[i:i+1])
+			continue
+		}
+		if i+1 == len(mask) {
+			return nil, fmt.Errorf("mask %q ends with a lone ?", mask)
+		}
+		i++
+		if mask[i] == '?' {
+			positions = append(positions, "?")
+			continue
+		}
+		set, ok := maskCharsets[mask[i]]
+		if !ok {
+			return nil, fmt.Errorf("mask %q: unknown charset ?%c", mask, mask[i])
+		}
+		positions = append(positions, set)
+	}
+	return positions, nil
+}
+
+// maskReader streams the candidates of a mask one per line, in hashcat
+// order (the last position changes fastest), so a mask source is scanned
+// like a file without building the whole text first.
+type maskReader struct {
+	positions []string
+	counters  []int
+	pending   []byte
+	done      bool
+}
+
+func newMaskReader(mask string) (*maskReader, error) {
+	positions, err := parseMask(mask)
+	if err != nil {
+		return nil, err
+	}
+	return &maskReader{positions: positions, counters: make([]int, len(positions))}, nil
+}
+
+func (r *maskReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if len(r.pending) == 0 {
+			if r.done {
+				break
+			}
+			r.pending = r.candidate()
+			r.advance()
+		}
+		c := copy(p[n:], r.pending)
+		r.pending = r.pending[c:]
+		n += c
+	}
+	if n == 0 && r.done {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+// candidate returns the current candidate followed by a newline.
+func (r *maskReader) candidate() []byte {
+	line := make([]byte, 0, len(r.positions)+1)
+	for i, set := range r.positions {
+		line = append(line, set[r.counters[i]])
+	}
+	return append(line, '\n')
+}
+
+// advance moves to the next candidate like an odometer.
+func (r *maskReader) advance() {
+	for i := len(r.counters) - 1; i >= 0; i-- {
+		if r.counters[i]++; r.counters[i] < len(r.positions[i]) {
+			return
+		}
+		r.counters[i] = 0
+	}
+	r.done = true
+}
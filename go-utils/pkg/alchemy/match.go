@@ -0,0 +1,32 @@
+package alchemy
+
+import "regexp"
+
+// compilePatterns compiles -match or -exclude-match expressions (RE2 syntax).
+func compilePatterns(exprs []string) ([]*regexp.Regexp, error) {
+	var res []*regexp.Regexp
+	for _, expr := range exprs {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// matchesPatterns reports whether line matches every pattern of match and
+// none of exclude.
+func matchesPatterns(line string, match, exclude []*regexp.Regexp) bool {
+	for _, re := range match {
+		if !re.MatchString(line) {
+			return false
+		}
+	}
+	for _, re := range exclude {
+		if re.MatchString(line) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,54 @@
+package alchemy
+
+import "unicode/utf8"
+
+// lengthBound prunes the sequences whose lines are all longer than -max-len,
+// instead of generating them only for the output gate to drop them.
+type lengthBound struct {
+	max   int   // longest line written, in runes
+	fixed int   // runes of the prefix and suffix
+	sep   int   // runes of the shortest separator
+	items []int // runes of every item
+}
+
+// newLengthBound returns the bound of opts.MaxLen, or nil when there is none
+// or a line may come out shorter than its sequence: -rules can delete
+// characters, and -template gaps replace the separators.
+func newLengthBound(allItems []string, opts Options) *lengthBound {
+	if opts.MaxLen == 0 || opts.Rules != nil || opts.Gaps != nil || len(opts.Seps) == 0 {
+		return nil
+	}
+	b := &lengthBound{
+		max:   opts.MaxLen,
+		fixed: utf8.RuneCountInString(opts.Prefix) + utf8.RuneCountInString(opts.Suffix),
+		sep:   utf8.RuneCountInString(opts.Seps[0]),
+		items: make([]int, len(allItems)),
+	}
+	for _, sep := range opts.Seps[1:] {
+		b.sep = min(b.sep, utf8.RuneCountInString(sep))
+	}
+	for _, sep := range opts.srcSeps {
+		if sep != nil {
+			b.sep = min(b.sep, utf8.RuneCountInString(*sep))
+		}
+	}
+	for i, item := range allItems {
+		b.items[i] = utf8.RuneCountInString(item)
+	}
+	return b
+}
+
+// exceeds reports whether every line of path, and of every longer sequence
+// starting with it, is longer than the bound. Extending a sequence or
+// appending -incremental suffixes never shortens a line, and -mutate-case
+// maps runes one to one.
+func (b *lengthBound) exceeds(path []int) bool {
+	if b == nil {
+		return false
+	}
+	n := b.fixed + (len(path)-1)*b.sep
+	for _, idx := range path {
+		n += b.items[idx]
+	}
+	return n > b.max
+}
@@ -0,0 +1,56 @@
+package alchemy
+
+// withSources resolves the shortest emitted sequence of every source: its own
+// "file:min-max" minimum when given, else -min-depth, and the per-source
+// separators, prefixes and suffixes. Entry points call it once the sources
+// are known so that generation and counting agree.
+func (o Options) withSources(sources []Source) Options {
+	o.srcMinDepths = make([]int, len(sources))
+	o.srcSeps, o.srcAffixes = nil, nil
+	for i, src := range sources {
+		m := o.MinDepth
+		if src.MinDepth > 0 {
+			m = src.MinDepth
+		}
+		o.srcMinDepths[i] = max(m, 1)
+		if src.Sep != nil {
+			if o.srcSeps == nil {
+				o.srcSeps = make([]*string, len(sources))
+			}
+			o.srcSeps[i] = src.Sep
+		}
+		if src.Prefix != "" || src.Suffix != "" {
+			if o.srcAffixes == nil {
+				o.srcAffixes = make(sourceAffixes, len(sources))
+			}
+			o.srcAffixes[i].prefix, o.srcAffixes[i].suffix = src.Prefix, src.Suffix
+		}
+	}
+	return o
+}
+
+// CapDepths lowers every source depth above maxDepth to it (-max-depth).
+// Per-source minimums above the cap are left for Validate to report.
+func CapDepths(sources []Source, maxDepth int) {
+	for i := range sources {
+		sources[i].Depth = min(sources[i].Depth, maxDepth)
+	}
+}
+
+// minDepthOf returns the shortest sequence emitted for lines starting in
+// source src.
+func (o Options) minDepthOf(src int) int {
+	if src < len(o.srcMinDepths) {
+		return o.srcMinDepths[src]
+	}
+	return max(o.MinDepth, 1)
+}
+
+// minDepths returns minDepthOf for every source.
+func (o Options) minDepths(sources int) []int {
+	m := make([]int, sources)
+	for i := range m {
+		m[i] = o.minDepthOf(i)
+	}
+	return m
+}
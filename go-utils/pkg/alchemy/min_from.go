@@ -0,0 +1,102 @@
+package alchemy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// SplitMinFrom splits a -min-from value into the source it names and the
+// number of items K required from it.
+func SplitMinFrom(val string) (source string, k int, err error) {
+	i := strings.LastIndex(val, "=")
+	if i <= 0 {
+		return "", 0, fmt.Errorf("min-from %q must be in format source=K", val)
+	}
+	k, err = strconv.Atoi(val[i+1:])
+	if err != nil || k < 0 {
+		return "", 0, fmt.Errorf("invalid count in min-from %q", val)
+	}
+	return val[:i], k, nil
+}
+
+// ResolveMinFrom maps each source=K value to its source index. A source is
+// named by its path exactly as given to -source, or by its 1-based position.
+func ResolveMinFrom(vals []string, sources []Source) (map[int]int, error) {
+	if len(vals) == 0 {
+		return nil, nil
+	}
+	out := make(map[int]int)
+	for _, val := range vals {
+		name, k, err := SplitMinFrom(val)
+		if err != nil {
+			return nil, err
+		}
+		idx := -1
+		for i, src := range sources {
+			if src.Path == name {
+				idx = i
+				break
+			}
+		}
+		if idx < 0 {
+			if n, err := strconv.Atoi(name); err == nil && n >= 1 && n <= len(sources) {
+				idx = n - 1
+			}
+		}
+		if idx < 0 {
+			return nil, fmt.Errorf("min-from %q names no source", val)
+		}
+		out[idx] = k
+	}
+	return out, nil
+}
+
+// sourceMinimums holds, per source index, how many items of that source every
+// sequence must contain.
+type sourceMinimums []int
+
+// minimums returns the -min-from requirements for the given number of
+// sources, or nil when there are none.
+func (o Options) minimums(sources int) sourceMinimums {
+	if len(o.MinFrom) == 0 {
+		return nil
+	}
+	m := make(sourceMinimums, sources)
+	for src, k := range o.MinFrom {
+		if src >= 0 && src < sources {
+			m[src] = k
+		}
+	}
+	return m
+}
+
+// deficit returns how many more items the sequence needs before every
+// minimum is met, given each of its items' source.
+func (m sourceMinimums) deficit(path []int, srcOfItem []int) int {
+	var have [8]int
+	counts := have[:0]
+	if len(m) <= len(have) {
+		counts = have[:len(m)]
+	} else {
+		counts = make([]int, len(m))
+	}
+	for _, item := range path {
+		counts[srcOfItem[item]]++
+	}
+	missing := 0
+	for src, need := range m {
+		missing += max(need-counts[src], 0)
+	}
+	return missing
+}
+
+// satisfied reports whether per-source usage counts meet every minimum.
+func (m sourceMinimums) satisfied(used []int) bool {
+	for src, need := range m {
+		if used[src] < need {
+			return false
+		}
+	}
+	return true
+}
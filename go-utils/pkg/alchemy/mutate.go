@@ -0,0 +1,229 @@
+package alchemy
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// itemMutations are the variants -mutate can add next to every item, leet
+// aside: it depends on the -leet-table (see parseMutations).
+var itemMutations = map[string]func(string) string{
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	"cap": func(s string) string {
+		r, size := utf8.DecodeRuneInString(s)
+		if r == utf8.RuneError {
+			return s
+		}
+		return string(unicode.ToUpper(r)) + strings.ToLower(s[size:])
+	},
+}
+
+// caseMutations are the line variants of -mutate-case.
+var caseMutations = map[string]func(string) string{
+	"capitalize": itemMutations["cap"],
+	"upper":      strings.ToUpper,
+	"lower":      strings.ToLower,
+	"toggle": func(s string) string {
+		return strings.Map(func(r rune) rune {
+			if unicode.IsUpper(r) {
+				return unicode.ToLower(r)
+			}
+			return unicode.ToUpper(r)
+		}, s)
+	},
+}
+
+// parseCaseMutations parses a comma-separated -mutate-case list such as
+// "capitalize,upper".
+func parseCaseMutations(spec string) ([]func(string) string, error) {
+	var mutations []func(string) string
+	for _, name := range strings.Split(spec, ",") {
+		m, ok := caseMutations[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown case %q (want capitalize, upper, lower or toggle)", name)
+		}
+		mutations = append(mutations, m)
+	}
+	return mutations, nil
+}
+
+// parseMutations parses a comma-separated -mutate list such as "cap,leet".
+// leet writes every letter of table as its first substitute (see
+// mutateLeetSubstitutions).
+func parseMutations(spec string, table map[rune][]rune) ([]func(string) string, error) {
+	var mutations []func(string) string
+	for _, name := range strings.Split(spec, ",") {
+		if name == "leet" {
+			mutations = append(mutations, func(s string) string {
+				return strings.Map(func(r rune) rune {
+					if subs := leetSubs(table, r); len(subs) > 0 {
+						return subs[0]
+					}
+					return r
+				}, s)
+			})
+			continue
+		}
+		m, ok := itemMutations[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown mutation %q (want lower, cap, upper or leet)", name)
+		}
+		mutations = append(mutations, m)
+	}
+	return mutations, nil
+}
+
+// mutateItems expands every item into itself followed by its -mutate
+// variants, in flag order, dropping variants equal to an earlier one (e.g.
+// "2024" under cap).
+func (o Options) mutateItems(items []string) []string {
+	if o.Mutate == "" {
+		return items
+	}
+	// Rejected by Validate.
+	mutations, _ := parseMutations(o.Mutate, o.mutateLeetSubstitutions())
+	expanded := make([]string, 0, len(items)*(len(mutations)+1))
+	for _, item := range items {
+		first := len(expanded)
+		expanded = append(expanded, item)
+	variants:
+		for _, m := range mutations {
+			v := m(item)
+			for _, prev := range expanded[first:] {
+				if v == prev {
+					continue variants
+				}
+			}
+			expanded = append(expanded, v)
+		}
+	}
+	return expanded
+}
+
+// defaultLeetTable is the -leet-table used when none is given.
+const defaultLeetTable = "a=4@,b=8,e=3,g=9,i=1!,l=1,o=0,s=5$,t=7"
+
+// mutateLeetTable is the table of -mutate leet when no -leet-table is
+// given: the basic substitution it always made ("pass" becomes "p@$$").
+const mutateLeetTable = "a=@,e=3,i=1,o=0,s=$"
+
+// parseLeetTable parses a -leet-table such as "a=4@,e=3": each letter with
+// the runes it may be written as, in order, each kept once. Letters match
+// either case.
+func parseLeetTable(spec string) (map[rune][]rune, error) {
+	table := make(map[rune][]rune)
+	for _, entry := range strings.Split(spec, ",") {
+		from, to, ok := strings.Cut(entry, "=")
+		if !ok || utf8.RuneCountInString(from) != 1 || to == "" {
+			return nil, fmt.Errorf("bad entry %q (want letter=substitutes, e.g. a=4@)", entry)
+		}
+		r, _ := utf8.DecodeRuneInString(from)
+		r = unicode.ToLower(r)
+		for _, sub := range to {
+			if !slices.Contains(table[r], sub) {
+				table[r] = append(table[r], sub)
+			}
+		}
+	}
+	return table, nil
+}
+
+// leetSubstitutions returns the parsed -leet-table, or the default one.
+func (o Options) leetSubstitutions() map[rune][]rune {
+	spec := o.LeetTable
+	if spec == "" {
+		spec = defaultLeetTable
+	}
+	// Rejected by Validate.
+	table, _ := parseLeetTable(spec)
+	return table
+}
+
+// mutateLeetSubstitutions returns the table of -mutate leet: the
+// -leet-table if one is given, mutateLeetTable otherwise.
+func (o Options) mutateLeetSubstitutions() map[rune][]rune {
+	if o.LeetTable == "" {
+		o.LeetTable = mutateLeetTable
+	}
+	return o.leetSubstitutions()
+}
+
+// leetSubs returns the runes r may be written as: its table entry, less r
+// itself, so that every substitution changes the line.
+func leetSubs(table map[rune][]rune, r rune) []rune {
+	subs := table[unicode.ToLower(r)]
+	if i := slices.Index(subs, r); i >= 0 {
+		subs = slices.Delete(slices.Clone(subs), i, i+1)
+	}
+	return subs
+}
+
+// parseLeetLevel parses -leet: the most characters substituted in one
+// line, or "all" for every combination (returned as -1).
+func parseLeetLevel(spec string) (int, error) {
+	if spec == "all" {
+		return -1, nil
+	}
+	n, err := strconv.Atoi(spec)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("want a positive number of substitutions or all, got %q", spec)
+	}
+	return n, nil
+}
+
+// leetVariants emits line followed by every variant substituting at most
+// maxSubs of its characters (all of them when maxSubs < 0) through table,
+// leftmost substitutions first. Substitutes differ from the character they
+// replace, so the variants are all distinct.
+func leetVariants(line string, table map[rune][]rune, maxSubs int, emit func(string)) {
+	runes := []rune(line)
+	if maxSubs < 0 {
+		maxSubs = len(runes)
+	}
+	emit(line)
+	var walk func(from, left int)
+	walk = func(from, left int) {
+		if left == 0 {
+			return
+		}
+		for i := from; i < len(runes); i++ {
+			orig := runes[i]
+			for _, sub := range leetSubs(table, orig) {
+				runes[i] = sub
+				emit(string(runes))
+				walk(i+1, left-1)
+			}
+			runes[i] = orig
+		}
+	}
+	walk(0, maxSubs)
+}
+
+// leetFanOut returns the function emitting every -leet variant of a line,
+// nil without -leet.
+func (o Options) leetFanOut() func(line string, emit func(string)) {
+	if o.Leet == "" {
+		return nil
+	}
+	// Rejected by Validate.
+	maxSubs, _ := parseLeetLevel(o.Leet)
+	table := o.leetSubstitutions()
+	return func(line string, emit func(string)) {
+		leetVariants(line, table, maxSubs, emit)
+	}
+}
+
+// leetLines wraps output so each line is emitted once per -leet variant.
+// Without -leet it returns output unchanged.
+func (o Options) leetLines(output func(string)) func(string) {
+	fan := o.leetFanOut()
+	if fan == nil {
+		return output
+	}
+	return func(s string) { fan(s, output) }
+}
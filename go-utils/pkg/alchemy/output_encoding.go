@@ -0,0 +1,78 @@
+package alchemy
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+// outputEncodings are the -output-encoding values besides UTF-8.
+var outputEncodings = map[string]encoding.Encoding{
+	"latin1":       charmap.ISO8859_1,
+	"iso-8859-1":   charmap.ISO8859_1,
+	"iso-8859-15":  charmap.ISO8859_15,
+	"windows-1252": charmap.Windows1252,
+	"utf-16le":     unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM),
+	"utf-16be":     unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM),
+}
+
+// lookupOutputEncoding returns the encoding named by an -output-encoding
+// value, or nil for UTF-8 (which needs no transcoding).
+func lookupOutputEncoding(name string) (encoding.Encoding, error) {
+	switch n := strings.ToLower(name); n {
+	case "", "utf-8", "utf8":
+		return nil, nil
+	default:
+		if enc, ok := outputEncodings[n]; ok {
+			return enc, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown output encoding %q (want utf-8, latin1, iso-8859-15, windows-1252, utf-16le or utf-16be)", name)
+}
+
+// encodingWriter transcodes UTF-8 output to another encoding. Lines may be
+// split anywhere across writes. The first failure, typically a rune the
+// target cannot represent, is kept and returned by every later call.
+type encodingWriter struct {
+	name string
+	tw   io.WriteCloser
+	err  error
+}
+
+// newEncodingWriter wraps w so everything written is transcoded to enc. With
+// replace, unencodable runes are substituted instead of failing.
+func newEncodingWriter(w io.Writer, name string, enc encoding.Encoding, replace bool) *encodingWriter {
+	e := enc.NewEncoder()
+	if replace {
+		e = encoding.ReplaceUnsupported(e)
+	}
+	return &encodingWriter{name: name, tw: transform.NewWriter(w, e)}
+}
+
+func (e *encodingWriter) Write(b []byte) (int, error) {
+	if e.err != nil {
+		return 0, e.err
+	}
+	n, err := e.tw.Write(b)
+	if err != nil {
+		e.err = fmt.Errorf("encoding output as %s: %v (use -output-encoding-replace to substitute)", e.name, err)
+		return n, e.err
+	}
+	return n, nil
+}
+
+// Close flushes any buffered output and reports the first failure.
+func (e *encodingWriter) Close() error {
+	if e.err != nil {
+		return e.err
+	}
+	if err := e.tw.Close(); err != nil {
+		return fmt.Errorf("encoding output as %s: %v", e.name, err)
+	}
+	return nil
+}
@@ -0,0 +1,1488 @@
+// Package alchemy is the engine behind the permute command: it loads
+// sources, validates a configuration, counts the lines it produces and
+// generates them with every filter, fan-out and ordering the command offers.
+// Programs embed it by filling Options and calling Validate, then
+// RunPermutatorFast or one of the Calculate functions.
+package alchemy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// --- Argument Types ---
+
+// Source is one input list and the depth of the sequences it starts, as
+// given by -source file.txt:depth.
+type Source struct {
+	Path       string
+	Items      []string // lines read instead of Path when not nil; Path only names the source
+	Depth      int
+	MinDepth   int     // shortest sequence this source starts (0 = the -min-depth default)
+	Transforms string  // comma-separated transforms applied to this source's items when written
+	Sep        *string // separator written before this source's items instead of -sep (nil = -sep)
+	Prefix     string  // written after -prefix when a line starts with this source's item
+	Suffix     string  // written before -suffix when a line ends with this source's item
+}
+
+// Sources collects -source values; it implements flag.Value, and Set
+// returns a *SourceParseError for a malformed value.
+type Sources []Source
+
+func (s *Sources) Set(val string) error {
+	parts := strings.SplitN(val, ":", 2)
+	if mask, ok := strings.CutPrefix(val, maskPrefix); ok {
+		// The path of a mask source keeps its prefix; :depth follows the mask.
+		mask, spec, found := strings.Cut(mask, ":")
+		parts = []string{maskPrefix + mask}
+		if found {
+			parts = append(parts, spec)
+		}
+	}
+	if len(parts) != 2 {
+		return &SourceParseError{Value: val, Err: errors.New("missing :depth")}
+	}
+	depthSpec, opt, hasOpt := strings.Cut(parts[1], ":")
+	minSpec, maxSpec, hasMin := strings.Cut(depthSpec, "-")
+	if !hasMin {
+		maxSpec = minSpec
+	}
+	depth, err := strconv.Atoi(maxSpec)
+	if err != nil {
+		return &SourceParseError{Value: val, Path: parts[0], Err: err}
+	}
+	if depth < 1 {
+		return &SourceParseError{Value: val, Path: parts[0], Err: ErrInvalidDepth}
+	}
+	if mask, ok := strings.CutPrefix(parts[0], maskPrefix); ok {
+		if _, err := parseMask(mask); err != nil {
+			return &SourceParseError{Value: val, Path: parts[0], Err: err}
+		}
+	}
+	if IsStdinPath(parts[0]) {
+		for _, prev := range *s {
+			if IsStdinPath(prev.Path) {
+				return &SourceParseError{Value: val, Path: parts[0], Err: ErrDuplicateStdin}
+			}
+		}
+	}
+	src := Source{Path: parts[0], Depth: depth}
+	if hasMin {
+		if src.MinDepth, err = strconv.Atoi(minSpec); err != nil {
+			return &SourceParseError{Value: val, Path: parts[0], Err: err}
+		}
+		if src.MinDepth < 1 || src.MinDepth > depth {
+			return &SourceParseError{Value: val, Path: parts[0], Err: fmt.Errorf("%w: min %d, max %d", ErrInvalidDepth, src.MinDepth, depth)}
+		}
+	}
+	for hasOpt {
+		if sep, ok := strings.CutPrefix(opt, "sep="); ok {
+			// Taken literally, colons included, so it comes last.
+			src.Sep = &sep
+			break
+		}
+		var rest string
+		opt, rest, hasOpt = strings.Cut(opt, ":")
+		if affix, ok := strings.CutPrefix(opt, "prefix="); ok {
+			src.Prefix = affix
+		} else if affix, ok := strings.CutPrefix(opt, "suffix="); ok {
+			src.Suffix = affix
+		} else if chain, ok := strings.CutPrefix(opt, "transform="); ok {
+			if _, err := parseTransforms(chain); err != nil {
+				return &SourceParseError{Value: val, Path: parts[0], Err: err}
+			}
+			src.Transforms = chain
+		} else {
+			return &SourceParseError{Value: val, Path: parts[0], Err: fmt.Errorf("unknown source option %q", opt)}
+		}
+		opt = rest
+	}
+	*s = append(*s, src)
+	return nil
+}
+
+func (s *Sources) String() string {
+	parts := make([]string, len(*s))
+	for i, src := range *s {
+		parts[i] = fmt.Sprintf("%s:%d", src.Path, src.Depth)
+		if src.MinDepth > 0 {
+			parts[i] = fmt.Sprintf("%s:%d-%d", src.Path, src.MinDepth, src.Depth)
+		}
+		if src.Transforms != "" {
+			parts[i] += ":transform=" + src.Transforms
+		}
+		if src.Prefix != "" {
+			parts[i] += ":prefix=" + src.Prefix
+		}
+		if src.Suffix != "" {
+			parts[i] += ":suffix=" + src.Suffix
+		}
+		if src.Sep != nil {
+			parts[i] += ":sep=" + *src.Sep
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// LineFilter transforms a raw input line before it becomes an item, or drops
+// it by returning false.
+type LineFilter func(raw string) (string, bool)
+
+// Options holds the generation settings, one field per command-line flag.
+// Seps needs at least one separator ("" joins items directly).
+type Options struct {
+	Seps       []string
+	Prefix     string
+	Suffix     string
+	NoRepeats  bool
+	LimitTime  time.Duration // stop generation after this long (0 = no limit)
+	Reverse    bool          // emit in reverse sequential generation order
+	ReverseMax uint64        // refuse a buffered -reverse-output above this many lines (0 = no limit)
+	Workers    int           // goroutines generating concurrently (0 = one per CPU)
+	Sorted     bool          // deterministic output in sequential generation order
+
+	Context context.Context // stops generation once done, e.g. on SIGINT (nil = never)
+
+	Checkpoint string // file the progress is saved to periodically, for -resume ("" = off)
+	Resume     string // checkpoint file to continue from ("" = start over)
+	Progress   bool   // report lines, throughput and ETA to stderr periodically
+
+	LineBuffered bool   // flush stdout after every line for live consumers
+	Format       string // stdout encoding: text (one line each) or json (one array)
+
+	counted *lineCountingWriter // counts the lines written, below -format json and -output-encoding (nil = off)
+
+	OutputEncoding        string // character encoding of stdout ("" = UTF-8)
+	OutputEncodingReplace bool   // substitute runes the encoding lacks instead of failing
+
+	Stdout io.Writer // where lines are written when no output callback is given (nil = os.Stdout)
+	Stderr io.Writer // where reports such as -progress and -dedup-input go (nil = os.Stderr)
+
+	MinTokenLen int    // drop input items shorter than this many runes
+	MaxTokenLen int    // drop input items longer than this many runes (0 = no limit)
+	Charset     string // drop input items using characters outside this set, e.g. "a-z0-9"
+	Mutate      string // comma list of variants added for every item: lower, cap, upper, leet
+	Leet        string // most characters substituted per -leet variant of every line, or "all" ("" = off)
+	LeetTable   string // -leet and -mutate leet substitutions, e.g. "a=4@,e=3" ("" = defaultLeetTable, mutateLeetTable for -mutate leet)
+	ReadRetries int    // rescans of a source after a read error
+
+	MaxTotalItems int  // stop loading once this many items are pooled (0 = no cap)
+	DedupInput    bool // keep one copy of an item loaded more than once
+
+	Incremental    string // charset appended incrementally to every line ("" = off)
+	IncrementalMax int    // longest incremental suffix
+
+	MutateCase string   // comma list of case variants every line is written in: capitalize, upper, lower, toggle
+	Rules      []string // hashcat rules from -rules; every line is written once per rule (nil = off)
+
+	SortExternal bool // sort and de-duplicate output through temp-file runs
+	SortMemory   int  // bytes buffered before spilling a sorted run
+
+	NoCrossSource       bool     // every sequence draws only from its first item's source
+	NoConsecutiveSource bool     // adjacent items never come from the same source
+	Slots               bool     // sources are template positions: item d comes from source d
+	Gaps                []string // -template text written between items instead of the separator
+	Combinations        bool     // emit every unordered selection of items once (a-b, never b-a)
+
+	MinFrom map[int]int // source index -> items every sequence must take from it
+
+	MinDepth     int           // shortest sequence emitted by sources without their own minimum (0 = 1)
+	srcMinDepths []int         // each source's resolved minimum, filled in by withSources
+	srcSeps      []*string     // each source's own separator, filled in by withSources (nil = none has one)
+	srcAffixes   sourceAffixes // each source's own prefix and suffix, filled in by withSources
+
+	DFSOrder        string // order items are tried in: forward, reverse or random
+	DFSSeed         int64  // seed of the random dfs order
+	ReverseSources  bool   // start sequences from the last source's items first
+	OrderedByWeight bool   // items are read as word<TAB>weight; lines come out heaviest first
+
+	LineFilter LineFilter // applied to each scanned line before load filters (nil = none)
+
+	FailOnDuplicate bool    // abort with an error on the first repeated output line
+	LimitUnique     int     // stop once this many distinct lines were written (0 = no limit)
+	DiffAgainst     string  // only emit lines absent from this previous output file
+	HashShard       string  // "i/n": only emit lines whose content hashes to shard i of n
+	MinLen          int     // only emit lines of at least this many runes
+	MaxLen          int     // only emit lines of at most this many runes (0 = no limit)
+	ExcludeChars    string  // only emit lines containing none of these characters
+	Unique          bool    // drop lines already written (exact, in memory)
+	UniqueBloom     float64 // false positive rate of a bloom filter replacing the exact -unique set (0 = exact)
+	UniqueExactMax  int     // distinct lines -unique tracks exactly before switching to the bloom filter (0 = always)
+	Skip            int     // drop the first skip lines that would be written (-skip)
+	Limit           int     // stop after writing this many lines (0 = no limit)
+	Sample          int     // write this many lines drawn uniformly from the space instead (0 = off)
+	SampleSeed      int64   // seed of the -sample draw
+
+	ExcludeFiles []string // only emit lines absent from all of these lists of already tried lines
+	Match        []string // only emit lines matching every one of these regular expressions
+	ExcludeMatch []string // only emit lines matching none of these regular expressions
+
+	TokenMap    string  // file of canonical<TAB>display replacements applied to emitted items
+	SanitizeSep *string // replaces separator occurrences inside items (nil = off)
+	TokenWrap   string  // opening then closing marker put around every item, e.g. "[]"
+
+	HeaderLine string // written once before the first line
+	FooterLine string // written once after the last line, on success only
+}
+
+// --- Patch points for testability (must be defined at package level) ---
+
+var (
+	osOpen                    = func(name string) (*os.File, error) { return os.Open(name) }
+	bufioNewScanner           = func(file *os.File) *bufio.Scanner { return bufio.NewScanner(file) }
+	stdout          io.Writer = os.Stdout              // default of Options.Stdout
+	stderr          io.Writer = os.Stderr              // default of Options.Stderr
+	readRetryDelay            = 100 * time.Millisecond // first -read-retries backoff, doubled each retry
+)
+
+// stdout returns the writer lines go to.
+func (o Options) stdout() io.Writer {
+	if o.Stdout != nil {
+		return o.Stdout
+	}
+	return stdout
+}
+
+// stderr returns the writer reports go to.
+func (o Options) stderr() io.Writer {
+	if o.Stderr != nil {
+		return o.Stderr
+	}
+	return stderr
+}
+
+// --- Fast Permutator Implementation ---
+
+// PermutatorFast writes the sequences of loaded items to a writer,
+// generating from every start item concurrently.
+type PermutatorFast struct {
+	allItems  []string
+	srcOfItem []int
+	srcDepths []int
+	seps      []string
+	prefix    string
+	suffix    string
+	noRepeats bool
+
+	out     *bufio.Writer
+	writer  io.Writer  // destination behind out
+	mu      sync.Mutex // protects out and written
+	written uint64     // lines handed to out
+
+	startsDone atomic.Int64 // start items fully generated
+
+	flushedStarts int    // starts generateSorted wrote in full, under mu
+	flushedLines  uint64 // written once the last of them was, under mu
+
+	pool sync.Pool // for *strings.Builder
+
+	stopped atomic.Bool // set by Stop, checked on every dfs step
+
+	leet     func(string, func(string)) // -leet variants fanned out per line after the suffixes (nil = none)
+	rewrites []func(string) string      // -mutate-case and -rules fanned out per variant (nil = none)
+
+	lineSuffixes []string // incremental suffixes fanned out per line (nil = none)
+	lineBuffered bool     // flush after every line instead of every 64 KiB
+	workers      int      // size of the Generate worker pool (0 = runtime.NumCPU())
+	sorted       bool     // write lines in sequential generation order
+
+	noCrossSource       bool
+	noConsecutiveSource bool
+	slots               bool     // position d only takes items of source d (-slot)
+	gaps                []string // -template text between items, {sep} expanded (nil = the separator)
+	combinations        bool     // items only follow items loaded before them (-combinations)
+
+	order  []int // item indices in the order they are tried (-dfs-order)
+	starts []int // first items in the order they are started (nil = order)
+
+	minFrom   sourceMinimums // items every sequence needs per source (nil = none)
+	minDepths []int          // shortest emitted sequence per source (nil = 1)
+	lenBound  *lengthBound   // prunes sequences too long for -max-len (nil = none)
+	srcSeps   []*string      // separator written before each source's items (nil = the line's -sep)
+	affixes   sourceAffixes  // prefix/suffix of the first/last item's source (nil = none)
+
+	gate *outputGate // emit-time checks, guarded by mu (nil = none)
+}
+
+// NewPermutatorFast returns a permutator over allItems, where srcOfItem[i] is
+// the source of item i and srcDepths the depth of each source.
+func NewPermutatorFast(
+	allItems []string, srcOfItem []int, srcDepths []int,
+	seps []string, prefix, suffix string, noRepeats bool,
+	writer io.Writer,
+) *PermutatorFast {
+	p := &PermutatorFast{
+		allItems:  allItems,
+		srcOfItem: srcOfItem,
+		srcDepths: srcDepths,
+		seps:      seps,
+		prefix:    prefix,
+		suffix:    suffix,
+		noRepeats: noRepeats,
+		out:       bufio.NewWriterSize(writer, 64*1024), // 64 KiB buffer
+		writer:    writer,
+	}
+	p.pool.New = func() any { return &strings.Builder{} }
+	p.order, _ = candidateOrder(len(allItems), "forward", 0)
+	return p
+}
+
+// WithFlushCallback makes Generate call fn with the number of bytes handed to
+// the destination writer each time the output buffer is flushed, so live
+// consumers can track actual delivery. Set it before calling Generate.
+func (p *PermutatorFast) WithFlushCallback(fn func(n int)) *PermutatorFast {
+	p.out.Reset(&flushNotifier{w: p.writer, fn: fn})
+	return p
+}
+
+// flushNotifier reports every write reaching the destination, i.e. every flush.
+type flushNotifier struct {
+	w  io.Writer
+	fn func(n int)
+}
+
+func (f *flushNotifier) Write(b []byte) (int, error) {
+	n, err := f.w.Write(b)
+	f.fn(n)
+	return n, err
+}
+
+// Stop asks a running Generate to return early. Lines already written stay
+// complete and are flushed; it is safe to call from any goroutine.
+func (p *PermutatorFast) Stop() {
+	p.stopped.Store(true)
+}
+
+func (p *PermutatorFast) writeLine(s string) {
+	p.mu.Lock()
+	if p.leet != nil || p.rewrites != nil {
+		if p.lineSuffixes == nil {
+			p.writeVariants(s)
+		}
+		for _, sfx := range p.lineSuffixes {
+			p.writeVariants(s + sfx)
+		}
+	} else if p.lineSuffixes == nil {
+		if p.gate.allow(s) {
+			p.out.WriteString(s)
+			p.out.WriteByte('\n')
+			p.written++
+		}
+	} else {
+		for _, sfx := range p.lineSuffixes {
+			if p.gate != nil && !p.gate.allow(s+sfx) {
+				continue
+			}
+			p.out.WriteString(s)
+			p.out.WriteString(sfx)
+			p.out.WriteByte('\n')
+			p.written++
+		}
+	}
+	if p.lineBuffered {
+		// Under mu, so a flush never splits a line.
+		p.out.Flush()
+	}
+	p.mu.Unlock()
+}
+
+// writeVariants writes every -leet variant of s once per line rewrite.
+// Called with mu held.
+func (p *PermutatorFast) writeVariants(s string) {
+	if p.leet != nil {
+		p.leet(s, p.writeRewritten)
+	} else {
+		p.writeRewritten(s)
+	}
+}
+
+// writeRewritten writes s once per line rewrite, or as is without them.
+// Called with mu held.
+func (p *PermutatorFast) writeRewritten(s string) {
+	if p.rewrites == nil {
+		p.writeChecked(s)
+	}
+	for _, rw := range p.rewrites {
+		p.writeChecked(rw(s))
+	}
+}
+
+// writeChecked writes line if the output gate allows it. Called with mu held.
+func (p *PermutatorFast) writeChecked(line string) {
+	if !p.gate.allow(line) {
+		return
+	}
+	p.out.WriteString(line)
+	p.out.WriteByte('\n')
+	p.written++
+}
+
+// dfs writes every line extending path. With lines non-nil the lines are
+// collected there instead of written, for -sorted.
+func (p *PermutatorFast) dfs(path []int, depth, maxDepth int, used []bool, lines *[]string) {
+	if p.stopped.Load() || p.lenBound.exceeds(path[:depth]) {
+		return
+	}
+	last := path[depth-1]
+
+	if p.noRepeats {
+		used[last] = true
+		defer func() { used[last] = false }()
+	}
+
+	// Sequences shorter than the minimum are still extended, just not written.
+	emit := p.minDepths == nil || depth >= p.minDepths[p.srcOfItem[path[0]]]
+	if p.minFrom != nil {
+		// Lines missing required items are skipped; extensions that cannot
+		// make up for them are pruned.
+		deficit := p.minFrom.deficit(path[:depth], p.srcOfItem)
+		if deficit > maxDepth-depth {
+			return
+		}
+		emit = emit && deficit == 0
+	}
+
+	if emit {
+		for _, sep := range p.lineSeps(path[:depth]) {
+			builder := p.pool.Get().(*strings.Builder)
+			builder.Reset()
+
+			srcPrefix, srcSuffix := p.affixes.around(p.srcOfItem, path[:depth])
+			builder.WriteString(p.prefix)
+			builder.WriteString(srcPrefix)
+			builder.WriteString(p.allItems[path[0]])
+			for i := 1; i < depth; i++ {
+				if p.gaps != nil {
+					builder.WriteString(templateGap(p.gaps[i-1], sep))
+				} else {
+					builder.WriteString(sourceSep(sep, p.srcSeps, p.srcOfItem, path[i]))
+				}
+				builder.WriteString(p.allItems[path[i]])
+			}
+			builder.WriteString(srcSuffix)
+			builder.WriteString(p.suffix)
+
+			if lines != nil {
+				*lines = append(*lines, builder.String())
+			} else {
+				p.writeLine(builder.String())
+			}
+			p.pool.Put(builder)
+		}
+	}
+
+	if depth == maxDepth {
+		return
+	}
+
+	for _, next := range p.order {
+		if p.noRepeats && used[next] {
+			continue
+		}
+		if p.noCrossSource && p.srcOfItem[next] != p.srcOfItem[path[0]] {
+			continue
+		}
+		if p.noConsecutiveSource && p.srcOfItem[next] == p.srcOfItem[last] {
+			continue
+		}
+		if p.slots && p.srcOfItem[next] != depth {
+			continue
+		}
+		if p.combinations && next < last {
+			continue
+		}
+		path[depth] = next
+		p.dfs(path, depth+1, maxDepth, used, lines)
+	}
+}
+
+// lineSeps returns the separators to write the line of path with.
+func (p *PermutatorFast) lineSeps(path []int) []string {
+	return pathSeps(p.seps, p.srcSeps, p.srcOfItem, path)
+}
+
+// Generate writes every line and flushes the writer; lines of different
+// start items interleave unless the permutator is sorted.
+func (p *PermutatorFast) Generate() {
+	var wg sync.WaitGroup
+	n := len(p.allItems)
+
+	starts := p.startItems()
+	workers := p.workers
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+	workers = min(workers, len(starts))
+	longest := 0
+	for _, d := range p.srcDepths {
+		longest = max(longest, d)
+	}
+	if p.sorted {
+		p.generateSorted(starts, workers, longest)
+		p.out.Flush()
+		return
+	}
+
+	// A bounded pool pulls start items off jobs. Each worker owns one path
+	// and one used buffer for all its starts: dfs clears every used flag it
+	// sets before returning, so the buffer is clean again after each start.
+	jobs := make(chan int)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			path := make([]int, longest)
+			used := make([]bool, n)
+			for start := range jobs {
+				path[0] = start
+				p.dfs(path, 1, p.srcDepths[p.srcOfItem[start]], used, nil)
+				if !p.stopped.Load() {
+					p.startsDone.Add(1)
+				}
+			}
+		}()
+	}
+	for _, i := range starts {
+		if p.stopped.Load() {
+			break
+		}
+		jobs <- i
+	}
+	close(jobs)
+
+	wg.Wait()
+	p.out.Flush()
+}
+
+// startItems returns the items sequences are started from, in order.
+func (p *PermutatorFast) startItems() []int {
+	if p.starts == nil {
+		return p.order
+	}
+	return p.starts
+}
+
+// generateSorted runs the same worker pool as Generate but collects each
+// start's lines separately and writes them in start order, giving the output
+// of the sequential permutator. At most 2*workers starts are in flight, so
+// only their lines are held while an earlier start is still running.
+func (p *PermutatorFast) generateSorted(starts []int, workers, longest int) {
+	type rootLines struct {
+		k        int // position in starts
+		lines    []string
+		complete bool // false when Stop cut the start short
+	}
+	jobs := make(chan int)
+	done := make(chan rootLines)
+	window := make(chan struct{}, 2*workers)
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			path := make([]int, longest)
+			used := make([]bool, len(p.allItems))
+			for k := range jobs {
+				var lines []string
+				path[0] = starts[k]
+				p.dfs(path, 1, p.srcDepths[p.srcOfItem[starts[k]]], used, &lines)
+				complete := !p.stopped.Load()
+				if complete {
+					p.startsDone.Add(1)
+				}
+				done <- rootLines{k: k, lines: lines, complete: complete}
+			}
+		}()
+	}
+	go func() {
+		for k := range starts {
+			if p.stopped.Load() {
+				break
+			}
+			window <- struct{}{}
+			jobs <- k
+		}
+		close(jobs)
+		wg.Wait()
+		close(done)
+	}()
+
+	// Once a start comes back incomplete nothing after it is written, so the
+	// output stays a prefix of the sequential order and can be resumed.
+	pending := make(map[int]rootLines)
+	next := 0
+	cut := false
+	for r := range done {
+		pending[r.k] = r
+		for r, ok := pending[next]; ok; r, ok = pending[next] {
+			delete(pending, next)
+			if !cut {
+				for _, line := range r.lines {
+					p.writeLine(line)
+				}
+				if cut = !r.complete; !cut {
+					p.mu.Lock()
+					p.flushedStarts++
+					p.flushedLines = p.written
+					p.mu.Unlock()
+				}
+			}
+			next++
+			<-window
+		}
+	}
+}
+
+// lineSeps returns the separators a line of depth items is written with: a
+// single item has no separator to vary, so it is written once.
+func lineSeps(seps []string, depth int) []string {
+	if depth == 1 && len(seps) > 1 {
+		return seps[:1]
+	}
+	return seps
+}
+
+// --- Original Permutator (for testability/callbacks) ---
+
+type permutator struct {
+	allItems  []string
+	srcOfItem []int
+	srcDepths []int
+	seps      []string
+	prefix    string
+	suffix    string
+	noRepeats bool
+	output    func(string)
+
+	noCrossSource       bool
+	noConsecutiveSource bool
+	slots               bool     // position d only takes items of source d (-slot)
+	gaps                []string // -template text between items, {sep} expanded (nil = the separator)
+	combinations        bool     // items only follow items loaded before them (-combinations)
+
+	order  []int // item indices in the order they are tried (-dfs-order)
+	starts []int // first items in the order they are started
+
+	minFrom   sourceMinimums // items every sequence needs per source (nil = none)
+	minDepths []int          // shortest emitted sequence per source (nil = 1)
+	lenBound  *lengthBound   // prunes sequences too long for -max-len (nil = none)
+	srcSeps   []*string      // separator written before each source's items (nil = the line's -sep)
+	affixes   sourceAffixes  // prefix/suffix of the first/last item's source (nil = none)
+
+	stopped atomic.Bool
+}
+
+func (p *permutator) Stop() {
+	p.stopped.Store(true)
+}
+
+// newPermutatorFor builds a sequential permutator over already loaded items.
+func newPermutatorFor(allItems []string, srcOfItem, srcDepths []int, opts Options, output func(string)) *permutator {
+	// An invalid order is rejected by Validate; fall back to forward.
+	order, err := candidateOrder(len(allItems), opts.DFSOrder, opts.DFSSeed)
+	if err != nil {
+		order, _ = candidateOrder(len(allItems), "forward", 0)
+	}
+	return &permutator{
+		allItems:  allItems,
+		srcOfItem: srcOfItem,
+		srcDepths: srcDepths,
+		seps:      opts.Seps,
+		prefix:    opts.Prefix,
+		suffix:    opts.Suffix,
+		noRepeats: opts.NoRepeats,
+		output:    opts.fanOut(opts.leetLines(opts.rewriteLines(output))),
+
+		noCrossSource:       opts.NoCrossSource,
+		noConsecutiveSource: opts.NoConsecutiveSource,
+		slots:               opts.Slots,
+		gaps:                opts.Gaps,
+		combinations:        opts.Combinations,
+
+		order:  order,
+		starts: opts.startOrder(order, srcOfItem, len(srcDepths)),
+
+		minFrom:   opts.minimums(len(srcDepths)),
+		minDepths: opts.minDepths(len(srcDepths)),
+		lenBound:  newLengthBound(allItems, opts),
+		srcSeps:   opts.srcSeps,
+		affixes:   opts.srcAffixes,
+	}
+}
+
+func (p *permutator) generate() {
+	n := len(p.allItems)
+	used := make([]bool, n)
+	for _, i := range p.starts {
+		src := p.srcOfItem[i]
+		maxDepth := p.srcDepths[src]
+		p.dfs([]int{i}, used, maxDepth)
+	}
+}
+
+func (p *permutator) dfs(path []int, used []bool, maxDepth int) {
+	if p.stopped.Load() || p.lenBound.exceeds(path) {
+		return
+	}
+	depth := len(path)
+	last := path[depth-1]
+	if p.noRepeats {
+		used[last] = true
+		defer func() { used[last] = false }()
+	}
+	emit := depth <= maxDepth && (p.minDepths == nil || depth >= p.minDepths[p.srcOfItem[path[0]]])
+	if p.minFrom != nil {
+		deficit := p.minFrom.deficit(path, p.srcOfItem)
+		if deficit > maxDepth-depth {
+			return
+		}
+		emit = emit && deficit == 0
+	}
+	if emit {
+		p.emit(path)
+	}
+	if depth == maxDepth {
+		return
+	}
+	for _, next := range p.order {
+		if p.noRepeats && used[next] {
+			continue
+		}
+		if p.noCrossSource && p.srcOfItem[next] != p.srcOfItem[path[0]] {
+			continue
+		}
+		if p.noConsecutiveSource && p.srcOfItem[next] == p.srcOfItem[last] {
+			continue
+		}
+		if p.slots && p.srcOfItem[next] != depth {
+			continue
+		}
+		if p.combinations && next < last {
+			continue
+		}
+		p.dfs(append(path, next), used, maxDepth)
+	}
+}
+
+// emit writes the line of path, once per separator it is written with.
+func (p *permutator) emit(path []int) {
+	for _, sep := range pathSeps(p.seps, p.srcSeps, p.srcOfItem, path) {
+		var b strings.Builder
+		srcPrefix, srcSuffix := p.affixes.around(p.srcOfItem, path)
+		b.WriteString(p.prefix)
+		b.WriteString(srcPrefix)
+		for j, idx := range path {
+			if j > 0 && p.gaps != nil {
+				b.WriteString(templateGap(p.gaps[j-1], sep))
+			} else if j > 0 {
+				b.WriteString(sourceSep(sep, p.srcSeps, p.srcOfItem, idx))
+			}
+			b.WriteString(p.allItems[idx])
+		}
+		b.WriteString(srcSuffix)
+		b.WriteString(p.suffix)
+		if p.output != nil {
+			p.output(b.String())
+		} else {
+			fmt.Println(b.String())
+		}
+	}
+}
+
+// --- Source Loading ---
+
+// loadSources reads every source into one pool, remembering which source each
+// item came from. Generation and counting both load through here so that the
+// input filters are applied identically. With opts.MaxTotalItems set, loading
+// stops once the pool holds that many items; later sources contribute none.
+// With opts.DedupInput, repeated items are collapsed and the number dropped
+// is reported on stderr.
+func loadSources(sources []Source, opts Options) (allItems []string, srcOfItem []int, srcDepths []int, err error) {
+	allItems, _, srcOfItem, srcDepths, err = loadWeightedSources(sources, opts)
+	return allItems, srcOfItem, srcDepths, err
+}
+
+// loadWrittenSources is loadSources returning the items as they are written:
+// after -token-map, per-source transforms, -sanitize-sep and -token-wrap.
+func loadWrittenSources(sources []Source, opts Options) (allItems []string, srcOfItem []int, srcDepths []int, err error) {
+	if allItems, srcOfItem, srcDepths, err = loadSources(sources, opts); err != nil {
+		return nil, nil, nil, err
+	}
+	allItems, err = opts.writtenItems(sources, allItems, srcOfItem)
+	return allItems, srcOfItem, srcDepths, err
+}
+
+// writtenItems turns loaded items into the text written for them.
+func (o Options) writtenItems(sources []Source, items []string, srcOfItem []int) ([]string, error) {
+	items, err := o.mapItems(items)
+	if err != nil {
+		return nil, err
+	}
+	items = transformItems(sources, items, srcOfItem)
+	return o.wrapItems(o.sanitizeItems(items)), nil
+}
+
+// loadWeightedSources is loadSources also returning each item's weight under
+// -ordered-by-weight, where source lines read "word<TAB>weight" (nil
+// otherwise). Variants made by -mutate inherit their item's weight.
+func loadWeightedSources(sources []Source, opts Options) (allItems []string, weights []float64, srcOfItem []int, srcDepths []int, err error) {
+	keepItem, err := opts.itemFilter()
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	for srcIdx, src := range sources {
+		limit := -1
+		if opts.MaxTotalItems > 0 {
+			limit = opts.MaxTotalItems - len(allItems)
+		}
+		if limit == 0 {
+			srcDepths = append(srcDepths, src.Depth)
+			continue
+		}
+		items, err := readSource(src, opts, keepItem, limit)
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		if opts.OrderedByWeight {
+			items, itemWeights, err := splitWeights(src.Path, items)
+			if err != nil {
+				return nil, nil, nil, nil, err
+			}
+			for i, item := range items {
+				for _, v := range opts.mutateItems([]string{item}) {
+					allItems = append(allItems, v)
+					weights = append(weights, itemWeights[i])
+					srcOfItem = append(srcOfItem, srcIdx)
+				}
+			}
+			srcDepths = append(srcDepths, src.Depth)
+			continue
+		}
+		for _, item := range opts.mutateItems(items) {
+			allItems = append(allItems, item)
+			srcOfItem = append(srcOfItem, srcIdx)
+		}
+		srcDepths = append(srcDepths, src.Depth)
+	}
+	if opts.DedupInput {
+		var dropped int
+		if allItems, srcOfItem, dropped = dedupItems(allItems, srcOfItem, srcDepths); dropped > 0 {
+			fmt.Fprintf(opts.stderr(), "dedup-input: collapsed %d duplicate items\n", dropped)
+		}
+	}
+	return allItems, weights, srcOfItem, srcDepths, nil
+}
+
+// readSource reads one source's items. When reading fails part way (as
+// opposed to a clean EOF), the source is rescanned from the start up to
+// opts.ReadRetries times, with a doubling delay between attempts. At most
+// limit items are read (limit < 0 = no limit).
+func readSource(src Source, opts Options, keepItem func(string) bool, limit int) ([]string, error) {
+	for attempt := 0; ; attempt++ {
+		items, readErr, err := scanSource(src, opts, keepItem, limit)
+		if err != nil {
+			return nil, err
+		}
+		if readErr == nil {
+			return items, nil
+		}
+		// stdin cannot be rescanned: a failed read of it is final.
+		if attempt >= opts.ReadRetries || errors.Is(readErr, bufio.ErrTooLong) || IsStdinPath(src.Path) {
+			return nil, &SourceReadError{Path: src.Path, Retries: attempt, Err: readErr}
+		}
+		time.Sleep(readRetryDelay << attempt)
+	}
+}
+
+// scanSource makes one pass over a source. err reports a failure to open it;
+// readErr a failure while scanning, which is worth retrying.
+func scanSource(src Source, opts Options, keepItem func(string) bool, limit int) (items []string, readErr error, err error) {
+	var scanner *bufio.Scanner
+	if src.Items != nil {
+		scanner = bufio.NewScanner(strings.NewReader(strings.Join(src.Items, "\n")))
+	} else if mask, ok := strings.CutPrefix(src.Path, maskPrefix); ok {
+		r, err := newMaskReader(mask)
+		if err != nil {
+			return nil, nil, &SourceOpenError{Path: src.Path, Err: err}
+		}
+		scanner = bufio.NewScanner(r)
+	} else if IsStdinPath(src.Path) {
+		data, err := readStdin()
+		if err != nil {
+			return nil, err, nil
+		}
+		scanner = bufio.NewScanner(bytes.NewReader(data))
+	} else {
+		file, err := osOpen(src.Path)
+		if err != nil {
+			return nil, nil, &SourceOpenError{Path: src.Path, Err: err}
+		}
+		defer file.Close()
+		if dec, err := newDecompressor(src.Path, file); err != nil {
+			return nil, err, nil
+		} else if dec != nil {
+			defer dec.Close()
+			scanner = bufio.NewScanner(dec)
+		} else {
+			scanner = bufioNewScanner(file)
+		}
+	}
+	for scanner.Scan() {
+		line := scanner.Text()
+		var weight string
+		if opts.OrderedByWeight {
+			// The filters see the word; loadSources splits the weight off again.
+			line, weight, _ = strings.Cut(line, "\t")
+		}
+		if opts.LineFilter != nil {
+			var keep bool
+			if line, keep = opts.LineFilter(line); !keep {
+				continue
+			}
+		}
+		if line == "" || !keepItem(line) {
+			continue
+		}
+		if weight != "" {
+			line += "\t" + weight
+		}
+		items = append(items, line)
+		if len(items) == limit {
+			break
+		}
+	}
+	return items, scanner.Err(), nil
+}
+
+// itemFilter returns the load-time check deciding whether an input item is
+// kept, with any per-run setup (like parsing -charset) done once.
+func (o Options) itemFilter() (func(item string) bool, error) {
+	var allowed *charSet
+	if o.Charset != "" {
+		set, err := parseCharset(o.Charset)
+		if err != nil {
+			return nil, err
+		}
+		allowed = set
+	}
+	return func(item string) bool {
+		if o.MinTokenLen > 0 || o.MaxTokenLen > 0 {
+			n := utf8.RuneCountInString(item)
+			if n < o.MinTokenLen || (o.MaxTokenLen > 0 && n > o.MaxTokenLen) {
+				return false
+			}
+		}
+		if allowed != nil && !allowed.containsAll(item) {
+			return false
+		}
+		return true
+	}, nil
+}
+
+// --- Fast Permutator Entry Point ---
+
+// RunPermutatorFast loads sources and generates every line opts describes,
+// passing each to output, or writing it to opts.Stdout when output is nil.
+func RunPermutatorFast(sources []Source, opts Options, output func(string)) (err error) {
+	// A resumed run skips the lines of its first start item written before.
+	var resumed checkpointState
+	var checkpointConfig string
+	if opts.Checkpoint != "" || opts.Resume != "" {
+		if output != nil {
+			return errors.New("-checkpoint and -resume only apply to generation to stdout")
+		}
+		checkpointConfig = checkpointKey(sources, opts)
+		if opts.Resume != "" {
+			if resumed, err = loadCheckpoint(opts.Resume, checkpointConfig); err != nil {
+				return err
+			}
+			opts.Skip = int(resumed.StartLines)
+		}
+	}
+
+	allItems, weights, srcOfItem, srcDepths, err := loadWeightedSources(sources, opts)
+	if err != nil {
+		return err
+	}
+	opts = opts.withSources(sources)
+	if allItems, err = opts.writtenItems(sources, allItems, srcOfItem); err != nil {
+		return err
+	}
+
+	if opts.Reverse && opts.ReverseMax > 0 && !opts.reversesByUnranking() {
+		// Reversing buffers every line, so bound it like -count-exact.
+		total := big.NewInt(0)
+		for _, cnt := range countByDepth(allItems, srcOfItem, srcDepths, opts) {
+			total.Add(total, cnt)
+		}
+		if total.Cmp(new(big.Int).SetUint64(opts.ReverseMax)) > 0 {
+			return fmt.Errorf("-reverse-output would buffer %s lines, more than -reverse-output-max %d", total, opts.ReverseMax)
+		}
+	}
+
+	// Transcoding sits closest to the real stdout, below JSON.
+	out := opts.stdout()
+	if output == nil {
+		if enc, _ := lookupOutputEncoding(opts.OutputEncoding); enc != nil {
+			ew := newEncodingWriter(out, opts.OutputEncoding, enc, opts.OutputEncodingReplace)
+			out = ew
+			defer func() {
+				if cerr := ew.Close(); err == nil {
+					err = cerr
+				}
+			}()
+		}
+	}
+
+	// JSON wraps whatever reaches stdout, header and footer included.
+	if output == nil && opts.Format == "json" {
+		jw := newJSONArrayWriter(out)
+		out = jw
+		defer func() {
+			if cerr := jw.Close(); err == nil {
+				err = cerr
+			}
+		}()
+	}
+
+	// The header goes out even if generation is cut short; the footer only
+	// once it completed without error. Both bypass the emit-time checks and
+	// the line count.
+	raw := output
+	if raw == nil {
+		w := out
+		raw = func(s string) { fmt.Fprintln(w, s) }
+	}
+	if opts.HeaderLine != "" {
+		raw(opts.HeaderLine)
+	}
+	if opts.FooterLine != "" {
+		defer func() {
+			if err == nil {
+				raw(opts.FooterLine)
+			}
+		}()
+	}
+
+	// Lines are counted as generated, before JSON framing and transcoding.
+	if output == nil && opts.counted != nil {
+		opts.counted.w = out
+		out = opts.counted
+	}
+
+	// Sorted and buffered reversed output is cut by -skip and -limit once
+	// reordered, at the sink, not as it is generated.
+	unranked := opts.Sample > 0 || opts.reversesByUnranking()
+	reordered := opts.SortExternal || (opts.Reverse && !unranked)
+	gateOpts := opts
+	if reordered {
+		gateOpts.Skip, gateOpts.Limit = 0, 0
+	}
+	gate, err := newSizedOutputGate(allItems, srcOfItem, srcDepths, gateOpts)
+	if err != nil {
+		return err
+	}
+	defer gate.reportUnique(opts.stderr())
+	newPermutator := func(output func(string)) *permutator {
+		p := newPermutatorFor(allItems, srcOfItem, srcDepths, opts, gate.wrap(output))
+		if gate != nil {
+			gate.stop = p.Stop
+		}
+		return p
+	}
+
+	// Sorted and reversed output are produced after generation completes.
+	sink := output
+	if sink == nil && reordered {
+		w := bufio.NewWriterSize(out, 64*1024)
+		defer w.Flush()
+		sink = writeLines(w)
+		if opts.LineBuffered {
+			write := sink
+			sink = func(s string) {
+				write(s)
+				w.Flush()
+			}
+		}
+	}
+	if reordered {
+		sink = cutLines(sink, opts.Skip, opts.Limit)
+	}
+
+	// -sample and plain -reverse-output unrank the lines they write instead
+	// of generating the space.
+	if unranked {
+		sink := output
+		if sink == nil {
+			w := bufio.NewWriterSize(out, 64*1024)
+			defer w.Flush()
+			sink = writeLines(w)
+			if opts.LineBuffered {
+				write := sink
+				sink = func(s string) {
+					write(s)
+					w.Flush()
+				}
+			}
+		}
+		var stopped atomic.Bool
+		stop := func() { stopped.Store(true) }
+		if gate != nil {
+			gate.stop = stop
+		}
+		defer stopAfter(opts.LimitTime, stop)()
+		defer stopOnDone(opts.context(), stop)()
+		unrank := sampleLines
+		if opts.Sample == 0 {
+			unrank = reverseLines
+		}
+		if err := unrank(allItems, srcOfItem, srcDepths, opts, gate.wrap(sink), stopped.Load); err != nil {
+			return err
+		}
+		return errors.Join(gate.result(), opts.context().Err())
+	}
+
+	if opts.OrderedByWeight {
+		if sink == nil {
+			w := bufio.NewWriterSize(out, 64*1024)
+			defer w.Flush()
+			sink = writeLines(w)
+			if opts.LineBuffered {
+				write := sink
+				sink = func(s string) {
+					write(s)
+					w.Flush()
+				}
+			}
+		}
+		p := newPermutator(sink)
+		defer stopAfter(opts.LimitTime, p.Stop)()
+		defer stopOnDone(opts.context(), p.Stop)()
+		p.generateByWeight(weights)
+		return errors.Join(gate.result(), opts.context().Err())
+	}
+
+	if opts.SortExternal {
+		sorter := newExternalSorter("", opts.SortMemory)
+		var sortErr error
+		var p *permutator
+		p = newPermutator(func(s string) {
+			if err := sorter.add(s); err != nil && sortErr == nil {
+				sortErr = err
+				p.Stop()
+			}
+		})
+		stop := stopAfter(opts.LimitTime, p.Stop)
+		cancel := stopOnDone(opts.context(), p.Stop)
+		p.generate()
+		stop()
+		cancel()
+		if err := errors.Join(sortErr, gate.result(), opts.context().Err()); err != nil {
+			sorter.cleanup()
+			return err
+		}
+		return sorter.finish(sink)
+	}
+
+	if opts.Reverse {
+		// Other modes cannot be unranked: reversing needs the whole
+		// sequential order, so the output is buffered.
+		var lines []string
+		p := newPermutator(func(s string) { lines = append(lines, s) })
+		stop := stopAfter(opts.LimitTime, p.Stop)
+		cancel := stopOnDone(opts.context(), p.Stop)
+		p.generate()
+		stop()
+		cancel()
+		if err := errors.Join(gate.result(), opts.context().Err()); err != nil {
+			return err
+		}
+
+		for i := len(lines) - 1; i >= 0; i-- {
+			sink(lines[i])
+		}
+		return nil
+	}
+
+	if output != nil {
+		p := newPermutator(output)
+		defer stopAfter(opts.LimitTime, p.Stop)()
+		defer stopOnDone(opts.context(), p.Stop)()
+		p.generate()
+		return errors.Join(gate.result(), opts.context().Err())
+	}
+
+	fast := NewPermutatorFast(allItems, srcOfItem, srcDepths, opts.Seps, opts.Prefix, opts.Suffix, opts.NoRepeats, out)
+	if opts.Incremental != "" {
+		fast.lineSuffixes = incrementalSuffixes(opts.Incremental, opts.IncrementalMax)
+	}
+	fast.leet = opts.leetFanOut()
+	fast.rewrites = opts.lineRewrites()
+	fast.lineBuffered = opts.LineBuffered
+	fast.workers = opts.Workers
+	// Line numbers must be stable across runs for -skip, -limit and -resume.
+	fast.sorted = opts.Sorted || opts.Skip > 0 || opts.Limit > 0 || checkpointConfig != ""
+	fast.noCrossSource = opts.NoCrossSource
+	fast.noConsecutiveSource = opts.NoConsecutiveSource
+	fast.slots = opts.Slots
+	fast.gaps = opts.Gaps
+	fast.combinations = opts.Combinations
+	if order, err := candidateOrder(len(allItems), opts.DFSOrder, opts.DFSSeed); err == nil {
+		fast.order = order
+	}
+	fast.starts = opts.startOrder(fast.order, srcOfItem, len(srcDepths))
+	totalStarts := len(fast.startItems())
+	if opts.Resume != "" {
+		fast.starts = fast.startItems()[min(resumed.Starts, totalStarts):]
+	}
+	if gate != nil && gate.skip > 0 {
+		fast.starts, gate.skip = skipWholeStarts(fast.startItems(), srcOfItem, srcDepths, opts, gate.skip)
+	}
+	fast.minFrom = opts.minimums(len(srcDepths))
+	fast.minDepths = opts.minDepths(len(srcDepths))
+	fast.lenBound = newLengthBound(allItems, opts)
+	fast.srcSeps = opts.srcSeps
+	fast.affixes = opts.srcAffixes
+	if gate != nil {
+		fast.gate = gate
+		gate.stop = fast.Stop
+	}
+	if opts.Checkpoint != "" {
+		base := resumed
+		base.Config, base.TotalStarts = checkpointConfig, totalStarts
+		stopCheckpoints := (&checkpointer{path: opts.Checkpoint, base: base, p: fast}).start()
+		defer func() {
+			if cerr := stopCheckpoints(); err == nil {
+				err = cerr
+			}
+		}()
+	}
+	if opts.Progress {
+		total := big.NewInt(0)
+		for _, cnt := range countByDepth(allItems, srcOfItem, srcDepths, opts) {
+			total.Add(total, cnt)
+		}
+		r := &progressReporter{w: opts.stderr(), p: fast, total: total}
+		if opts.Resume != "" {
+			r.base = resumed.Lines
+		} else {
+			if total.Sub(total, big.NewInt(int64(opts.Skip))); total.Sign() < 0 {
+				total.SetInt64(0)
+			}
+			if limit := big.NewInt(int64(opts.Limit)); opts.Limit > 0 && limit.Cmp(total) < 0 {
+				total.Set(limit)
+			}
+		}
+		defer r.start()()
+	}
+	defer stopAfter(opts.LimitTime, fast.Stop)()
+	if progress, err := fast.GenerateContext(opts.context()); err != nil {
+		return fmt.Errorf("generation interrupted, %v: %w", progress, err)
+	}
+	return gate.result()
+}
+
+// stopAfter arms a timer calling stop once d has elapsed and returns a func
+// disarming it. A zero duration arms nothing.
+func stopAfter(d time.Duration, stop func()) func() {
+	if d <= 0 {
+		return func() {}
+	}
+	t := time.AfterFunc(d, stop)
+	return func() { t.Stop() }
+}
+
+// --- Counting Logic ---
+
+// CalculateOutputLines returns the number of output lines (permutations) as *big.Int
+func CalculateOutputLines(sources []Source, opts Options) (*big.Int, error) {
+	byDepth, err := CalculateOutputLinesByDepth(sources, opts)
+	if err != nil {
+		return nil, err
+	}
+	total := big.NewInt(0)
+	for _, cnt := range byDepth {
+		total.Add(total, cnt)
+	}
+	return total, nil
+}
+
+// CalculateOutputLinesByDepth returns the number of output lines per sequence
+// length: element l-1 counts the lines made of l items.
+func CalculateOutputLinesByDepth(sources []Source, opts Options) ([]*big.Int, error) {
+	allItems, srcOfItem, srcDepths, err := loadWrittenSources(sources, opts)
+	if err != nil {
+		return nil, err
+	}
+	return countByDepth(allItems, srcOfItem, srcDepths, opts.withSources(sources)), nil
+}
+
+// countByDepth does the counting for already loaded items, given the items
+// as written (only -leet looks at them), the source of each item and each
+// source's depth.
+func countByDepth(allItems []string, srcOfItem []int, srcDepths []int, opts Options) []*big.Int {
+	return countByDepthFrom(allItems, srcOfItem, srcDepths, opts, -1)
+}
+
+// countByDepthFrom is countByDepth restricted to the lines starting with an
+// item of source from (all lines when from is negative).
+func countByDepthFrom(allItems []string, srcOfItem []int, srcDepths []int, opts Options, from int) []*big.Int {
+	if opts.Leet != "" {
+		return countLeetByDepth(allItems, srcOfItem, srcDepths, opts, from)
+	}
+	seps, noRepeats := opts.Seps, opts.NoRepeats
+
+	maxDepth := 0
+	for _, d := range srcDepths {
+		maxDepth = max(maxDepth, d)
+	}
+	byDepth := make([]*big.Int, maxDepth)
+	for l := range byDepth {
+		byDepth[l] = big.NewInt(0)
+	}
+
+	n := len(srcOfItem)
+	if n == 0 || len(seps) == 0 {
+		return byDepth
+	}
+	if opts.Slots {
+		return countSlotsByDepth(srcOfItem, len(srcDepths), opts, from)
+	}
+	if opts.Combinations {
+		return countCombinationsByDepth(srcOfItem, srcDepths, opts, from)
+	}
+	if opts.NoConsecutiveSource || len(opts.MinFrom) > 0 {
+		return countTransitionsByDepth(srcOfItem, srcDepths, opts, from)
+	}
+
+	// Helper: nPr (order matters, no repeats)
+	perm := func(n, r int) *big.Int {
+		if r < 0 || n < 0 || n < r {
+			return big.NewInt(0)
+		}
+		res := big.NewInt(1)
+		for i := 0; i < r; i++ {
+			res.Mul(res, big.NewInt(int64(n-i)))
+		}
+		return res
+	}
+	// Helper: base^exp (repeats allowed)
+	pow := func(base, exp int) *big.Int {
+		if exp < 0 || base < 0 {
+			return big.NewInt(0)
+		}
+		res := big.NewInt(1)
+		b := big.NewInt(int64(base))
+		for i := 0; i < exp; i++ {
+			res.Mul(res, b)
+		}
+		return res
+	}
+
+	sepFactor, singleFactor := opts.lineFactors()
+
+	// Items a sequence may continue with: the whole pool, or only the
+	// starting item's source under -no-cross-source.
+	poolSize := make([]int, len(srcDepths))
+	for _, src := range srcOfItem {
+		poolSize[src]++
+	}
+	// Items bringing their own separator, in the whole pool.
+	scopedItems := 0
+	for src, sep := range opts.srcSeps {
+		if sep != nil {
+			scopedItems += poolSize[src]
+		}
+	}
+	for i := 0; i < n; i++ {
+		if from >= 0 && srcOfItem[i] != from {
+			continue
+		}
+		maxDepth := srcDepths[srcOfItem[i]]
+		pool := n
+		if opts.NoCrossSource {
+			pool = poolSize[srcOfItem[i]]
+		}
+		// Of the pool, the items a line can be written with once only, and
+		// whether the start item is one of them.
+		scoped, startScoped := scopedItems, false
+		if opts.srcSeps != nil {
+			startScoped = opts.srcSeps[srcOfItem[i]] != nil
+			if opts.NoCrossSource && !startScoped {
+				scoped = 0
+			} else if opts.NoCrossSource {
+				scoped = pool
+			}
+		}
+		for l := opts.minDepthOf(srcOfItem[i]); l <= maxDepth; l++ {
+			var cnt *big.Int
+			if noRepeats {
+				// pick l-1 more items out of (pool-1) without repetition
+				cnt = perm(pool-1, l-1)
+			} else {
+				// any of the pool items can occupy each of (l-1) positions
+				cnt = pow(pool, l-1)
+			}
+			if l == 1 {
+				cnt.Mul(cnt, singleFactor)
+			} else if scoped > 0 {
+				// Sequences continuing only with scoped items are written
+				// once, not once per -sep.
+				once := pow(scoped, l-1)
+				if noRepeats && startScoped {
+					once = perm(scoped-1, l-1)
+				} else if noRepeats {
+					once = perm(scoped, l-1)
+				}
+				cnt.Sub(cnt, once).Mul(cnt, sepFactor)
+				cnt.Add(cnt, once.Mul(once, singleFactor))
+			} else {
+				cnt.Mul(cnt, sepFactor)
+			}
+			byDepth[l-1].Add(byDepth[l-1], cnt)
+		}
+	}
+	return byDepth
+}
+
+// lineFactors returns how many output lines one sequence of several items
+// yields (one per separator, times the incremental suffixes, the case
+// variants and the rules) and how many a single item yields (no separator is
+// written, so only the suffixes, case variants and rules count).
+func (o Options) lineFactors() (multi, single *big.Int) {
+	multi = big.NewInt(int64(len(o.Seps)))
+	single = big.NewInt(1)
+	if len(o.Seps) == 0 {
+		single = big.NewInt(0)
+	}
+	if o.Incremental != "" {
+		k := incrementalCardinality(o.Incremental, o.IncrementalMax)
+		multi.Mul(multi, k)
+		single.Mul(single, k)
+	}
+	if o.MutateCase != "" {
+		k := big.NewInt(int64(len(strings.Split(o.MutateCase, ","))))
+		multi.Mul(multi, k)
+		single.Mul(single, k)
+	}
+	if o.Rules != nil {
+		k := big.NewInt(int64(len(o.Rules)))
+		multi.Mul(multi, k)
+		single.Mul(single, k)
+	}
+	return multi, single
+}
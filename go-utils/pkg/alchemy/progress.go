@@ -0,0 +1,80 @@
+package alchemy
+
+import (
+	"fmt"
+	"io"
+	"math/big"
+	"sync/atomic"
+	"time"
+)
+
+// progressInterval is how often -progress reports (patch point for tests).
+var progressInterval = 2 * time.Second
+
+// progressReporter prints how far a PermutatorFast got, every
+// progressInterval and once more when it stops (-progress).
+type progressReporter struct {
+	w     io.Writer
+	p     *PermutatorFast
+	base  uint64   // lines written by earlier runs (-resume)
+	total *big.Int // lines the run writes at most, base included
+
+	bytes atomic.Int64 // bytes flushed to the destination
+	begin time.Time
+}
+
+// start reports every progressInterval until the returned func is called,
+// which reports a last time. Call it before Generate.
+func (r *progressReporter) start() func() {
+	r.begin = time.Now()
+	r.p.WithFlushCallback(func(n int) { r.bytes.Add(int64(n)) })
+	ticker := time.NewTicker(progressInterval)
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-ticker.C:
+				r.report()
+			case <-quit:
+				return
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(quit)
+		<-done
+		r.report()
+	}
+}
+
+// report writes one line such as "progress: 1,250,000 lines, 625,000
+// lines/s, 5.0 MB/s, 12.5% of 10,000,000, ETA 14s".
+func (r *progressReporter) report() {
+	r.p.mu.Lock()
+	written := r.p.written
+	r.p.mu.Unlock()
+	lines := r.base + written
+	elapsed := time.Since(r.begin).Seconds()
+	var rate, mbps float64
+	if elapsed > 0 {
+		rate = float64(written) / elapsed
+		mbps = float64(r.bytes.Load()) / elapsed / 1e6
+	}
+
+	msg := fmt.Sprintf("progress: %s lines, %s lines/s, %.1f MB/s", groupDigits(fmt.Sprint(lines)), groupDigits(fmt.Sprint(int64(rate))), mbps)
+	if r.total != nil && r.total.Sign() > 0 {
+		total, _ := new(big.Float).SetInt(r.total).Float64()
+		msg += fmt.Sprintf(", %.1f%% of %s", 100*min(float64(lines)/total, 1), groupDigits(r.total.String()))
+		if left := total - float64(lines); left <= 0 {
+			msg += ", done"
+		} else if eta := left / rate; rate > 0 && eta < 1e9 {
+			msg += fmt.Sprintf(", ETA %v", time.Duration(eta*float64(time.Second)).Round(time.Second))
+		} else if rate > 0 {
+			msg += ", ETA over 30 years"
+		}
+	}
+	fmt.Fprintln(r.w, msg)
+}
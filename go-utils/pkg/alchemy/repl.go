@@ -0,0 +1,231 @@
+package alchemy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+const replHelp = `Commands:
+  set sep SEP [SEP...]      Replace the separators (quote empty or spaced values: "" "a b")
+  set depth N               Use depth N for every source
+  set depth SOURCE N        Use depth N for one source (1-based index)
+  set prefix|suffix VALUE   Change the prefix or suffix
+  set no-repeats on|off     Toggle -no-repeats
+  show count                Print the number of lines the current settings produce
+  show config               Print the current settings
+  generate N                Print the first N lines
+  help                      Show this help
+  quit                      Leave the REPL`
+
+// repl keeps sources loaded between commands so settings can be tuned
+// without re-reading the input files.
+type repl struct {
+	sources   []Source
+	loaded    []string // items as read, before writtenItems
+	allItems  []string // items as written under the current settings
+	srcOfItem []int
+	srcDepths []int
+	opts      Options
+	out       io.Writer
+}
+
+// RunREPL loads sources once, then executes commands read from in until EOF
+// or "quit". Command errors are reported on out and do not end the session.
+func RunREPL(sources []Source, opts Options, in io.Reader, out io.Writer) error {
+	loaded, srcOfItem, srcDepths, err := loadSources(sources, opts)
+	if err != nil {
+		return err
+	}
+	r := &repl{sources: sources, loaded: loaded, srcOfItem: srcOfItem, srcDepths: srcDepths, opts: opts.withSources(sources), out: out}
+	if err := r.rewriteItems(); err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		args, err := splitCommand(scanner.Text())
+		if err != nil {
+			fmt.Fprintln(out, "error:", err)
+			continue
+		}
+		if len(args) == 0 {
+			continue
+		}
+		if args[0] == "quit" || args[0] == "exit" {
+			return nil
+		}
+		if err := r.exec(args); err != nil {
+			fmt.Fprintln(out, "error:", err)
+		}
+	}
+	return scanner.Err()
+}
+
+func (r *repl) exec(args []string) error {
+	switch {
+	case args[0] == "help":
+		fmt.Fprintln(r.out, replHelp)
+	case args[0] == "set" && len(args) >= 2:
+		return r.set(args[1], args[2:])
+	case args[0] == "show" && len(args) == 2 && args[1] == "count":
+		total := big.NewInt(0)
+		for _, cnt := range countByDepth(r.allItems, r.srcOfItem, r.srcDepths, r.opts) {
+			total.Add(total, cnt)
+		}
+		fmt.Fprintln(r.out, total)
+	case args[0] == "show" && len(args) == 2 && args[1] == "config":
+		fmt.Fprintf(r.out, "items=%d depths=%v seps=%q prefix=%q suffix=%q no-repeats=%t\n",
+			len(r.allItems), r.srcDepths, r.opts.Seps, r.opts.Prefix, r.opts.Suffix, r.opts.NoRepeats)
+	case args[0] == "generate" && len(args) == 2:
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid line count %q", args[1])
+		}
+		return r.generate(n)
+	default:
+		return fmt.Errorf("unknown command %q (try help)", strings.Join(args, " "))
+	}
+	return nil
+}
+
+func (r *repl) set(key string, vals []string) error {
+	switch key {
+	case "sep":
+		if len(vals) == 0 {
+			return errors.New("set sep needs at least one separator")
+		}
+		seps := r.opts.Seps
+		r.opts.Seps = append([]string(nil), vals...)
+		// -sanitize-sep rewrites items against the separators.
+		if err := r.rewriteItems(); err != nil {
+			r.opts.Seps = seps
+			return err
+		}
+	case "depth":
+		return r.setDepth(vals)
+	case "prefix", "suffix":
+		if len(vals) != 1 {
+			return fmt.Errorf("set %s needs one value", key)
+		}
+		if key == "prefix" {
+			r.opts.Prefix = vals[0]
+		} else {
+			r.opts.Suffix = vals[0]
+		}
+	case "no-repeats":
+		if len(vals) != 1 || (vals[0] != "on" && vals[0] != "off") {
+			return errors.New("set no-repeats needs on or off")
+		}
+		r.opts.NoRepeats = vals[0] == "on"
+	default:
+		return fmt.Errorf("unknown setting %q", key)
+	}
+	return nil
+}
+
+func (r *repl) setDepth(vals []string) error {
+	target := -1
+	if len(vals) == 2 {
+		idx, err := strconv.Atoi(vals[0])
+		if err != nil || idx < 1 || idx > len(r.srcDepths) {
+			return fmt.Errorf("invalid source index %q", vals[0])
+		}
+		target, vals = idx-1, vals[1:]
+	}
+	if len(vals) != 1 {
+		return errors.New("usage: set depth [SOURCE] N")
+	}
+	depth, err := strconv.Atoi(vals[0])
+	if err != nil || depth < 1 {
+		return fmt.Errorf("invalid depth %q", vals[0])
+	}
+	for i := range r.srcDepths {
+		if (target < 0 || i == target) && depth < r.opts.minDepthOf(i) {
+			return fmt.Errorf("depth %d is below the minimum depth %d of source %d", depth, r.opts.minDepthOf(i), i+1)
+		}
+	}
+	for i := range r.srcDepths {
+		if target < 0 || i == target {
+			r.srcDepths[i] = depth
+		}
+	}
+	return nil
+}
+
+// rewriteItems recomputes the written items from the loaded ones.
+func (r *repl) rewriteItems() error {
+	items, err := r.opts.writtenItems(r.sources, r.loaded, r.srcOfItem)
+	if err != nil {
+		return err
+	}
+	r.allItems = items
+	return nil
+}
+
+// generate prints the first n lines in sequential generation order that
+// pass the emit-time checks, as a run with the current settings would.
+func (r *repl) generate(n int) error {
+	if n == 0 {
+		return nil
+	}
+	gate, err := newSizedOutputGate(r.allItems, r.srcOfItem, r.srcDepths, r.opts)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(r.out)
+	defer w.Flush()
+	emitted := 0
+	var p *permutator
+	p = newPermutatorFor(r.allItems, r.srcOfItem, r.srcDepths, r.opts, gate.wrap(func(s string) {
+		if emitted == n {
+			return
+		}
+		w.WriteString(s)
+		w.WriteByte('\n')
+		if emitted++; emitted == n {
+			p.Stop()
+		}
+	}))
+	if gate != nil {
+		gate.stop = p.Stop
+	}
+	p.generate()
+	return gate.result()
+}
+
+// splitCommand splits a command line on spaces, honoring Go-style double
+// quoted arguments so empty or spaced values can be given.
+func splitCommand(line string) ([]string, error) {
+	var args []string
+	rest := strings.TrimSpace(line)
+	for rest != "" {
+		if rest[0] == '"' {
+			end := 1
+			for end < len(rest) && rest[end] != '"' {
+				if rest[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(rest) {
+				return nil, errors.New("unterminated quote")
+			}
+			arg, err := strconv.Unquote(rest[:end+1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid quoted argument %s", rest[:end+1])
+			}
+			args = append(args, arg)
+			rest = strings.TrimSpace(rest[end+1:])
+			continue
+		}
+		field, tail, _ := strings.Cut(rest, " ")
+		args = append(args, field)
+		rest = strings.TrimSpace(tail)
+	}
+	return args, nil
+}
@@ -0,0 +1,374 @@
+package alchemy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ruleFunc is one hashcat rule function applied to a candidate.
+type ruleFunc func(w []byte) []byte
+
+// rule is a parsed -rules line: its functions applied left to right.
+type rule []ruleFunc
+
+func (r rule) apply(s string) string {
+	w := []byte(s)
+	for _, f := range r {
+		w = f(w)
+	}
+	return string(w)
+}
+
+// LoadRules reads a -rules file: one rule per line, blank lines and lines
+// starting with # skipped, as hashcat does. Rules are returned as text; they
+// are checked by Validate and compiled by (options).compileRules.
+func LoadRules(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %v", path, err)
+	}
+	defer f.Close()
+
+	var rules []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := strings.TrimRight(sc.Text(), "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rules = append(rules, line)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("reading %s: %v", path, err)
+	}
+	if len(rules) == 0 {
+		return nil, fmt.Errorf("%s holds no rules", path)
+	}
+	return rules, nil
+}
+
+// compileRules parses the -rules lines (nil without -rules). Validate has
+// already reported any line that does not parse.
+func (o Options) compileRules() []rule {
+	if o.Rules == nil {
+		return nil
+	}
+	rules := make([]rule, 0, len(o.Rules))
+	for _, line := range o.Rules {
+		r, err := parseRule(line)
+		if err != nil {
+			continue
+		}
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// lineRewrites returns the rewrites every line is fanned out into: each
+// -mutate-case variant, then each rule of it. nil when neither is set.
+func (o Options) lineRewrites() []func(string) string {
+	if o.MutateCase == "" && o.Rules == nil {
+		return nil
+	}
+	cases := []func(string) string{func(s string) string { return s }}
+	if o.MutateCase != "" {
+		// Rejected by Validate.
+		cases, _ = parseCaseMutations(o.MutateCase)
+	}
+	rules := o.compileRules()
+	if rules == nil {
+		return cases
+	}
+	rewrites := make([]func(string) string, 0, len(cases)*len(rules))
+	for _, c := range cases {
+		for _, r := range rules {
+			rewrites = append(rewrites, func(s string) string { return r.apply(c(s)) })
+		}
+	}
+	return rewrites
+}
+
+// rewriteLines wraps output so each line is emitted once per line rewrite.
+// Without -mutate-case and -rules it returns output unchanged.
+func (o Options) rewriteLines(output func(string)) func(string) {
+	rewrites := o.lineRewrites()
+	if rewrites == nil {
+		return output
+	}
+	return func(s string) {
+		for _, rw := range rewrites {
+			output(rw(s))
+		}
+	}
+}
+
+// parseRule parses one line of hashcat rule syntax. The supported functions
+// work on bytes with ASCII case mapping, like hashcat; N and M are positions
+// 0-9 then A-Z, and a position past the end leaves the candidate unchanged.
+//
+//	:        nothing              l u c C t   lower, upper, capitalize, invert capitalize, toggle case
+//	TN       toggle case at N     r d f       reverse, duplicate, reflect
+//	pN       append N copies      { }         rotate left, rotate right
+//	$X ^X    append, prepend X    [ ]         delete first, last character
+//	DN       delete at N          'N          truncate at N
+//	xNM      keep M from N        ONM         omit M from N
+//	iNX      insert X at N        oNX         overwrite at N with X
+//	sXY      replace X with Y     @X          purge every X
+//	zN ZN    repeat first, last character N times
+//	q        duplicate every character
+//	k K      swap the first two, the last two characters
+//
+// Spaces between functions are ignored.
+func parseRule(line string) (rule, error) {
+	var r rule
+	for i := 0; i < len(line); {
+		op := line[i]
+		args, ok := ruleArgs[op]
+		if !ok {
+			return nil, fmt.Errorf("rule %q: unsupported function %q", line, op)
+		}
+		if i+1+len(args) > len(line) {
+			return nil, fmt.Errorf("rule %q: function %q needs %d argument(s)", line, op, len(args))
+		}
+		var pos [2]int
+		var chars [2]byte
+		for k, kind := range args {
+			c := line[i+1+k]
+			if kind == 'N' {
+				p, ok := rulePosition(c)
+				if !ok {
+					return nil, fmt.Errorf("rule %q: %q is not a position", line, c)
+				}
+				pos[k] = p
+			}
+			chars[k] = c
+		}
+		i += 1 + len(args)
+		if f := ruleFor(op, pos, chars); f != nil {
+			r = append(r, f)
+		}
+	}
+	return r, nil
+}
+
+// ruleArgs lists each supported function's arguments: N a position, X a
+// character.
+var ruleArgs = map[byte]string{
+	':': "", ' ': "", 'l': "", 'u': "", 'c': "", 'C': "", 't': "", 'T': "N",
+	'r': "", 'd': "", 'f': "", 'p': "N", '{': "", '}': "",
+	'$': "X", '^': "X", '[': "", ']': "", 'D': "N", '\'': "N",
+	'x': "NN", 'O': "NN", 'i': "NX", 'o': "NX",
+	's': "XX", '@': "X", 'z': "N", 'Z': "N", 'q': "", 'k': "", 'K': "",
+}
+
+func rulePosition(c byte) (int, bool) {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c - '0'), true
+	case c >= 'A' && c <= 'Z':
+		return int(c-'A') + 10, true
+	}
+	return 0, false
+}
+
+// ruleFor returns the function for op with its parsed arguments, or nil for
+// the no-ops.
+func ruleFor(op byte, pos [2]int, chars [2]byte) ruleFunc {
+	n, m := pos[0], pos[1]
+	x, y := chars[0], chars[1]
+	switch op {
+	case 'l':
+		return func(w []byte) []byte { return mapASCII(w, lowerASCII) }
+	case 'u':
+		return func(w []byte) []byte { return mapASCII(w, upperASCII) }
+	case 'c':
+		return func(w []byte) []byte {
+			w = mapASCII(w, lowerASCII)
+			if len(w) > 0 {
+				w[0] = upperASCII(w[0])
+			}
+			return w
+		}
+	case 'C':
+		return func(w []byte) []byte {
+			w = mapASCII(w, upperASCII)
+			if len(w) > 0 {
+				w[0] = lowerASCII(w[0])
+			}
+			return w
+		}
+	case 't':
+		return func(w []byte) []byte { return mapASCII(w, toggleASCII) }
+	case 'T':
+		return func(w []byte) []byte {
+			if n < len(w) {
+				w[n] = toggleASCII(w[n])
+			}
+			return w
+		}
+	case 'r':
+		return func(w []byte) []byte {
+			for i, j := 0, len(w)-1; i < j; i, j = i+1, j-1 {
+				w[i], w[j] = w[j], w[i]
+			}
+			return w
+		}
+	case 'd':
+		return func(w []byte) []byte { return append(w, w...) }
+	case 'f':
+		return func(w []byte) []byte {
+			for i := len(w) - 1; i >= 0; i-- {
+				w = append(w, w[i])
+			}
+			return w
+		}
+	case 'p':
+		return func(w []byte) []byte { return bytes.Repeat(w, n+1) }
+	case '{':
+		return func(w []byte) []byte {
+			if len(w) > 1 {
+				w = append(w[1:], w[0])
+			}
+			return w
+		}
+	case '}':
+		return func(w []byte) []byte {
+			if len(w) > 1 {
+				w = append([]byte{w[len(w)-1]}, w[:len(w)-1]...)
+			}
+			return w
+		}
+	case '$':
+		return func(w []byte) []byte { return append(w, x) }
+	case '^':
+		return func(w []byte) []byte { return append([]byte{x}, w...) }
+	case '[':
+		return func(w []byte) []byte {
+			if len(w) > 0 {
+				w = w[1:]
+			}
+			return w
+		}
+	case ']':
+		return func(w []byte) []byte {
+			if len(w) > 0 {
+				w = w[:len(w)-1]
+			}
+			return w
+		}
+	case 'D':
+		return func(w []byte) []byte {
+			if n < len(w) {
+				w = append(w[:n], w[n+1:]...)
+			}
+			return w
+		}
+	case '\'':
+		return func(w []byte) []byte {
+			if n < len(w) {
+				w = w[:n]
+			}
+			return w
+		}
+	case 'x':
+		return func(w []byte) []byte {
+			if n+m <= len(w) {
+				w = w[n : n+m]
+			}
+			return w
+		}
+	case 'O':
+		return func(w []byte) []byte {
+			if n+m <= len(w) {
+				w = append(w[:n], w[n+m:]...)
+			}
+			return w
+		}
+	case 'i':
+		return func(w []byte) []byte {
+			if n <= len(w) {
+				w = append(w[:n], append([]byte{y}, w[n:]...)...)
+			}
+			return w
+		}
+	case 'o':
+		return func(w []byte) []byte {
+			if n < len(w) {
+				w[n] = y
+			}
+			return w
+		}
+	case 's':
+		return func(w []byte) []byte { return bytes.ReplaceAll(w, []byte{x}, []byte{y}) }
+	case '@':
+		return func(w []byte) []byte { return bytes.ReplaceAll(w, []byte{x}, nil) }
+	case 'z':
+		return func(w []byte) []byte {
+			if len(w) > 0 {
+				w = append(bytes.Repeat(w[:1], n), w...)
+			}
+			return w
+		}
+	case 'Z':
+		return func(w []byte) []byte {
+			if len(w) > 0 {
+				w = append(w, bytes.Repeat(w[len(w)-1:], n)...)
+			}
+			return w
+		}
+	case 'q':
+		return func(w []byte) []byte {
+			out := make([]byte, 0, 2*len(w))
+			for _, c := range w {
+				out = append(out, c, c)
+			}
+			return out
+		}
+	case 'k':
+		return func(w []byte) []byte {
+			if len(w) > 1 {
+				w[0], w[1] = w[1], w[0]
+			}
+			return w
+		}
+	case 'K':
+		return func(w []byte) []byte {
+			if k := len(w); k > 1 {
+				w[k-2], w[k-1] = w[k-1], w[k-2]
+			}
+			return w
+		}
+	}
+	return nil
+}
+
+func mapASCII(w []byte, f func(byte) byte) []byte {
+	for i, c := range w {
+		w[i] = f(c)
+	}
+	return w
+}
+
+func lowerASCII(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+func upperASCII(c byte) byte {
+	if c >= 'a' && c <= 'z' {
+		return c - ('a' - 'A')
+	}
+	return c
+}
+
+func toggleASCII(c byte) byte {
+	if c >= 'a' && c <= 'z' {
+		return upperASCII(c)
+	}
+	return lowerASCII(c)
+}
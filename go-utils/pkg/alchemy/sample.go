@@ -0,0 +1,93 @@
+package alchemy
+
+import (
+	"math/big"
+	"math/rand"
+	"sort"
+)
+
+// sequenceSpace returns a Permutator over the loaded items, for plain
+// sequences (see unrankable): its candidate order is the sequential
+// generation order, so CandidateAt unranks the lines written.
+func sequenceSpace(allItems []string, srcOfItem, srcDepths []int, opts Options) *Permutator {
+	plain := Config{Seps: opts.Seps, Prefix: opts.Prefix, Suffix: opts.Suffix, NoRepeats: opts.NoRepeats}.options()
+	plain.MinDepth, plain.srcMinDepths = opts.MinDepth, opts.srcMinDepths
+	return &Permutator{allItems: allItems, srcOfItem: srcOfItem, srcDepths: srcDepths, opts: plain}
+}
+
+// unrankable reports whether opts writes plain sequences in the default
+// order, which sequenceSpace can unrank: no layout, fan-out or reordering of
+// the items and no per-source separators or affixes.
+func (o Options) unrankable() bool {
+	return !o.Slots && !o.Combinations && !o.NoCrossSource && !o.NoConsecutiveSource && len(o.MinFrom) == 0 &&
+		o.Incremental == "" && o.MutateCase == "" && o.Rules == nil && o.Leet == "" &&
+		(o.DFSOrder == "" || o.DFSOrder == "forward") && !o.ReverseSources && !o.OrderedByWeight &&
+		o.srcSeps == nil && o.srcAffixes == nil
+}
+
+// sampleLines writes opts.Sample lines drawn uniformly, without
+// replacement, from every line the sources generate (the whole space when
+// it holds fewer). Indices are drawn from opts.SampleSeed and unranked with
+// CandidateAt, so a sample of an enormous space costs no more
+// than its own size. Lines are written in generation order; stopped is
+// checked between lines.
+func sampleLines(allItems []string, srcOfItem, srcDepths []int, opts Options, output func(string), stopped func() bool) error {
+	p := sequenceSpace(allItems, srcOfItem, srcDepths, opts)
+
+	total := p.Count()
+	if total.Cmp(big.NewInt(int64(opts.Sample))) <= 0 {
+		for it := p.Iter(); it.Next() && !stopped(); {
+			output(it.Candidate())
+		}
+		return nil
+	}
+
+	rnd := rand.New(rand.NewSource(opts.SampleSeed))
+	seen := make(map[string]bool, opts.Sample)
+	picked := make([]*big.Int, 0, opts.Sample)
+	for len(picked) < opts.Sample {
+		n := new(big.Int).Rand(rnd, total)
+		if key := n.String(); !seen[key] {
+			seen[key] = true
+			picked = append(picked, n)
+		}
+	}
+	sort.Slice(picked, func(i, j int) bool { return picked[i].Cmp(picked[j]) < 0 })
+	for _, n := range picked {
+		if stopped() {
+			break
+		}
+		line, err := p.CandidateAt(n)
+		if err != nil {
+			return err
+		}
+		output(line)
+	}
+	return nil
+}
+
+// reversesByUnranking reports whether -reverse-output can unrank the lines
+// from the last one instead of buffering them all: plain sequences, no
+// filter whose verdict depends on the lines seen before (-unique,
+// -limit-unique, -fail-on-duplicate) and no -max-len, which generation
+// prunes whole subtrees for where unranking would visit every line.
+func (o Options) reversesByUnranking() bool {
+	return o.Reverse && o.unrankable() && !o.Unique && o.UniqueBloom == 0 && o.LimitUnique == 0 && !o.FailOnDuplicate &&
+		o.MaxLen == 0
+}
+
+// reverseLines writes every line the sources generate, last first, each
+// unranked with CandidateAt, so nothing is buffered and a
+// -limit only costs the lines it keeps. stopped is checked between lines.
+func reverseLines(allItems []string, srcOfItem, srcDepths []int, opts Options, output func(string), stopped func() bool) error {
+	p := sequenceSpace(allItems, srcOfItem, srcDepths, opts)
+	one := big.NewInt(1)
+	for n := new(big.Int).Sub(p.Count(), one); n.Sign() >= 0 && !stopped(); n.Sub(n, one) {
+		line, err := p.CandidateAt(n)
+		if err != nil {
+			return err
+		}
+		output(line)
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package alchemy
+
+import "strings"
+
+// sanitizeItems returns the items with every occurrence of a (non-empty)
+// separator replaced by opts.SanitizeSep, so joined output can be split back
+// unambiguously. The transform is lossy and only applies when the option is
+// set; items are otherwise returned untouched.
+func (o Options) sanitizeItems(items []string) []string {
+	if o.SanitizeSep == nil {
+		return items
+	}
+	var pairs []string
+	for _, sep := range o.Seps {
+		if sep != "" {
+			pairs = append(pairs, sep, *o.SanitizeSep)
+		}
+	}
+	if len(pairs) == 0 {
+		return items
+	}
+	r := strings.NewReplacer(pairs...)
+
+	out := make([]string, len(items))
+	for i, item := range items {
+		out[i] = r.Replace(item)
+	}
+	return out
+}
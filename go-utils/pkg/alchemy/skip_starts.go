@@ -0,0 +1,64 @@
+package alchemy
+
+import "math/big"
+
+// dropsLines reports whether an output check may drop lines or needs to
+// see every one of them, so that line positions cannot be computed from
+// counts.
+func (o Options) dropsLines() bool {
+	return o.FailOnDuplicate || o.LimitUnique > 0 || o.DiffAgainst != "" || len(o.ExcludeFiles) > 0 || o.HashShard != "" ||
+		o.MinLen > 0 || o.MaxLen > 0 || o.ExcludeChars != "" || o.Unique || o.UniqueBloom > 0 ||
+		len(o.Match) > 0 || len(o.ExcludeMatch) > 0
+}
+
+// cutLines passes on the lines given to it after the first skip, at most
+// limit of them (0 = no limit): -skip and -limit applied to output that is
+// reordered after generation.
+func cutLines(output func(string), skip, limit int) func(string) {
+	if skip == 0 && limit == 0 {
+		return output
+	}
+	var seen int
+	return func(s string) {
+		seen++
+		if seen > skip && (limit == 0 || seen <= skip+limit) {
+			output(s)
+		}
+	}
+}
+
+// skipWholeStarts jumps over the leading start items whose lines all fall
+// within the first skip lines, from their counts instead of generating
+// them, and returns the starts left and the lines still to skip. Every start
+// item of a source yields as many lines, so a start's count is its source's
+// count divided among its start items. That does not hold for
+// -combinations or -leet, and filtered lines cannot be counted ahead: then
+// nothing is skipped here and the gate discards the lines as they are
+// generated.
+func skipWholeStarts(starts, srcOfItem, srcDepths []int, opts Options, skip int) ([]int, int) {
+	if skip == 0 || opts.Combinations || opts.Leet != "" || opts.dropsLines() {
+		return starts, skip
+	}
+	startsOf := make([]int64, len(srcDepths))
+	for _, i := range starts {
+		startsOf[srcOfItem[i]]++
+	}
+	perStart := make([]*big.Int, len(srcDepths))
+	left := big.NewInt(int64(skip))
+	k := 0
+	for ; k < len(starts); k++ {
+		src := srcOfItem[starts[k]]
+		if perStart[src] == nil {
+			total := big.NewInt(0)
+			for _, cnt := range countByDepthFrom(nil, srcOfItem, srcDepths, opts, src) {
+				total.Add(total, cnt)
+			}
+			perStart[src] = total.Quo(total, big.NewInt(startsOf[src]))
+		}
+		if perStart[src].Cmp(left) > 0 {
+			break
+		}
+		left.Sub(left, perStart[src])
+	}
+	return starts[k:], int(left.Int64())
+}
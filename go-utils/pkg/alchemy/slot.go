@@ -0,0 +1,56 @@
+package alchemy
+
+import "math/big"
+
+// SlotSources turns -slot files into sources. In slot mode every line has
+// one item per slot, position d drawing only from slot d: a cartesian
+// product of the files in order, e.g. <name><year><symbol>. Each source is
+// as deep as the template and emits nothing shorter, so only complete lines
+// are written; Options.Slots restricts position d to source d.
+func SlotSources(paths []string) []Source {
+	sources := make([]Source, len(paths))
+	for i, path := range paths {
+		sources[i] = Source{Path: path}
+	}
+	return AsSlots(sources)
+}
+
+// AsSlots returns a copy of sources set up as slots, in order (-product):
+// their depths are replaced by the template length, other options are kept.
+func AsSlots(sources []Source) []Source {
+	slots := make([]Source, len(sources))
+	for i, src := range sources {
+		src.Depth, src.MinDepth = len(sources), len(sources)
+		slots[i] = src
+	}
+	return slots
+}
+
+// countSlotsByDepth counts slot mode lines: the product of the slot sizes
+// times the lines per sequence, all of them as long as the template. Lines
+// are only started by the first slot, so from > 0 counts nothing.
+func countSlotsByDepth(srcOfItem []int, slots int, opts Options, from int) []*big.Int {
+	byDepth := make([]*big.Int, slots)
+	for l := range byDepth {
+		byDepth[l] = big.NewInt(0)
+	}
+	if slots == 0 || from > 0 {
+		return byDepth
+	}
+	sizes := make([]int64, slots)
+	for _, src := range srcOfItem {
+		sizes[src]++
+	}
+	total := big.NewInt(1)
+	for _, size := range sizes {
+		total.Mul(total, big.NewInt(size))
+	}
+	multi, single := opts.lineFactors()
+	if slots == 1 {
+		total.Mul(total, single)
+	} else {
+		total.Mul(total, multi)
+	}
+	byDepth[slots-1] = total
+	return byDepth
+}
@@ -0,0 +1,233 @@
+package alchemy
+
+import (
+	"bufio"
+	"container/heap"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// mergeFanIn caps how many runs are merged at once, and so how many files
+// are open during a merge; more runs are first merged into fewer, larger
+// ones.
+const mergeFanIn = 64
+
+// maxRunLine is the longest line a run can hold. Runs are read back with a
+// bufio.Scanner, whose default 64 KB limit long lines would exceed; the
+// buffer only grows as long lines require it.
+const maxRunLine = 1 << 30
+
+// externalSorter sorts and de-duplicates an arbitrarily large line stream in
+// bounded memory: lines are buffered until budget bytes, then spilled to a
+// sorted temp run; finish merges the runs, at most fanIn at a time.
+type externalSorter struct {
+	dir    string
+	budget int
+	fanIn  int
+
+	buf  []string
+	used int
+
+	runs []string // temp run paths, each sorted and de-duplicated
+}
+
+func newExternalSorter(dir string, budget int) *externalSorter {
+	return &externalSorter{dir: dir, budget: budget, fanIn: mergeFanIn}
+}
+
+func (e *externalSorter) add(line string) error {
+	e.buf = append(e.buf, line)
+	e.used += len(line) + 16 // rough per-string overhead
+	if e.used >= e.budget {
+		return e.spill()
+	}
+	return nil
+}
+
+// spill writes the buffered lines to a new sorted, de-duplicated run.
+func (e *externalSorter) spill() error {
+	if len(e.buf) == 0 {
+		return nil
+	}
+	sort.Strings(e.buf)
+
+	err := e.writeRun(func(output func(string)) error {
+		for i, line := range e.buf {
+			if i > 0 && line == e.buf[i-1] {
+				continue
+			}
+			output(line)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	e.buf = e.buf[:0]
+	e.used = 0
+	return nil
+}
+
+// writeRun adds a temp run holding the lines fill outputs.
+func (e *externalSorter) writeRun(fill func(output func(string)) error) error {
+	f, err := os.CreateTemp(e.dir, "permute-run-*")
+	if err != nil {
+		return fmt.Errorf("creating sort run: %v", err)
+	}
+	e.runs = append(e.runs, f.Name()) // removed by cleanup, even if incomplete
+	w := bufio.NewWriterSize(f, 64*1024)
+	if err := fill(writeLines(w)); err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("writing sort run: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("writing sort run: %v", err)
+	}
+	return nil
+}
+
+// finish merges all runs into output in sorted order, dropping duplicates,
+// and removes the temp files. While there are more than fanIn runs, groups
+// of fanIn are merged into single runs first.
+func (e *externalSorter) finish(output func(string)) error {
+	defer e.cleanup()
+	if err := e.spill(); err != nil {
+		return err
+	}
+
+	for len(e.runs) > e.fanIn {
+		runs := e.runs
+		e.runs = nil
+		for start := 0; start < len(runs); start += e.fanIn {
+			group := runs[start:min(start+e.fanIn, len(runs))]
+			err := e.writeRun(func(output func(string)) error {
+				return mergeRuns(group, output)
+			})
+			for _, path := range group {
+				os.Remove(path)
+			}
+			if err != nil {
+				e.runs = append(e.runs, runs[start+len(group):]...)
+				return err
+			}
+		}
+	}
+	return mergeRuns(e.runs, output)
+}
+
+// mergeRuns k-way merges the sorted runs at paths into output, dropping
+// duplicates.
+func mergeRuns(paths []string, output func(string)) error {
+	h := &runHeap{}
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("opening sort run: %v", err)
+		}
+		defer f.Close()
+		sc := bufio.NewScanner(f)
+		sc.Buffer(make([]byte, 0, 64*1024), maxRunLine)
+		r := &runReader{sc: sc}
+		if r.next() {
+			heap.Push(h, r)
+		} else if err := r.sc.Err(); err != nil {
+			return fmt.Errorf("reading sort run: %v", err)
+		}
+	}
+
+	var last string
+	first := true
+	for h.Len() > 0 {
+		r := (*h)[0]
+		if first || r.line != last {
+			output(r.line)
+			last, first = r.line, false
+		}
+		if r.next() {
+			heap.Fix(h, 0)
+		} else {
+			if err := r.sc.Err(); err != nil {
+				return fmt.Errorf("reading sort run: %v", err)
+			}
+			heap.Pop(h)
+		}
+	}
+	return nil
+}
+
+func (e *externalSorter) cleanup() {
+	for _, path := range e.runs {
+		os.Remove(path)
+	}
+	e.runs = nil
+}
+
+// runReader is the merge cursor over one sorted run.
+type runReader struct {
+	sc   *bufio.Scanner
+	line string
+}
+
+func (r *runReader) next() bool {
+	if !r.sc.Scan() {
+		return false
+	}
+	r.line = r.sc.Text()
+	return true
+}
+
+type runHeap []*runReader
+
+func (h runHeap) Len() int           { return len(h) }
+func (h runHeap) Less(i, j int) bool { return h[i].line < h[j].line }
+func (h runHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *runHeap) Push(x any)        { *h = append(*h, x.(*runReader)) }
+func (h *runHeap) Pop() any {
+	old := *h
+	r := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return r
+}
+
+// writeLines adapts a writer to the func(string) output shape.
+func writeLines(w io.Writer) func(string) {
+	return func(s string) {
+		io.WriteString(w, s)
+		io.WriteString(w, "\n")
+	}
+}
+
+// ParseSize parses a byte size such as 512, 64K, 256M or 1G (powers of 1024).
+func ParseSize(val string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(val))
+	s = strings.TrimSuffix(s, "B")
+	mult := int64(1)
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'K':
+			mult = 1 << 10
+		case 'M':
+			mult = 1 << 20
+		case 'G':
+			mult = 1 << 30
+		case 'T':
+			mult = 1 << 40
+		}
+		if mult > 1 {
+			s = s[:len(s)-1]
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", val)
+	}
+	return n * mult, nil
+}
@@ -0,0 +1,15 @@
+package alchemy
+
+// sourceAffixes holds each source's own prefix and suffix (-source
+// file:depth:prefix=X:suffix=Y), written inside -prefix/-suffix when a line
+// starts or ends with an item of that source. nil when no source has one.
+type sourceAffixes []struct{ prefix, suffix string }
+
+// around returns the prefix of path's first item's source and the suffix of
+// its last item's source.
+func (a sourceAffixes) around(srcOfItem []int, path []int) (prefix, suffix string) {
+	if a == nil {
+		return "", ""
+	}
+	return a[srcOfItem[path[0]]].prefix, a[srcOfItem[path[len(path)-1]]].suffix
+}
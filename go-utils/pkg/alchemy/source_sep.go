@@ -0,0 +1,42 @@
+package alchemy
+
+// Per-source separators (-source file:depth:sep=X) are written before the
+// items of their source in place of -sep. A line whose every separator is
+// scoped this way does not vary with -sep, so it is written once instead of
+// once per -sep.
+
+// usesSourceSeps reports whether any source has its own separator.
+func (o Options) usesSourceSeps() bool {
+	for _, sep := range o.srcSeps {
+		if sep != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// sourceSep returns the separator written before item idx: its source's own,
+// else sep. srcSeps is nil when no source has one.
+func sourceSep(sep string, srcSeps []*string, srcOfItem []int, idx int) string {
+	if srcSeps != nil {
+		if own := srcSeps[srcOfItem[idx]]; own != nil {
+			return *own
+		}
+	}
+	return sep
+}
+
+// pathSeps returns the -sep values the line of path is written with, like
+// lineSeps, but only the first one when every item after the first brings
+// its own separator.
+func pathSeps(seps []string, srcSeps []*string, srcOfItem []int, path []int) []string {
+	if srcSeps != nil && len(seps) > 1 {
+		for _, idx := range path[1:] {
+			if srcSeps[srcOfItem[idx]] == nil {
+				return lineSeps(seps, len(path))
+			}
+		}
+		return seps[:1]
+	}
+	return lineSeps(seps, len(path))
+}
@@ -0,0 +1,72 @@
+package alchemy
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ErrUnknownTransform is wrapped when a source names a transform that does
+// not exist.
+var ErrUnknownTransform = errors.New("unknown transform")
+
+// itemTransforms are the per-source transforms available to the
+// "transform=" source option.
+var itemTransforms = map[string]func(string) string{
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	"title": func(s string) string {
+		r, size := utf8.DecodeRuneInString(s)
+		if r == utf8.RuneError {
+			return s
+		}
+		return string(unicode.ToTitle(r)) + s[size:]
+	},
+}
+
+// parseTransforms parses a comma-separated transform chain such as
+// "lower,title".
+func parseTransforms(spec string) ([]string, error) {
+	names := strings.Split(spec, ",")
+	for _, name := range names {
+		if _, ok := itemTransforms[name]; !ok {
+			return nil, fmt.Errorf("%w %q (want lower, upper or title)", ErrUnknownTransform, name)
+		}
+	}
+	return names, nil
+}
+
+// transformItems applies each source's transform chain, in order, to the
+// items it contributed. The space is computed on the loaded items; only what
+// gets written changes.
+func transformItems(sources []Source, items []string, srcOfItem []int) []string {
+	chains := make([][]func(string) string, len(sources))
+	enabled := false
+	for i, src := range sources {
+		if src.Transforms == "" {
+			continue
+		}
+		// Unknown names are rejected by Set and Validate.
+		names, _ := parseTransforms(src.Transforms)
+		for _, name := range names {
+			chains[i] = append(chains[i], itemTransforms[name])
+		}
+		enabled = true
+	}
+	if !enabled {
+		return items
+	}
+
+	out := make([]string, len(items))
+	for i, item := range items {
+		for _, fn := range chains[srcOfItem[i]] {
+			if fn != nil {
+				item = fn(item)
+			}
+		}
+		out[i] = item
+	}
+	return out
+}
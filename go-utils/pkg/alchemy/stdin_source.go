@@ -0,0 +1,41 @@
+package alchemy
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+// stdin is where a "-" source is read from (patch point for tests).
+var stdin io.Reader = os.Stdin
+
+// ErrDuplicateStdin rejects a second stdin source: stdin can only be read
+// once, so it would silently come back empty.
+var ErrDuplicateStdin = errors.New("stdin can only be used as one source")
+
+// IsStdinPath reports whether a source path names standard input.
+func IsStdinPath(path string) bool {
+	return path == "-" || path == "/dev/stdin"
+}
+
+// stdinBuffer holds stdin once it has been read. Sources are loaded more than
+// once per invocation (validation, -max-depth-auto, -report-unreachable, the
+// run itself), so stdin is consumed on first use and every later load sees
+// the same bytes.
+type stdinBuffer struct {
+	once sync.Once
+	data []byte
+	err  error
+}
+
+var stdinCache = &stdinBuffer{}
+
+// readStdin returns the whole of stdin, reading it on the first call only.
+func readStdin() ([]byte, error) {
+	c := stdinCache
+	c.once.Do(func() {
+		c.data, c.err = io.ReadAll(stdin)
+	})
+	return c.data, c.err
+}
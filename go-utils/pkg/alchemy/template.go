@@ -0,0 +1,119 @@
+package alchemy
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// sepPlaceholder stands for the separator inside a -template.
+const sepPlaceholder = "{sep}"
+
+// Template is a parsed -template such as "{users}{sep}{years}!". Each
+// placeholder but {sep} names a -source; the text around them is literal.
+type Template struct {
+	names []string // source placeholders, in order
+	lead  string   // text before the first placeholder
+	gaps  []string // text between consecutive placeholders, may hold {sep}
+	trail string   // text after the last placeholder
+}
+
+// ParseTemplate splits a -template into its source placeholders and the
+// literal text around them. {sep} may only appear between two of them.
+func ParseTemplate(tpl string) (*Template, error) {
+	t := &Template{}
+	var text strings.Builder
+	for rest := tpl; rest != ""; {
+		open := strings.IndexByte(rest, '{')
+		if open < 0 {
+			text.WriteString(rest)
+			break
+		}
+		end := strings.IndexByte(rest[open:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("template %q: unclosed {", tpl)
+		}
+		name := rest[open+1 : open+end]
+		text.WriteString(rest[:open])
+		rest = rest[open+end+1:]
+		if "{"+name+"}" == sepPlaceholder {
+			text.WriteString(sepPlaceholder)
+			continue
+		}
+		if name == "" {
+			return nil, fmt.Errorf("template %q: empty placeholder", tpl)
+		}
+		if len(t.names) == 0 {
+			t.lead = text.String()
+		} else {
+			t.gaps = append(t.gaps, text.String())
+		}
+		text.Reset()
+		t.names = append(t.names, name)
+	}
+	t.trail = text.String()
+	if len(t.names) == 0 {
+		return nil, fmt.Errorf("template %q names no source", tpl)
+	}
+	if strings.Contains(t.lead, sepPlaceholder) || strings.Contains(t.trail, sepPlaceholder) {
+		return nil, fmt.Errorf("template %q: {sep} must sit between two sources", tpl)
+	}
+	return t, nil
+}
+
+// usesSep reports whether any gap holds {sep}. Without it every separator
+// would give the same line, so the template is written once.
+func (t *Template) usesSep() bool {
+	for _, gap := range t.gaps {
+		if strings.Contains(gap, sepPlaceholder) {
+			return true
+		}
+	}
+	return false
+}
+
+// Sources resolves every placeholder against the -source list, by path, by
+// file name without extension or by 1-based index, and returns one slot
+// source per placeholder (a source named twice fills two positions).
+func (t *Template) Sources(given []Source) ([]Source, error) {
+	slots := make([]Source, len(t.names))
+	for i, name := range t.names {
+		idx := -1
+		for j, src := range given {
+			base := filepath.Base(src.Path)
+			if src.Path == name || strings.TrimSuffix(base, filepath.Ext(base)) == name {
+				idx = j
+				break
+			}
+		}
+		if idx < 0 {
+			if n, err := strconv.Atoi(name); err == nil && n >= 1 && n <= len(given) {
+				idx = n - 1
+			}
+		}
+		if idx < 0 {
+			return nil, fmt.Errorf("template placeholder {%s} names no source", name)
+		}
+		slots[i] = given[idx]
+	}
+	return AsSlots(slots), nil
+}
+
+// Apply returns opts laid out by the template: its gaps go between the
+// items and its leading and trailing text around -prefix and -suffix.
+func (t *Template) Apply(opts Options) Options {
+	opts.Slots = true
+	opts.Gaps = t.gaps
+	opts.Prefix += t.lead
+	opts.Suffix = t.trail + opts.Suffix
+	if !t.usesSep() {
+		opts.Seps = opts.Seps[:1]
+	}
+	return opts
+}
+
+// templateGap returns the text written between two items for sep.
+func templateGap(gap, sep string) string {
+	return strings.ReplaceAll(gap, sepPlaceholder, sep)
+}
@@ -0,0 +1,57 @@
+package alchemy
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// loadTokenMap reads a -token-map file of "canonical<TAB>display" lines.
+// Empty lines are skipped; the last mapping of a canonical form wins.
+func loadTokenMap(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %v", path, err)
+	}
+	defer f.Close()
+
+	m := make(map[string]string)
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimRight(sc.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		canonical, display, ok := strings.Cut(line, "\t")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected canonical<TAB>display, got %q", path, n, line)
+		}
+		m[canonical] = display
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("reading %s: %v", path, err)
+	}
+	return m, nil
+}
+
+// mapItems replaces every item having a -token-map entry with its display
+// form. Items are loaded, filtered and combined as canonical forms; only what
+// gets written changes. Unmapped items are kept as is.
+func (o Options) mapItems(items []string) ([]string, error) {
+	if o.TokenMap == "" {
+		return items, nil
+	}
+	m, err := loadTokenMap(o.TokenMap)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]string, len(items))
+	for i, item := range items {
+		if display, ok := m[item]; ok {
+			item = display
+		}
+		out[i] = item
+	}
+	return out, nil
+}
@@ -0,0 +1,32 @@
+package alchemy
+
+import "fmt"
+
+// parseTokenWrap splits a -token-wrap value evenly into its opening and
+// closing halves: "[]" gives "[" and "]", "<<>>" gives "<<" and ">>".
+func parseTokenWrap(spec string) (open, close string, err error) {
+	runes := []rune(spec)
+	if len(runes) == 0 || len(runes)%2 != 0 {
+		return "", "", fmt.Errorf("token wrap %q must have an even number of characters (open then close)", spec)
+	}
+	half := len(runes) / 2
+	return string(runes[:half]), string(runes[half:]), nil
+}
+
+// wrapItems surrounds every item with the -token-wrap markers. Separators,
+// prefix and suffix are left outside the wrapping.
+func (o Options) wrapItems(items []string) []string {
+	if o.TokenWrap == "" {
+		return items
+	}
+	open, close, err := parseTokenWrap(o.TokenWrap)
+	if err != nil {
+		// Rejected by Validate; nothing sensible to wrap with.
+		return items
+	}
+	out := make([]string, len(items))
+	for i, item := range items {
+		out[i] = open + item + close
+	}
+	return out
+}
@@ -0,0 +1,212 @@
+package alchemy
+
+import (
+	"errors"
+	"math/big"
+	"sort"
+	"strings"
+)
+
+// ErrIndexOutOfRange is returned by CandidateAt for an index outside
+// [0, Count()).
+var ErrIndexOutOfRange = errors.New("candidate index out of range")
+
+// CandidateAt returns the line Generate writes at position n (0-based)
+// without generating the ones before it. Together with Count it gives random
+// access to the enumeration, e.g. to shard it or spot-check a huge space.
+//
+// Every sequence of a given length started by an item of a given source
+// roots a subtree of the same size, so the line is found by walking down
+// from the root, dividing n by subtree sizes at each level.
+func (p *Permutator) CandidateAt(n *big.Int) (string, error) {
+	if n.Sign() < 0 {
+		return "", ErrIndexOutOfRange
+	}
+	rest := new(big.Int).Set(n)
+	sizes := make(map[int][]*big.Int) // source -> subtree size per depth
+	for root := range p.allItems {
+		src := p.srcOfItem[root]
+		if sizes[src] == nil {
+			sizes[src] = p.subtreeSizes(src)
+		}
+		if rest.Cmp(sizes[src][1]) < 0 {
+			return p.descend(root, sizes[src], rest), nil
+		}
+		rest.Sub(rest, sizes[src][1])
+	}
+	return "", ErrIndexOutOfRange
+}
+
+// subtreeSizes returns, for sequences started by an item of src, the number
+// of lines written by the subtree of a sequence of each length (index 1 to
+// the source's depth).
+func (p *Permutator) subtreeSizes(src int) []*big.Int {
+	depth := p.srcDepths[src]
+	sizes := make([]*big.Int, depth+2)
+	sizes[depth+1] = big.NewInt(0)
+	for d := depth; d >= 1; d-- {
+		children := int64(len(p.allItems))
+		if p.opts.NoRepeats {
+			children -= int64(d)
+		}
+		size := big.NewInt(0)
+		if children > 0 && d < depth {
+			size.Mul(big.NewInt(children), sizes[d+1])
+		}
+		sizes[d] = size.Add(size, big.NewInt(int64(p.linesAt(src, d))))
+	}
+	return sizes
+}
+
+// linesAt is how many lines one sequence of length d started in src writes.
+func (p *Permutator) linesAt(src, d int) int {
+	switch {
+	case d < p.opts.minDepthOf(src):
+		return 0
+	case d == 1:
+		return 1
+	}
+	return len(p.opts.Seps)
+}
+
+// descend walks from root to the line at position rest of its subtree.
+func (p *Permutator) descend(root int, sizes []*big.Int, rest *big.Int) string {
+	src := p.srcOfItem[root]
+	path := []int{root}
+	var used []int // path items in ascending order, under NoRepeats
+	child, sep := new(big.Int), 0
+	for d := 1; ; d++ {
+		if p.opts.NoRepeats {
+			at := sort.SearchInts(used, path[d-1])
+			used = append(used[:at], append([]int{path[d-1]}, used[at:]...)...)
+		}
+		lines := big.NewInt(int64(p.linesAt(src, d)))
+		if rest.Cmp(lines) < 0 {
+			sep = int(rest.Int64())
+			break
+		}
+		rest.Sub(rest, lines)
+		child.QuoRem(rest, sizes[d+1], rest)
+		next := int(child.Int64())
+		// The next-th item not already used: skip over the used ones at
+		// or before it.
+		for _, u := range used {
+			if u <= next {
+				next++
+			}
+		}
+		path = append(path, next)
+	}
+
+	var b strings.Builder
+	b.WriteString(p.opts.Prefix)
+	for j, idx := range path {
+		if j > 0 {
+			b.WriteString(p.opts.Seps[sep])
+		}
+		b.WriteString(p.allItems[idx])
+	}
+	b.WriteString(p.opts.Suffix)
+	return b.String()
+}
+
+// ErrNotCandidate is returned by IndexOf for a line Generate never writes.
+var ErrNotCandidate = errors.New("not a candidate of this permutator")
+
+// IndexOf is the inverse of CandidateAt: it returns the position (0-based)
+// of line in the order Generate writes it, e.g. to resume from the last
+// candidate a consumer processed. When items and separators make line
+// readable more than one way, the first position it is written at is
+// returned.
+func (p *Permutator) IndexOf(line string) (*big.Int, error) {
+	body, ok := strings.CutPrefix(line, p.opts.Prefix)
+	if ok {
+		body, ok = strings.CutSuffix(body, p.opts.Suffix)
+	}
+	if !ok {
+		return nil, ErrNotCandidate
+	}
+	byText := make(map[string][]int)
+	maxDepth := 0
+	for i, item := range p.allItems {
+		byText[item] = append(byText[item], i)
+		maxDepth = max(maxDepth, p.srcDepths[p.srcOfItem[i]])
+	}
+
+	var best *big.Int
+	try := func(path []int, sep int) {
+		if rank, ok := p.rank(path, sep); ok && (best == nil || rank.Cmp(best) < 0) {
+			best = rank
+		}
+	}
+	for _, i := range byText[body] {
+		try([]int{i}, 0)
+	}
+	for sep := range p.opts.Seps {
+		p.splitLine(body, p.opts.Seps[sep], byText, nil, maxDepth, func(path []int) { try(path, sep) })
+	}
+	if best == nil {
+		return nil, ErrNotCandidate
+	}
+	return best, nil
+}
+
+// splitLine calls found with every way of reading rest as at least two
+// items joined by sep, after the items already in path.
+func (p *Permutator) splitLine(rest, sep string, byText map[string][]int, path []int, maxDepth int, found func([]int)) {
+	if len(path) == maxDepth {
+		return
+	}
+	for end := 0; end <= len(rest); end++ {
+		for _, i := range byText[rest[:end]] {
+			next := append(path, i)
+			if end == len(rest) {
+				if len(next) > 1 {
+					found(next)
+				}
+			} else if after, ok := strings.CutPrefix(rest[end:], sep); ok {
+				p.splitLine(after, sep, byText, next, maxDepth, found)
+			}
+		}
+	}
+}
+
+// rank returns the position of the line path writes with separator sep, or
+// false when Generate never writes it.
+func (p *Permutator) rank(path []int, sep int) (*big.Int, bool) {
+	src := p.srcOfItem[path[0]]
+	if len(path) > p.srcDepths[src] || len(path) < p.opts.minDepthOf(src) {
+		return nil, false
+	}
+	sizes := make(map[int][]*big.Int)
+	rank := big.NewInt(0)
+	for root := 0; root < path[0]; root++ {
+		s := p.srcOfItem[root]
+		if sizes[s] == nil {
+			sizes[s] = p.subtreeSizes(s)
+		}
+		rank.Add(rank, sizes[s][1])
+	}
+	if sizes[src] == nil {
+		sizes[src] = p.subtreeSizes(src)
+	}
+	var used []int // path items so far in ascending order, under NoRepeats
+	for d := 1; d < len(path); d++ {
+		if p.opts.NoRepeats {
+			at := sort.SearchInts(used, path[d-1])
+			used = append(used[:at], append([]int{path[d-1]}, used[at:]...)...)
+		}
+		rank.Add(rank, big.NewInt(int64(p.linesAt(src, d))))
+		child := path[d]
+		if p.opts.NoRepeats {
+			at := sort.SearchInts(used, child)
+			if at < len(used) && used[at] == child {
+				return nil, false
+			}
+			// Its rank among the items not used yet.
+			child -= at
+		}
+		rank.Add(rank, new(big.Int).Mul(big.NewInt(int64(child)), sizes[src][d+1]))
+	}
+	return rank.Add(rank, big.NewInt(int64(sep))), true
+}
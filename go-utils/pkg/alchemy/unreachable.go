@@ -0,0 +1,50 @@
+package alchemy
+
+import (
+	"fmt"
+	"io"
+)
+
+// UnreachableLength is a sequence length a source is configured for but can
+// never produce, typically because -no-repeats runs out of distinct items.
+type UnreachableLength struct {
+	Source Source
+	Length int
+}
+
+// FindUnreachableLengths lists every (source, length) pair, from the source's
+// minimum to its depth, whose line count is zero.
+func FindUnreachableLengths(sources []Source, opts Options) ([]UnreachableLength, error) {
+	allItems, srcOfItem, srcDepths, err := loadWrittenSources(sources, opts)
+	if err != nil {
+		return nil, err
+	}
+	opts = opts.withSources(sources)
+	var found []UnreachableLength
+	for src, source := range sources {
+		byDepth := countByDepthFrom(allItems, srcOfItem, srcDepths, opts, src)
+		for l := opts.minDepthOf(src); l <= source.Depth; l++ {
+			if byDepth[l-1].Sign() == 0 {
+				found = append(found, UnreachableLength{Source: source, Length: l})
+			}
+		}
+	}
+	return found, nil
+}
+
+// PrintUnreachable writes one warning line per source, grouping its lengths.
+func PrintUnreachable(w io.Writer, found []UnreachableLength) {
+	for i := 0; i < len(found); {
+		j := i
+		// A source's lengths ascend; the next source starts over.
+		for j+1 < len(found) && found[j+1].Source.Path == found[i].Source.Path && found[j+1].Length > found[j].Length {
+			j++
+		}
+		if i == j {
+			fmt.Fprintf(w, "unreachable: %s length %d produces no lines\n", found[i].Source.Path, found[i].Length)
+		} else {
+			fmt.Fprintf(w, "unreachable: %s lengths %d-%d produce no lines\n", found[i].Source.Path, found[i].Length, found[j].Length)
+		}
+		i = j + 1
+	}
+}
@@ -0,0 +1,221 @@
+package alchemy
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Validate checks a configuration before any generation starts and reports
+// every problem found at once (joined with errors.Join), or nil.
+func Validate(sources []Source, opts Options) error {
+	var errs []error
+
+	if len(sources) == 0 {
+		errs = append(errs, errors.New("at least one source is required"))
+	}
+	stdinSources := 0
+	for _, src := range sources {
+		if src.Depth < 1 {
+			errs = append(errs, fmt.Errorf("source %s: depth must be at least 1, got %d", src.Path, src.Depth))
+		}
+		if src.MinDepth > src.Depth {
+			errs = append(errs, fmt.Errorf("source %s: minimum depth %d is greater than depth %d", src.Path, src.MinDepth, src.Depth))
+		}
+		if src.Transforms != "" {
+			if _, err := parseTransforms(src.Transforms); err != nil {
+				errs = append(errs, fmt.Errorf("source %s: %v", src.Path, err))
+			}
+		}
+		if src.Items != nil {
+			continue
+		}
+		if mask, ok := strings.CutPrefix(src.Path, maskPrefix); ok {
+			if _, err := parseMask(mask); err != nil {
+				errs = append(errs, fmt.Errorf("source %s: %v", src.Path, err))
+			}
+			continue
+		}
+		if IsStdinPath(src.Path) {
+			if stdinSources++; stdinSources == 2 {
+				errs = append(errs, fmt.Errorf("source %s: %w", src.Path, ErrDuplicateStdin))
+			}
+			continue
+		}
+		file, err := osOpen(src.Path)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("source %s: cannot be read: %v", src.Path, err))
+			continue
+		}
+		file.Close()
+	}
+
+	for src, k := range opts.MinFrom {
+		if src < 0 || src >= len(sources) {
+			errs = append(errs, fmt.Errorf("-min-from names source %d, only %d given", src+1, len(sources)))
+		} else if k < 0 {
+			errs = append(errs, fmt.Errorf("-min-from %s: count must not be negative, got %d", sources[src].Path, k))
+		}
+	}
+	if opts.Slots && (opts.NoCrossSource || opts.ReverseSources || len(opts.MinFrom) > 0) {
+		errs = append(errs, errors.New("-slot fixes the source of every position: -no-cross-source, -reverse-sources and -min-from do not apply"))
+	}
+	if opts.Gaps != nil && len(opts.Gaps) != len(sources)-1 {
+		errs = append(errs, fmt.Errorf("-template has %d gaps for %d sources", len(opts.Gaps), len(sources)))
+	}
+	for _, src := range sources {
+		if (src.Prefix != "" || src.Suffix != "") && opts.Sample > 0 {
+			errs = append(errs, fmt.Errorf("source %s: a per-source prefix= or suffix= cannot be combined with -sample", src.Path))
+			break
+		}
+	}
+	for _, src := range sources {
+		if src.Sep != nil && (opts.Slots || opts.Combinations || opts.NoConsecutiveSource || len(opts.MinFrom) > 0 || opts.Sample > 0) {
+			errs = append(errs, fmt.Errorf("source %s: a per-source sep= cannot be combined with -slot, -template, -product, -combinations, -no-consecutive-source, -min-from or -sample", src.Path))
+			break
+		}
+	}
+	for _, src := range sources {
+		if (src.Sep != nil || src.Prefix != "" || src.Suffix != "") && opts.Leet != "" {
+			errs = append(errs, fmt.Errorf("source %s: a per-source sep=, prefix= or suffix= cannot be combined with -leet", src.Path))
+			break
+		}
+	}
+	if opts.Combinations && (opts.Slots || opts.NoConsecutiveSource || len(opts.MinFrom) > 0) {
+		errs = append(errs, errors.New("-combinations cannot be combined with -slot, -template, -product, -no-consecutive-source or -min-from"))
+	}
+	if opts.MinDepth < 0 {
+		errs = append(errs, fmt.Errorf("-min-depth must not be negative, got %d", opts.MinDepth))
+	}
+	if opts.LimitTime < 0 {
+		errs = append(errs, fmt.Errorf("-limit-time must not be negative, got %v", opts.LimitTime))
+	}
+	if opts.MinTokenLen < 0 || opts.MaxTokenLen < 0 {
+		errs = append(errs, errors.New("-min-token-len and -max-token-len must not be negative"))
+	}
+	if opts.MaxTokenLen > 0 && opts.MinTokenLen > opts.MaxTokenLen {
+		errs = append(errs, fmt.Errorf("-min-token-len (%d) is greater than -max-token-len (%d)", opts.MinTokenLen, opts.MaxTokenLen))
+	}
+	if opts.MinLen < 0 || opts.MaxLen < 0 {
+		errs = append(errs, errors.New("-min-len and -max-len must not be negative"))
+	}
+	if opts.MaxLen > 0 && opts.MinLen > opts.MaxLen {
+		errs = append(errs, fmt.Errorf("-min-len (%d) is greater than -max-len (%d)", opts.MinLen, opts.MaxLen))
+	}
+	if opts.UniqueBloom < 0 || opts.UniqueBloom >= 1 {
+		errs = append(errs, fmt.Errorf("-unique-bloom must be a rate between 0 and 1, got %g", opts.UniqueBloom))
+	}
+	if opts.UniqueExactMax < 0 {
+		errs = append(errs, fmt.Errorf("-unique-exact-max must not be negative, got %d", opts.UniqueExactMax))
+	}
+	if opts.UniqueExactMax > 0 && (opts.UniqueBloom == 0 || opts.LimitUnique > 0) {
+		errs = append(errs, errors.New("-unique-exact-max needs -unique-bloom and cannot be combined with -limit-unique"))
+	}
+	if opts.FailOnDuplicate && (opts.Unique || opts.UniqueBloom > 0) {
+		errs = append(errs, errors.New("-fail-on-duplicate and -unique cannot be combined"))
+	}
+	if opts.Skip < 0 || opts.Limit < 0 {
+		errs = append(errs, errors.New("-skip and -limit must not be negative"))
+	}
+	if (opts.Checkpoint != "" || opts.Resume != "") && (opts.Skip > 0 || opts.Limit > 0 || opts.LimitUnique > 0 ||
+		opts.Unique || opts.UniqueBloom > 0 || opts.FailOnDuplicate || opts.SortExternal || opts.Reverse) {
+		errs = append(errs, errors.New("-checkpoint and -resume cannot be combined with -skip, -limit, -limit-unique, -unique, -fail-on-duplicate, -sort-external or -reverse-output"))
+	}
+	if opts.Sample < 0 {
+		errs = append(errs, fmt.Errorf("-sample must not be negative, got %d", opts.Sample))
+	}
+	if opts.Sample > 0 && (opts.Slots || opts.Combinations || opts.NoCrossSource || opts.NoConsecutiveSource || len(opts.MinFrom) > 0 ||
+		opts.Incremental != "" || opts.MutateCase != "" || opts.Rules != nil || opts.Leet != "" ||
+		opts.Reverse || opts.SortExternal || opts.Checkpoint != "" || opts.Resume != "" ||
+		(opts.DFSOrder != "" && opts.DFSOrder != "forward") || opts.ReverseSources) {
+		errs = append(errs, errors.New("-sample draws from plain sequences: it cannot be combined with -slot, -template, -product, -combinations, -no-cross-source, -no-consecutive-source, -min-from, -incremental, -mutate-case, -rules, -leet, -reverse-output, -sort-external, -checkpoint, -resume, -dfs-order reverse|random or -reverse-sources"))
+	}
+	if opts.Progress && (opts.Sample > 0 || opts.SortExternal || opts.Reverse) {
+		errs = append(errs, errors.New("-progress cannot be combined with -sample, -sort-external or -reverse-output"))
+	}
+	if opts.OrderedByWeight && (opts.Sample > 0 || opts.SortExternal || opts.Reverse || opts.Checkpoint != "" || opts.Resume != "" ||
+		opts.Progress || opts.DedupInput) {
+		errs = append(errs, errors.New("-ordered-by-weight cannot be combined with -sample, -sort-external, -reverse-output, -checkpoint, -resume, -progress or -dedup-input"))
+	}
+	if opts.DedupInput && opts.Slots {
+		errs = append(errs, errors.New("-dedup-input cannot be combined with -slot, -template or -product, where an item may fill several positions"))
+	}
+	if opts.MaxTotalItems < 0 {
+		errs = append(errs, fmt.Errorf("-max-total-items must not be negative, got %d", opts.MaxTotalItems))
+	}
+	if opts.Workers < 0 {
+		errs = append(errs, fmt.Errorf("-workers must not be negative, got %d", opts.Workers))
+	}
+	if opts.ReadRetries < 0 {
+		errs = append(errs, fmt.Errorf("-read-retries must not be negative, got %d", opts.ReadRetries))
+	}
+	if opts.Charset != "" {
+		if _, err := parseCharset(opts.Charset); err != nil {
+			errs = append(errs, fmt.Errorf("-charset: %v", err))
+		}
+	}
+	if opts.Mutate != "" {
+		if _, err := parseMutations(opts.Mutate, nil); err != nil {
+			errs = append(errs, fmt.Errorf("-mutate: %v", err))
+		}
+	}
+	if opts.Leet != "" {
+		if _, err := parseLeetLevel(opts.Leet); err != nil {
+			errs = append(errs, fmt.Errorf("-leet: %v", err))
+		}
+	}
+	if opts.LeetTable != "" {
+		if _, err := parseLeetTable(opts.LeetTable); err != nil {
+			errs = append(errs, fmt.Errorf("-leet-table: %v", err))
+		}
+	}
+	if opts.MutateCase != "" {
+		if _, err := parseCaseMutations(opts.MutateCase); err != nil {
+			errs = append(errs, fmt.Errorf("-mutate-case: %v", err))
+		}
+	}
+	for _, line := range opts.Rules {
+		if _, err := parseRule(line); err != nil {
+			errs = append(errs, fmt.Errorf("-rules: %v", err))
+		}
+	}
+	if _, err := compilePatterns(opts.Match); err != nil {
+		errs = append(errs, fmt.Errorf("-match: %v", err))
+	}
+	if _, err := compilePatterns(opts.ExcludeMatch); err != nil {
+		errs = append(errs, fmt.Errorf("-exclude-match: %v", err))
+	}
+	if opts.TokenWrap != "" {
+		if _, _, err := parseTokenWrap(opts.TokenWrap); err != nil {
+			errs = append(errs, fmt.Errorf("-token-wrap: %v", err))
+		}
+	}
+	if _, err := lookupOutputEncoding(opts.OutputEncoding); err != nil {
+		errs = append(errs, fmt.Errorf("-output-encoding: %v", err))
+	}
+	if err := checkOutputFormat(opts.Format); err != nil {
+		errs = append(errs, fmt.Errorf("-format: %v", err))
+	}
+	if _, err := candidateOrder(0, opts.DFSOrder, opts.DFSSeed); err != nil {
+		errs = append(errs, fmt.Errorf("-dfs-order: %v", err))
+	}
+	if opts.LimitUnique < 0 {
+		errs = append(errs, fmt.Errorf("-limit-unique must not be negative, got %d", opts.LimitUnique))
+	}
+	if opts.HashShard != "" {
+		if _, _, err := parseHashShard(opts.HashShard); err != nil {
+			errs = append(errs, fmt.Errorf("-hash-shard: %v", err))
+		}
+	}
+	if opts.Incremental != "" && opts.IncrementalMax < 1 {
+		errs = append(errs, fmt.Errorf("-incremental-max must be at least 1, got %d", opts.IncrementalMax))
+	}
+	if opts.SortExternal && opts.SortMemory < 1 {
+		errs = append(errs, fmt.Errorf("-sort-memory must be positive, got %d", opts.SortMemory))
+	}
+	if opts.SortExternal && opts.Reverse {
+		errs = append(errs, errors.New("-sort-external and -reverse-output cannot be combined"))
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,168 @@
+package alchemy
+
+import (
+	"cmp"
+	"container/heap"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// splitWeights splits the "word<TAB>weight" items of a source read under
+// -ordered-by-weight into words and weights. An item without a tab weighs 1.
+func splitWeights(path string, items []string) ([]string, []float64, error) {
+	words := make([]string, len(items))
+	weights := make([]float64, len(items))
+	for i, item := range items {
+		word, text, found := strings.Cut(item, "\t")
+		words[i], weights[i] = word, 1
+		if !found {
+			continue
+		}
+		w, err := strconv.ParseFloat(strings.TrimSpace(text), 64)
+		if err != nil || w < 0 || math.IsNaN(w) || math.IsInf(w, 0) {
+			return nil, nil, fmt.Errorf("parsing %s: invalid weight %q for %q", path, text, word)
+		}
+		weights[i] = w
+	}
+	return words, weights, nil
+}
+
+// weightedPath is a sequence of ranks into the items sorted by decreasing
+// weight, scored by the sum of the logs of its weights.
+type weightedPath struct {
+	ranks []int
+	score float64
+	last  int // the last rank increased to reach this path from its parent
+}
+
+// pathHeap pops the heaviest path first; ties go to the shorter path, then
+// the lower ranks, so the order is deterministic.
+type pathHeap []weightedPath
+
+func (h pathHeap) Len() int { return len(h) }
+func (h pathHeap) Less(i, j int) bool {
+	if h[i].score != h[j].score {
+		return h[i].score > h[j].score
+	}
+	if len(h[i].ranks) != len(h[j].ranks) {
+		return len(h[i].ranks) < len(h[j].ranks)
+	}
+	return slices.Compare(h[i].ranks, h[j].ranks) < 0
+}
+func (h pathHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *pathHeap) Push(x any)   { *h = append(*h, x.(weightedPath)) }
+func (h *pathHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// generateByWeight writes the lines of p best first: by decreasing product
+// of their items' weights (-ordered-by-weight). Every sequence is a tuple of
+// ranks into the items sorted by weight, and its children increase one rank
+// at or after the last one increased, so each tuple has a single parent that
+// weighs at least as much. Popping the heaviest tuple off a heap and pushing
+// its children visits them all in order; the heap holds the frontier, which
+// grows with the number of lines written. A child only ever changes ranks
+// from the one it increased on, so when the items before that one already
+// break the sequence rules (repeats, sources, depths, slots) no descendant
+// can be written and the child is not pushed.
+func (p *permutator) generateByWeight(weights []float64) {
+	n := len(p.allItems)
+	if n == 0 {
+		return
+	}
+	byWeight := make([]int, n)
+	for i := range byWeight {
+		byWeight[i] = i
+	}
+	slices.SortStableFunc(byWeight, func(a, b int) int {
+		return cmp.Compare(weights[b], weights[a])
+	})
+	logs := make([]float64, n)
+	for r, idx := range byWeight {
+		logs[r] = math.Log(weights[idx])
+	}
+	score := func(ranks []int) float64 {
+		s := 0.0
+		for _, r := range ranks {
+			s += logs[r]
+		}
+		return s
+	}
+
+	maxDepth := 0
+	for _, d := range p.srcDepths {
+		maxDepth = max(maxDepth, d)
+	}
+	h := &pathHeap{}
+	for l := 1; l <= maxDepth; l++ {
+		ranks := make([]int, l)
+		heap.Push(h, weightedPath{ranks: ranks, score: score(ranks)})
+	}
+
+	path := make([]int, 0, maxDepth)
+	for h.Len() > 0 && !p.stopped.Load() {
+		c := heap.Pop(h).(weightedPath)
+		path = path[:0]
+		for _, r := range c.ranks {
+			path = append(path, byWeight[r])
+		}
+		if p.allows(path) {
+			p.emit(path)
+		}
+		for k := c.last; k < len(c.ranks); k++ {
+			if c.ranks[k]+1 == n || !p.fits(path[:k], len(path)) {
+				continue
+			}
+			ranks := slices.Clone(c.ranks)
+			ranks[k]++
+			heap.Push(h, weightedPath{ranks: ranks, score: score(ranks), last: k})
+		}
+	}
+}
+
+// allows reports whether dfs would write path: the checks dfs makes while
+// extending a sequence, applied to a whole one.
+func (p *permutator) allows(path []int) bool {
+	return p.fits(path, len(path)) && (p.minFrom == nil || p.minFrom.deficit(path, p.srcOfItem) == 0)
+}
+
+// fits reports whether prefix may start a line of length items: the checks of
+// allows that only involve the items placed so far.
+func (p *permutator) fits(prefix []int, length int) bool {
+	if len(prefix) == 0 {
+		return true
+	}
+	first := p.srcOfItem[prefix[0]]
+	if length > p.srcDepths[first] || (p.minDepths != nil && length < p.minDepths[first]) {
+		return false
+	}
+	for d := 1; d < len(prefix); d++ {
+		next, last := prefix[d], prefix[d-1]
+		if p.noRepeats && slices.Contains(prefix[:d], next) {
+			return false
+		}
+		if p.noCrossSource && p.srcOfItem[next] != first {
+			return false
+		}
+		if p.noConsecutiveSource && p.srcOfItem[next] == p.srcOfItem[last] {
+			return false
+		}
+		if p.combinations && next < last {
+			return false
+		}
+	}
+	if p.slots {
+		for d, idx := range prefix {
+			if p.srcOfItem[idx] != d {
+				return false
+			}
+		}
+	}
+	return true
+}